@@ -2,10 +2,13 @@ package cmd
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/manifoldco/promptui"
@@ -49,6 +52,8 @@ Commands:
     logs [server-id]    View server logs
     delete             Delete current configuration
     restart [server-id]  Restart a running server
+    rekey [db-name]     Change a database's encryption key
+    rotate-keys [db-name]  Rotate token signing keys
 
 Flags:
     -d, --dashboard    Start with dashboard enabled
@@ -159,6 +164,73 @@ Example:
     lumberjack logs abc123xyz`,
 		Run: viewLogs,
 	}
+	rekeyCmd = &cobra.Command{
+		Use:   "rekey [database-name]",
+		Short: "Change the encryption key of a database",
+		Long: `Re-encrypt a stopped database with a new passphrase or key file.
+The current passphrase is read from LUMBERJACK_PASSPHRASE or prompted for.
+Choosing "none" stores the database unencrypted.
+
+Example:
+    lumberjack rekey
+    lumberjack rekey mydb`,
+		Run: rekeyDatabase,
+	}
+	rotateKeysCmd = &cobra.Command{
+		Use:   "rotate-keys [database-name]",
+		Short: "Rotate the token signing keys of a database",
+		Long: `Generate new session and refresh token signing keys.
+A running server rotates its keys without restarting; tokens signed with
+the previous keys stay valid for the database's key rotation window.
+
+Example:
+    lumberjack rotate-keys
+    lumberjack rotate-keys mydb`,
+		Run: rotateKeys,
+	}
+	reportCmd = &cobra.Command{
+		Use:   "report [database-name]",
+		Short: "Report time rolled up through the node hierarchy",
+		Long: `Roll tracked time and finished event durations up through the branches of
+a database, grouped by user, category and day, week or month. Nodes with
+several parents count once in each ancestor unless --per-path is given.
+Dates are read in local time, as YYYY-MM-DD or RFC 3339.
+
+Example:
+    lumberjack report mydb --path work --group-by user,week
+    lumberjack report mydb --from 2024-01-01 --to 2024-02-01 --format csv -o january.csv`,
+		Run: runReport,
+	}
+	exportCmd = &cobra.Command{
+		Use:   "export [database-name]",
+		Short: "Export a database as JSON, NDJSON or CSV",
+		Long: `Write the forest of a database, or the subtree at --path, as one nested JSON
+document or as flat NDJSON or CSV rows of nodes, events, entries and users.
+Attachment contents are left out unless --attachments is inline, which keeps
+them in the document, or tar, which packs them next to it in a tar archive.
+Password hashes are only written with --credentials.
+
+Example:
+    lumberjack export mydb -o backup.json
+    lumberjack export mydb --path work --format csv --kinds events,entries -o work.csv
+    lumberjack export mydb --attachments tar --credentials -o mydb.tar`,
+		Run: runExport,
+	}
+	importCmd = &cobra.Command{
+		Use:   "import [database-name]",
+		Short: "Merge an export into a database",
+		Long: `Merge a file written by 'lumberjack export' or the /export endpoint into a
+stopped database. Nodes are matched by path below --path, missing ones are
+created and only what a node lacks is added, so importing the same file
+twice changes nothing. Tar archives are recognised on their own; the format
+of other files is taken from --format or their extension.
+
+Example:
+    lumberjack import mydb -i backup.json
+    lumberjack import mydb --path archive -i work.ndjson
+    lumberjack import mydb -i mydb.tar`,
+		Run: runImport,
+	}
 	restartCmd = &cobra.Command{
 		Use:   "restart [server-id]",
 		Short: "Restart a running server",
@@ -181,6 +253,11 @@ func init() {
 	rootCmd.AddCommand(killCmd)
 	rootCmd.AddCommand(logsCmd)
 	rootCmd.AddCommand(restartCmd)
+	rootCmd.AddCommand(rekeyCmd)
+	rootCmd.AddCommand(rotateKeysCmd)
+	rootCmd.AddCommand(reportCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
 
 	createCmd.AddCommand(newHelpCmd(createCmd))
 	startCmd.AddCommand(newHelpCmd(startCmd))
@@ -189,6 +266,11 @@ func init() {
 	killCmd.AddCommand(newHelpCmd(killCmd))
 	logsCmd.AddCommand(newHelpCmd(logsCmd))
 	restartCmd.AddCommand(newHelpCmd(restartCmd))
+	rekeyCmd.AddCommand(newHelpCmd(rekeyCmd))
+	rotateKeysCmd.AddCommand(newHelpCmd(rotateKeysCmd))
+	reportCmd.AddCommand(newHelpCmd(reportCmd))
+	exportCmd.AddCommand(newHelpCmd(exportCmd))
+	importCmd.AddCommand(newHelpCmd(importCmd))
 
 	startCmd.Flags().BoolVarP(&dashboardSet, "dashboard", "d", false, "Start with dashboard")
 	startCmd.Flags().StringVarP(&configFile, "config", "c", "", "Config file to use")
@@ -203,6 +285,25 @@ func init() {
 	logsCmd.Flags().IntP("lines", "n", 0, "Number of lines to show from the end")
 	logsCmd.Flags().BoolP("follow", "f", false, "Follow log output")
 
+	reportCmd.Flags().String("path", "", "Node to report on, the root when empty")
+	reportCmd.Flags().String("from", "", "Start of the reported range")
+	reportCmd.Flags().String("to", "", "End of the reported range")
+	reportCmd.Flags().String("group-by", "", "Comma separated groups: user, category and day, week or month")
+	reportCmd.Flags().Bool("per-path", false, "Count nodes with several parents once per path")
+	reportCmd.Flags().String("format", "json", "Output format: json or csv")
+	reportCmd.Flags().StringP("output", "o", "", "File to write, standard output when empty")
+
+	exportCmd.Flags().String("path", "", "Node to export, the root when empty")
+	exportCmd.Flags().String("format", "json", "Output format: json, ndjson or csv")
+	exportCmd.Flags().String("kinds", "", "Comma separated rows to write in ndjson or csv: node, event, entry, user")
+	exportCmd.Flags().String("attachments", "none", "Attachment contents: none, inline or tar")
+	exportCmd.Flags().Bool("credentials", false, "Include password hashes")
+	exportCmd.Flags().StringP("output", "o", "", "File to write, standard output when empty")
+
+	importCmd.Flags().String("path", "", "Node to merge into, the root when empty")
+	importCmd.Flags().String("format", "", "Input format: json, ndjson or csv, from the file extension when empty")
+	importCmd.Flags().StringP("input", "i", "", "File to read, standard input when empty")
+
 	rootCmd.Flags().BoolVarP(&dashboardSet, "dashboard", "d", false, "Start with dashboard")
 
 	rootCmd.RunE = func(cmd *cobra.Command, args []string) error {
@@ -299,8 +400,15 @@ func runServer(cmd *cobra.Command, args []string) {
 	processInfo.DatabasePath = filepath.Join(defaultLibDir, dbName)
 	processInfo.LogPath = defaultLogDir
 
+	secret, err := resolveSecret(config, false)
+	if err != nil {
+		fmt.Printf("Error reading encryption secret: %v\n", err)
+		os.Exit(1)
+	}
+
 	serverConfig := types.ServerConfig{
 		Process: *processInfo,
+		Secret:  secret,
 	}
 
 	server, err := internal.LoadServer(serverConfig)
@@ -443,6 +551,14 @@ func createConfig(cmd *cobra.Command, args []string) error {
 		user.Password = prompts[5].default_
 	}
 
+	encryption, keyFile, secret, err := promptEncryption(dbName)
+	if err != nil {
+		fmt.Printf("Encryption setup failed: %v\n", err)
+		os.Exit(1)
+	}
+	dbConfig.Encryption = encryption
+	dbConfig.KeyFile = keyFile
+
 	dbConfig.Name = dbName
 	config.Databases[dbName] = dbConfig
 
@@ -476,8 +592,11 @@ func createConfig(cmd *cobra.Command, args []string) error {
 			DashboardURL:  dbConfig.ServerURL,
 			DashboardPort: dbConfig.DashboardPort,
 			LogPath:       defaultLogDir,
-			DatabasePath:  defaultLibDir,
+			DatabasePath:  filepath.Join(defaultLibDir, dbName),
+			Encryption:    encryption,
+			KeyFile:       keyFile,
 		},
+		Secret: secret,
 	}
 
 	// Initialize server just to save admin info
@@ -846,6 +965,346 @@ func restartServer(cmd *cobra.Command, args []string) {
 	}
 }
 
+func rekeyDatabase(cmd *cobra.Command, args []string) {
+	dbName := "default"
+	if len(args) > 0 {
+		dbName = args[0]
+	}
+
+	processes, err := getRunningServers()
+	if err != nil {
+		fmt.Printf("Error getting running servers: %v\n", err)
+		os.Exit(1)
+	}
+	for _, p := range processes {
+		if p.Name == dbName {
+			fmt.Printf("Database %s is running, stop it with 'lumberjack kill %s' first\n", dbName, p.ID)
+			os.Exit(1)
+		}
+	}
+
+	dbConfig := loadConfig(dbName)
+	secret, err := resolveSecret(dbConfig, true)
+	if err != nil {
+		fmt.Printf("Error reading current secret: %v\n", err)
+		os.Exit(1)
+	}
+
+	encryption, keyFile, newSecret, err := promptEncryption(dbName)
+	if err != nil {
+		fmt.Printf("Encryption setup failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	dbConfig.DatabasePath = filepath.Join(defaultLibDir, dbName)
+	dbConfig.LogPath = defaultLogDir
+	if err := internal.Rekey(types.ServerConfig{Process: dbConfig, Secret: secret}, newSecret); err != nil {
+		fmt.Printf("Error re-encrypting database: %v\n", err)
+		if errors.Is(err, internal.ErrRekeyIncomplete) {
+			// Some files are only readable with the new key now
+			if keyFile != "" {
+				fmt.Printf("Keep both %s and the current key, the database needs them to be rekeyed again\n", keyFile)
+			}
+		} else if keyFile != "" {
+			// Everything was put back under the current key, so nothing uses the new one
+			os.Remove(keyFile)
+		}
+		os.Exit(1)
+	}
+
+	var config types.Config
+	if err := viper.Unmarshal(&config); err != nil {
+		fmt.Printf("Error parsing config: %v\n", err)
+		os.Exit(1)
+	}
+
+	oldKeyFile := dbConfig.KeyFile
+	dbConfig.Encryption = encryption
+	dbConfig.KeyFile = keyFile
+	config.Databases[dbName] = dbConfig
+	if err := saveConfig(config); err != nil {
+		fmt.Printf("Error saving config: %v\n", err)
+		if keyFile != "" {
+			fmt.Printf("The database is now encrypted with %s, point the config at it\n", keyFile)
+		}
+		os.Exit(1)
+	}
+
+	// The database is no longer readable with the old key file
+	if oldKeyFile != "" && oldKeyFile != keyFile {
+		os.Remove(oldKeyFile)
+	}
+
+	fmt.Printf("Database %s re-encrypted successfully\n", dbName)
+}
+
+func rotateKeys(cmd *cobra.Command, args []string) {
+	dbName := "default"
+	if len(args) > 0 {
+		dbName = args[0]
+	}
+
+	processes, err := getRunningServers()
+	if err != nil {
+		fmt.Printf("Error getting running servers: %v\n", err)
+		os.Exit(1)
+	}
+
+	// A running server owns its key file, so ask it to rotate its own keys
+	for _, p := range processes {
+		if p.Name != dbName {
+			continue
+		}
+		if err := syscall.Kill(p.PID, syscall.SIGHUP); err != nil {
+			fmt.Printf("Error signalling server %s: %v\n", p.ID, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Signing keys rotation requested for running server %s\n", p.ID)
+		return
+	}
+
+	dbConfig := loadConfig(dbName)
+	secret, err := resolveSecret(dbConfig, true)
+	if err != nil {
+		fmt.Printf("Error reading encryption secret: %v\n", err)
+		os.Exit(1)
+	}
+
+	dbConfig.DatabasePath = filepath.Join(defaultLibDir, dbName)
+	if err := internal.RotateKeys(types.ServerConfig{Process: dbConfig, Secret: secret}); err != nil {
+		fmt.Printf("Error rotating signing keys: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Signing keys for %s rotated successfully\n", dbName)
+}
+
+func runReport(cmd *cobra.Command, args []string) {
+	dbName := "default"
+	if len(args) > 0 {
+		dbName = args[0]
+	}
+
+	path, _ := cmd.Flags().GetString("path")
+	groupBy, _ := cmd.Flags().GetString("group-by")
+	perPath, _ := cmd.Flags().GetBool("per-path")
+	format, _ := cmd.Flags().GetString("format")
+	output, _ := cmd.Flags().GetString("output")
+
+	options := core.RollupOptions{PerPath: perPath, Location: time.Local}
+	if err := core.ParseRollupGroups(groupBy, &options); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	for flag, target := range map[string]*time.Time{"from": &options.From, "to": &options.To} {
+		value, _ := cmd.Flags().GetString(flag)
+		at, err := parseReportTime(value)
+		if err != nil {
+			fmt.Printf("Error: invalid --%s: %v\n", flag, err)
+			os.Exit(1)
+		}
+		*target = at
+	}
+	if format != "json" && format != "csv" {
+		fmt.Println("Error: --format must be json or csv")
+		os.Exit(1)
+	}
+
+	dbConfig := loadConfig(dbName)
+	secret, err := resolveSecret(dbConfig, true)
+	if err != nil {
+		fmt.Printf("Error reading encryption secret: %v\n", err)
+		os.Exit(1)
+	}
+
+	dbConfig.DatabasePath = filepath.Join(defaultLibDir, dbName)
+	forest, err := internal.LoadForest(types.ServerConfig{Process: dbConfig, Secret: secret})
+	if err != nil {
+		fmt.Printf("Error loading database: %v\n", err)
+		os.Exit(1)
+	}
+	node, err := forest.Resolve(path)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if paths := forest.Paths(node.ID); len(paths) > 0 {
+		path = paths[0]
+	}
+
+	report := node.Rollup(path, options)
+	report.SetUsernames(forest.Directory)
+
+	out := os.Stdout
+	if output != "" {
+		if out, err = os.Create(output); err != nil {
+			fmt.Printf("Error creating %s: %v\n", output, err)
+			os.Exit(1)
+		}
+		defer out.Close()
+	}
+
+	if format == "csv" {
+		err = report.WriteCSV(out)
+	} else {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	}
+	if err != nil {
+		fmt.Printf("Error writing report: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runExport(cmd *cobra.Command, args []string) {
+	dbName := "default"
+	if len(args) > 0 {
+		dbName = args[0]
+	}
+
+	path, _ := cmd.Flags().GetString("path")
+	format, _ := cmd.Flags().GetString("format")
+	kindsFlag, _ := cmd.Flags().GetString("kinds")
+	attachments, _ := cmd.Flags().GetString("attachments")
+	credentials, _ := cmd.Flags().GetBool("credentials")
+	output, _ := cmd.Flags().GetString("output")
+
+	if format != core.ExportJSON && format != core.ExportNDJSON && format != core.ExportCSV {
+		fmt.Println("Error: --format must be json, ndjson or csv")
+		os.Exit(1)
+	}
+	if attachments != "none" && attachments != "inline" && attachments != "tar" {
+		fmt.Println("Error: --attachments must be none, inline or tar")
+		os.Exit(1)
+	}
+	kinds, err := core.ParseExportKinds(kindsFlag)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	dbConfig := loadConfig(dbName)
+	secret, err := resolveSecret(dbConfig, true)
+	if err != nil {
+		fmt.Printf("Error reading encryption secret: %v\n", err)
+		os.Exit(1)
+	}
+
+	dbConfig.DatabasePath = filepath.Join(defaultLibDir, dbName)
+	config := types.ServerConfig{Process: dbConfig, Secret: secret}
+	forest, err := internal.LoadForest(config)
+	if err != nil {
+		fmt.Printf("Error loading database: %v\n", err)
+		os.Exit(1)
+	}
+	node, err := forest.Resolve(path)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if paths := forest.Paths(node.ID); len(paths) > 0 {
+		path = paths[0]
+	}
+
+	export := node.Export(path, forest.Directory, core.ExportOptions{
+		Data:        attachments != "none",
+		Blobs:       internal.LoadBlobs(config),
+		Directory:   true,
+		Credentials: credentials,
+	})
+
+	out := os.Stdout
+	if output != "" {
+		if out, err = os.Create(output); err != nil {
+			fmt.Printf("Error creating %s: %v\n", output, err)
+			os.Exit(1)
+		}
+		defer out.Close()
+	}
+
+	if attachments == "tar" {
+		err = export.WriteArchive(out, format, kinds)
+	} else {
+		err = export.Write(out, format, kinds)
+	}
+	if err != nil {
+		fmt.Printf("Error writing export: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runImport(cmd *cobra.Command, args []string) {
+	dbName := "default"
+	if len(args) > 0 {
+		dbName = args[0]
+	}
+
+	path, _ := cmd.Flags().GetString("path")
+	format, _ := cmd.Flags().GetString("format")
+	input, _ := cmd.Flags().GetString("input")
+
+	processes, err := getRunningServers()
+	if err != nil {
+		fmt.Printf("Error getting running servers: %v\n", err)
+		os.Exit(1)
+	}
+	for _, p := range processes {
+		if p.Name == dbName {
+			fmt.Printf("Database %s is running, import through its /import endpoint or stop it with 'lumberjack kill %s' first\n", dbName, p.ID)
+			os.Exit(1)
+		}
+	}
+
+	in := os.Stdin
+	if input != "" {
+		if in, err = os.Open(input); err != nil {
+			fmt.Printf("Error opening %s: %v\n", input, err)
+			os.Exit(1)
+		}
+		defer in.Close()
+		if extension := strings.TrimPrefix(filepath.Ext(input), "."); format == "" && (extension == core.ExportNDJSON || extension == core.ExportCSV) {
+			format = extension
+		}
+	}
+
+	dbConfig := loadConfig(dbName)
+	secret, err := resolveSecret(dbConfig, true)
+	if err != nil {
+		fmt.Printf("Error reading encryption secret: %v\n", err)
+		os.Exit(1)
+	}
+
+	dbConfig.DatabasePath = filepath.Join(defaultLibDir, dbName)
+	dbConfig.LogPath = defaultLogDir
+	report, err := internal.Import(types.ServerConfig{Process: dbConfig, Secret: secret}, in, format, path)
+	if err != nil {
+		fmt.Printf("Error importing into %s: %v\n", dbName, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Imported into %s at /%s: %d nodes, %d links, %d events, %d entries, %d attachments, %d time sessions, %d users\n",
+		dbName, report.Path, report.Nodes, report.Links, report.Events, report.Entries, report.Attachments, report.Sessions, report.Users)
+	for _, skipped := range report.Skipped {
+		item := skipped.Item
+		if item != "" {
+			item = " " + item
+		}
+		fmt.Printf("Skipped /%s%s: %s\n", skipped.Path, item, skipped.Reason)
+	}
+}
+
+// parseReportTime reads a local YYYY-MM-DD date or an RFC 3339 time, the
+// zero time when value is empty
+func parseReportTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if at, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return at, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
 // Add this function to handle database name validation
 func validateDBName(input string) error {
 	if len(input) < 1 {
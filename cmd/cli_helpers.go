@@ -1,13 +1,16 @@
 package cmd
 
 import (
+	crand "crypto/rand"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 
+	"github.com/manifoldco/promptui"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/vaziolabs/lumberjack/internal"
 	"github.com/vaziolabs/lumberjack/types"
 	"golang.org/x/exp/rand"
 )
@@ -218,3 +221,92 @@ func updateProcessInfo(proc types.ProcessInfo) error {
 	processFile := getProcessFilePath(proc.ID)
 	return os.WriteFile(processFile, data, 0644)
 }
+
+// promptEncryption asks how a database should be encrypted at rest and returns
+// the chosen mode, key file path and secret. A key file is generated in the
+// database directory; a passphrase is entered twice.
+func promptEncryption(dbName string) (string, string, []byte, error) {
+	selectPrompt := promptui.Select{
+		Label: "Encryption at rest",
+		Items: []string{"none", "passphrase", "keyfile"},
+	}
+	_, mode, err := selectPrompt.Run()
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	switch mode {
+	case "passphrase":
+		passphrase, err := promptPassphrase("Database Passphrase")
+		if err != nil {
+			return "", "", nil, err
+		}
+		confirm, err := promptPassphrase("Re-enter Database Passphrase")
+		if err != nil {
+			return "", "", nil, err
+		}
+		if string(passphrase) != string(confirm) {
+			return "", "", nil, fmt.Errorf("passphrases do not match")
+		}
+		return mode, "", passphrase, nil
+	case "keyfile":
+		key := make([]byte, 32)
+		if _, err := crand.Read(key); err != nil {
+			return "", "", nil, err
+		}
+		dbDir := filepath.Join(defaultLibDir, dbName)
+		if err := os.MkdirAll(dbDir, 0755); err != nil {
+			return "", "", nil, err
+		}
+		keyFile := filepath.Join(dbDir, fmt.Sprintf("%s.%s.key", dbName, generateID()))
+		if err := os.WriteFile(keyFile, key, 0600); err != nil {
+			return "", "", nil, fmt.Errorf("failed to write key file: %v", err)
+		}
+		fmt.Printf("Key file written to %s, keep a backup of it\n", keyFile)
+		return mode, keyFile, key, nil
+	}
+	return "", "", nil, nil
+}
+
+func promptPassphrase(label string) ([]byte, error) {
+	prompt := promptui.Prompt{
+		Label: label,
+		Mask:  '*',
+		Validate: func(input string) error {
+			if len(input) < 8 {
+				return fmt.Errorf("passphrase must be at least 8 characters")
+			}
+			return nil
+		},
+	}
+	result, err := prompt.Run()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(result), nil
+}
+
+// resolveSecret returns the secret a database is encrypted with: the key file's
+// contents, or the passphrase from LUMBERJACK_PASSPHRASE, prompting for it when
+// interactive is set and the variable is empty.
+func resolveSecret(info types.ProcessInfo, interactive bool) ([]byte, error) {
+	switch info.Encryption {
+	case "":
+		return nil, nil
+	case "keyfile":
+		key, err := os.ReadFile(info.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		return key, nil
+	case "passphrase":
+		if passphrase := os.Getenv(internal.PassphraseEnv); passphrase != "" {
+			return []byte(passphrase), nil
+		}
+		if !interactive {
+			return nil, fmt.Errorf("database %s is encrypted, set %s", info.Name, internal.PassphraseEnv)
+		}
+		return promptPassphrase(fmt.Sprintf("Passphrase for %s", info.Name))
+	}
+	return nil, fmt.Errorf("unknown encryption mode: %s", info.Encryption)
+}
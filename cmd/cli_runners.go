@@ -10,6 +10,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/vaziolabs/lumberjack/internal"
 	"github.com/vaziolabs/lumberjack/types"
 )
 
@@ -90,6 +91,15 @@ func spawnServer(userInput types.ProcessInfo, withDashboard bool) error {
 	cmd := exec.Command(os.Args[0], args...)
 	cmd.Env = append(os.Environ(), "LUMBERJACK_SPAWNED=1")
 
+	// The spawned server cannot prompt, so hand it the passphrase through its environment
+	if userInput.Encryption == "passphrase" && os.Getenv(internal.PassphraseEnv) == "" {
+		passphrase, err := resolveSecret(userInput, true)
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env, internal.PassphraseEnv+"="+string(passphrase))
+	}
+
 	// Properly detach the process
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
@@ -3,9 +3,9 @@ package internal
 import (
 	"context"
 	"errors"
+	"io"
 	"net/http"
-	"path/filepath"
-	"time"
+	"os"
 
 	"github.com/gorilla/mux"
 	"github.com/vaziolabs/lumberjack/internal/core"
@@ -17,24 +17,30 @@ func NewServer(config types.ServerConfig, adminUser core.User) (*Server, error)
 
 	server := &Server{
 		forest: core.NewForest("forest"),
-		jwtConfig: JWTConfig{
-			SecretKey: []byte("your-secret-key"), // TODO: Add certificate management to handle this securely
-			ExpiresIn: 24 * time.Hour,
-		},
 		logger: types.NewLogger(),
 		server: &http.Server{
 			Addr:    ":" + config.Process.ServerPort,
 			Handler: router,
 		},
 		config: config,
+		secret: config.Secret,
 	}
 
 	server.logger.Enter("NewServer")
 	defer server.logger.Exit("NewServer")
 
+	if len(config.Secret) > 0 {
+		stateCipher, err := NewStateCipher(config.Secret, nil)
+		if err != nil {
+			server.logger.Failure("failed to set up encryption: %v", err)
+			return nil, err
+		}
+		server.cipher = stateCipher
+	}
+
 	// Create admin user for new database
 	coreUser := core.User{
-		ID:           core.GenerateID(),
+		Name:         adminUser.Name,
 		Username:     adminUser.Username,
 		Email:        adminUser.Email,
 		Organization: adminUser.Organization,
@@ -46,18 +52,56 @@ func NewServer(config types.ServerConfig, adminUser core.User) (*Server, error)
 		return nil, err
 	}
 
-	if err := server.forest.AssignUser(coreUser, core.AdminPermission); err != nil {
+	coreUser, err := server.forest.Directory.Add(coreUser)
+	if err != nil {
+		server.logger.Failure("failed to add admin user: %v", err)
+		return nil, err
+	}
+
+	if err := server.forest.AssignUser(coreUser.ID, core.AdminPermission); err != nil {
 		server.logger.Failure("failed to save admin user: %v", err)
 		return nil, err
 	}
 
-	dbPath := filepath.Join(config.Process.DatabasePath, config.Process.Name+".dat")
-	if err := server.writeChangesToFile(server.forest, dbPath); err != nil {
+	if err := server.writeChangesToFile(server.forest, server.dbFile()); err != nil {
 		server.logger.Failure("failed to save state after user creation: %v", err)
 		return nil, err
 	}
 
+	// A new database gets freshly generated signing keys
+	keys, err := NewKeyRing(keyRingFile(config), config.Secret)
+	if err != nil {
+		server.logger.Failure("failed to generate signing keys: %v", err)
+		return nil, err
+	}
+	if server.jwtConfig, err = newJWTConfig(config, keys); err != nil {
+		server.logger.Failure("failed to configure tokens: %v", err)
+		return nil, err
+	}
+	if server.sessions, err = NewSessionStore(sessionsFile(config), config.Secret); err != nil {
+		server.logger.Failure("failed to create session store: %v", err)
+		return nil, err
+	}
+
+	// A new database starts from a fresh snapshot, so any leftover journal is stale
+	if err := os.Remove(server.dbFile() + ".journal"); err != nil && !os.IsNotExist(err) {
+		server.logger.Failure("failed to remove stale journal: %v", err)
+		return nil, err
+	}
+	if err := server.openJournal(); err != nil {
+		server.logger.Failure("failed to open journal: %v", err)
+		return nil, err
+	}
+	if err := server.initBlobs(); err != nil {
+		server.logger.Failure("failed to open blob store: %v", err)
+		return nil, err
+	}
+
 	server.initCache()
+	server.initSearch()
+	server.changes = NewChangeFeed()
+	server.initWebhooks()
+	server.initNotifiers()
 	server.initAPIQueue(5) // Start with 5 workers
 
 	return server, nil
@@ -68,32 +112,149 @@ func LoadServer(config types.ServerConfig) (*Server, error) {
 
 	server := &Server{
 		forest: core.NewForest("forest"),
-		jwtConfig: JWTConfig{
-			SecretKey: []byte("your-secret-key"), // TODO: Determine on how to handle key securely
-			ExpiresIn: 24 * time.Hour,
-		},
 		logger: types.NewLogger(),
 		server: &http.Server{
 			Addr:    ":" + config.Process.ServerPort,
 			Handler: router,
 		},
 		config: config,
+		secret: config.Secret,
 	}
 
 	server.logger.Enter("LoadServer")
 	defer server.logger.Exit("LoadServer")
 
-	dbPath := filepath.Join(config.Process.DatabasePath, config.Process.Name+".dat")
+	dbPath := server.dbFile()
 	server.logger.Debug("Loading database from %s", dbPath)
 	if err := server.loadFromFile(dbPath); err != nil {
 		server.logger.Failure("failed to load database: %v", err)
 		return nil, err
 	}
 
+	keys, err := LoadKeyRing(keyRingFile(config), config.Secret)
+	if err != nil {
+		server.logger.Failure("failed to load signing keys: %v", err)
+		return nil, err
+	}
+	if server.jwtConfig, err = newJWTConfig(config, keys); err != nil {
+		server.logger.Failure("failed to configure tokens: %v", err)
+		return nil, err
+	}
+	if server.sessions, err = LoadSessionStore(sessionsFile(config), config.Secret); err != nil {
+		server.logger.Failure("failed to load sessions: %v", err)
+		return nil, err
+	}
+
+	if err := server.openJournal(); err != nil {
+		server.logger.Failure("failed to open journal: %v", err)
+		return nil, err
+	}
+	if err := server.replayJournal(); err != nil {
+		server.logger.Failure("failed to replay journal: %v", err)
+		return nil, err
+	}
+	if repaired, err := server.journal.Repair(); err != nil {
+		server.logger.Failure("failed to repair journal: %v", err)
+		return nil, err
+	} else if repaired {
+		server.logger.Notice("Cut a torn record off the end of the journal")
+	}
+	server.forest.Link()
+
+	// Users stored on nodes by older versions move into the directory
+	if migrated := server.forest.MigrateUsers(); len(migrated) > 0 {
+		if err := server.persist(migrated...); err != nil {
+			server.logger.Failure("failed to migrate users: %v", err)
+			return nil, err
+		}
+		server.logger.Notice("Migrated users of %d nodes into the user directory", len(migrated))
+	}
+
+	// Time tracked as start and stop entries by older versions becomes sessions
+	if migrated := server.forest.MigrateTimeEntries(); len(migrated) > 0 {
+		if err := server.persist(migrated...); err != nil {
+			server.logger.Failure("failed to migrate time entries: %v", err)
+			return nil, err
+		}
+		server.logger.Notice("Migrated time entries of %d nodes into sessions", len(migrated))
+	}
+
+	// Attachment contents kept in the state file by older versions move into the blob store
+	if err := server.initBlobs(); err != nil {
+		server.logger.Failure("failed to open blob store: %v", err)
+		return nil, err
+	}
+
+	server.initCache()
+	server.initSearch()
+	server.changes = NewChangeFeed()
+	server.initWebhooks()
+	server.initNotifiers()
+	server.initAPIQueue(5)
+
 	server.logger.Info("Loaded existing database from %s", dbPath)
 	return server, nil
 }
 
+// LoadForest reads the forest of a database along with the changes still in
+// its journal. Nothing is written, so it is safe while a server runs on it.
+func LoadForest(config types.ServerConfig) (*core.Node, error) {
+	server := &Server{
+		forest: core.NewForest("forest"),
+		logger: types.NewLogger(),
+		config: config,
+		secret: config.Secret,
+	}
+
+	if err := server.loadFromFile(server.dbFile()); err != nil {
+		return nil, err
+	}
+	journal, err := OpenJournal(server.dbFile() + ".journal")
+	if err != nil {
+		return nil, err
+	}
+	defer journal.Close()
+
+	journal.cipher = server.cipher
+	server.journal = journal
+	if err := server.replayJournal(); err != nil {
+		return nil, err
+	}
+	server.forest.Link()
+
+	// Migrated in memory only, the server migrates them on disk when it loads
+	server.forest.MigrateUsers()
+	server.forest.MigrateTimeEntries()
+	return server.forest, nil
+}
+
+// Import merges an export into the node at path of a database no server is
+// running on. Users it creates keep the password hashes the export holds.
+func Import(config types.ServerConfig, r io.Reader, format string, path string) (core.ImportReport, error) {
+	server, err := LoadServer(config)
+	if err != nil {
+		return core.ImportReport{}, err
+	}
+
+	var report core.ImportReport
+	var updated []*core.Node
+	export, blobs, err := core.ReadImport(r, format, server.blobs)
+	if err == nil {
+		report, updated, err = server.forest.Import(path, export, core.ImportOptions{Credentials: true, Blobs: blobs, Store: server.blobs})
+		server.blobs.releaseImported(blobs)
+	}
+	if err == nil {
+		err = server.storeAttachmentData(updated...)
+	}
+	if err == nil && len(updated) > 0 {
+		err = server.persist(updated...)
+	}
+	if shutdownErr := server.Shutdown(context.Background()); err == nil {
+		err = shutdownErr
+	}
+	return report, err
+}
+
 func (s *Server) Start() error {
 	if s.server == nil {
 		return errors.New("server not initialized")
@@ -109,25 +270,84 @@ func (s *Server) Start() error {
 	router.HandleFunc("/time", s.authMiddleware(s.handleGetTimeTracking)).Methods("GET")
 	router.HandleFunc("/time/start", s.authMiddleware(s.handleStartTimeTracking)).Methods("POST")
 	router.HandleFunc("/time/stop", s.authMiddleware(s.handleStopTimeTracking)).Methods("POST")
+	router.HandleFunc("/time/running", s.authMiddleware(s.handleGetRunningTimer)).Methods("GET")
+	router.HandleFunc("/time/sessions/{id}", s.authMiddleware(s.handleUpdateTimeSession)).Methods("PATCH")
 	router.HandleFunc("/events", s.authMiddleware(s.handleGetEventEntries)).Methods("POST")
+	router.HandleFunc("/events", s.authMiddleware(s.handleListEvents)).Methods("GET")
+	router.HandleFunc("/events/{eventId}/entries", s.authMiddleware(s.handleListEventEntries)).Methods("GET")
+	router.HandleFunc("/entries", s.authMiddleware(s.handleListEntries)).Methods("GET")
 	router.HandleFunc("/events/plan", s.authMiddleware(s.handlePlanEvent)).Methods("POST")
 	router.HandleFunc("/events/start", s.authMiddleware(s.handleStartEvent)).Methods("POST")
 	router.HandleFunc("/events/append", s.authMiddleware(s.handleAppendToEvent)).Methods("POST")
 	router.HandleFunc("/events/end", s.authMiddleware(s.handleEndEvent)).Methods("POST")
+	router.HandleFunc("/events/occurrences", s.authMiddleware(s.handleGetOccurrences)).Methods("GET")
+	router.HandleFunc("/events/occurrences/cancel", s.authMiddleware(s.handleCancelOccurrence)).Methods("POST")
+	router.HandleFunc("/events/occurrences/update", s.authMiddleware(s.handleUpdateOccurrence)).Methods("POST")
+	router.HandleFunc("/reports/variance", s.authMiddleware(s.handleGetVarianceReport)).Methods("GET")
+	router.HandleFunc("/reports/timesheet", s.authMiddleware(s.handleGetTimesheet)).Methods("GET")
+	router.HandleFunc("/search", s.authMiddleware(s.handleSearch)).Methods("GET")
+	router.HandleFunc("/changes", s.authMiddleware(s.handleChangeStream)).Methods("GET")
+	router.HandleFunc("/changes/ws", s.authMiddleware(s.handleChangeSocket)).Methods("GET")
+	router.HandleFunc("/webhooks", s.authMiddleware(s.handleCreateWebhook)).Methods("POST")
+	router.HandleFunc("/webhooks", s.authMiddleware(s.handleListWebhooks)).Methods("GET")
+	router.HandleFunc("/webhooks/{id}", s.authMiddleware(s.handleDeleteWebhook)).Methods("DELETE")
+	router.HandleFunc("/webhooks/{id}/dead-letters", s.authMiddleware(s.handleGetDeadLetters)).Methods("GET")
+	router.HandleFunc("/webhooks/{id}/redeliver", s.authMiddleware(s.handleRedeliverWebhook)).Methods("POST")
+	router.HandleFunc("/notifiers", s.authMiddleware(s.handleCreateNotifier)).Methods("POST")
+	router.HandleFunc("/notifiers", s.authMiddleware(s.handleListNotifiers)).Methods("GET")
+	router.HandleFunc("/notifiers/{id}", s.authMiddleware(s.handleDeleteNotifier)).Methods("DELETE")
+	router.HandleFunc("/notifiers/{id}/test", s.authMiddleware(s.handleTestNotifier)).Methods("POST")
+	router.HandleFunc("/calendar/token", s.authMiddleware(s.handleCreateFeedToken)).Methods("POST")
+	router.HandleFunc("/calendar/token", s.authMiddleware(s.handleRevokeFeedToken)).Methods("DELETE")
+	router.HandleFunc("/calendar/import", s.authMiddleware(s.handleImportCalendar)).Methods("POST")
+	router.HandleFunc("/calendar/{path:.+}.ics", s.calendarAuth(s.handleGetCalendar)).Methods("GET")
+	router.HandleFunc("/export", s.authMiddleware(s.handleExport)).Methods("GET")
+	router.HandleFunc("/import", s.authMiddleware(s.handleImport)).Methods("POST")
 	router.HandleFunc("/forest", s.authMiddleware(s.handleGetForest)).Methods("GET")
 	router.HandleFunc("/forest/tree", s.authMiddleware(s.handleGetTree)).Methods("GET")
+	router.HandleFunc("/nodes", s.authMiddleware(s.handleCreateNode)).Methods("POST")
+	router.HandleFunc("/nodes", s.authMiddleware(s.handleListNodes)).Methods("GET")
+	router.HandleFunc("/nodes/resolve", s.authMiddleware(s.handleResolveNode)).Methods("GET")
+	router.HandleFunc("/nodes/{id}", s.authMiddleware(s.handleUpdateNode)).Methods("PATCH")
+	router.HandleFunc("/nodes/{id}/move", s.authMiddleware(s.handleMoveNode)).Methods("POST")
+	router.HandleFunc("/nodes/{id}", s.authMiddleware(s.handleDeleteNode)).Methods("DELETE")
 	router.HandleFunc("/users", s.authMiddleware(s.handleGetUsers)).Methods("GET")
 	router.HandleFunc("/users/assign", s.authMiddleware(s.handleAssignUser)).Methods("POST")
 	router.HandleFunc("/users/profile", s.authMiddleware(s.handleGetUserProfile)).Methods("GET")
+	router.HandleFunc("/users/{id}", s.authMiddleware(s.handleUpdateUser)).Methods("PATCH")
+	router.HandleFunc("/users/{id}", s.authMiddleware(s.handleDeleteUser)).Methods("DELETE")
+	router.HandleFunc("/users/{id}/password", s.authMiddleware(s.handleChangePassword)).Methods("POST")
+	router.HandleFunc("/users/{id}/disable", s.authMiddleware(s.handleDisableUser)).Methods("POST")
+	router.HandleFunc("/users/{id}/enable", s.authMiddleware(s.handleEnableUser)).Methods("POST")
+	router.HandleFunc("/users/{id}/sessions", s.authMiddleware(s.handleGetSessions)).Methods("GET")
+	router.HandleFunc("/users/{id}/sessions/revoke", s.authMiddleware(s.handleRevokeSessions)).Methods("POST")
+	router.HandleFunc("/logout", s.authMiddleware(s.handleLogout)).Methods("POST")
 	router.HandleFunc("/settings/", s.authMiddleware(s.handleGetServerSettings)).Methods("GET")
 	router.HandleFunc("/settings/update", s.authMiddleware(s.handleUpdateServerSettings)).Methods("POST")
+	router.HandleFunc("/attachments", s.authMiddleware(s.handleListAttachments)).Methods("GET")
 	router.HandleFunc("/attachments/upload", s.authMiddleware(s.handleUploadAttachment)).Methods("POST")
+	router.HandleFunc("/attachments/uploads", s.authMiddleware(s.handleCreateUpload)).Methods("POST")
+	router.HandleFunc("/attachments/uploads/{id}", s.authMiddleware(s.handleGetUpload)).Methods("GET", "HEAD")
+	router.HandleFunc("/attachments/uploads/{id}", s.authMiddleware(s.handleAppendUpload)).Methods("PATCH")
+	router.HandleFunc("/attachments/uploads/{id}", s.authMiddleware(s.handleCancelUpload)).Methods("DELETE")
+	router.HandleFunc("/attachments/usage", s.authMiddleware(s.handleGetAttachmentUsage)).Methods("GET")
 	router.HandleFunc("/attachments/{id}", s.authMiddleware(s.handleGetAttachment)).Methods("GET")
+	router.HandleFunc("/attachments/{id}/thumbnail", s.authMiddleware(s.handleGetThumbnail)).Methods("GET")
+	router.HandleFunc("/attachments/{id}/preview", s.authMiddleware(s.handleGetPreview)).Methods("GET")
 	router.HandleFunc("/attachments/{id}", s.authMiddleware(s.handleDeleteAttachment)).Methods("DELETE")
 	router.HandleFunc("/events/{eventId}/entries/{entryIndex}/attachments", s.authMiddleware(s.handleAddEntryAttachment)).Methods("POST")
+	router.HandleFunc("/events/{eventId}/entries/{entryIndex}/attachments/{id}", s.authMiddleware(s.handleGetEntryAttachment)).Methods("GET")
+	router.HandleFunc("/events/{eventId}/entries/{entryIndex}/attachments/{id}", s.authMiddleware(s.handleDeleteEntryAttachment)).Methods("DELETE")
 	router.HandleFunc("/logs", s.authMiddleware(s.handleGetLogs)).Methods("GET")
 
 	s.server.Handler = router
+	if s.changes != nil {
+		// Streaming requests never finish on their own, so end them as
+		// Shutdown starts rather than have it wait for them
+		s.server.RegisterOnShutdown(s.changes.Close)
+	}
+	s.watchKeyRotation()
+	s.startScheduler(defaultSchedulerInterval)
 	go func() {
 		s.logger.Info("API server starting on http://localhost" + s.server.Addr)
 		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -138,16 +358,42 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// Shutdown stops the workers and the API server and checkpoints the journal.
+// Later calls do nothing.
 func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	s.stopOnce.Do(func() {
+		err = s.shutdown(ctx)
+	})
+	return err
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	// Stop taking requests first so the changes of those in flight are still
+	// journaled. Change streams are closed as it starts, see Start.
+	var err error
+	if s.server != nil {
+		s.logger.Info("Shutting down API server")
+		err = s.server.Shutdown(ctx)
+	}
+
 	// Signal workers to shut down
 	close(s.apiQueue.shutdown)
 
 	// Wait for all workers to finish
 	s.apiQueue.wg.Wait()
+	s.stopWebhooks()
 
-	if s.server != nil {
-		s.logger.Info("Shutting down API server")
-		return s.server.Shutdown(ctx)
+	s.stopKeyRotation()
+	s.stopScheduler()
+	if s.changes != nil {
+		s.changes.Close()
 	}
-	return nil
+
+	// Fold the journal into the state file so the next start loads a single
+	// snapshot. Nothing writes to it any more.
+	if journalErr := s.closeJournal(); journalErr != nil {
+		s.logger.Failure("Failed to checkpoint journal: %v", journalErr)
+	}
+	return err
 }
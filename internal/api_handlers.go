@@ -2,12 +2,17 @@ package internal
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/vaziolabs/lumberjack/internal/core"
@@ -35,9 +40,9 @@ func (server *Server) handleAssignUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	node, err := server.forest.GetNode(request.Path)
+	node, err := server.getNodeFromPath(request.Path)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writePathError(w, err)
 		return
 	}
 
@@ -47,8 +52,12 @@ func (server *Server) handleAssignUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	assigneeUser := core.User{ID: request.AssigneeID}
-	if err := node.AssignUser(assigneeUser, request.Permission); err != nil {
+	if _, err := server.forest.Directory.Get(request.AssigneeID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := node.AssignUser(request.AssigneeID, request.Permission); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -60,20 +69,28 @@ func (server *Server) handleAssignUser(w http.ResponseWriter, r *http.Request) {
 	}, userID)
 
 	// Write changes to file
-	if err := server.writeChangesToFile(node, "state_file.dat"); err != nil {
+	if err := server.persist(node); err != nil {
 		http.Error(w, "Failed to save state", http.StatusInternalServerError)
 		return
 	}
 
+	server.publish(ChangeUserAssigned, node, userID, map[string]interface{}{
+		"assignee_id": request.AssigneeID,
+		"permission":  request.Permission,
+	})
+
 	w.WriteHeader(http.StatusOK)
 }
 
-// HTTP handler for starting time tracking
+// HTTP handler for starting time tracking. Users run one timer at a time, so
+// a timer running on another node is stopped first.
 func (server *Server) handleStartTimeTracking(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(string)
 
 	var request struct {
-		Path string `json:"path"`
+		Path     string `json:"path"`
+		Note     string `json:"note"`
+		Billable bool   `json:"billable"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -81,24 +98,53 @@ func (server *Server) handleStartTimeTracking(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	node, err := server.forest.GetNode(request.Path)
+	node, err := server.getNodeFromPath(request.Path)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	server.timers.Lock()
+	defer server.timers.Unlock()
+
+	if _, running := node.RunningTimer(userID); running {
+		http.Error(w, "Timer already running on this node", http.StatusConflict)
 		return
 	}
 
-	node.StartTimeTracking(userID)
+	stopped, stoppedNodes := server.stopRunningTimers(userID, time.Now())
+	session, err := node.StartTimeTracking(userID, request.Note, request.Billable)
+	if err != nil {
+		// The timers stopped above stay stopped, so they are saved all the same
+		if len(stoppedNodes) > 0 {
+			if err := server.persist(stoppedNodes...); err != nil {
+				server.logger.Failure("Failed to save stopped timers: %v", err)
+			}
+		}
+		writeTimeSessionError(w, err)
+		return
+	}
 
 	// Write changes to file
-	if err := server.writeChangesToFile(node, "state_file.dat"); err != nil {
+	if err := server.persist(append(stoppedNodes, node)...); err != nil {
 		http.Error(w, "Failed to save state", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session": session,
+		"stopped": stopped,
+	})
 }
 
-// HTTP handler for stopping time tracking
+// HTTP handler for stopping time tracking. Without a path the user's timer is
+// stopped wherever it runs.
 func (server *Server) handleStopTimeTracking(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(string)
 
@@ -106,35 +152,118 @@ func (server *Server) handleStopTimeTracking(w http.ResponseWriter, r *http.Requ
 		Path string `json:"path"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	node, err := server.forest.GetNode(request.Path)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	server.timers.Lock()
+	defer server.timers.Unlock()
+
+	node := server.runningTimerNode(userID)
+	if request.Path != "" {
+		var err error
+		if node, err = server.getNodeFromPath(request.Path); err != nil {
+			writePathError(w, err)
+			return
+		}
+	}
+	if node == nil {
+		http.Error(w, "No timer running", http.StatusNotFound)
 		return
 	}
 
-	node.StopTimeTracking(userID)
-
-	summary := node.GetTimeTrackingSummary(userID)
-	json.NewEncoder(w).Encode(summary)
+	session, err := node.StopTimeTracking(userID)
+	if err != nil {
+		writeTimeSessionError(w, err)
+		return
+	}
 
 	// Write changes to file
-	if err := server.writeChangesToFile(node, "state_file.dat"); err != nil {
+	if err := server.persist(node); err != nil {
 		http.Error(w, "Failed to save state", http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
 }
 
-// HTTP handler for getting time tracking summary
+// HTTP handler for getting time tracking summary. Admins of the node may ask
+// for the sessions of another user, or of everyone with user=all.
 func (server *Server) handleGetTimeTracking(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(string)
+	query := r.URL.Query()
+
+	node, err := server.getNodeFromPath(query.Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.ReadPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	target := userID
+	if value := query.Get("user"); value != "" && value != userID {
+		if !node.CheckPermission(userID, core.AdminPermission) {
+			http.Error(w, "Insufficient permissions", http.StatusForbidden)
+			return
+		}
+		target = value
+		if value == "all" {
+			target = ""
+		}
+	}
+
+	var from, to time.Time
+	if value := query.Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid from time format", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid to time format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	summary := node.GetTimeTrackingSummary(target, from, to)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// handleGetRunningTimer returns the user's running timer, or no content when
+// none is running
+func (server *Server) handleGetRunningTimer(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	node := server.runningTimerNode(userID)
+	if node == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	session, _ := node.RunningTimer(userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// handleUpdateTimeSession edits a past or running session. Users edit their
+// own sessions; admins of the node may edit anyone's.
+func (server *Server) handleUpdateTimeSession(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	sessionID := mux.Vars(r)["id"]
 
 	var request struct {
-		Path string `json:"path"`
+		Start    *time.Time `json:"start"`
+		Stop     *time.Time `json:"stop"`
+		Note     *string    `json:"note"`
+		Billable *bool      `json:"billable"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -142,14 +271,39 @@ func (server *Server) handleGetTimeTracking(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	node, err := server.forest.GetNode(request.Path)
+	server.timers.Lock()
+	defer server.timers.Unlock()
+
+	node, session, err := server.findTimeSession(sessionID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeTimeSessionError(w, err)
 		return
 	}
 
-	summary := node.GetTimeTrackingSummary(userID)
-	json.NewEncoder(w).Encode(summary)
+	if !node.CheckPermission(userID, core.WritePermission) ||
+		(session.UserID != userID && !node.CheckPermission(userID, core.AdminPermission)) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	updated, err := node.UpdateTimeSession(sessionID, core.TimeSessionChanges{
+		Start:    request.Start,
+		Stop:     request.Stop,
+		Note:     request.Note,
+		Billable: request.Billable,
+	}, userID)
+	if err != nil {
+		writeTimeSessionError(w, err)
+		return
+	}
+
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
 }
 
 // HTTP handler for starting an event
@@ -169,21 +323,31 @@ func (server *Server) handleStartEvent(w http.ResponseWriter, r *http.Request) {
 
 	node, err := server.getNodeFromPath(request.Path)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Path error: %v", err), http.StatusNotFound)
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
 		return
 	}
 
-	if err := node.StartEvent(request.EventID, userID, nil, nil, request.Metadata); err != nil {
+	if err := node.StartEvent(request.EventID, userID, nil, nil, request.Metadata); errors.Is(err, core.ErrInvalidRecurrence) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, fmt.Sprintf("Start event error: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	// Save state after event creation
-	if err := server.writeChangesToFile(server.forest, "state_file.dat"); err != nil {
+	if err := server.persist(node); err != nil {
 		http.Error(w, "Failed to save state", http.StatusInternalServerError)
 		return
 	}
 
+	server.publish(ChangeEventStarted, node, userID, map[string]interface{}{"event_id": request.EventID})
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -203,7 +367,7 @@ func (server *Server) handleEndEvent(w http.ResponseWriter, r *http.Request) {
 
 	node, err := server.getNodeFromPath(request.Path)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writePathError(w, err)
 		return
 	}
 
@@ -217,6 +381,13 @@ func (server *Server) handleEndEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	server.publish(ChangeEventEnded, node, userID, map[string]interface{}{"event_id": request.EventID})
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -241,7 +412,12 @@ func (server *Server) handleAppendToEvent(w http.ResponseWriter, r *http.Request
 	node, err := server.getNodeFromPath(request.Path)
 	if err != nil {
 		log.Printf("Failed to get node: %v", err)
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
 		return
 	}
 
@@ -261,17 +437,26 @@ func (server *Server) handleAppendToEvent(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	if err := server.writeChangesToFile(server.forest, "state_file.dat"); err != nil {
+	if err := server.persist(node); err != nil {
 		log.Printf("Failed to save state: %v", err)
 		http.Error(w, "Failed to save state", http.StatusInternalServerError)
 		return
 	}
 
+	server.publish(ChangeEntryAppended, node, userID, map[string]interface{}{
+		"event_id": request.EventID,
+		"content":  request.Content,
+	})
+
 	w.WriteHeader(http.StatusOK)
 }
 
-// HTTP handler for getting event entries
+// HTTP handler for getting event entries. The entries are returned as a
+// plain list, paged by the same query parameters as the listings with the
+// next cursor and total in the X-Next-Cursor and X-Total-Count headers.
 func (server *Server) handleGetEventEntries(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
 	var request struct {
 		Path    string `json:"path"`
 		EventID string `json:"event_id"`
@@ -282,32 +467,172 @@ func (server *Server) handleGetEventEntries(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	query, err := server.parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	node, err := server.getNodeFromPath(request.Path)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.ReadPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
 		return
 	}
 
-	entries, err := node.GetEventEntries(request.EventID)
+	items, err := node.EventEntryItems(request.EventID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	page, err := query.Run(items)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(entries)
+	json.NewEncoder(w).Encode(page.Items)
+}
+
+// handleListEvents lists the events and planned events of a node
+func (server *Server) handleListEvents(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	query, err := server.parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	node, err := server.getNodeFromPath(r.URL.Query().Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.ReadPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	writeQueryPage(w, query, node.EventItems())
+}
+
+// handleListEventEntries lists the entries of an event
+func (server *Server) handleListEventEntries(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	eventID := mux.Vars(r)["eventId"]
+
+	query, err := server.parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	node, err := server.getNodeFromPath(r.URL.Query().Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.ReadPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	items, err := node.EventEntryItems(eventID)
+	if err != nil {
+		writeOccurrenceError(w, err)
+		return
+	}
+	writeQueryPage(w, query, items)
+}
+
+// handleListEntries lists the entries made on a node itself
+func (server *Server) handleListEntries(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	query, err := server.parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	node, err := server.getNodeFromPath(r.URL.Query().Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.ReadPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	writeQueryPage(w, query, node.EntryItems())
+}
+
+// handleListNodes lists a node and the readable nodes below it, without
+// their contents, ordered by path unless sorted otherwise
+func (server *Server) handleListNodes(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	query, err := server.parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Sort == "" {
+		query.Sort = core.SortByPath
+	}
+
+	node, err := server.getNodeFromPath(r.URL.Query().Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	// Descendants are listed under their canonical path
+	path := r.URL.Query().Get("path")
+	if paths := server.forest.Paths(node.ID); len(paths) > 0 {
+		path = paths[0]
+	}
+
+	items := node.NodeItems(path, userID)
+	if !node.CheckPermission(userID, core.ReadPermission) && len(items) == 0 {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	writeQueryPage(w, query, items)
 }
 
-// HTTP handler for getting tree
+// HTTP handler for getting the forest, limited to what the user may read
 func (server *Server) handleGetForest(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(server.forest)
+	json.NewEncoder(w).Encode(server.forest.FilterFor(userID))
 }
 
-// HTTP handler for getting users
+// HTTP handler for getting users, without their credentials
 func (server *Server) handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	users := server.forest.Directory.List()
+	profiles := make([]core.UserProfile, len(users))
+	for i := range users {
+		profiles[i] = users[i].Profile()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(server.forest.Users)
+	json.NewEncoder(w).Encode(profiles)
 }
 
 // HTTP handler for creating a user
@@ -329,7 +654,6 @@ func (server *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 
 	// Create new user
 	user := core.User{
-		ID:       core.GenerateID(),
 		Username: request.Username,
 		Email:    request.Email,
 	}
@@ -340,21 +664,28 @@ func (server *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Add user to the root node
-	if err := server.forest.AssignUser(user, core.ReadPermission); err != nil {
-		server.logger.Failure("Failed to assign user: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	user, err := server.forest.Directory.Add(user)
+	if errors.Is(err, core.ErrUsernameTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		server.logger.Failure("Failed to add user: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Save state
-	if err := server.writeChangesToFile(server.forest, "state_file.dat"); err != nil {
+	// Signing up grants nothing, read access on the root would reach every
+	// node below it. Admins grant access with /users/assign.
+
+	// Save state, the directory is kept with the root
+	if err := server.persist(server.forest); err != nil {
 		server.logger.Failure("Failed to save state: %v", err)
 		http.Error(w, "Failed to save state", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user.Profile())
 	server.logger.Success("User created successfully")
 }
 
@@ -388,145 +719,1536 @@ func (server *Server) handlePlanEvent(w http.ResponseWriter, r *http.Request) {
 
 	node, err := server.getNodeFromPath(request.Path)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
 		return
 	}
 
-	if err := node.PlanEvent(request.EventID, userID, &startTime, &endTime, request.Metadata); err != nil {
+	if err := node.PlanEvent(request.EventID, userID, &startTime, &endTime, request.Metadata); errors.Is(err, core.ErrInvalidRecurrence) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
-// Add new handlers
-func (server *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
-	server.logger.Enter("handleLogin")
-	defer server.logger.Exit("handleLogin")
+// handleGetOccurrences lists the events of a node starting within [from, to),
+// expanding recurring series. The range defaults to the next 30 days.
+func (server *Server) handleGetOccurrences(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	query := r.URL.Query()
 
-	var credentials struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+	node, err := server.getNodeFromPath(query.Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
-		server.logger.Failure("Invalid request: %v", err)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if !node.CheckPermission(userID, core.ReadPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
 		return
 	}
 
-	server.logger.Info("Attempting login for user: %s", credentials.Username)
-	server.logger.Info("Number of users in system: %d", len(server.forest.Users))
+	from, to := time.Now(), time.Time{}
+	if value := query.Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid from time format", http.StatusBadRequest)
+			return
+		}
+	}
+	to = from.Add(core.RecurrenceHorizon)
+	if value := query.Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid to time format", http.StatusBadRequest)
+			return
+		}
+	}
+	if !to.After(from) {
+		http.Error(w, "to must be after from", http.StatusBadRequest)
+		return
+	}
+
+	occurrences := node.Occurrences(from, to)
+	if occurrences == nil {
+		occurrences = []core.Occurrence{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(occurrences)
+}
+
+// handleCancelOccurrence skips one occurrence of a recurring series
+func (server *Server) handleCancelOccurrence(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	var request struct {
+		Path       string    `json:"path"`
+		EventID    string    `json:"event_id"`
+		Occurrence time.Time `json:"occurrence"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	node, err := server.getNodeFromPath(request.Path)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	if err := node.CancelOccurrence(request.EventID, request.Occurrence, userID); err != nil {
+		writeOccurrenceError(w, err)
+		return
+	}
+
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleUpdateOccurrence edits one occurrence, this and the following
+// occurrences, or all occurrences of a recurring series
+func (server *Server) handleUpdateOccurrence(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	var request struct {
+		Path       string                 `json:"path"`
+		EventID    string                 `json:"event_id"`
+		Occurrence time.Time              `json:"occurrence"`
+		Scope      string                 `json:"scope"`
+		StartTime  *time.Time             `json:"start_time"`
+		EndTime    *time.Time             `json:"end_time"`
+		Metadata   map[string]interface{} `json:"metadata"`
+		Frequency  *string                `json:"frequency"`
+		Pattern    *string                `json:"custom_pattern"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Scope == "" {
+		request.Scope = core.ScopeThis
+	}
+
+	node, err := server.getNodeFromPath(request.Path)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	eventID, err := node.UpdateOccurrence(request.EventID, request.Occurrence, request.Scope, core.OccurrenceChanges{
+		Start:     request.StartTime,
+		End:       request.EndTime,
+		Metadata:  request.Metadata,
+		Frequency: request.Frequency,
+		Pattern:   request.Pattern,
+	}, userID)
+	if err != nil {
+		writeOccurrenceError(w, err)
+		return
+	}
+
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"event_id": eventID})
+}
+
+// handleGetTimesheet rolls the time tracked and the finished events of a
+// subtree up through its branches, as JSON or as CSV with format=csv
+func (server *Server) handleGetTimesheet(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	query := r.URL.Query()
+
+	node, err := server.getNodeFromPath(query.Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	options := core.RollupOptions{UserID: userID, PerPath: query.Get("per_path") == "true"}
+	if err := core.ParseRollupGroups(query.Get("group_by"), &options); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if value := query.Get("from"); value != "" {
+		if options.From, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid from time format", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if options.To, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid to time format", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("tz"); value != "" {
+		if options.Location, err = time.LoadLocation(value); err != nil {
+			http.Error(w, "Invalid time zone", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Descendants are reported under their canonical path
+	path := query.Get("path")
+	if paths := server.forest.Paths(node.ID); len(paths) > 0 {
+		path = paths[0]
+	}
+
+	report := node.Rollup(path, options)
+	if !node.CheckPermission(userID, core.ReadPermission) && len(report.Rows) == 0 {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	report.SetUsernames(server.forest.Directory)
+
+	switch query.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="timesheet.csv"`)
+		report.WriteCSV(w)
+	default:
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+	}
+}
+
+// handleSearch finds the nodes, entries, events and attachments matching a
+// query among those the user can read, optionally within a subtree
+func (server *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	query := r.URL.Query()
+
+	search := core.SearchQuery{Text: query.Get("q"), Category: query.Get("category")}
+	if strings.TrimSpace(search.Text) == "" {
+		http.Error(w, "Missing search query", http.StatusBadRequest)
+		return
+	}
+	if path := query.Get("path"); path != "" {
+		node, err := server.getNodeFromPath(path)
+		if err != nil {
+			writePathError(w, err)
+			return
+		}
+		search.Scope = node
+	}
+
+	if user := query.Get("user"); user != "" {
+		search.User = server.resolveUserID(user)
+	}
+
+	var err error
+	if value := query.Get("from"); value != "" {
+		if search.From, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid from time format", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if search.To, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid to time format", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if search.Limit, err = strconv.Atoi(value); err != nil || search.Limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	hits := server.search.Search(server.forest, search, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"query": search.Text,
+		"hits":  hits,
+	})
+}
+
+// handleChangeStream streams the changes below a node as Server-Sent Events.
+// Each event's ID is its sequence number, so browsers resume on their own.
+func (server *Server) handleChangeStream(w http.ResponseWriter, r *http.Request) {
+	subscription, backlog, complete, ok := server.subscribeChanges(w, r)
+	if !ok {
+		return
+	}
+	defer subscription.Close()
+
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+
+	send := func(change Change) error {
+		data, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Seq, change.Type, data); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+	keepalive := func() error {
+		if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+	server.streamChanges(r, subscription, backlog, complete, send, keepalive, nil)
+}
+
+// handleChangeSocket streams the changes below a node over a WebSocket, one
+// JSON text message per change
+func (server *Server) handleChangeSocket(w http.ResponseWriter, r *http.Request) {
+	subscription, backlog, complete, ok := server.subscribeChanges(w, r)
+	if !ok {
+		return
+	}
+	defer subscription.Close()
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+
+	// Clients only ping and close, everything else is ignored
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			opcode, payload, err := ws.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case wsPing:
+				ws.WriteMessage(wsPong, payload)
+			case wsClose:
+				ws.Close(wsCloseNormal, "")
+				return
+			}
+		}
+	}()
+
+	send := func(change Change) error {
+		data, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		return ws.WriteMessage(wsText, data)
+	}
+	keepalive := func() error {
+		return ws.WriteMessage(wsPing, nil)
+	}
+	server.streamChanges(r, subscription, backlog, complete, send, keepalive, closed)
+	ws.Close(wsCloseGoingAway, "stream ended, resume from the last sequence number")
+}
+
+// handleCreateWebhook registers a webhook for the changes on a node and below it.
+// The secret is only ever returned here.
+func (server *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	var request struct {
+		Path   string   `json:"path"`
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, event := range request.Events {
+		known := false
+		for _, changeType := range changeTypes {
+			known = known || event == changeType
+		}
+		if !known {
+			http.Error(w, fmt.Sprintf("Unknown event type %q", event), http.StatusBadRequest)
+			return
+		}
+	}
+
+	node, err := server.getNodeFromPath(request.Path)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.AdminPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	webhook, err := node.AddWebhook(request.URL, request.Events, request.Secret, userID)
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(webhook)
+}
+
+// handleListWebhooks lists the webhooks on a node and below it that the user
+// administers, without their secrets
+func (server *Server) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	node, err := server.getNodeFromPath(r.URL.Query().Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	webhooks := []core.Webhook{}
+	for _, descendant := range node.Index() {
+		if !descendant.CheckPermission(userID, core.AdminPermission) {
+			continue
+		}
+		for _, webhook := range descendant.ListWebhooks() {
+			webhooks = append(webhooks, webhook.Redacted())
+		}
+	}
+	if len(webhooks) == 0 && !node.CheckPermission(userID, core.AdminPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+// handleDeleteWebhook removes a webhook along with its dead letters
+func (server *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	node, webhook, err := server.findWebhook(mux.Vars(r)["id"])
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	if err := node.DeleteWebhook(webhook.ID, userID); err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetDeadLetters lists the deliveries of a webhook that failed for good
+func (server *Server) handleGetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	node, webhook, err := server.findWebhook(mux.Vars(r)["id"])
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.AdminPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	deadLetters := webhook.DeadLetters
+	if deadLetters == nil {
+		deadLetters = []core.WebhookDelivery{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deadLetters)
+}
+
+// handleRedeliverWebhook queues the dead letters of a webhook again, each
+// starting over with a full set of attempts
+func (server *Server) handleRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	node, webhook, err := server.findWebhook(mux.Vars(r)["id"])
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.AdminPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	deadLetters, err := node.TakeDeadLetters(webhook.ID)
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	for _, delivery := range deadLetters {
+		delivery.Attempts = 0
+		delivery.Status = 0
+		delivery.Error = ""
+		delivery.FailedAt = time.Time{}
+		server.queueWebhook(&webhookJob{nodeID: node.ID, delivery: delivery})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"redelivered": len(deadLetters)})
+}
+
+// handleCreateNotifier registers a chat notifier for the changes on a node and below it
+func (server *Server) handleCreateNotifier(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	var request struct {
+		Path string `json:"path"`
+		core.Notifier
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	notifier := request.Notifier
+	if len(notifier.Events) == 0 {
+		notifier.Events = notifierEvents
+	}
+	if err := validateNotifier(notifier); err != nil {
+		writeNotifierError(w, err)
+		return
+	}
+
+	node, err := server.getNodeFromPath(request.Path)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.AdminPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	created, err := node.AddNotifier(notifier, userID)
+	if err != nil {
+		writeNotifierError(w, err)
+		return
+	}
+
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// handleListNotifiers lists the notifiers on a node and below it that the user administers
+func (server *Server) handleListNotifiers(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	node, err := server.getNodeFromPath(r.URL.Query().Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	notifiers := []core.Notifier{}
+	for _, descendant := range node.Index() {
+		if descendant.CheckPermission(userID, core.AdminPermission) {
+			notifiers = append(notifiers, descendant.ListNotifiers()...)
+		}
+	}
+	if len(notifiers) == 0 && !node.CheckPermission(userID, core.AdminPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	sort.Slice(notifiers, func(i, j int) bool {
+		return notifiers[i].CreatedAt.Before(notifiers[j].CreatedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifiers)
+}
+
+// handleDeleteNotifier removes a notifier
+func (server *Server) handleDeleteNotifier(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	node, notifier, err := server.findNotifier(mux.Vars(r)["id"])
+	if err != nil {
+		writeNotifierError(w, err)
+		return
+	}
+
+	if err := node.DeleteNotifier(notifier.ID, userID); err != nil {
+		writeNotifierError(w, err)
+		return
+	}
+
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTestNotifier sends a test message right away, outside the rate limit,
+// and answers with how the service responded
+func (server *Server) handleTestNotifier(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	node, notifier, err := server.findNotifier(mux.Vars(r)["id"])
+	if err != nil {
+		writeNotifierError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.AdminPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	change := Change{Type: "notifier.test", NodeID: node.ID, UserID: userID, Time: time.Now()}
+	if paths := server.forest.Paths(node.ID); len(paths) > 0 {
+		change.Path = paths[0]
+	}
+	text := fmt.Sprintf("Test notification from lumberjack for %s", change.Path)
+	status, err := server.postNotification(notifier, Notification{Text: text, Change: change})
+
+	response := map[string]interface{}{"status": status}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		response["error"] = err.Error()
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleGetCalendar serves the events and planned events of a node and the
+// readable nodes below it as an iCalendar feed
+func (server *Server) handleGetCalendar(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	node, err := server.getNodeFromPath(mux.Vars(r)["path"])
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	// Descendants are listed under the path found through the node's canonical one
+	path := ""
+	if paths := node.PathsUp(); len(paths) > 0 {
+		path = paths[0]
+	}
+
+	var events []core.CalendarEvent
+	node.Walk(path, func(descendant *core.Node, path string) {
+		if descendant.CheckPermission(userID, core.ReadPermission) {
+			events = append(events, descendant.CalendarEvents(path)...)
+		}
+	})
+	if len(events) == 0 && !node.CheckPermission(userID, core.ReadPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Start.Before(events[j].Start)
+	})
+
+	name := node.Name
+	if path != "" {
+		name = path
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", node.Name+".ics"))
+	if err := core.WriteCalendar(w, name, events); err != nil {
+		server.logger.Error("Failed to write calendar: %v", err)
+	}
+}
+
+// handleImportCalendar plans the events of an uploaded .ics file on a leaf
+// node. Events keep their UID as ID, or the ID they were exported from this
+// node with, and events already on the node are skipped, so files can be
+// imported again after they change elsewhere.
+func (server *Server) handleImportCalendar(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "File too large", http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Invalid file upload", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	node, err := server.getNodeFromPath(r.FormValue("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	events, err := core.ParseCalendar(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	type skipped struct {
+		UID    string `json:"uid"`
+		Reason string `json:"reason"`
+	}
+	created := []string{}
+	skips := []skipped{}
+	for _, event := range events {
+		switch {
+		case event.UID == "":
+			skips = append(skips, skipped{event.UID, "no UID"})
+			continue
+		case event.Cancelled:
+			skips = append(skips, skipped{event.UID, "cancelled"})
+			continue
+		case event.RecurrenceID != nil:
+			// Edits of single occurrences have no plan to attach to yet
+			skips = append(skips, skipped{event.UID, "edited occurrence of a series"})
+			continue
+		}
+
+		eventID, exported := core.CalendarEventID(node.ID, event.UID)
+		if !exported {
+			eventID = event.UID
+		}
+		if node.HasEvent(eventID) {
+			skips = append(skips, skipped{event.UID, "already exists"})
+			continue
+		}
+
+		metadata := map[string]interface{}{"ical_uid": event.UID}
+		if event.Summary != "" {
+			metadata["title"] = event.Summary
+		}
+		if event.Description != "" {
+			metadata["description"] = event.Description
+		}
+		if event.Location != "" {
+			metadata["location"] = event.Location
+		}
+		if event.Category != "" {
+			metadata["category"] = event.Category
+		}
+		if event.RRule != "" {
+			metadata["custom_pattern"] = event.RRule
+		}
+
+		start := event.Start
+		if err := node.PlanEvent(eventID, userID, &start, event.End, metadata); err != nil {
+			skips = append(skips, skipped{event.UID, err.Error()})
+			continue
+		}
+		for _, exDate := range event.ExDates {
+			// Dates that are not occurrences of the rule have nothing to cancel
+			node.CancelOccurrence(eventID, exDate, userID)
+		}
+		created = append(created, eventID)
+	}
+
+	if len(created) > 0 {
+		if err := server.persist(node); err != nil {
+			http.Error(w, "Failed to save state", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"created": created,
+		"skipped": skips,
+	})
+}
+
+// handleCreateFeedToken gives the user a new calendar feed token, replacing
+// the one they had. The token is only shown here.
+func (server *Server) handleCreateFeedToken(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	token, hash, err := core.NewFeedToken()
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	_, err = server.forest.Directory.Update(userID, func(user *core.User) error {
+		user.FeedToken = hash
+		return nil
+	})
+	if !server.commitUserChange(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+// handleRevokeFeedToken removes the user's calendar feed token, so feeds
+// subscribed with it stop updating
+func (server *Server) handleRevokeFeedToken(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	_, err := server.forest.Directory.Update(userID, func(user *core.User) error {
+		user.FeedToken = ""
+		return nil
+	})
+	if !server.commitUserChange(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// exportContentTypes are the content types of the export formats
+var exportContentTypes = map[string]string{
+	core.ExportJSON:   "application/json",
+	core.ExportNDJSON: "application/x-ndjson",
+	core.ExportCSV:    "text/csv",
+}
+
+// maxImportSize caps the body of an import, attachments included
+const maxImportSize = 256 << 20
+
+// handleExport streams a subtree as a nested JSON document or as NDJSON or
+// CSV rows. Attachment contents are left out unless attachments=inline puts
+// them in the document or attachments=tar packs them next to it in a tar.
+func (server *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	query := r.URL.Query()
+
+	node, err := server.getNodeFromPath(query.Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = core.ExportJSON
+	}
+	contentType, known := exportContentTypes[format]
+	if !known {
+		http.Error(w, "format must be json, ndjson or csv", http.StatusBadRequest)
+		return
+	}
+	kinds, err := core.ParseExportKinds(query.Get("kinds"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	attachments := query.Get("attachments")
+	if attachments != "" && attachments != "none" && attachments != "inline" && attachments != "tar" {
+		http.Error(w, "attachments must be none, inline or tar", http.StatusBadRequest)
+		return
+	}
+
+	path := query.Get("path")
+	if paths := server.forest.Paths(node.ID); len(paths) > 0 {
+		path = paths[0]
+	}
+	export := node.Export(path, server.forest.Directory, core.ExportOptions{
+		UserID: userID,
+		Data:   attachments == "inline" || attachments == "tar",
+		Blobs:  server.blobs,
+	})
+	if !node.CheckPermission(userID, core.ReadPermission) && len(export.Root.Children) == 0 {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	filename := "lumberjack-export." + format
+	if attachments == "tar" {
+		contentType, filename = "application/x-tar", filename+".tar"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	if attachments == "tar" {
+		err = export.WriteArchive(w, format, kinds)
+	} else {
+		err = export.Write(w, format, kinds)
+	}
+	if err != nil {
+		server.logger.Failure("Failed to write export of %s: %v", path, err)
+	}
+}
+
+// handleImport merges an export from the request body into the node at path,
+// matching nodes by path. The format is read from the format parameter or the
+// Content-Type, and tars written by handleExport are recognised on their own.
+func (server *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	query := r.URL.Query()
+
+	node, err := server.getNodeFromPath(query.Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	if !node.CheckPermission(userID, core.AdminPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		for name, contentType := range exportContentTypes {
+			if mediaType == contentType {
+				format = name
+			}
+		}
+	}
+	export, blobs, err := core.ReadImport(http.MaxBytesReader(w, r.Body, maxImportSize), format, server.blobs)
+	if errors.Is(err, core.ErrInvalidExport) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		server.logger.Failure("Failed to store attachments: %v", err)
+		http.Error(w, "Failed to store attachments", http.StatusInternalServerError)
+		return
+	}
+
+	server.structure.Lock()
+	report, updated, err := server.forest.Import(core.IDPath(node.ID), export, core.ImportOptions{UserID: userID, Blobs: blobs, Store: server.blobs})
+	server.structure.Unlock()
+	server.blobs.releaseImported(blobs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := server.storeAttachmentData(updated...); err != nil {
+		server.logger.Failure("Failed to store attachments: %v", err)
+		http.Error(w, "Failed to store attachments", http.StatusInternalServerError)
+		return
+	}
+	if len(updated) > 0 {
+		if err := server.persist(updated...); err != nil {
+			server.logger.Failure("Failed to save state: %v", err)
+			http.Error(w, "Failed to save state", http.StatusInternalServerError)
+			return
+		}
+		server.publish(ChangeForestImported, node, userID, map[string]interface{}{
+			"nodes":   report.Nodes,
+			"events":  report.Events,
+			"entries": report.Entries,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleGetVarianceReport reports how far the events of a subtree drifted
+// from their plans, for plans starting within the range and due by now
+func (server *Server) handleGetVarianceReport(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	query := r.URL.Query()
+
+	node, err := server.getNodeFromPath(query.Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	now := time.Now()
+	to := now
+	if value := query.Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid to time format", http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.Add(-core.RecurrenceHorizon)
+	if value := query.Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid from time format", http.StatusBadRequest)
+			return
+		}
+	}
+	if !to.After(from) {
+		http.Error(w, "to must be after from", http.StatusBadRequest)
+		return
+	}
+
+	// Descendants are reported under their canonical path
+	path := query.Get("path")
+	if paths := server.forest.Paths(node.ID); len(paths) > 0 {
+		path = paths[0]
+	}
+
+	report := node.VarianceReport(path, from, to, now, userID)
+	if !node.CheckPermission(userID, core.ReadPermission) && len(report.Nodes) == 0 {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Add new handlers
+func (server *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	server.logger.Enter("handleLogin")
+	defer server.logger.Exit("handleLogin")
+
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+		server.logger.Failure("Invalid request: %v", err)
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	server.logger.Info("Attempting login for user: %s", credentials.Username)
+	server.logger.Info("Number of users in system: %d", server.forest.Directory.Len())
+
+	user, err := server.forest.Directory.FindByUsername(credentials.Username)
+	if err != nil {
+		server.logger.Failure("User not found: %s", credentials.Username)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	foundUser := &user
+
+	if !foundUser.VerifyPassword(credentials.Password) {
+		server.logger.Failure("Invalid password for user: %s", credentials.Username)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	if foundUser.Disabled {
+		server.logger.Failure("Login attempt for disabled user: %s", credentials.Username)
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	session, err := server.sessions.Create(foundUser.ID, r.UserAgent(), server.jwtConfig.RefreshExpiresIn)
+	if err != nil {
+		server.logger.Failure("Failed to create session: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	// Generate token pair
+	tokenPair, err := server.generateTokenPair(foundUser, session)
+	if err != nil {
+		server.logger.Failure("Failed to generate tokens: %v", err)
+		http.Error(w, "Failed to generate tokens", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_token": tokenPair.SessionToken,
+		"refresh_token": tokenPair.RefreshToken,
+	})
+	server.logger.Success("Login successful for user %s", foundUser.Username)
+}
+
+// handleRefreshToken exchanges a refresh token for a new token pair. Each
+// refresh token is single use; presenting one twice revokes its session.
+func (server *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	server.logger.Enter("handleRefreshToken")
+	defer server.logger.Exit("handleRefreshToken")
+
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	token, err := jwt.ParseWithClaims(request.RefreshToken, &TokenClaims{}, server.jwtConfig.Keys.Keyfunc(refreshTokenType, server.jwtConfig.RotationWindow))
+
+	if err != nil || !token.Valid {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	claims, ok := token.Claims.(*TokenClaims)
+	if !ok || claims.TokenType != refreshTokenType {
+		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+		return
+	}
+
+	session, err := server.sessions.Rotate(claims.SessionID, claims.Id, server.jwtConfig.RefreshExpiresIn)
+	if err == errRefreshTokenReuse {
+		server.logger.Failure("Refresh token reused for session %s of user %s, session revoked", claims.SessionID, claims.UserID)
+		http.Error(w, "Refresh token already used", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		server.logger.Failure("Failed to refresh session: %v", err)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	// Deleted and disabled users lose every session on their next refresh
+	user, err := server.forest.Directory.Get(claims.UserID)
+	if err != nil || user.Disabled {
+		server.sessions.RevokeUser(claims.UserID)
+		http.Error(w, "Account disabled", http.StatusUnauthorized)
+		return
+	}
+
+	// Generate new token pair
+	tokenPair, err := server.generateTokenPair(&user, session)
+	if err != nil {
+		http.Error(w, "Failed to generate tokens", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"session_token": tokenPair.SessionToken,
+		"refresh_token": tokenPair.RefreshToken,
+	})
+}
+
+// handleLogout revokes the session the request was made with
+func (server *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	server.logger.Enter("handleLogout")
+	defer server.logger.Exit("handleLogout")
+
+	userID := r.Context().Value("user_id").(string)
+	sessionID := r.Context().Value("session_id").(string)
+
+	if _, err := server.sessions.Revoke(userID, sessionID); err != nil {
+		server.logger.Failure("Failed to revoke session: %v", err)
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	server.logger.Success("User %s logged out", userID)
+}
+
+// userTarget resolves the {id} of a user route, where "me" is the caller.
+// Users manage their own account and sessions; root admins manage anyone's.
+func (server *Server) userTarget(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID := r.Context().Value("user_id").(string)
+	targetID := mux.Vars(r)["id"]
+	if targetID == "me" {
+		targetID = userID
+	}
+
+	if targetID != userID && !server.forest.CheckPermission(userID, core.AdminPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return "", false
+	}
+	return targetID, true
+}
+
+// handleGetSessions lists a user's active sessions
+func (server *Server) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	server.logger.Enter("handleGetSessions")
+	defer server.logger.Exit("handleGetSessions")
+
+	targetID, ok := server.userTarget(w, r)
+	if !ok {
+		return
+	}
+	currentID, _ := r.Context().Value("session_id").(string)
+
+	sessions := make([]map[string]interface{}, 0)
+	for _, session := range server.sessions.List(targetID) {
+		sessions = append(sessions, map[string]interface{}{
+			"id":           session.ID,
+			"device":       session.Device,
+			"issued_at":    session.IssuedAt,
+			"last_used_at": session.LastUsedAt,
+			"expires_at":   session.ExpiresAt,
+			"current":      session.ID == currentID,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// handleRevokeSessions revokes one session of a user, or all of them when no session_id is given
+func (server *Server) handleRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	server.logger.Enter("handleRevokeSessions")
+	defer server.logger.Exit("handleRevokeSessions")
+
+	targetID, ok := server.userTarget(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		SessionID string `json:"session_id"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
 
-	// Get pointer to user to avoid copying
-	var foundUser *core.User
-	for i := range server.forest.Users {
-		if server.forest.Users[i].Username == credentials.Username {
-			foundUser = &server.forest.Users[i]
-			break
+	revoked := 0
+	if request.SessionID != "" {
+		found, err := server.sessions.Revoke(targetID, request.SessionID)
+		if err != nil {
+			server.logger.Failure("Failed to revoke session: %v", err)
+			http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		revoked = 1
+	} else {
+		var err error
+		if revoked, err = server.sessions.RevokeUser(targetID); err != nil {
+			server.logger.Failure("Failed to revoke sessions: %v", err)
+			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
 		}
 	}
 
-	if foundUser == nil {
-		server.logger.Failure("User not found: %s", credentials.Username)
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"revoked": revoked})
+	server.logger.Success("Revoked %d sessions of user %s", revoked, targetID)
+}
+
+func (server *Server) handleGetUserProfile(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	user, err := server.forest.Directory.Get(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	if !foundUser.VerifyPassword(credentials.Password) {
-		server.logger.Failure("Invalid password for user: %s", credentials.Username)
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user.Profile())
+}
+
+// handleUpdateUser changes the profile fields present in the request
+func (server *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	server.logger.Enter("handleUpdateUser")
+	defer server.logger.Exit("handleUpdateUser")
+
+	targetID, ok := server.userTarget(w, r)
+	if !ok {
 		return
 	}
 
-	// Generate token pair
-	tokenPair, err := server.generateTokenPair(foundUser)
-	if err != nil {
-		server.logger.Failure("Failed to generate tokens: %v", err)
-		http.Error(w, "Failed to generate tokens", http.StatusInternalServerError)
+	var request struct {
+		Name         *string `json:"name"`
+		Username     *string `json:"username"`
+		Email        *string `json:"email"`
+		Organization *string `json:"organization"`
+		Phone        *string `json:"phone"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"session_token": tokenPair.SessionToken,
-		"refresh_token": tokenPair.RefreshToken,
+	user, err := server.forest.Directory.Update(targetID, func(user *core.User) error {
+		if request.Name != nil {
+			user.Name = *request.Name
+		}
+		if request.Username != nil {
+			user.Username = *request.Username
+		}
+		if request.Email != nil {
+			user.Email = *request.Email
+		}
+		if request.Organization != nil {
+			user.Organization = *request.Organization
+		}
+		if request.Phone != nil {
+			user.Phone = *request.Phone
+		}
+		return nil
 	})
-	server.logger.Success("Login successful for user %s", foundUser.Username)
+	if !server.commitUserChange(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user.Profile())
+	server.logger.Success("Updated user %s", targetID)
 }
 
-// Add new handler for token refresh
-func (server *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+// handleChangePassword sets a new password. Users changing their own password
+// confirm the current one; every other session of the user is revoked.
+func (server *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	server.logger.Enter("handleChangePassword")
+	defer server.logger.Exit("handleChangePassword")
+
+	userID := r.Context().Value("user_id").(string)
+	sessionID, _ := r.Context().Value("session_id").(string)
+	targetID, ok := server.userTarget(w, r)
+	if !ok {
+		return
+	}
+
 	var request struct {
-		RefreshToken string `json:"refresh_token"`
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.NewPassword == "" {
+		http.Error(w, "New password is required", http.StatusBadRequest)
 		return
 	}
 
-	token, err := jwt.ParseWithClaims(request.RefreshToken, &TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return server.jwtConfig.SecretKey, nil
-	})
-
-	if err != nil || !token.Valid {
-		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+	// The passwords are checked and hashed before the directory is locked,
+	// which then only swaps the hash
+	current, err := server.forest.Directory.Get(targetID)
+	if err == nil && targetID == userID && !current.VerifyPassword(request.CurrentPassword) {
+		err = errInvalidCredentials
+	}
+	var hashedPassword string
+	if err == nil {
+		hashedPassword, err = core.HashPassword(request.NewPassword)
+	}
+	if err == nil {
+		_, err = server.forest.Directory.Update(targetID, func(user *core.User) error {
+			// Changed by another request since it was checked
+			if user.Password != current.Password {
+				return errInvalidCredentials
+			}
+			user.Password = hashedPassword
+			return nil
+		})
+	}
+	if !server.commitUserChange(w, err) {
 		return
 	}
 
-	claims, ok := token.Claims.(*TokenClaims)
-	if !ok || claims.TokenType != "refresh" {
-		http.Error(w, "Invalid token type", http.StatusUnauthorized)
+	for _, session := range server.sessions.List(targetID) {
+		if session.ID != sessionID {
+			server.sessions.Revoke(targetID, session.ID)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	server.logger.Success("Changed password of user %s", targetID)
+}
+
+// handleDisableUser blocks a user from logging in and revokes their sessions
+func (server *Server) handleDisableUser(w http.ResponseWriter, r *http.Request) {
+	server.setUserDisabled(w, r, true)
+}
+
+// handleEnableUser lets a disabled user log in again
+func (server *Server) handleEnableUser(w http.ResponseWriter, r *http.Request) {
+	server.setUserDisabled(w, r, false)
+}
+
+func (server *Server) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	server.logger.Enter("setUserDisabled")
+	defer server.logger.Exit("setUserDisabled")
+
+	userID := r.Context().Value("user_id").(string)
+	targetID := mux.Vars(r)["id"]
+
+	if !server.forest.CheckPermission(userID, core.AdminPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	if targetID == userID {
+		http.Error(w, "Cannot disable your own account", http.StatusBadRequest)
 		return
 	}
 
-	// Generate new session token
-	user := &core.User{ID: claims.UserID, Username: claims.Username}
-	tokenPair, err := server.generateTokenPair(user)
-	if err != nil {
-		http.Error(w, "Failed to generate tokens", http.StatusInternalServerError)
+	user, err := server.forest.Directory.Update(targetID, func(user *core.User) error {
+		user.Disabled = disabled
+		return nil
+	})
+	if !server.commitUserChange(w, err) {
 		return
 	}
 
+	if disabled {
+		if _, err := server.sessions.RevokeUser(targetID); err != nil {
+			server.logger.Failure("Failed to revoke sessions: %v", err)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"session_token": tokenPair.SessionToken,
-	})
+	json.NewEncoder(w).Encode(user.Profile())
+	server.logger.Success("Set disabled=%v for user %s", disabled, targetID)
 }
 
-func (server *Server) handleGetUserProfile(w http.ResponseWriter, r *http.Request) {
+// handleDeleteUser removes a user from the directory along with every grant
+// they hold and all of their sessions
+func (server *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	server.logger.Enter("handleDeleteUser")
+	defer server.logger.Exit("handleDeleteUser")
+
 	userID := r.Context().Value("user_id").(string)
+	targetID := mux.Vars(r)["id"]
 
-	user, err := server.forest.GetUserProfile(userID)
-	if err != nil {
+	if !server.forest.CheckPermission(userID, core.AdminPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	if targetID == userID {
+		http.Error(w, "Cannot delete your own account", http.StatusBadRequest)
+		return
+	}
+
+	if err := server.forest.Directory.Delete(targetID); err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"username":     user.Username,
-		"email":        user.Email,
-		"organization": user.Organization,
-		"phone":        user.Phone,
-		"permissions":  user.Permissions,
-	})
+	changed := server.forest.RemoveUser(targetID)
+	if err := server.persist(append(changed, server.forest)...); err != nil {
+		server.logger.Failure("Failed to save state: %v", err)
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+	if _, err := server.sessions.RevokeUser(targetID); err != nil {
+		server.logger.Failure("Failed to revoke sessions: %v", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	server.logger.Success("Deleted user %s and %d grants", targetID, len(changed))
 }
 
 // HTTP handler for getting a specific tree
 func (server *Server) handleGetTree(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
 	path := r.URL.Query().Get("path")
 
 	node, err := server.queuedGetNode(path)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writePathError(w, err)
+		return
+	}
+
+	tree := node.FilterFor(userID)
+	if !node.CheckPermission(userID, core.ReadPermission) && len(tree.Children) == 0 {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tree)
+}
+
+// handleResolveNode resolves a path and returns the node's canonical paths,
+// one for each route through its parents
+func (server *Server) handleResolveNode(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	node, err := server.getNodeFromPath(r.URL.Query().Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.ReadPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(node)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":    node.ID,
+		"name":  node.Name,
+		"type":  node.Type,
+		"paths": server.forest.Paths(node.ID),
+	})
 }
 
 // HTTP handler for getting server settings
@@ -574,7 +2296,7 @@ func (server *Server) handleUpdateServerSettings(w http.ResponseWriter, r *http.
 	}
 
 	// Save state after settings update
-	if err := server.writeChangesToFile(server.forest, server.config.Process.DatabasePath); err != nil {
+	if err := server.persist(server.forest); err != nil {
 		http.Error(w, "Failed to save state", http.StatusInternalServerError)
 		return
 	}
@@ -593,16 +2315,19 @@ type TokenClaims struct {
 	UserID    string `json:"user_id"`
 	Username  string `json:"username"`
 	TokenType string `json:"token_type"` // "session" or "refresh"
+	SessionID string `json:"sid,omitempty"`
 	jwt.StandardClaims
 }
 
 // handleUploadAttachment handles file uploads and creates attachments
 func (server *Server) handleUploadAttachment(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(string)
+	limits := server.attachmentLimits()
 
-	// Parse multipart form with 10MB max memory
+	// Parse multipart form with 10MB max memory, the rest spilling to disk
+	r.Body = http.MaxBytesReader(w, r.Body, limits.Max()+maxMultipartOverhead)
 	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "File too large", http.StatusBadRequest)
+		writeMultipartError(w, err)
 		return
 	}
 
@@ -614,9 +2339,9 @@ func (server *Server) handleUploadAttachment(w http.ResponseWriter, r *http.Requ
 	defer file.Close()
 
 	path := r.FormValue("path")
-	node, err := server.forest.GetNode(path)
+	node, err := server.getNodeFromPath(path)
 	if err != nil {
-		http.Error(w, "Node not found", http.StatusNotFound)
+		writePathError(w, err)
 		return
 	}
 
@@ -625,148 +2350,322 @@ func (server *Server) handleUploadAttachment(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	attachment := &core.Attachment{
-		ID:         fmt.Sprintf("att-%d", time.Now().UnixNano()),
-		Name:       header.Filename,
-		Type:       header.Header.Get("Content-Type"),
-		Size:       header.Size,
-		UploadedBy: userID,
-		UploadedAt: time.Now(),
+	attachment, err := core.NewAttachmentStore(server.blobs, limits).Store(file, header, userID)
+	if err != nil {
+		writeAttachmentError(w, err)
+		return
 	}
+	attachment.ID = fmt.Sprintf("att-%d", time.Now().UnixNano())
 
 	if err := node.AddAttachment(attachment, userID); err != nil {
+		server.blobs.Release(attachment.Hash)
 		http.Error(w, "Failed to add attachment to node", http.StatusInternalServerError)
 		return
 	}
 
-	// Save state after attachment upload
-	if err := server.writeChangesToFile(server.forest, server.config.Process.DatabasePath); err != nil {
+	// Save state after attachment upload
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	server.publish(ChangeAttachmentAdded, node, userID, map[string]interface{}{
+		"attachment_id": attachment.ID,
+		"name":          attachment.Name,
+	})
+	server.queuePreviews(*attachment)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// handleGetAttachment retrieves an attachment
+func (server *Server) handleGetAttachment(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	vars := mux.Vars(r)
+	attachmentID := vars["id"]
+	path := r.URL.Query().Get("path")
+
+	node, err := server.getNodeFromPath(path)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.ReadPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	attachment, err := node.GetAttachment(attachmentID)
+	if err != nil {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	server.serveAttachment(w, r, attachment)
+}
+
+// handleAddEntryAttachment adds an attachment to a specific event entry
+func (server *Server) handleAddEntryAttachment(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	vars := mux.Vars(r)
+	eventID := vars["eventId"]
+	entryIndex := vars["entryIndex"]
+
+	path := r.URL.Query().Get("path")
+	node, err := server.getNodeFromPath(path)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	// Parse multipart form
+	limits := server.attachmentLimits()
+	r.Body = http.MaxBytesReader(w, r.Body, limits.Max()+maxMultipartOverhead)
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Invalid file upload", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	index, err := strconv.Atoi(entryIndex)
+	if err != nil {
+		http.Error(w, "Invalid entry index", http.StatusBadRequest)
+		return
+	}
+
+	attachment, err := core.NewAttachmentStore(server.blobs, limits).Store(file, header, userID)
+	if err != nil {
+		writeAttachmentError(w, err)
+		return
+	}
+
+	if err := node.AddEntryAttachment(eventID, index, attachment, userID); err != nil {
+		server.blobs.Release(attachment.Hash)
+		http.Error(w, "Failed to add attachment to entry", http.StatusInternalServerError)
+		return
+	}
+
+	// Save state
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	server.publish(ChangeAttachmentAdded, node, userID, map[string]interface{}{
+		"attachment_id": attachment.ID,
+		"name":          attachment.Name,
+		"event_id":      eventID,
+		"entry_index":   index,
+	})
+	server.queuePreviews(*attachment)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// handleDeleteAttachment deletes an attachment
+func (server *Server) handleDeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	vars := mux.Vars(r)
+	attachmentID := vars["id"]
+	path := r.URL.Query().Get("path")
+
+	node, err := server.getNodeFromPath(path)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	attachment, err := node.GetAttachment(attachmentID)
+	if err != nil {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err := node.DeleteAttachment(attachmentID, userID); err != nil {
+		writeDeleteAttachmentError(w, err)
+		return
+	}
+
+	// Save state after deletion
+	if err := server.persist(node); err != nil {
 		http.Error(w, "Failed to save state", http.StatusInternalServerError)
 		return
 	}
+	server.blobs.Release(attachment.BlobHash())
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(attachment)
+	server.publish(ChangeAttachmentRemoved, node, userID, map[string]interface{}{
+		"attachment_id": attachment.ID,
+		"name":          attachment.Name,
+	})
+
+	w.WriteHeader(http.StatusOK)
 }
 
-// handleGetAttachment retrieves an attachment
-func (server *Server) handleGetAttachment(w http.ResponseWriter, r *http.Request) {
+// handleListAttachments lists the attachments of a node and its entries and,
+// with recursive, those of the readable nodes below it
+func (server *Server) handleListAttachments(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(string)
-	vars := mux.Vars(r)
-	attachmentID := vars["id"]
-	path := r.URL.Query().Get("path")
 
-	node, err := server.forest.GetNode(path)
+	query, err := server.parseQuery(r)
 	if err != nil {
-		http.Error(w, "Node not found", http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if !node.CheckPermission(userID, core.ReadPermission) {
-		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+	node, err := server.getNodeFromPath(r.URL.Query().Get("path"))
+	if err != nil {
+		writePathError(w, err)
 		return
 	}
 
-	attachment, err := node.GetAttachment(attachmentID)
-	if err != nil {
-		http.Error(w, "Attachment not found", http.StatusNotFound)
+	// Descendants are listed under their canonical path
+	path := r.URL.Query().Get("path")
+	if paths := server.forest.Paths(node.ID); len(paths) > 0 {
+		path = paths[0]
+	}
+
+	readable := node.CheckPermission(userID, core.ReadPermission)
+	if r.URL.Query().Get("recursive") != "true" {
+		if !readable {
+			http.Error(w, "Insufficient permissions", http.StatusForbidden)
+			return
+		}
+		writeQueryPage(w, query, node.AttachmentItems(path, userID, false))
 		return
 	}
 
-	w.Header().Set("Content-Type", attachment.Type)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", attachment.Name))
-	w.Write(attachment.Data)
+	items := node.AttachmentItems(path, userID, true)
+	if !readable && len(items) == 0 {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	writeQueryPage(w, query, items)
 }
 
-// handleAddEntryAttachment adds an attachment to a specific event entry
-func (server *Server) handleAddEntryAttachment(w http.ResponseWriter, r *http.Request) {
+// entryAttachmentRequest reads the node, event, entry index and attachment
+// ID of a request for an entry's attachment, answering the request when they
+// cannot be used
+func (server *Server) entryAttachmentRequest(w http.ResponseWriter, r *http.Request, permission core.Permission) (*core.Node, string, int, *core.Attachment, bool) {
 	userID := r.Context().Value("user_id").(string)
 	vars := mux.Vars(r)
-	eventID := vars["eventId"]
-	entryIndex := vars["entryIndex"]
 
-	path := r.URL.Query().Get("path")
-	node, err := server.forest.GetNode(path)
+	node, err := server.getNodeFromPath(r.URL.Query().Get("path"))
 	if err != nil {
-		http.Error(w, "Node not found", http.StatusNotFound)
-		return
+		writePathError(w, err)
+		return nil, "", 0, nil, false
 	}
 
-	if !node.CheckPermission(userID, core.WritePermission) {
+	if !node.CheckPermission(userID, permission) {
 		http.Error(w, "Insufficient permissions", http.StatusForbidden)
-		return
+		return nil, "", 0, nil, false
 	}
 
-	// Parse multipart form
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "File too large", http.StatusBadRequest)
-		return
+	index, err := strconv.Atoi(vars["entryIndex"])
+	if err != nil {
+		http.Error(w, "Invalid entry index", http.StatusBadRequest)
+		return nil, "", 0, nil, false
 	}
 
-	file, header, err := r.FormFile("file")
+	attachment, err := node.GetEntryAttachment(vars["eventId"], index, vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid file upload", http.StatusBadRequest)
-		return
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, "", 0, nil, false
 	}
-	defer file.Close()
+	return node, vars["eventId"], index, attachment, true
+}
 
-	index, err := strconv.Atoi(entryIndex)
-	if err != nil {
-		http.Error(w, "Invalid entry index", http.StatusBadRequest)
-		return
+// handleGetEntryAttachment retrieves an attachment of an event entry
+func (server *Server) handleGetEntryAttachment(w http.ResponseWriter, r *http.Request) {
+	if _, _, _, attachment, ok := server.entryAttachmentRequest(w, r, core.ReadPermission); ok {
+		server.serveAttachment(w, r, attachment)
 	}
+}
 
-	attachment, err := core.NewAttachmentStore().Store(file, header, userID)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to store attachment: %v", err), http.StatusInternalServerError)
+// handleDeleteEntryAttachment deletes an attachment of an event entry
+func (server *Server) handleDeleteEntryAttachment(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	node, eventID, index, attachment, ok := server.entryAttachmentRequest(w, r, core.WritePermission)
+	if !ok {
 		return
 	}
 
-	if err := node.AddEntryAttachment(eventID, index, attachment, userID); err != nil {
-		http.Error(w, "Failed to add attachment to entry", http.StatusInternalServerError)
+	if err := node.DeleteEntryAttachment(eventID, index, attachment.ID, userID); err != nil {
+		writeDeleteAttachmentError(w, err)
 		return
 	}
 
-	// Save state
-	if err := server.writeChangesToFile(server.forest, server.config.Process.DatabasePath); err != nil {
+	if err := server.persist(node); err != nil {
 		http.Error(w, "Failed to save state", http.StatusInternalServerError)
 		return
 	}
+	server.blobs.Release(attachment.BlobHash())
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(attachment)
+	server.publish(ChangeAttachmentRemoved, node, userID, map[string]interface{}{
+		"attachment_id": attachment.ID,
+		"name":          attachment.Name,
+		"event_id":      eventID,
+		"entry_index":   index,
+	})
+
+	w.WriteHeader(http.StatusOK)
 }
 
-// handleDeleteAttachment deletes an attachment
-func (server *Server) handleDeleteAttachment(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("user_id").(string)
-	vars := mux.Vars(r)
-	attachmentID := vars["id"]
-	path := r.URL.Query().Get("path")
+// attachmentUsage is the space attachments take under a node, along with the
+// whole blob store's footprint for admins of the root
+type attachmentUsage struct {
+	core.AttachmentUsage
+	Store *blobStoreUsage `json:"store,omitempty"`
+}
+
+type blobStoreUsage struct {
+	Blobs    int   `json:"blobs"`
+	DiskSize int64 `json:"disk_size"` // Bytes on disk, encryption included
+}
 
-	node, err := server.forest.GetNode(path)
+// handleGetAttachmentUsage reports the original and stored sizes of the
+// attachments under a node
+func (server *Server) handleGetAttachmentUsage(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	node, err := server.getNodeFromPath(r.URL.Query().Get("path"))
 	if err != nil {
-		http.Error(w, "Node not found", http.StatusNotFound)
+		writePathError(w, err)
 		return
 	}
-
-	if !node.CheckPermission(userID, core.WritePermission) {
+	if !node.CheckPermission(userID, core.ReadPermission) {
 		http.Error(w, "Insufficient permissions", http.StatusForbidden)
 		return
 	}
 
-	if err := node.DeleteAttachment(attachmentID, userID); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to delete attachment: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	// Save state after deletion
-	if err := server.writeChangesToFile(server.forest, server.config.Process.DatabasePath); err != nil {
-		http.Error(w, "Failed to save state", http.StatusInternalServerError)
-		return
+	usage := attachmentUsage{AttachmentUsage: node.AttachmentUsage(server.forest.Paths(node.ID)[0], userID)}
+	if node == server.forest && node.CheckPermission(userID, core.AdminPermission) {
+		blobs, size, err := server.blobs.Usage()
+		if err != nil {
+			server.logger.Failure("Failed to measure blob store: %v", err)
+			http.Error(w, "Failed to measure blob store", http.StatusInternalServerError)
+			return
+		}
+		usage.Store = &blobStoreUsage{Blobs: blobs, DiskSize: size}
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
 }
 
 // Lazy loading approach
@@ -848,3 +2747,303 @@ func (server *Server) handleGetLogs(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+// HTTP handler for creating a branch or leaf node
+func (server *Server) handleCreateNode(w http.ResponseWriter, r *http.Request) {
+	server.logger.Enter("CreateNode")
+	defer server.logger.Exit("CreateNode")
+
+	userID := r.Context().Value("user_id").(string)
+
+	var request struct {
+		ParentID string `json:"parent_id"`
+		Path     string `json:"path"`
+		Name     string `json:"name"`
+		Type     string `json:"type"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	nodeType, err := core.ParseNodeType(request.Type)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var parent *core.Node
+	if request.ParentID != "" {
+		parent, err = server.getNodeFromPath(core.IDPath(request.ParentID))
+	} else {
+		parent, err = server.getNodeFromPath(request.Path)
+	}
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !parent.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	server.structure.Lock()
+	defer server.structure.Unlock()
+
+	node, err := parent.CreateChild(nodeType, request.Name, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	parent.AddActivity("create_node", map[string]interface{}{
+		"node_id": node.ID,
+		"name":    node.Name,
+		"type":    request.Type,
+	}, userID)
+
+	if err := server.persist(node, parent); err != nil {
+		server.logger.Failure("Failed to save state: %v", err)
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	server.publish(ChangeNodeCreated, node, userID, map[string]interface{}{
+		"parent_id": parent.ID,
+		"name":      node.Name,
+		"type":      request.Type,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(node.FilterFor(userID))
+}
+
+// HTTP handler for renaming a node
+func (server *Server) handleUpdateNode(w http.ResponseWriter, r *http.Request) {
+	server.logger.Enter("UpdateNode")
+	defer server.logger.Exit("UpdateNode")
+
+	userID := r.Context().Value("user_id").(string)
+	nodeID := mux.Vars(r)["id"]
+
+	var request struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	node, err := server.getNodeFromPath(core.IDPath(nodeID))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	server.structure.Lock()
+	defer server.structure.Unlock()
+
+	// Sibling names must stay unique under every parent
+	for parentID := range node.Parents {
+		parent, err := server.getNodeFromPath(core.IDPath(parentID))
+		if err == nil && request.Name != node.Name && parent.HasChildNamed(request.Name) {
+			http.Error(w, fmt.Sprintf("node %s already has a child named %s", parent.Name, request.Name), http.StatusConflict)
+			return
+		}
+	}
+
+	previousName := node.Name
+	if err := node.Rename(request.Name, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	node.AddActivity("rename_node", map[string]interface{}{
+		"previous_name": previousName,
+		"name":          node.Name,
+	}, userID)
+
+	if err := server.persist(append(node.ChildNodes(), node)...); err != nil {
+		server.logger.Failure("Failed to save state: %v", err)
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(node.FilterFor(userID))
+}
+
+// HTTP handler for moving a node to a new parent, or linking it to an additional one
+func (server *Server) handleMoveNode(w http.ResponseWriter, r *http.Request) {
+	server.logger.Enter("MoveNode")
+	defer server.logger.Exit("MoveNode")
+
+	userID := r.Context().Value("user_id").(string)
+	nodeID := mux.Vars(r)["id"]
+
+	var request struct {
+		FromParentID string `json:"from_parent_id"`
+		ToParentID   string `json:"to_parent_id"`
+		ToPath       string `json:"to_path"`
+		Link         bool   `json:"link"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	node, err := server.getNodeFromPath(core.IDPath(nodeID))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	var target *core.Node
+	if request.ToParentID != "" {
+		target, err = server.getNodeFromPath(core.IDPath(request.ToParentID))
+	} else {
+		target, err = server.getNodeFromPath(request.ToPath)
+	}
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.AdminPermission) || !target.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	server.structure.Lock()
+	defer server.structure.Unlock()
+
+	// Moving removes the node from a parent, given or its only one, which
+	// the user must be able to write to as well
+	fromParentID := request.FromParentID
+	if fromParentID == "" && len(node.Parents) == 1 {
+		for parentID := range node.Parents {
+			fromParentID = parentID
+		}
+	}
+	if fromParentID != "" && !request.Link {
+		fromParent, err := server.getNodeFromPath(core.IDPath(fromParentID))
+		if err != nil {
+			writePathError(w, err)
+			return
+		}
+		if !fromParent.CheckPermission(userID, core.WritePermission) {
+			http.Error(w, "Insufficient permissions", http.StatusForbidden)
+			return
+		}
+	}
+
+	var previousParents []*core.Node
+	for parentID := range node.Parents {
+		if parent, err := server.getNodeFromPath(core.IDPath(parentID)); err == nil {
+			previousParents = append(previousParents, parent)
+		}
+	}
+
+	if err := server.forest.MoveNode(nodeID, request.FromParentID, target, request.Link); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	node.AddActivity("move_node", map[string]interface{}{
+		"from_parent_id": request.FromParentID,
+		"to_parent_id":   target.ID,
+		"link":           request.Link,
+	}, userID)
+
+	if err := server.persist(append(previousParents, node, target)...); err != nil {
+		server.logger.Failure("Failed to save state: %v", err)
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(node.FilterFor(userID))
+}
+
+// HTTP handler for deleting a node. Nodes with children require mode=cascade
+// (delete the subtree) or mode=orphan (hand the children to the node's parents).
+func (server *Server) handleDeleteNode(w http.ResponseWriter, r *http.Request) {
+	server.logger.Enter("DeleteNode")
+	defer server.logger.Exit("DeleteNode")
+
+	userID := r.Context().Value("user_id").(string)
+	nodeID := mux.Vars(r)["id"]
+	mode := r.URL.Query().Get("mode")
+
+	node, err := server.getNodeFromPath(core.IDPath(nodeID))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	if !node.CheckPermission(userID, core.AdminPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	server.structure.Lock()
+	defer server.structure.Unlock()
+
+	switch mode {
+	case "cascade", "orphan":
+	case "":
+		if len(node.ChildNodes()) > 0 {
+			http.Error(w, "Node has children, mode must be cascade or orphan", http.StatusConflict)
+			return
+		}
+	default:
+		http.Error(w, "Invalid delete mode: "+mode, http.StatusBadRequest)
+		return
+	}
+
+	parentIDs := make(map[string]bool, len(node.Parents))
+	for parentID := range node.Parents {
+		parentIDs[parentID] = true
+	}
+
+	// Taken before the links go, the removed nodes' attachments are released once saved
+	index := server.forest.Index()
+	removed, updated, err := server.forest.DeleteNode(nodeID, mode == "cascade")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	for _, affected := range updated {
+		if parentIDs[affected.ID] {
+			affected.AddActivity("delete_node", map[string]interface{}{
+				"node_id": nodeID,
+				"name":    node.Name,
+				"mode":    mode,
+			}, userID)
+		}
+	}
+
+	if err := server.persistDelete(removed, updated...); err != nil {
+		server.logger.Failure("Failed to save state: %v", err)
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+	for _, removedID := range removed {
+		if removedNode, exists := index[removedID]; exists {
+			server.blobs.Release(removedNode.AttachmentHashes()...)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,6 +3,8 @@ package internal
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -17,6 +19,9 @@ import (
 	"github.com/vaziolabs/lumberjack/types"
 )
 
+// errInvalidCredentials is returned when a user's current password does not match
+var errInvalidCredentials = errors.New("invalid credentials")
+
 // compares two byte slices for equality
 func compareHashes(a, b []byte) bool {
 	if len(a) != len(b) {
@@ -39,12 +44,7 @@ func (server *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return server.jwtConfig.SecretKey, nil
-		})
+		token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, server.jwtConfig.Keys.Keyfunc(sessionTokenType, server.jwtConfig.RotationWindow))
 
 		if err != nil || !token.Valid {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
@@ -52,59 +52,261 @@ func (server *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		claims, ok := token.Claims.(*TokenClaims)
-		if !ok || claims.TokenType != "session" {
+		if !ok || claims.TokenType != sessionTokenType {
 			http.Error(w, "Invalid session token", http.StatusUnauthorized)
 			return
 		}
 
+		// Session tokens die with the login they belong to
+		if !server.sessions.IsActive(claims.SessionID) {
+			http.Error(w, "Session revoked", http.StatusUnauthorized)
+			return
+		}
+
 		// Add user info to context
 		ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
+		ctx = context.WithValue(ctx, "session_id", claims.SessionID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
 
-// getNodeFromPath traverses the forest to find a node by its path
+// calendarAuth lets calendar apps, which cannot send headers, authenticate
+// with the user's feed token in the token parameter. Requests without one go
+// through authMiddleware.
+func (server *Server) calendarAuth(next http.HandlerFunc) http.HandlerFunc {
+	authenticated := server.authMiddleware(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			authenticated(w, r)
+			return
+		}
+
+		user, err := server.forest.Directory.FindByFeedToken(token)
+		if err != nil || user.Disabled {
+			http.Error(w, "Invalid feed token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user_id", user.ID)))
+	}
+}
+
+// getNodeFromPath resolves a node path (see core.Node.Resolve) against the forest
 func (server *Server) getNodeFromPath(path string) (*core.Node, error) {
 	// Try cache first
 	if node, err := server.getFromCache(path); err == nil {
 		return node, nil
 	}
 
-	// Cache miss, get from forest
-	if path == "" {
-		return server.forest, nil
+	node, err := server.forest.Resolve(path)
+	if err != nil {
+		return nil, err
 	}
 
-	parts := strings.Split(path, "/")
-	current := server.forest
+	// Update cache after fetch
+	server.updateCache()
+	return node, nil
+}
 
-	for _, part := range parts {
-		found := false
-		for _, child := range current.Children {
-			if child.Name == part {
-				current = child
-				found = true
-				break
-			}
+// writePathError answers a request whose node path could not be resolved
+func writePathError(w http.ResponseWriter, err error) {
+	var ambiguous *core.AmbiguousPathError
+	switch {
+	case errors.As(err, &ambiguous):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, core.ErrInvalidPath):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
+
+// writeAttachmentError answers a file that could not be stored
+func writeAttachmentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, core.ErrAttachmentTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, core.ErrAttachmentType):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		http.Error(w, fmt.Sprintf("Failed to store attachment: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// writeMultipartError answers an upload whose form could not be read
+func writeMultipartError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Invalid file upload", http.StatusBadRequest)
+}
+
+// writeDeleteAttachmentError answers a failed attachment removal, the
+// attachment or its event being gone by then in the common case
+func writeDeleteAttachmentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, core.ErrAttachmentNotFound), errors.Is(err, core.ErrEventNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, fmt.Sprintf("Failed to delete attachment: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// writeOccurrenceError answers a failed recurring event operation
+func writeOccurrenceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, core.ErrEventNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// writeTimeSessionError answers a failed time tracking operation
+func writeTimeSessionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, core.ErrTimeSessionNotFound), errors.Is(err, core.ErrNoTimer):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, core.ErrTimerRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, core.ErrInvalidTimeSession):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+}
+
+// writeWebhookError answers a failed webhook operation
+func writeWebhookError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, core.ErrWebhookNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, core.ErrInvalidWebhook):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+}
+
+// writeNotifierError answers a failed notifier operation
+func writeNotifierError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, core.ErrNotifierNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, core.ErrInvalidNotifier):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+}
+
+// resolveUserID returns the ID of the user with the given username, or the
+// value itself when no user has that name, so requests may name users either way
+func (server *Server) resolveUserID(user string) string {
+	if found, err := server.forest.Directory.FindByUsername(user); err == nil {
+		return found.ID
+	}
+	return user
+}
+
+// parseQuery reads the listing query of a request
+func (server *Server) parseQuery(r *http.Request) (core.Query, error) {
+	query, err := core.ParseQuery(r.URL.Query())
+	if err != nil {
+		return core.Query{}, err
+	}
+	if query.User != "" {
+		query.User = server.resolveUserID(query.User)
+	}
+	return query, nil
+}
+
+// writeQueryPage answers a listing with the page of items the query selects
+func writeQueryPage(w http.ResponseWriter, query core.Query, items []core.QueryItem) {
+	page, err := query.Run(items)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// runningTimerNode returns the node the user's timer is running on, or nil
+func (server *Server) runningTimerNode(userID string) *core.Node {
+	for _, node := range server.forest.Index() {
+		if _, running := node.RunningTimer(userID); running {
+			return node
 		}
-		if !found {
-			return nil, fmt.Errorf("node not found: %s", path)
+	}
+	return nil
+}
+
+// stopRunningTimers stops every timer the user has running, returning the
+// stopped sessions and the nodes they are on
+func (server *Server) stopRunningTimers(userID string, at time.Time) ([]core.TimeSession, []*core.Node) {
+	stopped := []core.TimeSession{}
+	var nodes []*core.Node
+	for _, node := range server.forest.Index() {
+		if session, ok := node.StopTimer(userID, at); ok {
+			stopped = append(stopped, *session)
+			nodes = append(nodes, node)
 		}
 	}
+	return stopped, nodes
+}
 
-	// Update cache after fetch
-	server.updateCache()
-	return current, nil
+// findTimeSession returns the session with the given ID and the node it is on
+func (server *Server) findTimeSession(sessionID string) (*core.Node, core.TimeSession, error) {
+	for _, node := range server.forest.Index() {
+		if session, err := node.GetTimeSession(sessionID); err == nil {
+			return node, session, nil
+		}
+	}
+	return nil, core.TimeSession{}, fmt.Errorf("%w: %s", core.ErrTimeSessionNotFound, sessionID)
+}
+
+// commitUserChange finishes a change to the user directory, answering the
+// request when it failed and recording the root node otherwise. It reports
+// whether the handler should go on to write its response.
+func (server *Server) commitUserChange(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+	case errors.Is(err, core.ErrUserNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return false
+	case errors.Is(err, core.ErrUsernameTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return false
+	case errors.Is(err, errInvalidCredentials):
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return false
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	if err := server.persist(server.forest); err != nil {
+		server.logger.Failure("Failed to save state: %v", err)
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return false
+	}
+	return true
 }
 
 // UpdateSettings updates server configuration parameters
 func (server *Server) UpdateSettings(userID string, settings types.ServerConfig) error {
 	// Update user-specific settings
-	for i := range server.forest.Users {
-		if server.forest.Users[i].ID == userID {
-			server.forest.Users[i].Organization = settings.Organization
-			break
-		}
+	if _, err := server.forest.Directory.Update(userID, func(user *core.User) error {
+		user.Organization = settings.Organization
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := server.persist(server.forest); err != nil {
+		return err
 	}
 
 	// Update server settings if values are provided
@@ -142,20 +344,21 @@ func (server *Server) saveConfig() error {
 	return viper.WriteConfig()
 }
 
-func (server *Server) generateTokenPair(user *core.User) (*TokenPair, error) {
+// generateTokenPair issues a session token and the current refresh token of session
+func (server *Server) generateTokenPair(user *core.User, session RefreshSession) (*TokenPair, error) {
 	// Generate session token (short-lived)
 	sessionClaims := TokenClaims{
 		UserID:    user.ID,
 		Username:  user.Username,
-		TokenType: "session",
+		TokenType: sessionTokenType,
+		SessionID: session.ID,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(1 * time.Hour).Unix(),
+			ExpiresAt: time.Now().Add(server.jwtConfig.ExpiresIn).Unix(),
 			IssuedAt:  time.Now().Unix(),
 		},
 	}
 
-	sessionToken := jwt.NewWithClaims(jwt.SigningMethodHS256, sessionClaims)
-	sessionTokenString, err := sessionToken.SignedString(server.jwtConfig.SecretKey)
+	sessionTokenString, err := server.jwtConfig.Keys.Sign(sessionTokenType, sessionClaims)
 	if err != nil {
 		return nil, err
 	}
@@ -164,15 +367,16 @@ func (server *Server) generateTokenPair(user *core.User) (*TokenPair, error) {
 	refreshClaims := TokenClaims{
 		UserID:    user.ID,
 		Username:  user.Username,
-		TokenType: "refresh",
+		TokenType: refreshTokenType,
+		SessionID: session.ID,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(7 * 24 * time.Hour).Unix(),
+			Id:        session.TokenID,
+			ExpiresAt: session.ExpiresAt.Unix(),
 			IssuedAt:  time.Now().Unix(),
 		},
 	}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshTokenString, err := refreshToken.SignedString(server.jwtConfig.SecretKey)
+	refreshTokenString, err := server.jwtConfig.Keys.Sign(refreshTokenType, refreshClaims)
 	if err != nil {
 		return nil, err
 	}
@@ -347,6 +551,12 @@ func (server *Server) initCache() {
 	}
 }
 
+// initSearch indexes the whole forest, persist keeps the index up to date after that
+func (server *Server) initSearch() {
+	server.search = core.NewSearchIndex()
+	server.search.IndexAll(server.forest)
+}
+
 func (server *Server) initAPIQueue(workers int) {
 	server.apiQueue = &APIQueue{
 		queue:    make(chan APIRequest, 100),
@@ -373,7 +583,7 @@ func (server *Server) getFromCache(path string) (*core.Node, error) {
 		return server.cache.Forest, nil
 	}
 
-	return server.cache.Forest.GetNode(path)
+	return server.cache.Forest.Resolve(path)
 }
 
 func (server *Server) updateCache() error {
@@ -394,7 +604,10 @@ func (server *Server) worker() {
 		case req := <-server.apiQueue.queue:
 			response := APIResponse{}
 			response.Data = req.Callback(server.forest)
-			req.Response <- response
+			// Background work like webhook deliveries expects no answer
+			if req.Response != nil {
+				req.Response <- response
+			}
 		case <-server.apiQueue.shutdown:
 			return
 		}
@@ -411,9 +624,9 @@ func (server *Server) queuedGetNode(path string) (*core.Node, error) {
 		Callback: func(forest *core.Node) interface{} {
 			node, err := server.getNodeFromPath(path)
 			if err != nil {
-				return APIResponse{Error: err}
+				return err
 			}
-			return APIResponse{Data: node}
+			return node
 		},
 		Response: responseChan,
 	}
@@ -421,8 +634,8 @@ func (server *Server) queuedGetNode(path string) (*core.Node, error) {
 	server.apiQueue.queue <- request
 	response := <-responseChan
 
-	if response.Error != nil {
-		return nil, response.Error
+	if err, ok := response.Data.(error); ok {
+		return nil, err
 	}
 
 	return response.Data.(*core.Node), nil
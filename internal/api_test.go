@@ -1,16 +1,40 @@
 package internal
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"log"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
 	"github.com/vaziolabs/lumberjack/internal/core"
 	"github.com/vaziolabs/lumberjack/types"
 )
@@ -65,6 +89,7 @@ func setupTestForest(t *testing.T) *Server {
 	if err != nil {
 		t.Fatalf("Failed to create server: %v", err)
 	}
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
 	logger := types.NewLogger()
 	logger.Enter("Setting up test forest")
 	defer logger.Exit("Setting up test forest")
@@ -76,17 +101,13 @@ func setupTestForest(t *testing.T) *Server {
 	root.Type = core.BranchNode
 	root.Children = make(map[string]*core.Node)
 
-	adminUser := core.User{
-		ID:          "admin",
-		Username:    "admin",
-		Permissions: []core.Permission{core.AdminPermission},
-	}
-	root.Users = []core.User{adminUser}
+	adminGrant := core.Grant{UserID: "admin", Permission: core.AdminPermission}
+	root.Grants = []core.Grant{adminGrant}
 
 	// Create test node with admin permissions
 	testNode := core.NewNode(core.LeafNode, "test-node")
 	testNode.ID = "test-node"
-	testNode.Users = []core.User{adminUser}
+	testNode.Grants = []core.Grant{adminGrant}
 
 	// Add child and set up parent reference
 	root.AddChild(testNode)
@@ -102,6 +123,106 @@ func setupTestForest(t *testing.T) *Server {
 	return server
 }
 
+// testConfig returns the config of a database in a directory of the test's
+// own, removed when it ends
+func testConfig(t *testing.T, name string) types.ServerConfig {
+	return types.ServerConfig{
+		Process: types.ProcessInfo{
+			Name:         name,
+			ServerPort:   "8080",
+			DatabasePath: t.TempDir(),
+		},
+	}
+}
+
+// newTestServer creates a server with an admin/admin user, shutting it down
+// when the test ends
+func newTestServer(t *testing.T, config types.ServerConfig) *Server {
+	t.Helper()
+	server, err := NewServer(config, core.User{Username: "admin", Password: "admin"})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	return server
+}
+
+// loadTestServer loads a database like LoadServer, shutting the server down
+// when the test ends
+func loadTestServer(t *testing.T, config types.ServerConfig) (*Server, error) {
+	server, err := LoadServer(config)
+	if err == nil {
+		t.Cleanup(func() { server.Shutdown(context.Background()) })
+	}
+	return server, err
+}
+
+// withUser attaches an authenticated user to a request the way authMiddleware does
+func withUser(req *http.Request, userID string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), "user_id", userID))
+}
+
+// call calls a handler as the user and returns the response. A string body is
+// sent as it is and any other body but nil as JSON; vars are the route's.
+func call(handler http.HandlerFunc, userID, method, target string, vars map[string]string, body interface{}) *httptest.ResponseRecorder {
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(body)
+	default:
+		encoded, _ := json.Marshal(body)
+		reader = bytes.NewReader(encoded)
+	}
+	req := withUser(httptest.NewRequest(method, target, reader), userID)
+	if vars != nil {
+		req = mux.SetURLVars(req, vars)
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+// fileRequest builds the multipart form the upload and import handlers take,
+// sending a file with the node path. The type defaults to application/octet-stream.
+func fileRequest(target, userID, path, name, contentType string, contents []byte) *http.Request {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	writer.WriteField("path", path)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="file"; filename="`+name+`"`)
+	header.Set("Content-Type", contentType)
+	part, _ := writer.CreatePart(header)
+	part.Write(contents)
+	writer.Close()
+	req := withUser(httptest.NewRequest("POST", target, &buffer), userID)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+// uploadAttachment uploads a file to the node at path, or to an event entry
+// there when the entry's route vars are given, and returns the attachment
+// made. The test fails when the upload is refused.
+func uploadAttachment(t *testing.T, server *Server, userID, path, name, contentType string, contents []byte, vars map[string]string) core.Attachment {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	if vars != nil {
+		target := "/events/" + vars["eventId"] + "/entries/" + vars["entryIndex"] + "/attachments?path=" + url.QueryEscape(path)
+		server.handleAddEntryAttachment(rr, mux.SetURLVars(fileRequest(target, userID, path, name, contentType, contents), vars))
+	} else {
+		server.handleUploadAttachment(rr, fileRequest("/attachments/upload", userID, path, name, contentType, contents))
+	}
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Upload of %s failed: %d %s", name, rr.Code, rr.Body.String())
+	}
+	var attachment core.Attachment
+	json.NewDecoder(rr.Body).Decode(&attachment)
+	return attachment
+}
+
 func TestForestOperations(t *testing.T) {
 	logger.Enter("ForestOperations")
 	defer logger.Exit("ForestOperations")
@@ -147,28 +268,24 @@ func TestForestOperations(t *testing.T) {
 		logger.Enter("User Management")
 		defer logger.Exit("User Management")
 
-		user1 := core.User{ID: "user1", Permissions: []core.Permission{core.ReadPermission, core.WritePermission}}
-		user2 := core.User{ID: "user2", Permissions: []core.Permission{core.ReadPermission}}
-		user3 := core.User{ID: "user3", Permissions: []core.Permission{core.AdminPermission}}
-
 		childNode2 := rootNode.Children["child2"]
 		childNode3 := rootNode.Children["child3"]
 
-		if err := childNode2.AssignUser(user1, core.ReadPermission); err != nil {
+		if err := childNode2.AssignUser("user1", core.ReadPermission); err != nil {
 			logger.Failure("Failed to assign user1 to childNode2: %v", err)
 			t.Error(err)
 		} else {
 			logger.Success("User1 assigned to childNode2")
 		}
 
-		if err := childNode2.AssignUser(user2, core.ReadPermission); err != nil {
+		if err := childNode2.AssignUser("user2", core.ReadPermission); err != nil {
 			logger.Failure("Failed to assign user2 to childNode2: %v", err)
 			t.Error(err)
 		} else {
 			logger.Success("User2 assigned to childNode2")
 		}
 
-		if err := childNode3.AssignUser(user3, core.AdminPermission); err != nil {
+		if err := childNode3.AssignUser("user3", core.AdminPermission); err != nil {
 			logger.Failure("Failed to assign user3 to childNode3: %v", err)
 			t.Error(err)
 		} else {
@@ -283,12 +400,15 @@ func TestForestOperations(t *testing.T) {
 		}
 
 		// Compare planned vs actual events
-		match, err := childNode2.CompareEvents(event2ID, event1ID)
-		if match {
-			logger.Failure("Expected events to not match, but they did")
-			t.Errorf("Expected events to not match, but they did")
+		variance, err := childNode2.CompareEvents(event2ID, event1ID)
+		if err != nil {
+			logger.Failure("Failed to compare events: %v", err)
+			t.Errorf("Failed to compare events: %v", err)
+		} else if !variance.StatusMismatch || variance.StartSlip == nil || len(variance.MetadataDiff) == 0 {
+			logger.Failure("Expected events to not match, but they did: %+v", variance)
+			t.Errorf("Expected events to not match, but they did: %+v", variance)
 		} else {
-			logger.Success("Found expected differences: %s", err)
+			logger.Success("Found expected differences: start slip %ds", *variance.StartSlip)
 		}
 	})
 
@@ -298,7 +418,7 @@ func TestForestOperations(t *testing.T) {
 
 		childNode2 := rootNode.Children["child2"]
 
-		_, err := childNode2.StartTimeTracking("user1")
+		_, err := childNode2.StartTimeTracking("user1", "", false)
 		if err != nil {
 			logger.Failure("Failed to start time tracking: %v", err)
 			t.Error(err)
@@ -314,10 +434,10 @@ func TestForestOperations(t *testing.T) {
 			logger.Success("Time tracking stopped")
 		}
 
-		summary := childNode2.GetTimeTrackingSummary("user1")
-		if len(summary) != 1 {
-			logger.Failure("Expected 1 time tracking entry, got %d: %s", len(summary), summary)
-			t.Errorf("Expected 1 time tracking entry, got %d: %s", len(summary), summary)
+		summary := childNode2.GetTimeTrackingSummary("user1", time.Time{}, time.Time{})
+		if len(summary.Sessions) != 1 {
+			logger.Failure("Expected 1 time tracking session, got %d: %v", len(summary.Sessions), summary.Sessions)
+			t.Errorf("Expected 1 time tracking session, got %d: %v", len(summary.Sessions), summary.Sessions)
 		} else {
 			logger.Success("Time tracking summary is correct")
 		}
@@ -373,9 +493,9 @@ func TestJsonSerialization(t *testing.T) {
 
 	logger.Enter("Node Setup")
 	node := core.NewNode(core.BranchNode, "test-node")
-	node.Users = []core.User{
-		{ID: "user1", Username: "User 1", Email: "user1@example.com", Permissions: []core.Permission{core.ReadPermission, core.WritePermission}},
-		{ID: "user2", Username: "User 2", Email: "user2@example.com", Permissions: []core.Permission{core.ReadPermission}},
+	node.Grants = []core.Grant{
+		{UserID: "user1", Permission: core.WritePermission},
+		{UserID: "user2", Permission: core.ReadPermission},
 	}
 
 	// Add some events
@@ -418,11 +538,11 @@ func TestJsonSerialization(t *testing.T) {
 	} else {
 		logger.Success("Node name is correct")
 	}
-	if len(loadedNode.Users) != 2 {
-		logger.Failure("Expected 2 users, got %d", len(loadedNode.Users))
-		t.Errorf("Expected 2 users, got %d", len(loadedNode.Users))
+	if len(loadedNode.Grants) != 2 {
+		logger.Failure("Expected 2 grants, got %d", len(loadedNode.Grants))
+		t.Errorf("Expected 2 grants, got %d", len(loadedNode.Grants))
 	} else {
-		logger.Success("Found 2 users")
+		logger.Success("Found 2 grants")
 	}
 	if len(loadedNode.Events) != 1 {
 		logger.Failure("Expected 1 event, got %d", len(loadedNode.Events))
@@ -452,6 +572,7 @@ func TestHandleAssignUser(t *testing.T) {
 	defer logger.Exit("HandleAssignUser")
 
 	app := setupTestForest(t)
+	app.forest.Directory.Add(core.User{ID: "test_user", Username: "test_user"})
 
 	body := map[string]interface{}{
 		"path":        "test-node",
@@ -498,27 +619,24 @@ func TestHandleGetTimeTracking(t *testing.T) {
 		"path": "test-node",
 	}
 	startBytes, _ := json.Marshal(startBody)
-	startReq := httptest.NewRequest("POST", "/start_time_tracking", bytes.NewBuffer(startBytes))
-	startReq.Header.Set("X-User-ID", "admin")
+	startReq := httptest.NewRequest("POST", "/time/start", bytes.NewBuffer(startBytes))
 	startReq.Header.Set("Content-Type", "application/json")
-	app.handleStartTimeTracking(httptest.NewRecorder(), startReq)
+	app.handleStartTimeTracking(httptest.NewRecorder(), withUser(startReq, "admin"))
 
 	// Stop time tracking
-	stopReq := httptest.NewRequest("POST", "/stop_time_tracking", bytes.NewBuffer(startBytes))
-	stopReq.Header.Set("X-User-ID", "admin")
+	stopReq := httptest.NewRequest("POST", "/time/stop", bytes.NewBuffer(startBytes))
 	stopReq.Header.Set("Content-Type", "application/json")
-	app.handleStopTimeTracking(httptest.NewRecorder(), stopReq)
+	app.handleStopTimeTracking(httptest.NewRecorder(), withUser(stopReq, "admin"))
 
 	// Get summary
-	req := httptest.NewRequest("POST", "/get_time_tracking", bytes.NewBuffer(startBytes))
-	req.Header.Set("X-User-ID", "admin")
+	req := httptest.NewRequest("GET", "/time?path=test-node", nil)
 	rr := httptest.NewRecorder()
-	app.handleGetTimeTracking(rr, req)
+	app.handleGetTimeTracking(rr, withUser(req, "admin"))
 
-	var summary []map[string]interface{}
+	var summary core.TimeSummary
 	json.NewDecoder(rr.Body).Decode(&summary)
 
-	if len(summary) == 0 {
+	if len(summary.Sessions) == 0 {
 		logger.Failure("Expected non-empty summary")
 		t.Error("Expected non-empty summary")
 	} else {
@@ -754,14 +872,10 @@ func TestHandleAppendToEventWithCategories(t *testing.T) {
 	workoutNode.ID = "workout"
 
 	// Add admin user to all nodes
-	adminUser := core.User{
-		ID:          "admin",
-		Username:    "admin",
-		Permissions: []core.Permission{core.AdminPermission},
-	}
-	healthNode.Users = []core.User{adminUser}
-	exerciseNode.Users = []core.User{adminUser}
-	workoutNode.Users = []core.User{adminUser}
+	adminGrant := core.Grant{UserID: "admin", Permission: core.AdminPermission}
+	healthNode.Grants = []core.Grant{adminGrant}
+	exerciseNode.Grants = []core.Grant{adminGrant}
+	workoutNode.Grants = []core.Grant{adminGrant}
 
 	// Set up node hierarchy
 	app.forest.AddChild(healthNode)
@@ -949,6 +1063,3182 @@ func TestMultipleParentNodes(t *testing.T) {
 	logger.Exit("Event Propagation")
 }
 
+func TestHandleNodeLifecycle(t *testing.T) {
+	logger.Enter("HandleNodeLifecycle")
+	defer logger.Exit("HandleNodeLifecycle")
+
+	app := setupTestForest(t)
+
+	createNode := func(body map[string]interface{}) *core.Node {
+		bodyBytes, _ := json.Marshal(body)
+		req := withUser(httptest.NewRequest("POST", "/nodes", bytes.NewBuffer(bodyBytes)), "admin")
+		rr := httptest.NewRecorder()
+		app.handleCreateNode(rr, req)
+		if rr.Code != http.StatusCreated {
+			logger.Failure("Failed to create node: %v", rr.Body.String())
+			t.Fatalf("Failed to create node: %v", rr.Body.String())
+		}
+		var node core.Node
+		json.NewDecoder(rr.Body).Decode(&node)
+		created, err := app.forest.GetNode(node.ID)
+		if err != nil {
+			t.Fatalf("Created node not found in forest: %v", err)
+		}
+		return created
+	}
+
+	logger.Enter("Create")
+	work := createNode(map[string]interface{}{"path": "", "name": "work", "type": "branch"})
+	home := createNode(map[string]interface{}{"path": "", "name": "home", "type": "branch"})
+	budget := createNode(map[string]interface{}{"parent_id": work.ID, "name": "budget", "type": "leaf"})
+	if _, exists := budget.Parents[work.ID]; !exists {
+		logger.Failure("Expected budget to be a child of work")
+		t.Error("Expected budget to be a child of work")
+	} else {
+		logger.Success("Nodes created")
+	}
+
+	dupBytes, _ := json.Marshal(map[string]interface{}{"parent_id": work.ID, "name": "budget", "type": "leaf"})
+	dupRR := httptest.NewRecorder()
+	app.handleCreateNode(dupRR, withUser(httptest.NewRequest("POST", "/nodes", bytes.NewBuffer(dupBytes)), "admin"))
+	if dupRR.Code != http.StatusConflict {
+		logger.Failure("Expected duplicate sibling name to conflict, got %v", dupRR.Code)
+		t.Errorf("Expected duplicate sibling name to conflict, got %v", dupRR.Code)
+	}
+	logger.Exit("Create")
+
+	logger.Enter("Rename")
+	renameBytes, _ := json.Marshal(map[string]interface{}{"name": "office"})
+	renameReq := withUser(httptest.NewRequest("PATCH", "/nodes/"+work.ID, bytes.NewBuffer(renameBytes)), "admin")
+	renameReq = mux.SetURLVars(renameReq, map[string]string{"id": work.ID})
+	renameRR := httptest.NewRecorder()
+	app.handleUpdateNode(renameRR, renameReq)
+	if renameRR.Code != http.StatusOK || work.Name != "office" || budget.Parents[work.ID] != "office" {
+		logger.Failure("Rename failed: %v %v", renameRR.Code, renameRR.Body.String())
+		t.Errorf("Rename failed: %v %v", renameRR.Code, renameRR.Body.String())
+	} else {
+		logger.Success("Node renamed")
+	}
+	logger.Exit("Rename")
+
+	logger.Enter("Move")
+	linkBytes, _ := json.Marshal(map[string]interface{}{"to_parent_id": home.ID, "link": true})
+	linkReq := mux.SetURLVars(withUser(httptest.NewRequest("POST", "/nodes/"+budget.ID+"/move", bytes.NewBuffer(linkBytes)), "admin"), map[string]string{"id": budget.ID})
+	linkRR := httptest.NewRecorder()
+	app.handleMoveNode(linkRR, linkReq)
+	if linkRR.Code != http.StatusOK || len(budget.Parents) != 2 {
+		logger.Failure("Link failed: %v %v", linkRR.Code, linkRR.Body.String())
+		t.Errorf("Link failed: %v %v", linkRR.Code, linkRR.Body.String())
+	}
+
+	ambiguousBytes, _ := json.Marshal(map[string]interface{}{"to_parent_id": app.forest.ID})
+	ambiguousReq := mux.SetURLVars(withUser(httptest.NewRequest("POST", "/nodes/"+budget.ID+"/move", bytes.NewBuffer(ambiguousBytes)), "admin"), map[string]string{"id": budget.ID})
+	ambiguousRR := httptest.NewRecorder()
+	app.handleMoveNode(ambiguousRR, ambiguousReq)
+	if ambiguousRR.Code != http.StatusConflict {
+		logger.Failure("Expected move of multi-parent node without from_parent_id to conflict, got %v", ambiguousRR.Code)
+		t.Errorf("Expected move of multi-parent node without from_parent_id to conflict, got %v", ambiguousRR.Code)
+	}
+
+	cycleBytes, _ := json.Marshal(map[string]interface{}{"to_parent_id": work.ID})
+	cycleReq := mux.SetURLVars(withUser(httptest.NewRequest("POST", "/nodes/"+work.ID+"/move", bytes.NewBuffer(cycleBytes)), "admin"), map[string]string{"id": work.ID})
+	cycleRR := httptest.NewRecorder()
+	app.handleMoveNode(cycleRR, cycleReq)
+	if cycleRR.Code != http.StatusConflict {
+		logger.Failure("Expected move beneath itself to conflict, got %v", cycleRR.Code)
+		t.Errorf("Expected move beneath itself to conflict, got %v", cycleRR.Code)
+	} else {
+		logger.Success("Move rules enforced")
+	}
+
+	// Moving out of a parent needs write access to it, even when left implicit
+	notes := createNode(map[string]interface{}{"parent_id": home.ID, "name": "notes", "type": "leaf"})
+	archive := createNode(map[string]interface{}{"path": "", "name": "archive", "type": "branch"})
+	notes.AssignUser("mover", core.AdminPermission)
+	archive.AssignUser("mover", core.WritePermission)
+	sourceBytes, _ := json.Marshal(map[string]interface{}{"to_parent_id": archive.ID})
+	sourceReq := mux.SetURLVars(withUser(httptest.NewRequest("POST", "/nodes/"+notes.ID+"/move", bytes.NewBuffer(sourceBytes)), "mover"), map[string]string{"id": notes.ID})
+	sourceRR := httptest.NewRecorder()
+	app.handleMoveNode(sourceRR, sourceReq)
+	if _, stillThere := notes.Parents[home.ID]; sourceRR.Code != http.StatusForbidden || !stillThere {
+		logger.Failure("Expected move out of an unwritable parent to be forbidden, got %v", sourceRR.Code)
+		t.Errorf("Expected move out of an unwritable parent to be forbidden, got %v", sourceRR.Code)
+	}
+	logger.Exit("Move")
+
+	logger.Enter("Delete")
+	deleteReq := mux.SetURLVars(withUser(httptest.NewRequest("DELETE", "/nodes/"+work.ID, nil), "admin"), map[string]string{"id": work.ID})
+	deleteRR := httptest.NewRecorder()
+	app.handleDeleteNode(deleteRR, deleteReq)
+	if deleteRR.Code != http.StatusConflict {
+		logger.Failure("Expected delete of node with children to require a mode, got %v", deleteRR.Code)
+		t.Errorf("Expected delete of node with children to require a mode, got %v", deleteRR.Code)
+	}
+
+	cascadeReq := mux.SetURLVars(withUser(httptest.NewRequest("DELETE", "/nodes/"+work.ID+"?mode=cascade", nil), "admin"), map[string]string{"id": work.ID})
+	cascadeRR := httptest.NewRecorder()
+	app.handleDeleteNode(cascadeRR, cascadeReq)
+	if cascadeRR.Code != http.StatusNoContent {
+		logger.Failure("Cascade delete failed: %v %v", cascadeRR.Code, cascadeRR.Body.String())
+		t.Errorf("Cascade delete failed: %v %v", cascadeRR.Code, cascadeRR.Body.String())
+	}
+	if _, err := app.forest.GetNode(work.ID); err == nil {
+		logger.Failure("Deleted node still reachable")
+		t.Error("Deleted node still reachable")
+	}
+	if _, err := app.forest.GetNode(budget.ID); err != nil {
+		logger.Failure("Multi-parent child should survive through its other parent")
+		t.Error("Multi-parent child should survive through its other parent")
+	} else if _, exists := budget.Parents[work.ID]; exists {
+		logger.Failure("Surviving child still references deleted parent")
+		t.Error("Surviving child still references deleted parent")
+	} else {
+		logger.Success("Cascade delete kept multi-parent child")
+	}
+
+	// Orphaned children are handed to the parents only when their names are free there
+	trip := createNode(map[string]interface{}{"path": "", "name": "trip", "type": "branch"})
+	createNode(map[string]interface{}{"parent_id": trip.ID, "name": "home", "type": "leaf"})
+	orphanReq := mux.SetURLVars(withUser(httptest.NewRequest("DELETE", "/nodes/"+trip.ID+"?mode=orphan", nil), "admin"), map[string]string{"id": trip.ID})
+	orphanRR := httptest.NewRecorder()
+	app.handleDeleteNode(orphanRR, orphanReq)
+	if _, err := app.forest.GetNode(trip.ID); orphanRR.Code != http.StatusConflict || err != nil {
+		logger.Failure("Expected orphaning onto a clashing name to conflict, got %v", orphanRR.Code)
+		t.Errorf("Expected orphaning onto a clashing name to conflict, got %v", orphanRR.Code)
+	} else {
+		logger.Success("Orphan delete rejected on a name clash")
+	}
+	logger.Exit("Delete")
+}
+
+func TestJournalReplay(t *testing.T) {
+	logger.Enter("JournalReplay")
+	defer logger.Exit("JournalReplay")
+
+	config := testConfig(t, "journal_state")
+	app := newTestServer(t, config)
+	adminID := app.forest.Grants[0].UserID
+
+	snapshotInfo, err := os.Stat(app.dbFile())
+	if err != nil {
+		t.Fatalf("Failed to stat state file: %v", err)
+	}
+
+	project, err := app.forest.CreateChild(core.BranchNode, "project", adminID)
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	task, err := project.CreateChild(core.LeafNode, "task", adminID)
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	if err := app.persist(task, project, app.forest); err != nil {
+		t.Fatalf("Failed to persist nodes: %v", err)
+	}
+	if err := task.StartEvent("standup", adminID, nil, nil, map[string]interface{}{}); err != nil {
+		t.Fatalf("Failed to start event: %v", err)
+	}
+	if err := app.persist(task); err != nil {
+		t.Fatalf("Failed to persist event: %v", err)
+	}
+
+	logger.Enter("Snapshot Untouched")
+	if info, _ := os.Stat(app.dbFile()); !info.ModTime().Equal(snapshotInfo.ModTime()) || info.Size() != snapshotInfo.Size() {
+		logger.Failure("State file was rewritten on mutation")
+		t.Error("State file was rewritten on mutation")
+	} else if app.journal.Len() != 4 {
+		logger.Failure("Expected 4 journal records, got %d", app.journal.Len())
+		t.Errorf("Expected 4 journal records, got %d", app.journal.Len())
+	} else {
+		logger.Success("Mutations went to the journal")
+	}
+	logger.Exit("Snapshot Untouched")
+
+	// Simulate a torn write at the tail of the journal
+	journalFile, _ := os.OpenFile(app.dbFile()+".journal", os.O_APPEND|os.O_WRONLY, 0600)
+	journalFile.WriteString("0badc0de {\"seq\":")
+	journalFile.Close()
+
+	logger.Enter("Replay")
+	loaded, err := loadTestServer(t, config)
+	if err != nil {
+		logger.Failure("Failed to load server: %v", err)
+		t.Fatalf("Failed to load server: %v", err)
+	}
+	replayedTask, err := loaded.getNodeFromPath("project/task")
+	if err != nil {
+		logger.Failure("Replayed forest is missing project/task: %v", err)
+		t.Fatalf("Replayed forest is missing project/task: %v", err)
+	}
+	if _, exists := replayedTask.Events["standup"]; !exists {
+		logger.Failure("Replayed node is missing its event")
+		t.Error("Replayed node is missing its event")
+	} else {
+		logger.Success("Journal replayed onto snapshot")
+	}
+
+	// Records written after the torn one must survive the next replay
+	if err := replayedTask.StartEvent("retro", adminID, nil, nil, map[string]interface{}{}); err != nil {
+		t.Fatalf("Failed to start event: %v", err)
+	}
+	if err := loaded.persist(replayedTask); err != nil {
+		t.Fatalf("Failed to persist event: %v", err)
+	}
+	again, err := loadTestServer(t, config)
+	if err != nil {
+		t.Fatalf("Failed to load server again: %v", err)
+	}
+	if againTask, err := again.getNodeFromPath("project/task"); err != nil || againTask.Events["retro"].StartTime == nil {
+		logger.Failure("Record appended after a torn write was lost")
+		t.Error("Record appended after a torn write was lost")
+	} else {
+		logger.Success("Torn tail cut off before appending")
+	}
+	logger.Exit("Replay")
+
+	logger.Enter("Checkpoint")
+	if err := loaded.checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if info, _ := os.Stat(loaded.dbFile() + ".journal"); info.Size() != 0 {
+		logger.Failure("Journal not truncated after checkpoint")
+		t.Error("Journal not truncated after checkpoint")
+	}
+	reloaded, err := loadTestServer(t, config)
+	if err != nil {
+		t.Fatalf("Failed to reload server: %v", err)
+	}
+	if _, err := reloaded.getNodeFromPath("project/task"); err != nil {
+		logger.Failure("Checkpointed forest is missing project/task: %v", err)
+		t.Errorf("Checkpointed forest is missing project/task: %v", err)
+	} else {
+		logger.Success("Checkpoint compacted the journal")
+	}
+
+	// Checkpoints read every node under its lock while requests change them
+	project, _ = reloaded.getNodeFromPath("project")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if err := reloaded.checkpoint(); err != nil {
+				t.Errorf("Checkpoint failed: %v", err)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		child, _ := project.CreateChild(core.LeafNode, "busy-"+strconv.Itoa(i), adminID)
+		child.AddActivity("busy", map[string]interface{}{}, adminID)
+		reloaded.persist(project, child)
+	}
+	<-done
+	logger.Exit("Checkpoint")
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	logger.Enter("EncryptionAtRest")
+	defer logger.Exit("EncryptionAtRest")
+
+	config := testConfig(t, "encrypted_state")
+	config.Process.Encryption = "passphrase"
+	config.Secret = []byte("correct horse battery staple")
+	app := newTestServer(t, config)
+	project, err := app.forest.CreateChild(core.BranchNode, "secret-project", app.forest.Grants[0].UserID)
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	if err := app.persist(project, app.forest); err != nil {
+		t.Fatalf("Failed to persist nodes: %v", err)
+	}
+
+	logger.Enter("Ciphertext On Disk")
+	state, _ := os.ReadFile(app.dbFile())
+	journal, _ := os.ReadFile(app.dbFile() + ".journal")
+	if !isEncryptedState(state) {
+		logger.Failure("State file is missing the encrypted header")
+		t.Error("State file is missing the encrypted header")
+	} else if bytes.Contains(journal, []byte("secret-project")) {
+		logger.Failure("Journal contains plaintext node names")
+		t.Error("Journal contains plaintext node names")
+	} else {
+		logger.Success("State file and journal are encrypted")
+	}
+	logger.Exit("Ciphertext On Disk")
+
+	if err := app.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+
+	logger.Enter("Wrong Secret")
+	wrongConfig := config
+	wrongConfig.Secret = []byte("wrong passphrase")
+	if _, err := loadTestServer(t, wrongConfig); err == nil {
+		logger.Failure("Loaded database with the wrong secret")
+		t.Error("Loaded database with the wrong secret")
+	} else {
+		logger.Success("Wrong secret rejected: %v", err)
+	}
+	logger.Exit("Wrong Secret")
+
+	logger.Enter("Rekey")
+	if err := Rekey(config, []byte("a brand new passphrase")); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	if _, err := loadTestServer(t, config); err == nil {
+		logger.Failure("Old secret still opens the database after rekey")
+		t.Error("Old secret still opens the database after rekey")
+	}
+	rekeyed := config
+	rekeyed.Secret = []byte("a brand new passphrase")
+	loaded, err := loadTestServer(t, rekeyed)
+	if err != nil {
+		t.Fatalf("Failed to load rekeyed database: %v", err)
+	}
+	if _, err := loaded.getNodeFromPath("secret-project"); err != nil {
+		logger.Failure("Rekeyed forest is missing secret-project: %v", err)
+		t.Errorf("Rekeyed forest is missing secret-project: %v", err)
+	} else {
+		logger.Success("Database re-encrypted with the new secret")
+	}
+	logger.Exit("Rekey")
+
+	logger.Enter("Cached Keys")
+	// Saves reuse the key the file was read with rather than deriving one each time
+	sessionCipher := loaded.sessions.file.cipher
+	if _, err := loaded.sessions.Create("admin", "test-agent", time.Hour); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if sessionCipher == nil || loaded.sessions.file.cipher != sessionCipher {
+		t.Error("Expected the sessions file key derived once")
+	}
+	// A save captured before the one on disk is dropped
+	if err := loaded.sessions.file.write(1, []byte(`{"sessions":{}}`)); err != nil {
+		t.Fatalf("Failed to write sessions: %v", err)
+	}
+	if reloaded, err := LoadSessionStore(sessionsFile(rekeyed), rekeyed.Secret); err != nil || len(reloaded.Sessions) != 1 {
+		t.Errorf("Expected the later save kept on disk: %v", err)
+	} else {
+		logger.Success("Keys cached and stale saves dropped")
+	}
+	logger.Exit("Cached Keys")
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	logger.Enter("SigningKeyRotation")
+	defer logger.Exit("SigningKeyRotation")
+
+	config := testConfig(t, "signing_keys")
+	app := newTestServer(t, config)
+
+	authenticate := func(server *Server, token string) int {
+		req := httptest.NewRequest("GET", "/users/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		server.authMiddleware(func(w http.ResponseWriter, r *http.Request) {})(rr, req)
+		return rr.Code
+	}
+
+	admin, _ := app.forest.Directory.Get(app.forest.Grants[0].UserID)
+	session, err := app.sessions.Create(admin.ID, "test", app.jwtConfig.RefreshExpiresIn)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	oldPair, err := app.generateTokenPair(&admin, session)
+	if err != nil {
+		t.Fatalf("Failed to generate tokens: %v", err)
+	}
+
+	logger.Enter("Rotation Window")
+	if err := app.jwtConfig.Keys.Rotate(app.jwtConfig.RotationWindow); err != nil {
+		t.Fatalf("Failed to rotate keys: %v", err)
+	}
+	newPair, _ := app.generateTokenPair(&admin, session)
+	oldToken, _, _ := new(jwt.Parser).ParseUnverified(oldPair.SessionToken, &TokenClaims{})
+	newToken, _, _ := new(jwt.Parser).ParseUnverified(newPair.SessionToken, &TokenClaims{})
+	if oldToken.Header["kid"] == newToken.Header["kid"] {
+		logger.Failure("Rotation did not change the kid header")
+		t.Error("Rotation did not change the kid header")
+	}
+	if code := authenticate(app, oldPair.SessionToken); code != http.StatusOK {
+		logger.Failure("Token signed before rotation rejected with %d", code)
+		t.Errorf("Token signed before rotation rejected with %d", code)
+	} else {
+		logger.Success("Token signed before rotation still valid")
+	}
+	logger.Exit("Rotation Window")
+
+	logger.Enter("Persisted Keys")
+	loaded, err := loadTestServer(t, config)
+	if err != nil {
+		t.Fatalf("Failed to load server: %v", err)
+	}
+	if code := authenticate(loaded, newPair.SessionToken); code != http.StatusOK {
+		logger.Failure("Token rejected after restart with %d", code)
+		t.Errorf("Token rejected after restart with %d", code)
+	} else {
+		logger.Success("Signing keys survived a restart")
+	}
+	logger.Exit("Persisted Keys")
+
+	logger.Enter("Expired Window")
+	loaded.jwtConfig.RotationWindow = 0
+	if code := authenticate(loaded, oldPair.SessionToken); code != http.StatusUnauthorized {
+		logger.Failure("Token signed with a retired key accepted after the window")
+		t.Error("Token signed with a retired key accepted after the window")
+	} else {
+		logger.Success("Retired key rejected after the window")
+	}
+	logger.Exit("Expired Window")
+}
+
+func TestRefreshSessions(t *testing.T) {
+	logger.Enter("RefreshSessions")
+	defer logger.Exit("RefreshSessions")
+
+	app := newTestServer(t, testConfig(t, "refresh_sessions"))
+	adminID := app.forest.Grants[0].UserID
+
+	login := func() TokenPair {
+		req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(`{"username":"admin","password":"admin"}`))
+		req.Header.Set("User-Agent", "test-agent")
+		rr := httptest.NewRecorder()
+		app.handleLogin(rr, req)
+		var pair TokenPair
+		json.NewDecoder(rr.Body).Decode(&pair)
+		return pair
+	}
+	refresh := func(refreshToken string) (int, TokenPair) {
+		body, _ := json.Marshal(map[string]string{"refresh_token": refreshToken})
+		rr := httptest.NewRecorder()
+		app.handleRefreshToken(rr, httptest.NewRequest("POST", "/refresh", bytes.NewBuffer(body)))
+		var pair TokenPair
+		json.NewDecoder(rr.Body).Decode(&pair)
+		return rr.Code, pair
+	}
+	authenticated := func(pair TokenPair, handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+		req.Header.Set("Authorization", "Bearer "+pair.SessionToken)
+		rr := httptest.NewRecorder()
+		app.authMiddleware(handler)(rr, req)
+		return rr
+	}
+
+	logger.Enter("Rotation And Reuse")
+	first := login()
+	code, second := refresh(first.RefreshToken)
+	if code != http.StatusOK || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		logger.Failure("Refresh did not rotate the refresh token: %d", code)
+		t.Fatalf("Refresh did not rotate the refresh token: %d", code)
+	}
+	if code, _ := refresh(first.RefreshToken); code != http.StatusUnauthorized {
+		logger.Failure("Reused refresh token accepted with %d", code)
+		t.Errorf("Reused refresh token accepted with %d", code)
+	}
+	if code, _ := refresh(second.RefreshToken); code != http.StatusUnauthorized {
+		logger.Failure("Session survived refresh token reuse")
+		t.Error("Session survived refresh token reuse")
+	}
+	if rr := authenticated(second, app.handleGetUserProfile, httptest.NewRequest("GET", "/users/profile", nil)); rr.Code != http.StatusUnauthorized {
+		logger.Failure("Session token of a revoked session accepted with %d", rr.Code)
+		t.Errorf("Session token of a revoked session accepted with %d", rr.Code)
+	} else {
+		logger.Success("Reuse revoked the session")
+	}
+	logger.Exit("Rotation And Reuse")
+
+	logger.Enter("List And Revoke")
+	laptop, phone := login(), login()
+	listReq := mux.SetURLVars(httptest.NewRequest("GET", "/users/me/sessions", nil), map[string]string{"id": "me"})
+	rr := authenticated(laptop, app.handleGetSessions, listReq)
+	var sessions []map[string]interface{}
+	json.NewDecoder(rr.Body).Decode(&sessions)
+	if len(sessions) != 2 || sessions[0]["device"] != "test-agent" {
+		logger.Failure("Expected 2 listed sessions, got %v", sessions)
+		t.Errorf("Expected 2 listed sessions, got %v", sessions)
+	}
+
+	revokeReq := mux.SetURLVars(httptest.NewRequest("POST", "/users/"+adminID+"/sessions/revoke", nil), map[string]string{"id": adminID})
+	if rr := authenticated(phone, app.handleRevokeSessions, revokeReq); rr.Code != http.StatusOK {
+		t.Fatalf("Revoke failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	if code, _ := refresh(laptop.RefreshToken); code != http.StatusUnauthorized {
+		logger.Failure("Refresh token of a revoked session accepted")
+		t.Error("Refresh token of a revoked session accepted")
+	} else {
+		logger.Success("Revoked all sessions")
+	}
+	logger.Exit("List And Revoke")
+
+	logger.Enter("Logout")
+	current := login()
+	if rr := authenticated(current, app.handleLogout, httptest.NewRequest("POST", "/logout", nil)); rr.Code != http.StatusNoContent {
+		t.Fatalf("Logout failed with %d", rr.Code)
+	}
+	if code, _ := refresh(current.RefreshToken); code != http.StatusUnauthorized {
+		logger.Failure("Refresh token accepted after logout")
+		t.Error("Refresh token accepted after logout")
+	} else {
+		logger.Success("Logout revoked the session")
+	}
+	logger.Exit("Logout")
+}
+
+func TestResolveNodePaths(t *testing.T) {
+	logger.Enter("ResolveNodePaths")
+	defer logger.Exit("ResolveNodePaths")
+
+	app := setupTestForest(t)
+	adminID := app.forest.Grants[0].UserID
+
+	work, _ := app.forest.CreateChild(core.BranchNode, "work", adminID)
+	home, _ := app.forest.CreateChild(core.BranchNode, "home", adminID)
+	shared, _ := work.CreateChild(core.LeafNode, "errands/chores", adminID)
+	if err := app.forest.MoveNode(shared.ID, "", home, true); err != nil {
+		t.Fatalf("Failed to link node: %v", err)
+	}
+	// Legacy data may hold siblings with the same name
+	twinA, twinB := core.NewNode(core.LeafNode, "twin"), core.NewNode(core.LeafNode, "twin")
+	work.AddChild(twinA)
+	work.AddChild(twinB)
+
+	logger.Enter("Path Forms")
+	for path, want := range map[string]*core.Node{
+		"":                       app.forest,
+		"/":                      app.forest,
+		"work":                   work,
+		"/work/errands\\/chores": shared,
+		"home/errands\\/chores":  shared,
+		core.IDPath(shared.ID):   shared,
+		core.IDPath("forest"):    app.forest,
+		shared.ID:                shared,
+	} {
+		node, err := app.forest.Resolve(path)
+		if err != nil || node != want {
+			logger.Failure("Resolve(%q) = %v, %v", path, node, err)
+			t.Errorf("Resolve(%q) = %v, %v", path, node, err)
+		}
+	}
+	if _, err := app.forest.Resolve("work/missing"); !errors.Is(err, core.ErrNodeNotFound) {
+		t.Errorf("Expected ErrNodeNotFound, got %v", err)
+	}
+	if _, err := app.forest.Resolve("work/bad\\escape"); !errors.Is(err, core.ErrInvalidPath) {
+		t.Errorf("Expected ErrInvalidPath, got %v", err)
+	}
+	logger.Exit("Path Forms")
+
+	logger.Enter("Ambiguity And Canonical Paths")
+	rr := httptest.NewRecorder()
+	app.handleResolveNode(rr, withUser(httptest.NewRequest("GET", "/nodes/resolve?path=work/twin", nil), adminID))
+	if rr.Code != http.StatusConflict || !bytes.Contains(rr.Body.Bytes(), []byte(twinA.ID)) {
+		logger.Failure("Expected 409 listing the twins, got %d: %s", rr.Code, rr.Body.String())
+		t.Errorf("Expected 409 listing the twins, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	app.handleResolveNode(rr, withUser(httptest.NewRequest("GET", "/nodes/resolve?path="+url.QueryEscape(core.IDPath(shared.ID)), nil), adminID))
+	var resolved struct {
+		Paths []string `json:"paths"`
+	}
+	json.NewDecoder(rr.Body).Decode(&resolved)
+	want := []string{"home/errands\\/chores", "work/errands\\/chores"}
+	if !reflect.DeepEqual(resolved.Paths, want) {
+		logger.Failure("Expected paths %v, got %v", want, resolved.Paths)
+		t.Errorf("Expected paths %v, got %v", want, resolved.Paths)
+	} else {
+		logger.Success("Resolved every canonical path")
+	}
+	logger.Exit("Ambiguity And Canonical Paths")
+}
+
+func TestInheritedPermissions(t *testing.T) {
+	logger.Enter("InheritedPermissions")
+	defer logger.Exit("InheritedPermissions")
+
+	config := testConfig(t, "permission_state")
+	app := newTestServer(t, config)
+	adminID := app.forest.Grants[0].UserID
+
+	work, _ := app.forest.CreateChild(core.BranchNode, "work", adminID)
+	private, _ := work.CreateChild(core.BranchNode, "private", adminID)
+	secret, _ := private.CreateChild(core.LeafNode, "secret", adminID)
+	task, _ := work.CreateChild(core.LeafNode, "task", adminID)
+	home, _ := app.forest.CreateChild(core.BranchNode, "home", adminID)
+	chores, _ := home.CreateChild(core.LeafNode, "chores", adminID)
+
+	work.AssignUser("worker", core.WritePermission)
+	private.AssignUser("worker", core.DenyPermission)
+	home.AssignUser("lead", core.AdminPermission)
+
+	logger.Enter("Inheritance")
+	for _, check := range []struct {
+		node       *core.Node
+		userID     string
+		permission core.Permission
+		want       bool
+	}{
+		{task, "worker", core.WritePermission, true},
+		{task, "worker", core.ReadPermission, true},
+		{task, "worker", core.AdminPermission, false},
+		{secret, "worker", core.ReadPermission, false},
+		{chores, "worker", core.ReadPermission, false},
+		{chores, "lead", core.WritePermission, true},
+		{task, "lead", core.ReadPermission, false},
+	} {
+		if got := check.node.CheckPermission(check.userID, check.permission); got != check.want {
+			logger.Failure("CheckPermission(%s, %s, %d) = %v", check.node.Name, check.userID, check.permission, got)
+			t.Errorf("CheckPermission(%s, %s, %d) = %v, want %v", check.node.Name, check.userID, check.permission, got, check.want)
+		}
+	}
+
+	// A node linked under a second parent inherits through both
+	if err := app.forest.MoveNode(chores.ID, "", work, true); err != nil {
+		t.Fatalf("Failed to link node: %v", err)
+	}
+	if !chores.CheckPermission("worker", core.WritePermission) || !chores.CheckPermission("lead", core.AdminPermission) {
+		logger.Failure("Linked node did not inherit from both parents")
+		t.Error("Linked node did not inherit from both parents")
+	} else {
+		logger.Success("Permissions inherited through every parent")
+	}
+	logger.Exit("Inheritance")
+
+	logger.Enter("Filtered Forest")
+	rr := httptest.NewRecorder()
+	app.handleGetForest(rr, withUser(httptest.NewRequest("GET", "/forest", nil), "worker"))
+	var forest core.Node
+	if err := json.NewDecoder(rr.Body).Decode(&forest); err != nil {
+		t.Fatalf("Failed to decode forest: %v", err)
+	}
+	filteredWork := forest.Children[work.ID]
+	if filteredWork == nil || filteredWork.Children[task.ID] == nil {
+		logger.Failure("Readable nodes missing from filtered forest")
+		t.Fatal("Readable nodes missing from filtered forest")
+	}
+	if _, exists := filteredWork.Children[private.ID]; exists {
+		logger.Failure("Denied subtree leaked into filtered forest")
+		t.Error("Denied subtree leaked into filtered forest")
+	}
+	// home is unreadable but leads to the linked chores, so only its outline remains
+	if outline := forest.Children[home.ID]; outline == nil || len(outline.Grants) != 0 || outline.CreatedBy != "" {
+		logger.Failure("Unreadable ancestor not reduced to an outline")
+		t.Error("Unreadable ancestor not reduced to an outline")
+	}
+	if len(forest.Grants) != 0 {
+		logger.Failure("Unreadable root exposed its grants")
+		t.Error("Unreadable root exposed its grants")
+	}
+
+	rr = httptest.NewRecorder()
+	app.handleGetTree(rr, withUser(httptest.NewRequest("GET", "/forest/tree?path=work/private", nil), "worker"))
+	if rr.Code != http.StatusForbidden {
+		logger.Failure("Expected 403 for denied tree, got %d", rr.Code)
+		t.Errorf("Expected 403 for denied tree, got %d", rr.Code)
+	} else {
+		logger.Success("Forest and tree filtered per user")
+	}
+	logger.Exit("Filtered Forest")
+
+	logger.Enter("Concurrent Checks")
+	// Checks read grants and parents while they are being changed
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			chores.AddParent(home)
+			home.AssignUser("lead", core.AdminPermission)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		chores.CheckPermission("lead", core.WritePermission)
+		app.forest.FilterFor("worker")
+	}
+	wg.Wait()
+	if !chores.CheckPermission("lead", core.AdminPermission) {
+		logger.Failure("Permissions changed by concurrent checks")
+		t.Error("Permissions changed by concurrent checks")
+	} else {
+		logger.Success("Permissions checked while grants and parents change")
+	}
+	logger.Exit("Concurrent Checks")
+
+	logger.Enter("Reload")
+	if err := app.persist(app.forest, work, private, secret, task, home, chores); err != nil {
+		t.Fatalf("Failed to persist nodes: %v", err)
+	}
+	loaded, err := loadTestServer(t, config)
+	if err != nil {
+		t.Fatalf("Failed to load server: %v", err)
+	}
+	loadedTask, _ := loaded.getNodeFromPath("work/task")
+	loadedSecret, _ := loaded.getNodeFromPath("work/private/secret")
+	if loadedTask == nil || loadedSecret == nil {
+		t.Fatal("Reloaded forest is missing nodes")
+	}
+	if !loadedTask.CheckPermission("worker", core.WritePermission) || loadedSecret.CheckPermission("worker", core.ReadPermission) {
+		logger.Failure("Inheritance lost after reload")
+		t.Error("Inheritance lost after reload")
+	} else {
+		logger.Success("Inheritance restored after reload")
+	}
+	logger.Exit("Reload")
+}
+
+func TestUserDirectory(t *testing.T) {
+	logger.Enter("UserDirectory")
+	defer logger.Exit("UserDirectory")
+
+	config := testConfig(t, "directory_state")
+	app := newTestServer(t, config)
+	adminID := app.forest.Grants[0].UserID
+
+	login := func(username, password string) int {
+		body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+		rr := httptest.NewRecorder()
+		app.handleLogin(rr, httptest.NewRequest("POST", "/login", bytes.NewBuffer(body)))
+		return rr.Code
+	}
+
+	logger.Enter("Create And List")
+	rr := httptest.NewRecorder()
+	app.handleCreateUser(rr, httptest.NewRequest("POST", "/users/create", bytes.NewBufferString(`{"username":"alice","email":"alice@example.com","password":"wonderland"}`)))
+	var alice core.UserProfile
+	json.NewDecoder(rr.Body).Decode(&alice)
+	if rr.Code != http.StatusOK || alice.ID == "" {
+		t.Fatalf("Failed to create user: %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	app.handleCreateUser(rr, httptest.NewRequest("POST", "/users/create", bytes.NewBufferString(`{"username":"alice","password":"again"}`)))
+	if rr.Code != http.StatusConflict {
+		logger.Failure("Duplicate username accepted with %d", rr.Code)
+		t.Errorf("Duplicate username accepted with %d", rr.Code)
+	}
+
+	rr = call(app.handleGetUsers, adminID, "GET", "/users", nil, "")
+	if bytes.Contains(rr.Body.Bytes(), []byte("password")) || bytes.Contains(rr.Body.Bytes(), []byte("$2a$")) {
+		logger.Failure("User list leaked credentials: %s", rr.Body.String())
+		t.Errorf("User list leaked credentials: %s", rr.Body.String())
+	}
+	for _, grant := range app.forest.Grants {
+		if grant.UserID == alice.ID {
+			t.Errorf("Expected no grant on the root for a new user, got %d", grant.Permission)
+		}
+	}
+	logger.Exit("Create And List")
+
+	logger.Enter("Profile And Password")
+	rr = call(app.handleUpdateUser, alice.ID, "PATCH", "/users/me", map[string]string{"id": "me"}, `{"name":"Alice Liddell","username":"admin"}`)
+	if rr.Code != http.StatusConflict {
+		logger.Failure("Rename onto a taken username accepted with %d", rr.Code)
+		t.Errorf("Rename onto a taken username accepted with %d", rr.Code)
+	}
+	rr = call(app.handleUpdateUser, alice.ID, "PATCH", "/users/me", map[string]string{"id": "me"}, `{"name":"Alice Liddell"}`)
+	if user, _ := app.forest.Directory.Get(alice.ID); rr.Code != http.StatusOK || user.Name != "Alice Liddell" || user.Email != "alice@example.com" {
+		logger.Failure("Profile update failed: %d %+v", rr.Code, user.Profile())
+		t.Errorf("Profile update failed: %d %+v", rr.Code, user.Profile())
+	}
+	if rr := call(app.handleUpdateUser, alice.ID, "PATCH", "/users/"+adminID, map[string]string{"id": adminID}, `{"name":"mallory"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 updating another user, got %d", rr.Code)
+	}
+
+	if rr := call(app.handleChangePassword, alice.ID, "POST", "/users/me/password", map[string]string{"id": "me"}, `{"current_password":"wrong","new_password":"looking-glass"}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong current password, got %d", rr.Code)
+	}
+	call(app.handleChangePassword, alice.ID, "POST", "/users/me/password", map[string]string{"id": "me"}, `{"current_password":"wonderland","new_password":"looking-glass"}`)
+	if login("alice", "wonderland") != http.StatusUnauthorized || login("alice", "looking-glass") != http.StatusOK {
+		logger.Failure("Password change did not take effect")
+		t.Error("Password change did not take effect")
+	} else {
+		logger.Success("Profile and password updated")
+	}
+	logger.Exit("Profile And Password")
+
+	logger.Enter("Disable And Delete")
+	call(app.handleDisableUser, adminID, "POST", "/users/"+alice.ID+"/disable", map[string]string{"id": alice.ID}, "")
+	if code := login("alice", "looking-glass"); code != http.StatusForbidden {
+		logger.Failure("Disabled user logged in with %d", code)
+		t.Errorf("Disabled user logged in with %d", code)
+	}
+	call(app.handleEnableUser, adminID, "POST", "/users/"+alice.ID+"/enable", map[string]string{"id": alice.ID}, "")
+	if code := login("alice", "looking-glass"); code != http.StatusOK {
+		t.Errorf("Enabled user could not log in: %d", code)
+	}
+
+	project, _ := app.forest.CreateChild(core.BranchNode, "project", adminID)
+	project.AssignUser(alice.ID, core.WritePermission)
+	if rr := call(app.handleDeleteUser, adminID, "DELETE", "/users/"+alice.ID, map[string]string{"id": alice.ID}, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("Failed to delete user: %d", rr.Code)
+	}
+	if _, err := app.forest.Directory.Get(alice.ID); !errors.Is(err, core.ErrUserNotFound) || len(project.Grants) != 0 || project.CheckPermission(alice.ID, core.ReadPermission) {
+		logger.Failure("Deleted user kept access")
+		t.Error("Deleted user kept access")
+	} else {
+		logger.Success("Deleted user lost every grant")
+	}
+	logger.Exit("Disable And Delete")
+
+	logger.Enter("Legacy Migration")
+	legacy := core.User{ID: "legacy", Username: "legacy", Permissions: []core.Permission{core.ReadPermission, core.WritePermission}}
+	legacy.SetPassword("legacy-password")
+	project.LegacyUsers = []core.User{legacy}
+	if err := app.checkpoint(); err != nil {
+		t.Fatalf("Failed to write state: %v", err)
+	}
+
+	loaded, err := loadTestServer(t, config)
+	if err != nil {
+		t.Fatalf("Failed to load server: %v", err)
+	}
+	loadedProject, _ := loaded.getNodeFromPath("project")
+	if _, err := loaded.forest.Directory.FindByUsername("legacy"); err != nil || len(loadedProject.LegacyUsers) != 0 || !loadedProject.CheckPermission("legacy", core.WritePermission) {
+		logger.Failure("Legacy users were not migrated: %v", err)
+		t.Errorf("Legacy users were not migrated: %v", err)
+	} else if code := func() int {
+		rr := httptest.NewRecorder()
+		loaded.handleLogin(rr, httptest.NewRequest("POST", "/login", bytes.NewBufferString(`{"username":"legacy","password":"legacy-password"}`)))
+		return rr.Code
+	}(); code != http.StatusOK {
+		t.Errorf("Migrated user could not log in: %d", code)
+	} else {
+		logger.Success("Legacy users moved into the directory")
+	}
+	logger.Exit("Legacy Migration")
+}
+
+func TestRecurringEvents(t *testing.T) {
+	logger.Enter("RecurringEvents")
+	defer logger.Exit("RecurringEvents")
+
+	logger.Enter("Rules")
+	start := time.Date(2024, time.January, 31, 9, 0, 0, 0, time.UTC)
+	for pattern, want := range map[string][]string{
+		"FREQ=MONTHLY;BYMONTHDAY=31;COUNT=3":          {"2024-01-31", "2024-03-31", "2024-05-31"},
+		"RRULE:FREQ=MONTHLY;BYDAY=-1FR;COUNT=3":       {"2024-01-31", "2024-02-23", "2024-03-29"},
+		"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;COUNT=4":  {"2024-01-31", "2024-02-12", "2024-02-14", "2024-02-26"},
+		"FREQ=DAILY;UNTIL=20240202":                   {"2024-01-31", "2024-02-01", "2024-02-02"},
+		"FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=-1;COUNT=3": {"2024-01-31", "2024-02-29", "2025-02-28"},
+	} {
+		rule, err := core.ParseRRule(pattern)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %v", pattern, err)
+			continue
+		}
+		var got []string
+		for _, at := range rule.Between(start, start, start.AddDate(5, 0, 0)) {
+			got = append(got, at.Format("2006-01-02"))
+		}
+		if !reflect.DeepEqual(got, want) {
+			logger.Failure("%s expanded to %v, want %v", pattern, got, want)
+			t.Errorf("%s expanded to %v, want %v", pattern, got, want)
+		}
+	}
+	for _, pattern := range []string{"FREQ=HOURLY", "FREQ=DAILY;BYDAY=1MO", "FREQ=DAILY;COUNT=2;UNTIL=20240101", "INTERVAL=2"} {
+		if _, err := core.ParseRRule(pattern); !errors.Is(err, core.ErrInvalidRecurrence) {
+			t.Errorf("Expected %s to be rejected, got %v", pattern, err)
+		}
+	}
+	logger.Exit("Rules")
+
+	app := setupTestForest(t)
+	node, _ := app.getNodeFromPath("test-node")
+	first := time.Now().Add(time.Hour).Truncate(time.Second)
+	at := func(day int) time.Time { return first.AddDate(0, 0, day) }
+	post := func(handler http.HandlerFunc, body map[string]interface{}) *httptest.ResponseRecorder {
+		bodyBytes, _ := json.Marshal(body)
+		rr := httptest.NewRecorder()
+		handler(rr, withUser(httptest.NewRequest("POST", "/", bytes.NewBuffer(bodyBytes)), "admin"))
+		return rr
+	}
+	occurrences := func() []core.Occurrence {
+		query := url.Values{"path": {"test-node"}, "from": {first.Format(time.RFC3339)}, "to": {at(10).Format(time.RFC3339)}}
+		rr := httptest.NewRecorder()
+		app.handleGetOccurrences(rr, withUser(httptest.NewRequest("GET", "/events/occurrences?"+query.Encode(), nil), "admin"))
+		var list []core.Occurrence
+		json.NewDecoder(rr.Body).Decode(&list)
+		return list
+	}
+
+	logger.Enter("Materialise")
+	rr := post(app.handlePlanEvent, map[string]interface{}{
+		"path":       "test-node",
+		"event_id":   "standup",
+		"start_time": first.Format(time.RFC3339),
+		"end_time":   first.Add(15 * time.Minute).Format(time.RFC3339),
+		"metadata":   map[string]interface{}{"frequency": "daily", "room": "blue"},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Failed to plan series: %d %s", rr.Code, rr.Body.String())
+	}
+	if _, exists := node.PlannedEvents[core.OccurrenceID("standup", at(29))]; !exists {
+		logger.Failure("Occurrences within the horizon were not materialised")
+		t.Error("Occurrences within the horizon were not materialised")
+	}
+	if list := occurrences(); len(list) != 10 || !list[1].Start.Equal(at(1)) || list[1].SeriesID != "standup" {
+		logger.Failure("Expected 10 daily occurrences, got %d", len(list))
+		t.Errorf("Expected 10 daily occurrences, got %d", len(list))
+	} else {
+		logger.Success("Series materialised and listed")
+	}
+	if rr := post(app.handlePlanEvent, map[string]interface{}{
+		"path": "test-node", "event_id": "bad", "start_time": first.Format(time.RFC3339), "end_time": first.Format(time.RFC3339),
+		"metadata": map[string]interface{}{"custom_pattern": "FREQ=SECONDLY"},
+	}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid pattern, got %d", rr.Code)
+	}
+	logger.Exit("Materialise")
+
+	logger.Enter("Exceptions And Edits")
+	if rr := post(app.handleCancelOccurrence, map[string]interface{}{"path": "test-node", "event_id": "standup", "occurrence": at(2)}); rr.Code != http.StatusOK {
+		t.Errorf("Failed to cancel occurrence: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := post(app.handleCancelOccurrence, map[string]interface{}{"path": "test-node", "event_id": "standup", "occurrence": at(2).Add(time.Minute)}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 cancelling a time that is not an occurrence, got %d", rr.Code)
+	}
+	moved := at(3).Add(30 * time.Minute)
+	post(app.handleUpdateOccurrence, map[string]interface{}{"path": "test-node", "event_id": "standup", "occurrence": at(3), "scope": "this", "start_time": moved})
+	rr = post(app.handleUpdateOccurrence, map[string]interface{}{
+		"path": "test-node", "event_id": "standup", "occurrence": at(5), "scope": "following",
+		"metadata": map[string]interface{}{"room": "green"},
+	})
+	var split struct {
+		EventID string `json:"event_id"`
+	}
+	json.NewDecoder(rr.Body).Decode(&split)
+
+	list := occurrences()
+	rooms := make([]string, 0, len(list))
+	for _, occurrence := range list {
+		rooms = append(rooms, occurrence.Metadata["room"].(string))
+		if occurrence.Start.Equal(at(2)) {
+			t.Error("Cancelled occurrence still listed")
+		}
+	}
+	wantRooms := []string{"blue", "blue", "blue", "blue", "green", "green", "green", "green", "green"}
+	if len(list) != 9 || !list[2].Start.Equal(moved) || !reflect.DeepEqual(rooms, wantRooms) || split.EventID != core.OccurrenceID("standup", at(5)) {
+		logger.Failure("Unexpected occurrences after edits: %v %v", rooms, split.EventID)
+		t.Errorf("Unexpected occurrences after edits: %d %v %v", len(list), rooms, split.EventID)
+	} else {
+		logger.Success("Exceptions and this and following edits applied")
+	}
+
+	post(app.handleUpdateOccurrence, map[string]interface{}{
+		"path": "test-node", "event_id": "standup", "occurrence": first, "scope": "all",
+		"metadata": map[string]interface{}{"room": "red"},
+	})
+	if detached := node.PlannedEvents[core.OccurrenceID("standup", at(3))]; detached.Metadata["room"] != "blue" || !detached.StartTime.Equal(moved) {
+		t.Error("Series edit overwrote an occurrence edited on its own")
+	}
+	if occurrence := node.PlannedEvents[core.OccurrenceID("standup", at(4))]; occurrence.Metadata["room"] != "red" {
+		t.Errorf("Series edit not applied to its occurrences: %v", occurrence.Metadata)
+	}
+	logger.Exit("Exceptions And Edits")
+}
+
+func TestEventScheduler(t *testing.T) {
+	logger.Enter("EventScheduler")
+	defer logger.Exit("EventScheduler")
+
+	config := testConfig(t, "scheduler_state")
+	app := newTestServer(t, config)
+	adminID := app.forest.Grants[0].UserID
+	task, err := app.forest.CreateChild(core.LeafNode, "task", adminID)
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	plan := func(eventID string, start, end time.Time, metadata map[string]interface{}) {
+		if err := task.PlanEvent(eventID, adminID, &start, &end, metadata); err != nil {
+			t.Fatalf("Failed to plan %s: %v", eventID, err)
+		}
+	}
+	plan("review", now.Add(-2*time.Hour), now.Add(-time.Hour), map[string]interface{}{"auto_finish": true})
+	plan("standup", now.Add(-30*time.Minute), now.Add(-10*time.Minute), map[string]interface{}{})
+	plan("retro", now.Add(time.Hour), now.Add(2*time.Hour), map[string]interface{}{})
+	if err := app.persist(task, app.forest); err != nil {
+		t.Fatalf("Failed to persist nodes: %v", err)
+	}
+
+	// Transitions that came due while the server was down are caught up on load
+	logger.Enter("Catch Up")
+	loaded, err := loadTestServer(t, config)
+	if err != nil {
+		t.Fatalf("Failed to load server: %v", err)
+	}
+	if transitions, err := loaded.runSchedule(now); err != nil || transitions != 3 {
+		logger.Failure("Expected 3 transitions, got %d (%v)", transitions, err)
+		t.Errorf("Expected 3 transitions, got %d (%v)", transitions, err)
+	}
+	task, _ = loaded.getNodeFromPath("task")
+	if review := task.Events["review"]; review.Status != core.EventFinished || review.EndTime == nil || !review.EndTime.Equal(now.Add(-time.Hour)) {
+		logger.Failure("Auto-finishing event not finished at its planned end: %+v", review)
+		t.Errorf("Auto-finishing event not finished at its planned end: %+v", review)
+	}
+	if standup := task.Events["standup"]; standup.Status != core.EventOngoing || standup.EndTime != nil ||
+		standup.StartTime == nil || !standup.StartTime.Equal(now.Add(-30*time.Minute)) || standup.PlannedEnd == nil {
+		logger.Failure("Due event not started at its scheduled time: %+v", standup)
+		t.Errorf("Due event not started at its scheduled time: %+v", standup)
+	}
+	if _, planned := task.PlannedEvents["retro"]; !planned || len(task.PlannedEvents) != 1 {
+		logger.Failure("Expected only the future event to stay planned, got %v", task.PlannedEvents)
+		t.Errorf("Expected only the future event to stay planned, got %v", task.PlannedEvents)
+	}
+
+	var activity []string
+	for _, entry := range task.Entries {
+		if entry.UserID == core.SchedulerUserID {
+			activity = append(activity, entry.Content.(string)+" "+entry.Metadata["event_id"].(string))
+		}
+	}
+	if want := []string{"event_started review", "event_started standup", "event_finished review"}; !reflect.DeepEqual(activity, want) {
+		logger.Failure("Activity entries %v, want %v", activity, want)
+		t.Errorf("Activity entries %v, want %v", activity, want)
+	} else {
+		logger.Success("Missed transitions caught up")
+	}
+	logger.Exit("Catch Up")
+
+	logger.Enter("Auto Finish")
+	if transitions, _ := loaded.runSchedule(now); transitions != 0 {
+		t.Errorf("Expected no transitions on a second run, got %d", transitions)
+	}
+	loaded.config.Process.AutoFinishEvents = true
+	if transitions, _ := loaded.runSchedule(now); transitions != 1 {
+		t.Errorf("Expected the configured auto-finish to finish 1 event, got %d", transitions)
+	}
+	reloaded, err := loadTestServer(t, config)
+	if err != nil {
+		t.Fatalf("Failed to reload server: %v", err)
+	}
+	task, _ = reloaded.getNodeFromPath("task")
+	if standup := task.Events["standup"]; standup.Status != core.EventFinished {
+		logger.Failure("Finished event not persisted: %+v", standup)
+		t.Errorf("Finished event not persisted: %+v", standup)
+	} else {
+		logger.Success("Events finished at their planned end")
+	}
+	logger.Exit("Auto Finish")
+
+	logger.Enter("Concurrent Changes")
+	// Ticks walk the tree while handlers add and remove nodes
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			reloaded.runSchedule(time.Now())
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		child, err := reloaded.forest.CreateChild(core.LeafNode, "scratch-"+strconv.Itoa(i), adminID)
+		if err == nil {
+			reloaded.forest.RemoveChild(child.ID)
+		}
+	}
+	<-done
+	logger.Exit("Concurrent Changes")
+}
+
+func TestVarianceReport(t *testing.T) {
+	logger.Enter("VarianceReport")
+	defer logger.Exit("VarianceReport")
+
+	app := setupTestForest(t)
+	node, _ := app.getNodeFromPath("test-node")
+	other, err := app.forest.CreateChild(core.LeafNode, "other", "admin")
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	plan := func(target *core.Node, eventID string, start, end time.Time, metadata map[string]interface{}) {
+		if err := target.PlanEvent(eventID, "admin", &start, &end, metadata); err != nil {
+			t.Fatalf("Failed to plan %s: %v", eventID, err)
+		}
+	}
+	plan(node, "kickoff", now.Add(-3*time.Hour), now.Add(-2*time.Hour), map[string]interface{}{"room": "a"})
+	plan(node, "review", now.Add(-2*time.Hour), now.Add(-time.Hour), map[string]interface{}{"auto_finish": true})
+	plan(node, "retro", now.Add(time.Hour), now.Add(2*time.Hour), map[string]interface{}{})
+
+	// Started late by hand in another room, then run by the scheduler on time
+	if err := node.StartEvent("kickoff", "admin", nil, nil, map[string]interface{}{"room": "b"}); err != nil {
+		t.Fatalf("Failed to start planned event: %v", err)
+	}
+	if err := node.EndEvent("kickoff", "admin"); err != nil {
+		t.Fatalf("Failed to end event: %v", err)
+	}
+	if _, err := app.runSchedule(now); err != nil {
+		t.Fatalf("Failed to run schedule: %v", err)
+	}
+	plan(other, "sync", now.Add(-30*time.Minute), now.Add(30*time.Minute), map[string]interface{}{})
+
+	report := func(userID string, query url.Values) (*httptest.ResponseRecorder, core.VarianceReport) {
+		rr := httptest.NewRecorder()
+		app.handleGetVarianceReport(rr, withUser(httptest.NewRequest("GET", "/reports/variance?"+query.Encode(), nil), userID))
+		var result core.VarianceReport
+		json.NewDecoder(rr.Body).Decode(&result)
+		return rr, result
+	}
+
+	logger.Enter("Subtree")
+	rr, result := report("admin", url.Values{"path": {""}, "to": {now.Add(time.Minute).Format(time.RFC3339)}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var paths []string
+	for _, nodeVariance := range result.Nodes {
+		paths = append(paths, nodeVariance.Path)
+	}
+	if !reflect.DeepEqual(paths, []string{"other", "test-node"}) {
+		logger.Failure("Expected nodes other and test-node, got %v", paths)
+		t.Errorf("Expected nodes other and test-node, got %v", paths)
+	}
+	if summary := result.Summary; summary.Planned != 3 || summary.Started != 2 || summary.Missed != 1 || summary.StatusMismatches != 1 || summary.MetadataMismatches != 1 {
+		logger.Failure("Unexpected subtree summary: %+v", summary)
+		t.Errorf("Unexpected subtree summary: %+v", summary)
+	} else {
+		logger.Success("Subtree aggregated")
+	}
+	logger.Exit("Subtree")
+
+	logger.Enter("Events")
+	_, result = report("admin", url.Values{"path": {"test-node"}})
+	if len(result.Nodes) != 1 || len(result.Nodes[0].Events) != 2 {
+		t.Fatalf("Expected the two due plans of test-node, got %+v", result.Nodes)
+	}
+	kickoff, review := result.Nodes[0].Events[0], result.Nodes[0].Events[1]
+	if kickoff.PlannedEventID != "kickoff" || kickoff.StartSlip == nil || *kickoff.StartSlip < int64((3*time.Hour).Seconds()) ||
+		kickoff.DurationDelta == nil || *kickoff.DurationDelta >= 0 {
+		logger.Failure("Late start not reported: %+v", kickoff)
+		t.Errorf("Late start not reported: %+v", kickoff)
+	}
+	if len(kickoff.MetadataDiff) != 1 || kickoff.MetadataDiff[0].Key != "room" || kickoff.MetadataDiff[0].Actual != "b" {
+		logger.Failure("Metadata change not reported: %+v", kickoff.MetadataDiff)
+		t.Errorf("Metadata change not reported: %+v", kickoff.MetadataDiff)
+	}
+	if review.StartSlip == nil || *review.StartSlip != 0 || review.EndSlip == nil || *review.EndSlip != 0 || review.StatusMismatch {
+		logger.Failure("Scheduled event drifted: %+v", review)
+		t.Errorf("Scheduled event drifted: %+v", review)
+	} else {
+		logger.Success("Event variance reported")
+	}
+	logger.Exit("Events")
+
+	logger.Enter("Permissions")
+	if rr, _ := report("nobody", url.Values{"path": {"test-node"}}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a user without access, got %d", rr.Code)
+	}
+	if rr, _ := report("admin", url.Values{"path": {""}, "from": {"yesterday"}}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad from time, got %d", rr.Code)
+	}
+	logger.Exit("Permissions")
+}
+
+func TestTimeSessions(t *testing.T) {
+	logger.Enter("TimeSessions")
+	defer logger.Exit("TimeSessions")
+
+	app := setupTestForest(t)
+	node, _ := app.getNodeFromPath("test-node")
+	other, err := app.forest.CreateChild(core.LeafNode, "other", "admin")
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	app.forest.AssignUser("worker", core.WritePermission)
+
+	logger.Enter("One Timer Per User")
+	rr := call(app.handleStartTimeTracking, "admin", "POST", "/time/start", nil, map[string]interface{}{"path": "test-node", "note": "design", "billable": true})
+	var started struct {
+		Session core.TimeSession   `json:"session"`
+		Stopped []core.TimeSession `json:"stopped"`
+	}
+	json.NewDecoder(rr.Body).Decode(&started)
+	if rr.Code != http.StatusOK || !started.Session.Running() || started.Session.NodeID != node.ID || !started.Session.Billable {
+		t.Fatalf("Failed to start timer: %d %+v", rr.Code, started)
+	}
+	first := started.Session.ID
+
+	if rr := call(app.handleStartTimeTracking, "admin", "POST", "/time/start", nil, map[string]interface{}{"path": "test-node"}); rr.Code != http.StatusConflict {
+		logger.Failure("Expected 409 starting a running timer again, got %d", rr.Code)
+		t.Errorf("Expected 409 starting a running timer again, got %d", rr.Code)
+	}
+
+	rr = call(app.handleStartTimeTracking, "admin", "POST", "/time/start", nil, map[string]interface{}{"path": "other"})
+	json.NewDecoder(rr.Body).Decode(&started)
+	if rr.Code != http.StatusOK || len(started.Stopped) != 1 || started.Stopped[0].ID != first {
+		logger.Failure("Starting elsewhere did not stop the running timer: %d %+v", rr.Code, started)
+		t.Errorf("Starting elsewhere did not stop the running timer: %d %+v", rr.Code, started)
+	}
+	if _, running := node.RunningTimer("admin"); running {
+		t.Error("Timer still running on the first node")
+	}
+	var running core.TimeSession
+	rr = call(app.handleGetRunningTimer, "admin", "GET", "/time/running", nil, nil)
+	json.NewDecoder(rr.Body).Decode(&running)
+	if running.NodeID != other.ID {
+		logger.Failure("Expected the running timer on other, got %+v", running)
+		t.Errorf("Expected the running timer on other, got %+v", running)
+	} else {
+		logger.Success("Starting elsewhere stopped the running timer")
+	}
+
+	if rr := call(app.handleStopTimeTracking, "admin", "POST", "/time/stop", nil, nil); rr.Code != http.StatusOK {
+		t.Errorf("Failed to stop timer: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(app.handleStopTimeTracking, "admin", "POST", "/time/stop", nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 stopping without a running timer, got %d", rr.Code)
+	}
+	if rr := call(app.handleGetRunningTimer, "admin", "GET", "/time/running", nil, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected no running timer, got %d", rr.Code)
+	}
+	if rr := call(app.handleStartTimeTracking, "worker", "POST", "/time/start", nil, map[string]interface{}{"path": "other"}); rr.Code != http.StatusOK {
+		t.Fatalf("Failed to start timer: %d %s", rr.Code, rr.Body.String())
+	}
+	app.forest.AssignUser("worker", core.ReadPermission)
+	if rr := call(app.handleStopTimeTracking, "worker", "POST", "/time/stop", nil, nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected a reader to stop their own timer, got %d %s", rr.Code, rr.Body.String())
+	} else {
+		logger.Success("Timer stopped after access was lowered to read")
+	}
+	app.forest.AssignUser("worker", core.WritePermission)
+	logger.Exit("One Timer Per User")
+
+	logger.Enter("Edit Sessions")
+	session, _ := node.GetTimeSession(first)
+	start := session.Stop.Add(-2 * time.Hour)
+	if rr := call(app.handleUpdateTimeSession, "worker", "PATCH", "/time/sessions/"+first, map[string]string{"id": first}, map[string]interface{}{"start": start}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 editing another user's session, got %d", rr.Code)
+	}
+	if rr := call(app.handleUpdateTimeSession, "admin", "PATCH", "/time/sessions/"+first, map[string]string{"id": first}, map[string]interface{}{"stop": start}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a session ending before it starts, got %d", rr.Code)
+	}
+	if rr := call(app.handleUpdateTimeSession, "admin", "PATCH", "/time/sessions/"+first, map[string]string{"id": first}, map[string]interface{}{"start": start, "note": "review"}); rr.Code != http.StatusOK {
+		t.Errorf("Failed to edit session: %d %s", rr.Code, rr.Body.String())
+	}
+
+	var summary core.TimeSummary
+	rr = call(app.handleGetTimeTracking, "admin", "GET", "/time?path=test-node", nil, nil)
+	json.NewDecoder(rr.Body).Decode(&summary)
+	if len(summary.Sessions) != 1 || summary.Sessions[0].Note != "review" || summary.TotalSeconds != 7200 || summary.BillableSeconds != 7200 {
+		logger.Failure("Unexpected summary after edit: %+v", summary)
+		t.Errorf("Unexpected summary after edit: %+v", summary)
+	} else {
+		logger.Success("Edited session summarised")
+	}
+	if rr := call(app.handleGetTimeTracking, "worker", "GET", "/time?path=test-node&user=admin", nil, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 reading another user's time without admin, got %d", rr.Code)
+	}
+	logger.Exit("Edit Sessions")
+
+	logger.Enter("Migration")
+	config := testConfig(t, "time_state")
+	legacy := newTestServer(t, config)
+	adminID := legacy.forest.Grants[0].UserID
+	task, _ := legacy.forest.CreateChild(core.LeafNode, "task", adminID)
+	clockIn := time.Now().Add(-time.Hour).Truncate(time.Second)
+	task.Entries = append(task.Entries,
+		core.Entry{Content: "start_time_entry", UserID: adminID, Timestamp: clockIn},
+		core.Entry{Content: "comment", UserID: adminID, Timestamp: clockIn.Add(time.Minute)},
+		core.Entry{Content: "stop_time_entry", UserID: adminID, Timestamp: clockIn.Add(time.Hour)},
+	)
+	if err := legacy.persist(task, legacy.forest); err != nil {
+		t.Fatalf("Failed to persist nodes: %v", err)
+	}
+	loaded, err := loadTestServer(t, config)
+	if err != nil {
+		t.Fatalf("Failed to load server: %v", err)
+	}
+	task, _ = loaded.getNodeFromPath("task")
+	if summary := task.GetTimeTrackingSummary(adminID, time.Time{}, time.Time{}); len(summary.Sessions) != 1 || summary.TotalSeconds != 3600 || len(task.Entries) != 1 {
+		logger.Failure("Legacy entries not migrated: %+v, entries %v", summary, task.Entries)
+		t.Errorf("Legacy entries not migrated: %+v, entries %v", summary, task.Entries)
+	} else {
+		logger.Success("Legacy entries migrated into sessions")
+	}
+	logger.Exit("Migration")
+}
+
+func TestTimesheetRollup(t *testing.T) {
+	logger.Enter("TimesheetRollup")
+	defer logger.Exit("TimesheetRollup")
+
+	config := testConfig(t, "rollup_state")
+	app := newTestServer(t, config)
+	adminID := app.forest.Grants[0].UserID
+
+	// work/team-a/shared is also linked under work/team-b
+	work, _ := app.forest.CreateChild(core.BranchNode, "work", adminID)
+	teamA, _ := work.CreateChild(core.BranchNode, "team-a", adminID)
+	teamB, _ := work.CreateChild(core.BranchNode, "team-b", adminID)
+	shared, _ := teamA.CreateChild(core.LeafNode, "shared", adminID)
+	solo, _ := teamB.CreateChild(core.LeafNode, "solo", adminID)
+	if err := app.forest.MoveNode(shared.ID, teamA.ID, teamB, true); err != nil {
+		t.Fatalf("Failed to link node: %v", err)
+	}
+
+	at := func(day, hour int) *time.Time {
+		moment := time.Date(2024, time.January, day, hour, 0, 0, 0, time.UTC)
+		return &moment
+	}
+	shared.TimeSessions = map[string]core.TimeSession{
+		"s1": {ID: "s1", UserID: adminID, NodeID: shared.ID, Start: *at(1, 9), Stop: at(1, 11), Billable: true},
+	}
+	solo.TimeSessions = map[string]core.TimeSession{
+		"s2": {ID: "s2", UserID: "worker", NodeID: solo.ID, Start: *at(2, 9), Stop: at(2, 10)},
+		"s3": {ID: "s3", UserID: "worker", NodeID: solo.ID, Start: *at(2, 23), Stop: at(3, 1)},
+	}
+	solo.Events["deploy"] = core.Event{StartTime: at(2, 14), EndTime: at(2, 15), Status: core.EventFinished, Category: "ops", CreatedBy: adminID}
+	if err := app.persist(app.forest, work, teamA, teamB, shared, solo); err != nil {
+		t.Fatalf("Failed to persist nodes: %v", err)
+	}
+
+	get := func(query url.Values, userID string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		app.handleGetTimesheet(rr, withUser(httptest.NewRequest("GET", "/reports/timesheet?"+query.Encode(), nil), userID))
+		return rr
+	}
+	find := func(rows []core.RollupRow, path, user, period string) core.RollupRow {
+		for _, row := range rows {
+			if row.Path == path && row.User == user && row.Period == period {
+				return row
+			}
+		}
+		return core.RollupRow{}
+	}
+
+	logger.Enter("Shared Nodes")
+	var report core.RollupReport
+	json.NewDecoder(get(url.Values{"path": {"work"}}, adminID).Body).Decode(&report)
+	if row := find(report.Rows, "work", "", ""); row.TrackedSeconds != 5*3600 || row.EventSeconds != 3600 || row.Sessions != 3 || row.Events != 1 {
+		logger.Failure("Shared node counted more than once: %+v", row)
+		t.Errorf("Shared node counted more than once: %+v", row)
+	}
+	if row := find(report.Rows, "work/team-b", "", ""); row.TrackedSeconds != 5*3600 {
+		t.Errorf("Expected team-b to include the shared node, got %+v", row)
+	}
+	json.NewDecoder(get(url.Values{"path": {"work"}, "per_path": {"true"}}, adminID).Body).Decode(&report)
+	if row := find(report.Rows, "work", "", ""); row.TrackedSeconds != 7*3600 || row.BillableSeconds != 4*3600 {
+		logger.Failure("Shared node not counted per path: %+v", row)
+		t.Errorf("Shared node not counted per path: %+v", row)
+	} else {
+		logger.Success("Shared nodes counted once unless asked per path")
+	}
+	logger.Exit("Shared Nodes")
+
+	logger.Enter("Groups")
+	json.NewDecoder(get(url.Values{"path": {"work"}, "group_by": {"user,day"}}, adminID).Body).Decode(&report)
+	if row := find(report.Rows, "work/team-b/solo", "worker", "2024-01-02"); row.TrackedSeconds != 2*3600 {
+		logger.Failure("Session crossing midnight not split by day: %+v", row)
+		t.Errorf("Session crossing midnight not split by day: %+v", row)
+	}
+	if row := find(report.Rows, "work/team-b/solo", "worker", "2024-01-03"); row.TrackedSeconds != 3600 || row.Sessions != 0 {
+		t.Errorf("Expected the rest of the session on the next day, got %+v", row)
+	}
+	if row := find(report.Rows, "work", adminID, "2024-01-01"); row.Username != "admin" || row.TrackedSeconds != 2*3600 {
+		t.Errorf("Expected the admin's time with their username, got %+v", row)
+	}
+	json.NewDecoder(get(url.Values{"path": {"work"}, "group_by": {"category,month"}}, adminID).Body).Decode(&report)
+	for _, row := range report.Rows {
+		if row.Path == "work" && row.Category == "ops" && (row.Period != "2024-01-01" || row.EventSeconds != 3600) {
+			t.Errorf("Unexpected category row: %+v", row)
+		}
+	}
+	if rr := get(url.Values{"group_by": {"day,week"}}, adminID); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 grouping by two periods, got %d", rr.Code)
+	}
+	logger.Exit("Groups")
+
+	logger.Enter("CSV")
+	rr := get(url.Values{"path": {"work/team-a"}, "format": {"csv"}}, adminID)
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if rr.Header().Get("Content-Type") != "text/csv" || len(lines) != 3 || !strings.HasPrefix(lines[0], "path,node_id,user") ||
+		!strings.HasPrefix(lines[1], "work/team-a,"+teamA.ID) {
+		logger.Failure("Unexpected CSV: %s", rr.Body.String())
+		t.Errorf("Unexpected CSV: %s", rr.Body.String())
+	} else {
+		logger.Success("CSV written")
+	}
+	if rr := get(url.Values{"path": {"work"}}, "nobody"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a user without access, got %d", rr.Code)
+	}
+	logger.Exit("CSV")
+
+	logger.Enter("Offline")
+	forest, err := LoadForest(config)
+	if err != nil {
+		t.Fatalf("Failed to load forest: %v", err)
+	}
+	if row := find(forest.Rollup("", core.RollupOptions{}).Rows, "work", "", ""); row.TrackedSeconds != 5*3600 {
+		logger.Failure("Offline rollup differs: %+v", row)
+		t.Errorf("Offline rollup differs: %+v", row)
+	} else {
+		logger.Success("Rolled up from the database files")
+	}
+	logger.Exit("Offline")
+}
+
+func TestSearch(t *testing.T) {
+	logger.Enter("Search")
+	defer logger.Exit("Search")
+
+	app := newTestServer(t, testConfig(t, "search_state"))
+	adminID := app.forest.Grants[0].UserID
+
+	work, _ := app.forest.CreateChild(core.BranchNode, "work", adminID)
+	alpha, _ := work.CreateChild(core.LeafNode, "alpha", adminID)
+	home, _ := app.forest.CreateChild(core.LeafNode, "home", adminID)
+
+	at := time.Date(2024, time.January, 15, 10, 0, 0, 0, time.UTC)
+	alpha.Entries = append(alpha.Entries, core.Entry{
+		Content:     "Deploy to staging went fine",
+		Metadata:    map[string]interface{}{"ticket": "OPS-17"},
+		UserID:      adminID,
+		Timestamp:   at,
+		Attachments: []core.Attachment{{ID: "att-1", Name: "rollout-plan.pdf", UploadedBy: adminID, UploadedAt: at}},
+	})
+	alpha.Events["release-42"] = core.Event{
+		StartTime: &at,
+		Status:    core.EventOngoing,
+		Category:  "release",
+		Metadata:  map[string]interface{}{"target": "staging"},
+		Entries:   []core.Entry{{Content: map[string]interface{}{"note": "staging smoke tests passed"}, UserID: "worker", Timestamp: at.Add(time.Hour)}},
+		CreatedBy: adminID,
+	}
+	home.Entries = append(home.Entries, core.Entry{Content: "Repaint the staging area of the garage", UserID: adminID, Timestamp: at.AddDate(0, 1, 0)})
+	if err := app.persist(app.forest, work, alpha, home); err != nil {
+		t.Fatalf("Failed to persist nodes: %v", err)
+	}
+
+	search := func(query url.Values, userID string) (*httptest.ResponseRecorder, []core.SearchHit) {
+		rr := httptest.NewRecorder()
+		app.handleSearch(rr, withUser(httptest.NewRequest("GET", "/search?"+query.Encode(), nil), userID))
+		var result struct {
+			Hits []core.SearchHit `json:"hits"`
+		}
+		json.NewDecoder(rr.Body).Decode(&result)
+		return rr, result.Hits
+	}
+
+	logger.Enter("Matching")
+	if _, hits := search(url.Values{"q": {"staging"}}, adminID); len(hits) != 4 {
+		logger.Failure("Expected 4 hits for staging, got %d", len(hits))
+		t.Errorf("Expected 4 hits for staging, got %+v", hits)
+	}
+	if _, hits := search(url.Values{"q": {"deploy stag"}}, adminID); len(hits) != 1 || hits[0].Path != "work/alpha" || hits[0].Kind != core.SearchEntry {
+		t.Errorf("Expected the entry on work/alpha for a prefix search, got %+v", hits)
+	}
+	if _, hits := search(url.Values{"q": {"ops-17"}}, adminID); len(hits) != 1 {
+		t.Errorf("Expected entry metadata to be searched, got %+v", hits)
+	}
+	if _, hits := search(url.Values{"q": {"rollout"}}, adminID); len(hits) != 1 || hits[0].Kind != core.SearchAttachment || hits[0].AttachmentID != "att-1" {
+		t.Errorf("Expected the attachment to be found by name, got %+v", hits)
+	} else {
+		logger.Success("Entries, metadata and attachments are searched")
+	}
+	logger.Exit("Matching")
+
+	logger.Enter("Filters")
+	if _, hits := search(url.Values{"q": {"staging"}, "path": {"work"}}, adminID); len(hits) != 3 {
+		t.Errorf("Expected 3 hits under work, got %+v", hits)
+	}
+	if _, hits := search(url.Values{"q": {"staging"}, "category": {"release"}}, adminID); len(hits) != 2 {
+		t.Errorf("Expected the release event and its entry, got %+v", hits)
+	}
+	if _, hits := search(url.Values{"q": {"staging"}, "user": {"worker"}}, adminID); len(hits) != 1 || hits[0].EventID != "release-42" || hits[0].EntryIndex == nil {
+		t.Errorf("Expected the event entry written by worker, got %+v", hits)
+	}
+	if _, hits := search(url.Values{"q": {"staging"}, "from": {"2024-02-01T00:00:00Z"}}, adminID); len(hits) != 1 || hits[0].Path != "home" {
+		t.Errorf("Expected only the home entry from February, got %+v", hits)
+	}
+	if _, hits := search(url.Values{"q": {"staging"}}, "outsider"); len(hits) != 0 {
+		logger.Failure("Hits returned on unreadable nodes")
+		t.Errorf("Expected no hits for a user without access, got %+v", hits)
+	} else {
+		logger.Success("Filters and permissions applied")
+	}
+	if rr, _ := search(url.Values{"q": {" "}}, adminID); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a query, got %d", rr.Code)
+	}
+	logger.Exit("Filters")
+
+	logger.Enter("Updates")
+	alpha.Rename("beta", adminID)
+	alpha.Entries = append(alpha.Entries, core.Entry{Content: "Rollback rehearsal", UserID: adminID, Timestamp: at})
+	if err := app.persist(alpha); err != nil {
+		t.Fatalf("Failed to persist node: %v", err)
+	}
+	if _, hits := search(url.Values{"q": {"rehearsal"}}, adminID); len(hits) != 1 || hits[0].Path != "work/beta" {
+		t.Errorf("Expected the new entry under the new name, got %+v", hits)
+	}
+	if _, hits := search(url.Values{"q": {"alpha"}}, adminID); len(hits) != 0 {
+		t.Errorf("Expected the old name to be gone, got %+v", hits)
+	}
+
+	removed, updated, err := app.forest.DeleteNode(work.ID, true)
+	if err != nil {
+		t.Fatalf("Failed to delete node: %v", err)
+	}
+	if err := app.persistDelete(removed, updated...); err != nil {
+		t.Fatalf("Failed to persist deletion: %v", err)
+	}
+	if _, hits := search(url.Values{"q": {"staging"}}, adminID); len(hits) != 1 || hits[0].Path != "home" {
+		logger.Failure("Deleted nodes still searchable")
+		t.Errorf("Expected only the home entry after deleting work, got %+v", hits)
+	} else {
+		logger.Success("Index follows renames and deletions")
+	}
+	logger.Exit("Updates")
+}
+
+func TestQueryListings(t *testing.T) {
+	logger.Enter("QueryListings")
+	defer logger.Exit("QueryListings")
+
+	app := newTestServer(t, testConfig(t, "query_state"))
+	adminID := app.forest.Grants[0].UserID
+
+	work, _ := app.forest.CreateChild(core.BranchNode, "work", adminID)
+	alpha, _ := work.CreateChild(core.LeafNode, "alpha", adminID)
+	beta, _ := work.CreateChild(core.LeafNode, "beta", adminID)
+
+	at := func(hour int) *time.Time {
+		moment := time.Date(2024, time.March, 4, hour, 0, 0, 0, time.UTC)
+		return &moment
+	}
+	entries := make([]core.Entry, 7)
+	for i := range entries {
+		entries[i] = core.Entry{
+			Content:   "entry " + strconv.Itoa(i),
+			Metadata:  map[string]interface{}{"kind": "note"},
+			UserID:    adminID,
+			Timestamp: *at(i),
+		}
+	}
+	entries[2].Metadata["kind"] = "todo"
+	entries[5].UserID = "worker"
+	alpha.Events["build"] = core.Event{StartTime: at(1), Status: core.EventOngoing, Category: "ops", Entries: entries, CreatedBy: adminID,
+		Metadata: map[string]interface{}{"priority": 2}}
+	alpha.Events["review"] = core.Event{StartTime: at(2), EndTime: at(3), Status: core.EventFinished, Category: "dev", CreatedBy: adminID}
+	alpha.PlannedEvents["release"] = core.Event{StartTime: at(20), Status: core.EventPending, Category: "ops", CreatedBy: adminID}
+	alpha.Attachments = map[string]core.Attachment{"att-1": {ID: "att-1", Name: "notes.txt", Data: []byte("secret bytes")}}
+
+	type page struct {
+		Items      []map[string]interface{} `json:"items"`
+		Total      int                      `json:"total"`
+		NextCursor string                   `json:"next_cursor"`
+	}
+	list := func(handler http.HandlerFunc, target string, vars map[string]string) (*httptest.ResponseRecorder, page) {
+		rr := httptest.NewRecorder()
+		req := withUser(httptest.NewRequest("GET", target, nil), adminID)
+		if vars != nil {
+			req = mux.SetURLVars(req, vars)
+		}
+		handler(rr, req)
+		var result page
+		json.NewDecoder(rr.Body).Decode(&result)
+		return rr, result
+	}
+
+	logger.Enter("Events")
+	if _, result := list(app.handleListEvents, "/events?path=work/alpha&category=ops&sort=-time", nil); result.Total != 2 || len(result.Items) != 2 || result.Items[0]["id"] != "release" || result.Items[0]["planned"] != true {
+		t.Errorf("Expected the planned release first among ops events, got %+v", result)
+	}
+	if _, result := list(app.handleListEvents, "/events?path=work/alpha&status=finished&fields=category", nil); len(result.Items) != 1 || len(result.Items[0]) != 2 || result.Items[0]["category"] != "dev" {
+		t.Errorf("Expected the finished event projected to its ID and category, got %+v", result)
+	}
+	if _, result := list(app.handleListEvents, "/events?path=work/alpha&meta.priority=2", nil); len(result.Items) != 1 || result.Items[0]["entries"] != nil || result.Items[0]["entries_count"] != float64(7) {
+		logger.Failure("Metadata filter or entry count wrong: %+v", result)
+		t.Errorf("Expected the build event with its entries counted, got %+v", result)
+	} else {
+		logger.Success("Events filtered, sorted and projected")
+	}
+	if rr, _ := list(app.handleListEvents, "/events?path=work/alpha&sort=colour", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown sort, got %d", rr.Code)
+	}
+	logger.Exit("Events")
+
+	logger.Enter("Pagination")
+	var indexes []float64
+	target := "/events/build/entries?path=work/alpha&limit=3"
+	for pages := 0; pages < 5; pages++ {
+		_, result := list(app.handleListEventEntries, target, map[string]string{"eventId": "build"})
+		for _, item := range result.Items {
+			indexes = append(indexes, item["index"].(float64))
+		}
+		if result.NextCursor == "" {
+			break
+		}
+		target = "/events/build/entries?path=work/alpha&limit=3&cursor=" + url.QueryEscape(result.NextCursor)
+	}
+	if len(indexes) != 7 || indexes[0] != 0 || indexes[6] != 6 {
+		logger.Failure("Cursor pagination skipped or repeated entries: %v", indexes)
+		t.Errorf("Expected entries 0 to 6 over three pages, got %v", indexes)
+	} else {
+		logger.Success("Entries paged with cursors")
+	}
+	if _, result := list(app.handleListEventEntries, "/events/build/entries?path=work/alpha&meta.kind=note&user=admin&from=2024-03-04T01:00:00Z", map[string]string{"eventId": "build"}); result.Total != 4 {
+		t.Errorf("Expected 4 notes by admin from 01:00, got %+v", result)
+	}
+	if rr, _ := list(app.handleListEventEntries, "/events/missing/entries?path=work/alpha", map[string]string{"eventId": "missing"}); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing event, got %d", rr.Code)
+	}
+	_, first := list(app.handleListEventEntries, "/events/build/entries?path=work/alpha&limit=1", map[string]string{"eventId": "build"})
+	if rr, _ := list(app.handleListEventEntries, "/events/build/entries?path=work/alpha&sort=-time&cursor="+url.QueryEscape(first.NextCursor), map[string]string{"eventId": "build"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a cursor from another sort, got %d", rr.Code)
+	}
+
+	rr := httptest.NewRecorder()
+	body, _ := json.Marshal(map[string]string{"path": "work/alpha", "event_id": "build"})
+	app.handleGetEventEntries(rr, withUser(httptest.NewRequest("POST", "/events?limit=5", bytes.NewBuffer(body)), adminID))
+	var legacy []map[string]interface{}
+	json.NewDecoder(rr.Body).Decode(&legacy)
+	if len(legacy) != 5 || rr.Header().Get("X-Total-Count") != "7" || rr.Header().Get("X-Next-Cursor") == "" {
+		t.Errorf("Expected a plain list of 5 entries with paging headers, got %d entries and %v", len(legacy), rr.Header())
+	}
+	logger.Exit("Pagination")
+
+	logger.Enter("Nodes")
+	_, result := list(app.handleListNodes, "/nodes?path=work&fields=path", nil)
+	if result.Total != 3 || result.Items[0]["path"] != "work" || result.Items[1]["path"] != "work/alpha" || result.Items[2]["path"] != "work/beta" {
+		t.Errorf("Expected work and its children by name, got %+v", result)
+	}
+	if _, result := list(app.handleListNodes, "/nodes?path=work&sort=-path&limit=1", nil); len(result.Items) != 1 || result.Items[0]["id"] != beta.ID || result.Items[0]["entries"] != nil {
+		t.Errorf("Expected beta first in descending order, without contents, got %+v", result)
+	}
+
+	rr = httptest.NewRecorder()
+	app.handleGetTree(rr, withUser(httptest.NewRequest("GET", "/forest/tree?path=work/alpha", nil), adminID))
+	if strings.Contains(rr.Body.String(), "c2VjcmV0IGJ5dGVz") || !strings.Contains(rr.Body.String(), "notes.txt") {
+		logger.Failure("Attachment contents sent with the tree")
+		t.Error("Expected the tree to list attachments without their contents")
+	} else {
+		logger.Success("Nodes listed without their contents")
+	}
+	if attachment, _ := alpha.GetAttachment("att-1"); string(attachment.Data) != "secret bytes" {
+		t.Error("Filtering the tree stripped the stored attachment")
+	}
+	logger.Exit("Nodes")
+}
+
+func TestChangeFeed(t *testing.T) {
+	logger.Enter("ChangeFeed")
+	defer logger.Exit("ChangeFeed")
+
+	app := newTestServer(t, testConfig(t, "changes_state"))
+	defer app.changes.Close()
+	adminID := app.forest.Grants[0].UserID
+	work, _ := app.forest.CreateChild(core.BranchNode, "work", adminID)
+	app.forest.CreateChild(core.BranchNode, "home", adminID)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/changes", func(w http.ResponseWriter, r *http.Request) {
+		app.handleChangeStream(w, withUser(r, adminID))
+	})
+	router.HandleFunc("/changes/ws", func(w http.ResponseWriter, r *http.Request) {
+		app.handleChangeSocket(w, withUser(r, adminID))
+	})
+	stream := httptest.NewServer(router)
+	defer stream.Close()
+
+	// readEvent returns the next event of an SSE stream as its id, type and data
+	readEvent := func(reader *bufio.Reader) (string, string, Change) {
+		var id, event string
+		var change Change
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Stream ended early: %v", err)
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case line == "" && event != "":
+				return id, event, change
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &change)
+			}
+		}
+	}
+
+	logger.Enter("Server-Sent Events")
+	resp, err := http.Get(stream.URL + "/changes?path=work")
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+
+	call(app.handleCreateNode, adminID, "POST", "/", nil, map[string]string{"path": "home", "name": "garden", "type": "leaf"})
+	if code := call(app.handleCreateNode, adminID, "POST", "/", nil, map[string]string{"path": "work", "name": "alpha", "type": "leaf"}).Code; code != http.StatusCreated {
+		t.Fatalf("Failed to create node: %d", code)
+	}
+	call(app.handleStartEvent, adminID, "POST", "/", nil, map[string]string{"path": "work/alpha", "event_id": "build"})
+
+	id, event, change := readEvent(reader)
+	if event != ChangeNodeCreated || change.Path != "work/alpha" || id != "2" || change.UserID != adminID {
+		logger.Failure("Unexpected first change %s %s %+v", id, event, change)
+		t.Errorf("Expected node.created for work/alpha as change 2, got %s %s %+v", id, event, change)
+	}
+	if _, event, change = readEvent(reader); event != ChangeEventStarted || change.Data["event_id"] != "build" {
+		t.Errorf("Expected event.started for build, got %s %+v", event, change)
+	} else {
+		logger.Success("Changes below the subtree streamed in order")
+	}
+	logger.Exit("Server-Sent Events")
+
+	logger.Enter("Resume")
+	req, _ := http.NewRequest("GET", stream.URL+"/changes", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to resume stream: %v", err)
+	}
+	resumedReader := bufio.NewReader(resumed.Body)
+	if id, event, _ := readEvent(resumedReader); id != "2" || event != ChangeNodeCreated {
+		t.Errorf("Expected to resume at change 2, got %s %s", id, event)
+	}
+	if id, _, _ := readEvent(resumedReader); id != "3" {
+		t.Errorf("Expected change 3 next, got %s", id)
+	} else {
+		logger.Success("Stream resumed from Last-Event-ID")
+	}
+	resumed.Body.Close()
+
+	outsider, _, _ := app.changes.Subscribe(nil, "outsider", 0, true)
+	defer outsider.Close()
+	app.publish(ChangeNodeCreated, work, adminID, nil)
+	select {
+	case change := <-outsider.Changes:
+		t.Errorf("Change on an unreadable node delivered: %+v", change)
+	default:
+	}
+
+	feed := NewChangeFeed()
+	for i := 0; i < changeHistory+5; i++ {
+		feed.Publish(Change{Type: ChangeEntryAppended, NodeID: work.ID, node: work})
+	}
+	if _, backlog, complete := feed.Subscribe(nil, adminID, 2, true); complete || len(backlog) != changeHistory {
+		logger.Failure("Expected an incomplete backlog")
+		t.Errorf("Expected an incomplete backlog of %d changes, got %d (complete %v)", changeHistory, len(backlog), complete)
+	}
+	if _, backlog, complete := feed.Subscribe(nil, adminID, 0, false); !complete || len(backlog) != 0 {
+		t.Errorf("Expected no backlog without a sequence number, got %d", len(backlog))
+	} else {
+		logger.Success("Resumes beyond the history are reported")
+	}
+	logger.Exit("Resume")
+
+	logger.Enter("WebSocket")
+	conn, err := net.Dial("tcp", strings.TrimPrefix(stream.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /changes/ws?path=work HTTP/1.1\r\nHost: lumberjack\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	wsReader := bufio.NewReader(conn)
+	handshake, err := http.ReadResponse(wsReader, nil)
+	if err != nil || handshake.StatusCode != http.StatusSwitchingProtocols || handshake.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("WebSocket handshake failed: %v %+v", err, handshake)
+	}
+
+	call(app.handleEndEvent, adminID, "POST", "/", nil, map[string]string{"path": "work/alpha", "event_id": "build"})
+	header := make([]byte, 2)
+	io.ReadFull(wsReader, header)
+	payload := make([]byte, header[1]&0x7F)
+	if header[1]&0x7F == 126 {
+		length := make([]byte, 2)
+		io.ReadFull(wsReader, length)
+		payload = make([]byte, int(length[0])<<8|int(length[1]))
+	}
+	io.ReadFull(wsReader, payload)
+	var message Change
+	json.Unmarshal(payload, &message)
+	if header[0] != 0x80|wsText || message.Type != ChangeEventEnded || message.Path != "work/alpha" {
+		logger.Failure("Unexpected WebSocket message %x %s", header, payload)
+		t.Errorf("Expected event.ended as a text message, got %x %s", header, payload)
+	} else {
+		logger.Success("Changes sent over WebSocket")
+	}
+	logger.Exit("WebSocket")
+
+	logger.Enter("Linked Nodes")
+	// A node linked under two parents concerns subscribers of either subtree
+	home, _ := app.getNodeFromPath("home")
+	shared, _ := home.CreateChild(core.LeafNode, "shared", adminID)
+	work.AddChild(shared)
+	subscription, _, _ := app.changes.Subscribe(work, adminID, 0, false)
+	defer subscription.Close()
+	app.publish(ChangeEntryAppended, shared, adminID, nil)
+	select {
+	case change := <-subscription.Changes:
+		if change.NodeID != shared.ID || change.Path != "home/shared" {
+			t.Errorf("Expected the change under its first path, got %+v", change)
+		} else {
+			logger.Success("Changes on linked nodes reach every parent's subscribers")
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the change on the linked node under work")
+	}
+	logger.Exit("Linked Nodes")
+}
+
+func TestWebhooks(t *testing.T) {
+	logger.Enter("Webhooks")
+	defer logger.Exit("Webhooks")
+
+	app := newTestServer(t, testConfig(t, "webhooks_state"))
+	app.webhookBackoff = 10 * time.Millisecond
+	adminID := app.forest.Grants[0].UserID
+	app.forest.CreateChild(core.BranchNode, "work", adminID)
+
+	// The receiver records what it is sent and fails while failing is set
+	type received struct {
+		event, signature string
+		body             []byte
+	}
+	var mutex sync.Mutex
+	var deliveries []received
+	failing := true
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path == "/flaky" && failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, received{r.Header.Get(WebhookEventHeader), r.Header.Get(WebhookSignatureHeader), body})
+	}))
+	defer receiver.Close()
+	waitFor := func(condition func() bool) bool {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			mutex.Lock()
+			done := condition()
+			mutex.Unlock()
+			if done {
+				return true
+			}
+		}
+		return false
+	}
+
+	logger.Enter("Register")
+	rr := call(app.handleCreateWebhook, adminID, "POST", "/", nil, map[string]interface{}{
+		"path": "work", "url": receiver.URL + "/hook", "events": []string{ChangeEventStarted, ChangeEntryAppended},
+	})
+	var webhook core.Webhook
+	json.NewDecoder(rr.Body).Decode(&webhook)
+	if rr.Code != http.StatusCreated || webhook.Secret == "" {
+		t.Fatalf("Expected the webhook with its secret, got %d %+v", rr.Code, webhook)
+	}
+	if code := call(app.handleCreateWebhook, adminID, "POST", "/", nil, map[string]interface{}{"path": "work", "url": "ftp://example.com"}).Code; code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a non-http URL, got %d", code)
+	}
+	if code := call(app.handleCreateWebhook, adminID, "POST", "/", nil, map[string]interface{}{"path": "work", "url": receiver.URL, "events": []string{"node.renamed"}}).Code; code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown event type, got %d", code)
+	}
+	flakyRR := call(app.handleCreateWebhook, adminID, "POST", "/", nil, map[string]interface{}{
+		"path": "work", "url": receiver.URL + "/flaky", "events": []string{ChangeEventEnded}, "secret": "shared",
+	})
+	var flaky core.Webhook
+	json.NewDecoder(flakyRR.Body).Decode(&flaky)
+
+	listRR := httptest.NewRecorder()
+	app.handleListWebhooks(listRR, withUser(httptest.NewRequest("GET", "/webhooks?path=work", nil), adminID))
+	var listed []core.Webhook
+	json.NewDecoder(listRR.Body).Decode(&listed)
+	if len(listed) != 2 || listed[0].Secret != "" || listed[1].Secret != "" {
+		logger.Failure("Unexpected listing %+v", listed)
+		t.Errorf("Expected both webhooks without secrets, got %+v", listed)
+	} else {
+		logger.Success("Webhooks registered")
+	}
+	logger.Exit("Register")
+
+	logger.Enter("Deliver")
+	call(app.handleCreateNode, adminID, "POST", "/", nil, map[string]string{"path": "work", "name": "alpha", "type": "leaf"})
+	call(app.handleStartEvent, adminID, "POST", "/", nil, map[string]string{"path": "work/alpha", "event_id": "build"})
+	if !waitFor(func() bool { return len(deliveries) == 1 }) {
+		t.Fatalf("Expected one delivery, got %d", len(deliveries))
+	}
+	var change Change
+	json.Unmarshal(deliveries[0].body, &change)
+	if deliveries[0].event != ChangeEventStarted || change.Path != "work/alpha" || change.Data["event_id"] != "build" {
+		t.Errorf("Expected event.started for work/alpha, got %s %+v", deliveries[0].event, change)
+	}
+	if deliveries[0].signature != SignWebhookPayload(webhook.Secret, deliveries[0].body) {
+		logger.Failure("Signature mismatch")
+		t.Errorf("Signature %s does not match the payload", deliveries[0].signature)
+	} else {
+		logger.Success("Signed delivery received, node creation filtered out")
+	}
+	logger.Exit("Deliver")
+
+	logger.Enter("Dead letters")
+	call(app.handleEndEvent, adminID, "POST", "/", nil, map[string]string{"path": "work/alpha", "event_id": "build"})
+	var deadLetters []core.WebhookDelivery
+	getDeadLetters := func() {
+		rr := httptest.NewRecorder()
+		req := mux.SetURLVars(withUser(httptest.NewRequest("GET", "/", nil), adminID), map[string]string{"id": flaky.ID})
+		app.handleGetDeadLetters(rr, req)
+		deadLetters = nil
+		json.NewDecoder(rr.Body).Decode(&deadLetters)
+	}
+	waitFor(func() bool {
+		getDeadLetters()
+		return len(deadLetters) == 1
+	})
+	if len(deadLetters) != 1 || deadLetters[0].Attempts != webhookAttempts || deadLetters[0].Status != http.StatusInternalServerError {
+		logger.Failure("Unexpected dead letters %+v", deadLetters)
+		t.Fatalf("Expected one dead letter after %d attempts, got %+v", webhookAttempts, deadLetters)
+	}
+	logger.Success("Delivery moved to dead letters after %d attempts", deadLetters[0].Attempts)
+
+	mutex.Lock()
+	failing = false
+	mutex.Unlock()
+	redeliverRR := httptest.NewRecorder()
+	app.handleRedeliverWebhook(redeliverRR, mux.SetURLVars(withUser(httptest.NewRequest("POST", "/", nil), adminID), map[string]string{"id": flaky.ID}))
+	if redeliverRR.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 on redelivery, got %d", redeliverRR.Code)
+	}
+	if !waitFor(func() bool { return len(deliveries) == 2 }) || deliveries[1].event != ChangeEventEnded ||
+		deliveries[1].signature != SignWebhookPayload("shared", deliveries[1].body) {
+		t.Errorf("Expected the dead letter to be redelivered, got %d deliveries", len(deliveries))
+	}
+	getDeadLetters()
+	if len(deadLetters) != 0 {
+		t.Errorf("Expected no dead letters after redelivery, got %d", len(deadLetters))
+	} else {
+		logger.Success("Dead letter redelivered")
+	}
+	logger.Exit("Dead letters")
+
+	deleteRR := httptest.NewRecorder()
+	app.handleDeleteWebhook(deleteRR, mux.SetURLVars(withUser(httptest.NewRequest("DELETE", "/", nil), adminID), map[string]string{"id": webhook.ID}))
+	if deleteRR.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on delete, got %d", deleteRR.Code)
+	}
+	call(app.handleAppendToEvent, adminID, "POST", "/", nil, map[string]interface{}{"path": "work/alpha", "event_id": "build", "content": "late"})
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	if len(deliveries) != 2 {
+		t.Errorf("Expected nothing sent to a deleted webhook, got %d deliveries", len(deliveries))
+	}
+	mutex.Unlock()
+}
+
+func TestNotifiers(t *testing.T) {
+	logger.Enter("Notifiers")
+	defer logger.Exit("Notifiers")
+
+	app := newTestServer(t, testConfig(t, "notifiers_state"))
+	adminID := app.forest.Grants[0].UserID
+	app.forest.CreateChild(core.BranchNode, "work", adminID)
+
+	// The stub chat service keeps the messages it is sent by path
+	var mutex sync.Mutex
+	messages := make(map[string][]map[string]interface{})
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&message)
+		mutex.Lock()
+		defer mutex.Unlock()
+		messages[r.URL.Path] = append(messages[r.URL.Path], message)
+	}))
+	defer stub.Close()
+	received := func(path string, count int) []map[string]interface{} {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			mutex.Lock()
+			got := messages[path]
+			mutex.Unlock()
+			if len(got) >= count {
+				return got
+			}
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		return messages[path]
+	}
+
+	register := func(request map[string]interface{}) core.Notifier {
+		request["path"] = "work"
+		rr := call(app.handleCreateNotifier, adminID, "POST", "/", nil, request)
+		var notifier core.Notifier
+		json.NewDecoder(rr.Body).Decode(&notifier)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Failed to register notifier: %d", rr.Code)
+		}
+		return notifier
+	}
+
+	logger.Enter("Register")
+	register(map[string]interface{}{
+		"provider": NotifierSlack, "url": stub.URL + "/slack", "channel": "#ops", "events": []string{ChangeEventStarted},
+		"templates": map[string]string{ChangeEventStarted: "{{.User}} kicked off {{.EventID}} in {{.Path}}"},
+	})
+	register(map[string]interface{}{"provider": NotifierMattermost, "url": stub.URL + "/mattermost"})
+	register(map[string]interface{}{
+		"provider": NotifierJSON, "url": stub.URL + "/json", "events": []string{ChangeEntryAppended},
+		"templates": map[string]string{ChangeEntryAppended: "{{.User}} wrote {{index .Data \"content\"}}"},
+	})
+	limited := register(map[string]interface{}{
+		"provider": NotifierSlack, "url": stub.URL + "/limited", "rate_limit": 1,
+	})
+
+	invalid := []map[string]interface{}{
+		{"path": "work", "provider": "irc", "url": stub.URL},
+		{"path": "work", "provider": NotifierSlack, "url": stub.URL, "events": []string{ChangeEntryAppended}},
+		{"path": "work", "provider": NotifierSlack, "url": stub.URL, "templates": map[string]string{ChangeEventStarted: "{{.Path"}},
+		{"path": "work", "provider": NotifierSlack, "url": "mailto:ops@example.com"},
+	}
+	for _, request := range invalid {
+		if code := call(app.handleCreateNotifier, adminID, "POST", "/", nil, request).Code; code != http.StatusBadRequest {
+			logger.Failure("Expected 400 for %v, got %d", request, code)
+			t.Errorf("Expected 400 for %v, got %d", request, code)
+		}
+	}
+	logger.Exit("Register")
+
+	logger.Enter("Messages")
+	call(app.handleCreateNode, adminID, "POST", "/", nil, map[string]string{"path": "work", "name": "alpha", "type": "leaf"})
+	call(app.handleStartEvent, adminID, "POST", "/", nil, map[string]string{"path": "work/alpha", "event_id": "build"})
+	call(app.handleAppendToEvent, adminID, "POST", "/", nil, map[string]interface{}{"path": "work/alpha", "event_id": "build", "content": "tests pass"})
+
+	if slack := received("/slack", 1); len(slack) != 1 || slack[0]["text"] != "admin kicked off build in work/alpha" || slack[0]["channel"] != "#ops" {
+		logger.Failure("Unexpected Slack messages %v", slack)
+		t.Errorf("Expected the templated Slack message, got %v", slack)
+	}
+	mattermost := received("/mattermost", 1)
+	if len(mattermost) != 1 || mattermost[0]["text"] != "Event build started on work/alpha by admin" || mattermost[0]["props"] == nil {
+		t.Errorf("Expected the default Mattermost message with props, got %v", mattermost)
+	}
+	if generic := received("/json", 1); len(generic) != 1 || generic[0]["text"] != "admin wrote tests pass" || generic[0]["type"] != ChangeEntryAppended {
+		t.Errorf("Expected the generic JSON message, got %v", generic)
+	} else {
+		logger.Success("Messages formatted per provider")
+	}
+
+	// The scheduler reports an event still running past its planned end
+	alpha, _ := app.getNodeFromPath("work/alpha")
+	start, end := time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)
+	alpha.PlanEvent("deploy", adminID, &start, &end, map[string]interface{}{})
+	app.runSchedule(time.Now())
+	app.runSchedule(time.Now())
+	mattermost = received("/mattermost", 3)
+	overdue := 0
+	for _, message := range mattermost {
+		if text, _ := message["text"].(string); strings.HasPrefix(text, "Event deploy on work/alpha is overdue, it was planned to end") {
+			overdue++
+		}
+	}
+	if len(mattermost) != 3 || overdue != 1 {
+		logger.Failure("Unexpected Mattermost messages %v", mattermost)
+		t.Errorf("Expected one overdue message after the start, got %v", mattermost)
+	} else {
+		logger.Success("Overdue event reported once")
+	}
+	logger.Exit("Messages")
+
+	logger.Enter("Rate Limit")
+	if limitedMessages := received("/limited", 1); len(limitedMessages) != 1 {
+		t.Errorf("Expected 1 message within the rate limit, got %d", len(limitedMessages))
+	}
+	if allowed, suppressed := app.allowNotification(limited, time.Now().Add(time.Minute)); !allowed || suppressed != 2 {
+		logger.Failure("Expected 2 suppressed messages, got %d (allowed %v)", suppressed, allowed)
+		t.Errorf("Expected the next minute to allow a message noting 2 skipped, got %d (allowed %v)", suppressed, allowed)
+	} else {
+		logger.Success("Messages past the rate limit skipped and counted")
+	}
+	logger.Exit("Rate Limit")
+
+	rr := httptest.NewRecorder()
+	app.handleTestNotifier(rr, mux.SetURLVars(withUser(httptest.NewRequest("POST", "/", nil), adminID), map[string]string{"id": limited.ID}))
+	if rr.Code != http.StatusOK || len(received("/limited", 2)) != 2 {
+		t.Errorf("Expected the test message to be sent, got %d", rr.Code)
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	logger.Enter("Calendar")
+	defer logger.Exit("Calendar")
+
+	app := newTestServer(t, testConfig(t, "calendar_state"))
+	adminID := app.forest.Grants[0].UserID
+	work, _ := app.forest.CreateChild(core.BranchNode, "work", adminID)
+	alpha, _ := work.CreateChild(core.LeafNode, "alpha", adminID)
+	beta, _ := work.CreateChild(core.LeafNode, "beta", adminID)
+
+	// A weekly series with one cancelled occurrence, and an event already running
+	start := time.Date(2030, 1, 7, 9, 0, 0, 0, time.UTC)
+	end := start.Add(15 * time.Minute)
+	if err := alpha.PlanEvent("standup", adminID, &start, &end, map[string]interface{}{
+		"title": "Team standup", "description": "Bring notes; coffee, too", "category": "meeting",
+		"custom_pattern": "FREQ=WEEKLY;BYDAY=MO,WE",
+	}); err != nil {
+		t.Fatalf("Failed to plan series: %v", err)
+	}
+	if err := alpha.CancelOccurrence("standup", start.Add(2*24*time.Hour), adminID); err != nil {
+		t.Fatalf("Failed to cancel occurrence: %v", err)
+	}
+	alpha.MaterializeOccurrences(start, start.Add(14*24*time.Hour))
+	if err := alpha.StartEvent("build", adminID, nil, nil, map[string]interface{}{}); err != nil {
+		t.Fatalf("Failed to start event: %v", err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/calendar/{path:.+}.ics", app.calendarAuth(app.handleGetCalendar))
+	feed := httptest.NewServer(router)
+	defer feed.Close()
+
+	logger.Enter("Feed Token")
+	rr := httptest.NewRecorder()
+	app.handleCreateFeedToken(rr, withUser(httptest.NewRequest("POST", "/calendar/token", nil), adminID))
+	var created map[string]string
+	json.NewDecoder(rr.Body).Decode(&created)
+	token := created["token"]
+	if rr.Code != http.StatusCreated || token == "" {
+		t.Fatalf("Expected a feed token, got %d", rr.Code)
+	}
+	if user, _ := app.forest.Directory.Get(adminID); user.FeedToken == token || user.FeedToken == "" {
+		t.Errorf("Expected only the token's hash to be stored")
+	}
+	if resp, _ := http.Get(feed.URL + "/calendar/work.ics?token=wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown token, got %d", resp.StatusCode)
+	} else {
+		logger.Success("Feed token issued")
+	}
+	logger.Exit("Feed Token")
+
+	logger.Enter("Export")
+	resp, err := http.Get(feed.URL + "/calendar/work.ics?token=" + url.QueryEscape(token))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to fetch the feed: %v %v", err, resp)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	ics := string(body)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/calendar") || !strings.HasPrefix(ics, "BEGIN:VCALENDAR\r\n") {
+		t.Errorf("Expected an iCalendar feed, got %s", resp.Header.Get("Content-Type"))
+	}
+	for _, line := range []string{
+		"UID:" + core.CalendarUID(alpha.ID, "standup"),
+		"DTSTART:20300107T090000Z",
+		"DTEND:20300107T091500Z",
+		"RRULE:FREQ=WEEKLY;BYDAY=MO,WE",
+		"EXDATE:20300109T090000Z",
+		"SUMMARY:Team standup",
+		"DESCRIPTION:Bring notes\\; coffee\\, too",
+		"CATEGORIES:meeting",
+		"UID:" + core.CalendarUID(alpha.ID, "build"),
+		"X-LUMBERJACK-STATUS:ongoing",
+		"X-LUMBERJACK-PATH:work/alpha",
+	} {
+		if !strings.Contains(ics, line+"\r\n") {
+			logger.Failure("Missing %q", line)
+			t.Errorf("Expected the feed to hold %q:\n%s", line, ics)
+		}
+	}
+	// Occurrences that follow from the rule are left to calendar apps
+	if count := strings.Count(ics, "BEGIN:VEVENT"); count != 2 {
+		t.Errorf("Expected 2 events, got %d", count)
+	}
+	events, err := core.ParseCalendar(strings.NewReader(ics))
+	if err != nil || len(events) != 2 {
+		t.Fatalf("Failed to parse the feed back: %v (%d events)", err, len(events))
+	}
+	if standup := events[1]; standup.Description != "Bring notes; coffee, too" || len(standup.ExDates) != 1 || standup.RRule != "FREQ=WEEKLY;BYDAY=MO,WE" {
+		t.Errorf("Feed did not round trip: %+v", events)
+	} else {
+		logger.Success("Feed exported")
+	}
+	logger.Exit("Export")
+
+	logger.Enter("Import")
+	importFile := func(path, contents string) map[string]interface{} {
+		rr := httptest.NewRecorder()
+		app.handleImportCalendar(rr, fileRequest("/calendar/import", adminID, path, "calendar.ics", "", []byte(contents)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Import failed: %d %s", rr.Code, rr.Body.String())
+		}
+		var result map[string]interface{}
+		json.NewDecoder(rr.Body).Decode(&result)
+		return result
+	}
+
+	if result := importFile("work/alpha", ics); len(result["created"].([]interface{})) != 0 || len(result["skipped"].([]interface{})) != 2 {
+		t.Errorf("Expected reimporting the feed to skip both events, got %v", result)
+	}
+
+	external := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"BEGIN:VEVENT",
+		"UID:review-42@example.com",
+		"DTSTART:20300301T140000Z",
+		"DURATION:PT1H30M",
+		"SUMMARY:Quarterly review with a summary long enough to be folded across",
+		"  two lines",
+		"RRULE:FREQ=MONTHLY;COUNT=3",
+		"BEGIN:VALARM",
+		"ACTION:DISPLAY",
+		"TRIGGER:-PT10M",
+		"END:VALARM",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:review-42@example.com",
+		"RECURRENCE-ID:20300401T140000Z",
+		"DTSTART:20300402T140000Z",
+		"SUMMARY:Moved review",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:offsite@example.com",
+		"DTSTART;VALUE=DATE:20300510",
+		"STATUS:CANCELLED",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+	result := importFile("work/beta", external)
+	if createdIDs := result["created"].([]interface{}); len(createdIDs) != 1 || createdIDs[0] != "review-42@example.com" {
+		logger.Failure("Unexpected import %v", result)
+		t.Errorf("Expected only the series to be created, got %v", result)
+	}
+	review := beta.PlannedEvents["review-42@example.com"]
+	if review.StartTime == nil || review.EndTime == nil || review.EndTime.Sub(*review.StartTime) != 90*time.Minute ||
+		review.Pattern != "FREQ=MONTHLY;COUNT=3" || review.Metadata["title"] != "Quarterly review with a summary long enough to be folded across two lines" {
+		logger.Failure("Unexpected imported event %+v", review)
+		t.Errorf("Imported event does not match the file: %+v", review)
+	} else {
+		logger.Success("Events planned from an .ics file")
+	}
+	logger.Exit("Import")
+
+	rr = httptest.NewRecorder()
+	app.handleRevokeFeedToken(rr, withUser(httptest.NewRequest("DELETE", "/calendar/token", nil), adminID))
+	if resp, _ := http.Get(feed.URL + "/calendar/work.ics?token=" + url.QueryEscape(token)); rr.Code != http.StatusNoContent || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked token to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	logger.Enter("ExportImport")
+	defer logger.Exit("ExportImport")
+
+	newServer := func(name string) (*Server, types.ServerConfig) {
+		config := testConfig(t, name)
+		app := newTestServer(t, config)
+		return app, config
+	}
+
+	source, _ := newServer("export_state")
+	adminID := source.forest.Grants[0].UserID
+	bob := core.User{Username: "bob"}
+	bob.SetPassword("bob")
+	bob, _ = source.forest.Directory.Add(bob)
+
+	work, _ := source.forest.CreateChild(core.BranchNode, "work", adminID)
+	ops, _ := source.forest.CreateChild(core.BranchNode, "ops", adminID)
+	alpha, _ := work.CreateChild(core.LeafNode, "alpha", adminID)
+	shared, _ := ops.CreateChild(core.LeafNode, "shared", adminID)
+	if err := source.forest.MoveNode(shared.ID, "", work, true); err != nil {
+		t.Fatalf("Failed to link node: %v", err)
+	}
+	work.AssignUser(bob.ID, core.ReadPermission)
+	alpha.AddActivity("created alpha", map[string]interface{}{"step": 1}, adminID)
+	if err := alpha.StartEvent("build", adminID, nil, nil, map[string]interface{}{"category": "ci"}); err != nil {
+		t.Fatalf("Failed to start event: %v", err)
+	}
+	alpha.AppendToEvent("build", adminID, "compiling", map[string]interface{}{})
+	report := []byte("build log contents")
+	hash := sha256.Sum256(report)
+	logFile := &core.Attachment{ID: hex.EncodeToString(hash[:]), Name: "build.log", Type: "text/plain",
+		Size: int64(len(report)), Hash: hex.EncodeToString(hash[:]), Data: report}
+	if err := alpha.AddEntryAttachment("build", 0, logFile, adminID); err != nil {
+		t.Fatalf("Failed to attach file: %v", err)
+	}
+
+	export := func(userID, query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		source.handleExport(rr, withUser(httptest.NewRequest("GET", "/export?"+query, nil), userID))
+		return rr
+	}
+	importInto := func(app *Server, userID, query string, body []byte) (*httptest.ResponseRecorder, core.ImportReport) {
+		rr := httptest.NewRecorder()
+		app.handleImport(rr, withUser(httptest.NewRequest("POST", "/import?"+query, bytes.NewReader(body)), userID))
+		var report core.ImportReport
+		json.Unmarshal(rr.Body.Bytes(), &report)
+		return rr, report
+	}
+
+	logger.Enter("Export")
+	rr := export(adminID, "path=work")
+	var document core.Export
+	if err := json.Unmarshal(rr.Body.Bytes(), &document); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("Expected a JSON export, got %d: %v", rr.Code, err)
+	}
+	if document.Path != "work" || document.Root.Name != "work" || len(document.Root.Children) != 2 {
+		t.Errorf("Expected work with two children, got %s with %d", document.Path, len(document.Root.Children))
+	}
+	exported := document.Root.Children[0]
+	if exported.Name != "alpha" || len(exported.Events["build"].Entries) != 1 || len(exported.Entries) != 1 {
+		t.Errorf("Expected alpha's event and entry in the export, got %+v", exported)
+	}
+	if attachments := exported.Events["build"].Entries[0].Attachments; len(attachments) != 1 || attachments[0].Data != nil {
+		t.Errorf("Expected attachment details without contents, got %+v", attachments)
+	}
+	usernames := []string{}
+	for _, user := range document.Users {
+		usernames = append(usernames, user.Username)
+		if user.Password != "" {
+			t.Errorf("Expected no password hashes in an API export")
+		}
+	}
+	if !reflect.DeepEqual(usernames, []string{"admin", "bob"}) {
+		t.Errorf("Expected the users work refers to, got %v", usernames)
+	}
+
+	rr = export(adminID, "format=csv&kinds=entry")
+	records, _ := csv.NewReader(rr.Body).ReadAll()
+	if len(records) != 3 || records[0][0] != "kind" || records[1][0] != "entry" || records[2][0] != "entry" {
+		t.Errorf("Expected a header and two entry rows, got %v", records)
+	}
+	if rr = export(adminID, "format=xml"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown format, got %d", rr.Code)
+	} else {
+		logger.Success("Exported nested and flat")
+	}
+	logger.Exit("Export")
+
+	logger.Enter("Round Trip")
+	for _, query := range []string{"format=json", "format=ndjson", "format=csv", "format=ndjson&attachments=tar", "attachments=inline"} {
+		body := export(adminID, query).Body.Bytes()
+		target, _ := newServer("import_state")
+		targetAdmin := target.forest.Grants[0].UserID
+
+		rr, result := importInto(target, targetAdmin, strings.SplitN(query, "&", 2)[0], body)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected the import to succeed, got %d: %s", query, rr.Code, rr.Body.String())
+		}
+		if result.Nodes != 4 || result.Links != 1 || result.Events != 1 || result.Entries != 1 || result.Users != 1 {
+			t.Errorf("%s: unexpected import report %+v", query, result)
+		}
+
+		imported, err := target.forest.Resolve("work/alpha")
+		if err != nil {
+			t.Fatalf("%s: expected work/alpha after import: %v", query, err)
+		}
+		entries, _ := imported.GetEventEntries("build")
+		if imported.ID != alpha.ID || len(entries) != 1 || entries[0].Content != "compiling" {
+			t.Errorf("%s: expected alpha's event with its entry, got %+v", query, entries)
+		}
+		withData := strings.Contains(query, "tar") || strings.Contains(query, "inline")
+		attachment, err := imported.GetEntryAttachment("build", 0, logFile.ID)
+		if withData && err == nil {
+			var data []byte
+			if data, err = target.attachmentData(attachment); err == nil && !bytes.Equal(data, report) {
+				err = errors.New("the contents differ")
+			}
+		}
+		if withData && err != nil {
+			t.Errorf("%s: expected the attachment contents to come along: %v", query, err)
+		} else if !withData && (err == nil || len(result.Skipped) != 1) {
+			t.Errorf("%s: expected the attachment without contents to be skipped, got %+v", query, result.Skipped)
+		}
+
+		linked, _ := target.forest.Resolve("work/shared")
+		original, _ := target.forest.Resolve("ops/shared")
+		if linked == nil || linked != original {
+			t.Errorf("%s: expected shared to keep both parents", query)
+		}
+		importedBob, err := target.forest.Directory.FindByUsername("bob")
+		if err != nil || importedBob.Password != "" {
+			t.Errorf("%s: expected bob without a password, got %v", query, err)
+		}
+		if work, _ := target.forest.Resolve("work"); !work.CheckPermission(importedBob.ID, core.ReadPermission) {
+			t.Errorf("%s: expected bob's grant on work to be kept", query)
+		}
+
+		if _, again := importInto(target, targetAdmin, strings.SplitN(query, "&", 2)[0], body); again.Nodes+again.Links+again.Events+again.Entries+again.Attachments+again.Users != 0 {
+			t.Errorf("%s: expected importing twice to add nothing, got %+v", query, again)
+		}
+		target.blobs.mutex.Lock()
+		refs := target.blobs.refs[logFile.Hash]
+		target.blobs.mutex.Unlock()
+		if withData && refs != 1 {
+			t.Errorf("%s: expected one reference to the imported contents, got %d", query, refs)
+		}
+	}
+	logger.Success("Exports import into an empty forest")
+	logger.Exit("Round Trip")
+
+	logger.Enter("Merge")
+	target, _ := newServer("merge_state")
+	targetAdmin := target.forest.Grants[0].UserID
+	archive, _ := target.forest.CreateChild(core.BranchNode, "archive", targetAdmin)
+	existing, _ := archive.CreateChild(core.LeafNode, "alpha", targetAdmin)
+	existing.StartEvent("deploy", targetAdmin, nil, nil, map[string]interface{}{})
+
+	rr, result := importInto(target, targetAdmin, "path=archive", export(adminID, "path=work").Body.Bytes())
+	if rr.Code != http.StatusOK || result.Path != "archive" {
+		t.Fatalf("Expected the import to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if merged, _ := target.forest.Resolve("archive/alpha"); merged != existing || !merged.HasEvent("deploy") || !merged.HasEvent("build") {
+		t.Errorf("Expected alpha to be merged into the existing node")
+	}
+	if result.Nodes != 1 || result.Events != 1 {
+		t.Errorf("Expected only shared to be created, got %+v", result)
+	} else {
+		logger.Success("Merged by path")
+	}
+	logger.Exit("Merge")
+
+	logger.Enter("Permissions")
+	carol, _ := source.forest.Directory.Add(core.User{Username: "carol"})
+	if rr = export(carol.ID, "path=work"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 exporting an unreadable subtree, got %d", rr.Code)
+	}
+	rr = export(bob.ID, "")
+	document = core.Export{}
+	json.Unmarshal(rr.Body.Bytes(), &document)
+	if rr.Code != http.StatusOK || len(document.Root.Children) != 2 || len(document.Root.Grants) != 0 {
+		t.Errorf("Expected bob to see work and the shared node under ops only, got %d: %+v", rr.Code, document.Root)
+	}
+	if rr, _ = importInto(source, bob.ID, "path=work", export(bob.ID, "path=work").Body.Bytes()); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 importing without admin permission, got %d", rr.Code)
+	} else {
+		logger.Success("Exports follow permissions")
+	}
+	logger.Exit("Permissions")
+
+	logger.Enter("Offline Import")
+	offline, config := newServer("offline_state")
+	if err := offline.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to stop server: %v", err)
+	}
+	full := source.forest.Export("", source.forest.Directory, core.ExportOptions{Data: true, Directory: true, Credentials: true})
+	var packed bytes.Buffer
+	if err := full.WriteArchive(&packed, core.ExportCSV, nil); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+	if _, err := Import(config, &packed, "", ""); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	forest, err := LoadForest(config)
+	if err != nil {
+		t.Fatalf("Failed to load forest: %v", err)
+	}
+	loadedBob, _ := forest.Directory.FindByUsername("bob")
+	loadedAlpha, err := forest.Resolve("work/alpha")
+	if err != nil || !loadedBob.VerifyPassword("bob") {
+		t.Errorf("Expected the import to be saved with bob's password, got %v", err)
+	} else if attachment, err := loadedAlpha.GetEntryAttachment("build", 0, logFile.ID); err != nil || attachment.Data != nil {
+		t.Errorf("Expected the attachment to be saved without its contents: %v", err)
+	} else if data, err := LoadBlobs(config).ReadBlob(attachment.Hash); err != nil || !bytes.Equal(data, report) {
+		t.Errorf("Expected the attachment's contents in the blob store: %v", err)
+	} else {
+		logger.Success("Imported into a stopped database")
+	}
+	logger.Exit("Offline Import")
+
+	logger.Enter("Empty Attachments")
+	victim, _ := newServer("victim_state")
+	victimAdmin := victim.forest.Grants[0].UserID
+	private, _ := victim.forest.CreateChild(core.LeafNode, "private", victimAdmin)
+	info, _ := victim.blobs.WriteBlob([]byte("someone else's file"), false)
+	private.AddAttachment(&core.Attachment{ID: "att-private", Name: "private.txt", Type: "text/plain", Size: info.Size, Hash: info.Hash}, victimAdmin)
+	victim.persist(victim.forest, private)
+	crafted, _ := json.Marshal(core.Export{Version: core.ExportVersion, Root: core.ExportNode{Name: "", Type: core.BranchNode,
+		Children: []core.ExportNode{{ID: "crafted", Name: "crafted", Type: core.LeafNode,
+			Attachments: map[string]core.Attachment{"att-empty": {ID: "att-empty", Name: "empty.txt", Hash: info.Hash}}}}}})
+	if rr, _ := importInto(victim, victimAdmin, "path=", crafted); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the import to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	emptied, _ := victim.forest.Resolve("crafted")
+	rr = httptest.NewRecorder()
+	victim.handleDeleteNode(rr, mux.SetURLVars(withUser(httptest.NewRequest("DELETE", "/nodes/"+emptied.ID, nil), victimAdmin), map[string]string{"id": emptied.ID}))
+	if _, err := victim.blobs.ReadBlob(info.Hash); rr.Code != http.StatusNoContent || err != nil {
+		t.Errorf("Expected another node's blob kept after deleting an empty attachment, got %d: %v", rr.Code, err)
+	} else {
+		logger.Success("Empty attachments refer to no blob")
+	}
+	logger.Exit("Empty Attachments")
+}
+
+func TestBlobStore(t *testing.T) {
+	logger.Enter("BlobStore")
+	defer logger.Exit("BlobStore")
+
+	config := testConfig(t, "blob_state")
+	config.Process.Encryption = "passphrase"
+	config.Secret = []byte("correct horse battery staple")
+	app := newTestServer(t, config)
+	adminID := app.forest.Grants[0].UserID
+	alpha, _ := app.forest.CreateChild(core.LeafNode, "alpha", adminID)
+	beta, _ := app.forest.CreateChild(core.LeafNode, "beta", adminID)
+	app.persist(app.forest, alpha, beta)
+
+	// Previews are made in the background, so only the contents are counted
+	blobFiles := func() []string {
+		var files []string
+		filepath.WalkDir(blobsDir(config), func(path string, entry os.DirEntry, err error) error {
+			if _, suffix, ok := blobName(filepath.Base(path)); err == nil && !entry.IsDir() && ok && isContents(suffix) {
+				files = append(files, path)
+			}
+			return err
+		})
+		return files
+	}
+	download := func(path, attachmentID string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(withUser(httptest.NewRequest("GET", "/attachments/"+attachmentID+"?path="+path, nil), adminID),
+			map[string]string{"id": attachmentID})
+		rr := httptest.NewRecorder()
+		app.handleGetAttachment(rr, req)
+		return rr
+	}
+
+	logger.Enter("Dedup")
+	contents := "quarterly report, do not share"
+	first := uploadAttachment(t, app, adminID, "alpha", "report.txt", "", []byte(contents), nil)
+	second := uploadAttachment(t, app, adminID, "beta", "copy.txt", "", []byte(contents), nil)
+	sum := sha256.Sum256([]byte(contents))
+	if first.Hash != hex.EncodeToString(sum[:]) || first.Size != int64(len(contents)) || first.Data != nil {
+		t.Errorf("Expected the attachment's hash and size without its contents, got %+v", first)
+	}
+	if files := blobFiles(); len(files) != 1 {
+		t.Errorf("Expected identical uploads to share one blob, got %v", files)
+	} else if blob, _ := os.ReadFile(files[0]); bytes.Contains(blob, []byte(contents)) {
+		t.Error("Blob holds the contents in plaintext")
+	}
+	if stored, _ := alpha.GetAttachment(first.ID); stored == nil || stored.Data != nil {
+		t.Errorf("Expected only the attachment's details on the node, got %+v", stored)
+	}
+	if rr := download("beta", second.ID); rr.Code != http.StatusOK || rr.Body.String() != contents {
+		t.Errorf("Expected the contents back, got %d %q", rr.Code, rr.Body.String())
+	} else {
+		logger.Success("Identical uploads stored once")
+	}
+	logger.Exit("Dedup")
+
+	logger.Enter("Release")
+	req := mux.SetURLVars(withUser(httptest.NewRequest("DELETE", "/attachments/"+first.ID+"?path=alpha", nil), adminID),
+		map[string]string{"id": first.ID})
+	rr := httptest.NewRecorder()
+	app.handleDeleteAttachment(rr, req)
+	if rr.Code != http.StatusOK || len(blobFiles()) != 1 {
+		t.Errorf("Expected the blob kept for beta, got %d with %v", rr.Code, blobFiles())
+	}
+	req = mux.SetURLVars(withUser(httptest.NewRequest("DELETE", "/nodes/"+beta.ID, nil), adminID), map[string]string{"id": beta.ID})
+	rr = httptest.NewRecorder()
+	app.handleDeleteNode(rr, req)
+	if rr.Code != http.StatusNoContent || len(blobFiles()) != 0 {
+		t.Errorf("Expected the blob removed with its last node, got %d with %v", rr.Code, blobFiles())
+	} else {
+		logger.Success("Blob removed with its last reference")
+	}
+	logger.Exit("Release")
+
+	logger.Enter("Migrate")
+	legacy := []byte("kept inline by an older version")
+	legacySum := sha256.Sum256(legacy)
+	alpha.Attachments["att-legacy"] = core.Attachment{ID: "att-legacy", Name: "old.txt", Type: "text/plain",
+		Size: int64(len(legacy)), Hash: hex.EncodeToString(legacySum[:]), Data: legacy}
+	app.persist(alpha)
+	stray := filepath.Join(blobsDir(config), "ab", strings.Repeat("ab", sha256.Size))
+	os.MkdirAll(filepath.Dir(stray), 0700)
+	os.WriteFile(stray, []byte("orphan"), 0600)
+	if err := app.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+
+	app, err := loadTestServer(t, config)
+	if err != nil {
+		t.Fatalf("Failed to load server: %v", err)
+	}
+	loaded, _ := app.getNodeFromPath("alpha")
+	if attachment, _ := loaded.GetAttachment("att-legacy"); attachment == nil || attachment.Data != nil {
+		t.Errorf("Expected the inline contents moved out of the forest, got %+v", attachment)
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Error("Expected the unreferenced blob removed on load")
+	}
+	if rr := download("alpha", "att-legacy"); rr.Body.String() != string(legacy) {
+		t.Errorf("Expected the migrated contents back, got %q", rr.Body.String())
+	} else {
+		logger.Success("Inline contents moved into the blob store")
+	}
+	app.Shutdown(context.Background())
+	logger.Exit("Migrate")
+
+	logger.Enter("Failed Rekey")
+	// A directory where the blob's temporary file goes makes resealing fail
+	blocked := app.blobs.path(hex.EncodeToString(legacySum[:]), false) + ".tmp"
+	os.Mkdir(blocked, 0700)
+	if err := Rekey(config, []byte("a brand new passphrase")); err == nil || errors.Is(err, ErrRekeyIncomplete) {
+		t.Fatalf("Expected the rekey to fail and be undone, got %v", err)
+	}
+	os.Remove(blocked)
+	if app, err = loadTestServer(t, config); err != nil {
+		t.Fatalf("Expected the old secret to open the database after a failed rekey: %v", err)
+	}
+	if rr := download("alpha", "att-legacy"); rr.Body.String() != string(legacy) {
+		t.Errorf("Expected the blob readable with the old secret, got %d %q", rr.Code, rr.Body.String())
+	} else {
+		logger.Success("Failed rekey undone")
+	}
+	app.Shutdown(context.Background())
+	logger.Exit("Failed Rekey")
+
+	logger.Enter("Rekey")
+	if err := Rekey(config, []byte("a brand new passphrase")); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	config.Secret = []byte("a brand new passphrase")
+	if app, err = loadTestServer(t, config); err != nil {
+		t.Fatalf("Failed to load rekeyed database: %v", err)
+	}
+	if rr := download("alpha", "att-legacy"); rr.Body.String() != string(legacy) {
+		t.Errorf("Expected the blob readable with the new secret, got %d %q", rr.Code, rr.Body.String())
+	} else {
+		logger.Success("Blobs resealed with the new secret")
+	}
+	logger.Exit("Rekey")
+}
+
+func TestAttachmentTransfers(t *testing.T) {
+	logger.Enter("AttachmentTransfers")
+	defer logger.Exit("AttachmentTransfers")
+
+	for _, secret := range []string{"", "correct horse battery staple"} {
+		config := testConfig(t, "transfer_state")
+		config.Process.MaxAttachmentSize = 64
+		config.Process.AttachmentTypes = []string{"text/*", "application/pdf"}
+		config.Secret = []byte(secret)
+		app := newTestServer(t, config)
+		adminID := app.forest.Grants[0].UserID
+		alpha, _ := app.forest.CreateChild(core.LeafNode, "alpha", adminID)
+		app.persist(app.forest, alpha)
+
+		logger.Enter("Limits")
+		upload := func(name, contentType, contents string) *httptest.ResponseRecorder {
+			rr := httptest.NewRecorder()
+			app.handleUploadAttachment(rr, fileRequest("/attachments/upload", adminID, "alpha", name, contentType, []byte(contents)))
+			return rr
+		}
+		if rr := upload("big.txt", "text/plain", strings.Repeat("x", 65)); rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected a file over the limit to be refused, got %d", rr.Code)
+		}
+		if rr := upload("photo.png", "image/png", "not really a png"); rr.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("Expected a type off the allow list to be refused, got %d", rr.Code)
+		}
+		rr := upload("notes", "application/octet-stream", "plain notes")
+		var sniffed core.Attachment
+		json.NewDecoder(rr.Body).Decode(&sniffed)
+		if rr.Code != http.StatusOK || !strings.HasPrefix(sniffed.Type, "text/plain") {
+			t.Errorf("Expected the type sniffed as text, got %d %q", rr.Code, sniffed.Type)
+		} else {
+			logger.Success("Size and type limits enforced")
+		}
+		logger.Exit("Limits")
+
+		logger.Enter("Resumable")
+		contents := "first half, second half"
+		body, _ := json.Marshal(map[string]interface{}{"path": "alpha", "name": "résumé \"v2\".txt", "type": "text/plain", "size": len(contents)})
+		rr = httptest.NewRecorder()
+		app.handleCreateUpload(rr, withUser(httptest.NewRequest("POST", "/attachments/uploads", bytes.NewReader(body)), adminID))
+		var session uploadSession
+		json.NewDecoder(rr.Body).Decode(&session)
+		if rr.Code != http.StatusCreated || session.ID == "" || rr.Header().Get("Upload-Offset") != "0" {
+			t.Fatalf("Expected an upload session, got %d", rr.Code)
+		}
+		chunk := func(method string, offset int, data string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, "/attachments/uploads/"+session.ID, strings.NewReader(data))
+			req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+			rr := httptest.NewRecorder()
+			handler := app.handleAppendUpload
+			if method == "HEAD" {
+				handler = app.handleGetUpload
+			}
+			handler(rr, mux.SetURLVars(withUser(req, adminID), map[string]string{"id": session.ID}))
+			return rr
+		}
+		if rr := chunk("PATCH", 0, contents[:11]); rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "11" {
+			t.Errorf("Expected the first chunk to be taken, got %d at %s", rr.Code, rr.Header().Get("Upload-Offset"))
+		}
+		if partial, _ := os.ReadFile(filepath.Join(app.blobs.uploadsDir(), session.ID)); secret != "" && bytes.Contains(partial, []byte("first")) {
+			t.Error("Partial upload holds plaintext in an encrypted database")
+		}
+		if rr := chunk("PATCH", 0, contents[:11]); rr.Code != http.StatusConflict || rr.Header().Get("Upload-Offset") != "11" {
+			t.Errorf("Expected a chunk at the wrong offset to conflict, got %d", rr.Code)
+		}
+		if rr := chunk("HEAD", 0, ""); rr.Header().Get("Upload-Offset") != "11" || rr.Header().Get("Upload-Length") != strconv.Itoa(len(contents)) {
+			t.Errorf("Expected the offset to resume from, got %v", rr.Header())
+		}
+		rr = chunk("PATCH", 11, contents[11:])
+		var attachment core.Attachment
+		json.NewDecoder(rr.Body).Decode(&attachment)
+		if rr.Code != http.StatusCreated || attachment.Size != int64(len(contents)) {
+			t.Fatalf("Expected the last chunk to make the attachment, got %d %s", rr.Code, rr.Body.String())
+		}
+		if _, exists := app.session(session.ID, adminID); exists {
+			t.Error("Expected the session to end with its last chunk")
+		} else {
+			logger.Success("Upload resumed and completed")
+		}
+		logger.Exit("Resumable")
+
+		logger.Enter("Download")
+		download := func(header, value string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/attachments/"+attachment.ID+"?path=alpha", nil)
+			if header != "" {
+				req.Header.Set(header, value)
+			}
+			rr := httptest.NewRecorder()
+			app.handleGetAttachment(rr, mux.SetURLVars(withUser(req, adminID), map[string]string{"id": attachment.ID}))
+			return rr
+		}
+		rr = download("", "")
+		etag := rr.Header().Get("ETag")
+		_, params, _ := mime.ParseMediaType(rr.Header().Get("Content-Disposition"))
+		if rr.Body.String() != contents || etag != `"`+attachment.Hash+`"` || params["filename"] != "résumé \"v2\".txt" {
+			t.Errorf("Expected the contents with their hash and name, got %q %s %q", rr.Body.String(), etag, rr.Header().Get("Content-Disposition"))
+		}
+		if rr := download("If-None-Match", etag); rr.Code != http.StatusNotModified {
+			t.Errorf("Expected 304 for a matching ETag, got %d", rr.Code)
+		}
+		if rr := download("Range", "bytes=12-"); rr.Code != http.StatusPartialContent || rr.Body.String() != contents[12:] {
+			t.Errorf("Expected the requested range, got %d %q", rr.Code, rr.Body.String())
+		} else {
+			logger.Success("Ranges and conditional requests served")
+		}
+		logger.Exit("Download")
+
+		logger.Enter("Removed Node")
+		beta, _ := app.forest.CreateChild(core.LeafNode, "beta", adminID)
+		body, _ = json.Marshal(map[string]interface{}{"path": "beta", "name": "late.txt", "type": "text/plain", "size": 4})
+		rr = httptest.NewRecorder()
+		app.handleCreateUpload(rr, withUser(httptest.NewRequest("POST", "/attachments/uploads", bytes.NewReader(body)), adminID))
+		session = uploadSession{}
+		json.NewDecoder(rr.Body).Decode(&session)
+		app.forest.RemoveChild(beta.ID)
+		if rr := chunk("PATCH", 0, "late"); rr.Code != http.StatusGone {
+			t.Errorf("Expected 410 completing an upload to a removed node, got %d", rr.Code)
+		} else if len(beta.Attachments) != 0 {
+			t.Errorf("Expected nothing attached to the removed node")
+		} else {
+			logger.Success("Upload to a removed node refused")
+		}
+		logger.Exit("Removed Node")
+
+		logger.Enter("Open Sessions")
+		var ids []string
+		for i := 0; i <= maxUploadSessions; i++ {
+			body, _ = json.Marshal(map[string]interface{}{"path": "alpha", "name": "part.txt", "type": "text/plain", "size": 4})
+			rr = httptest.NewRecorder()
+			app.handleCreateUpload(rr, withUser(httptest.NewRequest("POST", "/attachments/uploads", bytes.NewReader(body)), adminID))
+			session = uploadSession{}
+			json.NewDecoder(rr.Body).Decode(&session)
+			ids = append(ids, session.ID)
+		}
+		if rr.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected 429 once a user has %d uploads open, got %d", maxUploadSessions, rr.Code)
+		} else if ids[0] == ids[1] || !strings.HasPrefix(ids[0], "upload-") || len(ids[0]) != len("upload-")+32 {
+			t.Errorf("Expected random upload IDs, got %s and %s", ids[0], ids[1])
+		} else {
+			logger.Success("Open uploads capped per user")
+		}
+		logger.Exit("Open Sessions")
+	}
+}
+
+func TestAttachmentCompression(t *testing.T) {
+	logger.Enter("AttachmentCompression")
+	defer logger.Exit("AttachmentCompression")
+
+	for _, secret := range []string{"", "correct horse battery staple"} {
+		config := testConfig(t, "compressed_state")
+		config.Secret = []byte(secret)
+		app := newTestServer(t, config)
+		adminID := app.forest.Grants[0].UserID
+		alpha, _ := app.forest.CreateChild(core.LeafNode, "alpha", adminID)
+		app.persist(app.forest, alpha)
+
+		download := func(attachment core.Attachment, rangeHeader string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/attachments/"+attachment.ID+"?path=alpha", nil)
+			if rangeHeader != "" {
+				req.Header.Set("Range", rangeHeader)
+			}
+			rr := httptest.NewRecorder()
+			app.handleGetAttachment(rr, mux.SetURLVars(withUser(req, adminID), map[string]string{"id": attachment.ID}))
+			return rr
+		}
+
+		logger.Enter("Compress")
+		logText := bytes.Repeat([]byte("2026-10-17 build step passed\n"), 400)
+		logFile := uploadAttachment(t, app, adminID, "alpha", "build.log", "text/plain; charset=utf-8", logText, nil)
+		if logFile.Compression != core.CompressionGzip || logFile.StoredSize >= logFile.Size || logFile.Size != int64(len(logText)) {
+			t.Errorf("Expected the log gzipped, got %+v", logFile)
+		}
+		if _, err := os.Stat(app.blobs.path(logFile.Hash, true)); err != nil {
+			t.Errorf("Expected a compressed blob on disk: %v", err)
+		}
+		if rr := download(logFile, ""); !bytes.Equal(rr.Body.Bytes(), logText) {
+			t.Error("Expected the log back as uploaded")
+		}
+		if rr := download(logFile, "bytes=0-9"); rr.Code != http.StatusPartialContent || rr.Body.String() != string(logText[:10]) {
+			t.Errorf("Expected a range of the decompressed log, got %d %q", rr.Code, rr.Body.String())
+		}
+
+		photo := make([]byte, 4096)
+		rand.New(rand.NewSource(1)).Read(photo)
+		image := uploadAttachment(t, app, adminID, "alpha", "photo.png", "image/png", photo, nil)
+		if image.Compression != "" || image.StoredSize != image.Size {
+			t.Errorf("Expected the image stored as it is, got %+v", image)
+		} else {
+			logger.Success("Compressible types gzipped, others stored as they are")
+		}
+		logger.Exit("Compress")
+
+		logger.Enter("Usage")
+		uploadAttachment(t, app, adminID, "alpha", "copy.log", "text/plain", logText, nil)
+		rr := httptest.NewRecorder()
+		app.handleGetAttachmentUsage(rr, withUser(httptest.NewRequest("GET", "/attachments/usage?path=", nil), adminID))
+		var usage attachmentUsage
+		json.NewDecoder(rr.Body).Decode(&usage)
+		if usage.Attachments.Count != 3 || usage.Blobs.Count != 2 ||
+			usage.Attachments.Size != 2*logFile.Size+image.Size || usage.Blobs.StoredSize != logFile.StoredSize+image.StoredSize {
+			t.Errorf("Unexpected usage %+v", usage)
+		}
+		if text := usage.Types["text/plain"]; text.Count != 2 || text.StoredSize != 2*logFile.StoredSize {
+			t.Errorf("Expected both logs under text/plain, got %+v", usage.Types)
+		}
+		if usage.Store == nil || usage.Store.Blobs != 2 {
+			t.Errorf("Expected the store's footprint for the root's admin, got %+v", usage.Store)
+		} else {
+			logger.Success("Usage reported")
+		}
+		logger.Exit("Usage")
+		app.Shutdown(context.Background())
+
+		if secret == "" {
+			continue
+		}
+		logger.Enter("Rekey")
+		if err := Rekey(config, []byte("a brand new passphrase")); err != nil {
+			t.Fatalf("Rekey failed: %v", err)
+		}
+		config.Secret = []byte("a brand new passphrase")
+		if data, err := LoadBlobs(config).ReadBlob(logFile.Hash); err != nil || !bytes.Equal(data, logText) {
+			t.Errorf("Expected the compressed blob resealed: %v", err)
+		} else {
+			logger.Success("Compressed blobs resealed")
+		}
+		logger.Exit("Rekey")
+	}
+}
+
+func TestAttachmentPreviews(t *testing.T) {
+	logger.Enter("AttachmentPreviews")
+	defer logger.Exit("AttachmentPreviews")
+
+	config := testConfig(t, "preview_state")
+	config.Secret = []byte("correct horse battery staple")
+	app := newTestServer(t, config)
+	adminID := app.forest.Grants[0].UserID
+	alpha, _ := app.forest.CreateChild(core.LeafNode, "alpha", adminID)
+	app.persist(app.forest, alpha)
+
+	// fetch polls a thumbnail or preview until the workers have made it
+	fetch := func(attachment core.Attachment, kind string) *httptest.ResponseRecorder {
+		handler := app.handleGetPreview
+		if kind == "thumbnail" {
+			handler = app.handleGetThumbnail
+		}
+		for attempt := 0; ; attempt++ {
+			req := httptest.NewRequest("GET", "/attachments/"+attachment.ID+"/"+kind+"?path=alpha", nil)
+			rr := httptest.NewRecorder()
+			handler(rr, mux.SetURLVars(withUser(req, adminID), map[string]string{"id": attachment.ID}))
+			if rr.Code != http.StatusAccepted || attempt == 100 {
+				return rr
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	logger.Enter("Thumbnail")
+	screenshot := image.NewRGBA(image.Rect(0, 0, 1024, 512))
+	for x := 0; x < 1024; x++ {
+		for y := 0; y < 512; y++ {
+			screenshot.Set(x, y, color.RGBA{R: uint8(x / 4), G: uint8(y / 2), B: 128, A: 255})
+		}
+	}
+	var encoded bytes.Buffer
+	png.Encode(&encoded, screenshot)
+	attachment := uploadAttachment(t, app, adminID, "alpha", "screenshot.png", "image/png", encoded.Bytes(), nil)
+	rr := fetch(attachment, "thumbnail")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected a PNG thumbnail, got %d %s", rr.Code, rr.Body.String())
+	}
+	thumbnail, err := png.Decode(rr.Body)
+	if err != nil {
+		t.Fatalf("Failed to decode thumbnail: %v", err)
+	}
+	if bounds := thumbnail.Bounds(); bounds.Dx() != core.ThumbnailSize || bounds.Dy() != core.ThumbnailSize/2 {
+		t.Errorf("Expected a 256x128 thumbnail, got %v", bounds)
+	} else {
+		logger.Success("Thumbnail made")
+	}
+	req := httptest.NewRequest("GET", "/attachments/"+attachment.ID+"/thumbnail?path=alpha", nil)
+	req.Header.Set("If-None-Match", `"`+attachment.Hash+`.thumb"`)
+	rr = httptest.NewRecorder()
+	app.handleGetThumbnail(rr, mux.SetURLVars(withUser(req, adminID), map[string]string{"id": attachment.ID}))
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a cached thumbnail, got %d", rr.Code)
+	}
+	if rr := fetch(attachment, "preview"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected no preview for an image, got %d", rr.Code)
+	}
+	broken := uploadAttachment(t, app, adminID, "alpha", "broken.gif", "image/gif", []byte("GIF89a not really"), nil)
+	if rr := fetch(broken, "thumbnail"); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a corrupt image, got %d", rr.Code)
+	}
+	logger.Exit("Thumbnail")
+
+	logger.Enter("Preview")
+	var preview core.Preview
+	settings := uploadAttachment(t, app, adminID, "alpha", "settings.json", "application/json", []byte(`{"theme":"dark","hours":[8,6]}`), nil)
+	json.NewDecoder(fetch(settings, "preview").Body).Decode(&preview)
+	if preview.Kind != core.PreviewJSON || !strings.Contains(preview.Text, "\n  \"theme\": \"dark\"") {
+		t.Errorf("Expected indented JSON, got %+v", preview)
+	}
+
+	var sheet bytes.Buffer
+	sheetWriter := csv.NewWriter(&sheet)
+	for day := 1; day <= 40; day++ {
+		sheetWriter.Write([]string{"2026-10-" + strconv.Itoa(day), "8"})
+	}
+	sheetWriter.Flush()
+	timesheet := uploadAttachment(t, app, adminID, "alpha", "timesheet.csv", "text/csv", sheet.Bytes(), nil)
+	preview = core.Preview{}
+	json.NewDecoder(fetch(timesheet, "preview").Body).Decode(&preview)
+	if preview.Kind != core.PreviewCSV || len(preview.Rows) != core.PreviewRows || preview.Rows[0][0] != "2026-10-1" {
+		t.Errorf("Expected the first CSV rows, got %+v", preview)
+	}
+
+	notes := uploadAttachment(t, app, adminID, "alpha", "notes.txt", "text/plain", bytes.Repeat([]byte("é"), core.PreviewLength), nil)
+	preview = core.Preview{}
+	json.NewDecoder(fetch(notes, "preview").Body).Decode(&preview)
+	if !preview.Truncated || len(preview.Text) > core.PreviewLength || !utf8.ValidString(preview.Text) {
+		t.Errorf("Expected valid truncated text, got %d bytes truncated=%v", len(preview.Text), preview.Truncated)
+	}
+
+	// Large files are previewed from their start, still indented when JSON
+	var entries bytes.Buffer
+	entries.WriteString(`{"entries":[`)
+	for entries.Len() <= core.PreviewReadSize {
+		entries.WriteString(`{"day":"2026-10-17","hours":8},`)
+	}
+	entries.WriteString(`{}]}`)
+	large := strings.NewReader(entries.String())
+	if preview, err := core.ReadPreview(large, "application/json"); err != nil || preview.Kind != core.PreviewJSON ||
+		!preview.Truncated || !strings.HasPrefix(preview.Text, "{\n  \"entries\": [\n    {\n      \"day\"") {
+		t.Errorf("Expected the start of the JSON indented, got %v %+v", err, preview)
+	} else if read := int(large.Size()) - large.Len(); read > core.PreviewReadSize+1 {
+		t.Errorf("Expected at most %d bytes read for a preview, read %d", core.PreviewReadSize+1, read)
+	} else {
+		logger.Success("Previews made")
+	}
+	if rr := fetch(notes, "thumbnail"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected no thumbnail for text, got %d", rr.Code)
+	}
+	logger.Exit("Preview")
+
+	logger.Enter("Limits")
+	photo := image.NewYCbCr(image.Rect(0, 0, 640, 480), image.YCbCrSubsampleRatio420)
+	for i := range photo.Y {
+		photo.Y[i] = uint8(i)
+	}
+	encoded.Reset()
+	jpeg.Encode(&encoded, photo, nil)
+	if rr := fetch(uploadAttachment(t, app, adminID, "alpha", "photo.jpg", "image/jpeg", encoded.Bytes(), nil), "thumbnail"); rr.Code != http.StatusOK {
+		t.Errorf("Expected a thumbnail of a JPEG, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	app.previewMutex.Lock()
+	for i := 0; i < maxPreviewJobs; i++ {
+		app.previewPending["busy"+strconv.Itoa(i)] = true
+	}
+	app.previewMutex.Unlock()
+	app.queuePreview(notes, thumbnailSuffix)
+	app.previewMutex.Lock()
+	queued := app.previewPending[notes.Hash+thumbnailSuffix]
+	for i := 0; i < maxPreviewJobs; i++ {
+		delete(app.previewPending, "busy"+strconv.Itoa(i))
+	}
+	app.previewMutex.Unlock()
+	if queued {
+		t.Errorf("Expected no more than %d preview jobs queued", maxPreviewJobs)
+	}
+
+	missing := core.Attachment{ID: "missing", Hash: strings.Repeat("0", 64), Type: "text/plain"}
+	app.queuePreview(missing, previewSuffix)
+	for attempt := 0; attempt < 100; attempt++ {
+		app.previewMutex.Lock()
+		pending := app.previewPending[missing.Hash+previewSuffix]
+		app.previewMutex.Unlock()
+		if !pending {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	app.previewMutex.Lock()
+	_, failed := app.previewFailed[missing.Hash+previewSuffix]
+	app.previewMutex.Unlock()
+	if failed {
+		t.Errorf("Expected a missing blob not to be remembered as a failure")
+	} else {
+		logger.Success("Preview jobs limited and transient failures retried")
+	}
+	logger.Exit("Limits")
+
+	logger.Enter("Release")
+	req = httptest.NewRequest("DELETE", "/attachments/"+attachment.ID+"?path=alpha", nil)
+	app.handleDeleteAttachment(httptest.NewRecorder(), mux.SetURLVars(withUser(req, adminID), map[string]string{"id": attachment.ID}))
+	if _, err := app.blobs.ReadDerived(attachment.Hash, thumbnailSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the thumbnail removed with its blob: %v", err)
+	} else {
+		logger.Success("Thumbnail removed with its blob")
+	}
+	logger.Exit("Release")
+}
+
+func TestAttachmentListings(t *testing.T) {
+	logger.Enter("AttachmentListings")
+	defer logger.Exit("AttachmentListings")
+
+	app := newTestServer(t, testConfig(t, "attachment_listing_state"))
+	adminID := app.forest.Grants[0].UserID
+
+	work, _ := app.forest.CreateChild(core.BranchNode, "work", adminID)
+	alpha, _ := work.CreateChild(core.LeafNode, "alpha", adminID)
+	beta, _ := work.CreateChild(core.LeafNode, "beta", adminID)
+	beta.AssignUser("reader", core.ReadPermission)
+	start := time.Now()
+	alpha.Events["build"] = core.Event{StartTime: &start, Status: core.EventOngoing, CreatedBy: adminID,
+		Entries: []core.Entry{{Content: "logs attached", UserID: adminID, Timestamp: start}}}
+	app.persist(app.forest, work, alpha, beta)
+
+	entryVars := map[string]string{"eventId": "build", "entryIndex": "0"}
+	uploadAttachment(t, app, adminID, "work/alpha", "spec.txt", "text/plain", []byte("the spec"), nil)
+	screenshot := uploadAttachment(t, app, adminID, "work/beta", "screenshot.png", "image/png", bytes.Repeat([]byte{0x89}, 2048), nil)
+	buildLog := uploadAttachment(t, app, adminID, "work/alpha", "build.log", "text/plain",
+		bytes.Repeat([]byte("step passed\n"), 100), entryVars)
+
+	type page struct {
+		Items      []map[string]interface{} `json:"items"`
+		Total      int                      `json:"total"`
+		NextCursor string                   `json:"next_cursor"`
+	}
+	list := func(target, userID string) (*httptest.ResponseRecorder, page) {
+		rr := httptest.NewRecorder()
+		app.handleListAttachments(rr, withUser(httptest.NewRequest("GET", target, nil), userID))
+		var result page
+		json.NewDecoder(rr.Body).Decode(&result)
+		return rr, result
+	}
+
+	logger.Enter("List")
+	if _, result := list("/attachments?path=work/alpha", adminID); result.Total != 2 {
+		t.Errorf("Expected the node's and its entry's attachments, got %+v", result)
+	}
+	if _, result := list("/attachments?path=work", adminID); result.Total != 0 {
+		t.Errorf("Expected nothing on work itself without recursive, got %+v", result)
+	}
+	_, result := list("/attachments?path=work&recursive=true&sort=-size", adminID)
+	if result.Total != 3 || result.Items[0]["name"] != "screenshot.png" || result.Items[0]["path"] != "work/beta" || result.Items[0]["data"] != nil {
+		t.Errorf("Expected every attachment below work, largest first, got %+v", result)
+	}
+	for _, item := range result.Items {
+		if item["name"] == "build.log" && (item["event_id"] != "build" || item["entry_index"] != float64(0) || item["node_id"] != alpha.ID) {
+			t.Errorf("Expected the log placed on its entry, got %+v", item)
+		}
+	}
+	if _, result := list("/attachments?path=work&recursive=true&type=image/*", adminID); result.Total != 1 || result.Items[0]["id"] != screenshot.ID {
+		t.Errorf("Expected the image alone, got %+v", result)
+	}
+	if _, result := list("/attachments?path=work&recursive=true&min_size=1000&max_size=1500", adminID); result.Total != 1 || result.Items[0]["id"] != buildLog.ID {
+		t.Errorf("Expected the log alone between 1000 and 1500 bytes, got %+v", result)
+	}
+	if _, result := list("/attachments?path=work&recursive=true&user=admin", adminID); result.Total != 3 {
+		t.Errorf("Expected the uploader filter to take a username, got %+v", result)
+	}
+	_, first := list("/attachments?path=work&recursive=true&sort=size&limit=2", adminID)
+	_, second := list("/attachments?path=work&recursive=true&sort=size&limit=2&cursor="+first.NextCursor, adminID)
+	if len(first.Items) != 2 || len(second.Items) != 1 || second.Items[0]["id"] != screenshot.ID {
+		t.Errorf("Expected pages by size, got %+v then %+v", first, second)
+	} else {
+		logger.Success("Attachments listed, filtered and paged")
+	}
+	if _, result := list("/attachments?path=work&recursive=true", "reader"); result.Total != 1 || result.Items[0]["id"] != screenshot.ID {
+		t.Errorf("Expected a reader to see only the node they can read, got %+v", result)
+	}
+	if rr, _ := list("/attachments?path=work/alpha", "reader"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 listing an unreadable node, got %d", rr.Code)
+	}
+	if rr, _ := list("/attachments?path=work&min_size=-1", adminID); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative size, got %d", rr.Code)
+	}
+	logger.Exit("List")
+
+	logger.Enter("EntryAttachment")
+	entryRequest := func(method, userID, attachmentID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/events/build/entries/0/attachments/"+attachmentID+"?path=work/alpha", nil)
+		vars := map[string]string{"eventId": "build", "entryIndex": "0", "id": attachmentID}
+		rr := httptest.NewRecorder()
+		if method == "DELETE" {
+			app.handleDeleteEntryAttachment(rr, mux.SetURLVars(withUser(req, userID), vars))
+		} else {
+			app.handleGetEntryAttachment(rr, mux.SetURLVars(withUser(req, userID), vars))
+		}
+		return rr
+	}
+	if rr := entryRequest("GET", adminID, buildLog.ID); rr.Code != http.StatusOK || rr.Body.Len() != int(buildLog.Size) {
+		t.Errorf("Expected the log downloaded, got %d with %d bytes", rr.Code, rr.Body.Len())
+	}
+	if rr := entryRequest("GET", adminID, "missing"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing attachment, got %d", rr.Code)
+	}
+	if rr := entryRequest("DELETE", "reader", buildLog.ID); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 deleting without write permission, got %d", rr.Code)
+	}
+	if rr := entryRequest("DELETE", adminID, buildLog.ID); rr.Code != http.StatusOK {
+		t.Fatalf("Delete failed: %d %s", rr.Code, rr.Body.String())
+	}
+	if len(alpha.Events["build"].Entries[0].Attachments) != 0 {
+		t.Error("Expected the entry's attachment removed")
+	}
+	// A delete racing this one finds the attachment gone after the lookup
+	if err := alpha.DeleteEntryAttachment("build", 0, buildLog.ID, adminID); !errors.Is(err, core.ErrAttachmentNotFound) {
+		t.Errorf("Expected ErrAttachmentNotFound deleting twice, got %v", err)
+	} else {
+		rr := httptest.NewRecorder()
+		if writeDeleteAttachmentError(rr, err); rr.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for an attachment deleted meanwhile, got %d", rr.Code)
+		}
+	}
+	if _, err := os.Stat(app.blobs.path(buildLog.Hash, buildLog.Compression != "")); !os.IsNotExist(err) {
+		t.Errorf("Expected the log's blob released: %v", err)
+	} else {
+		logger.Success("Entry attachment retrieved and deleted")
+	}
+	logger.Exit("EntryAttachment")
+}
+
 func TestUserCreationAndAuthentication(t *testing.T) {
 	logger.Enter("UserCreationAndAuthentication")
 	defer logger.Exit("UserCreationAndAuthentication")
@@ -0,0 +1,650 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/vaziolabs/lumberjack/internal/core"
+	"github.com/vaziolabs/lumberjack/types"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// blobGzipSuffix marks the files of compressed blobs
+	blobGzipSuffix = ".gz"
+	// Suffixes of the files derived from a blob's contents
+	thumbnailSuffix = ".thumb"
+	previewSuffix   = ".preview"
+	// blobSealOverhead is what sealing adds to a blob: the header, nonce and tag
+	blobSealOverhead = len(stateMagic) + 1 + stateSaltLen + chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+)
+
+// BlobStore keeps attachment contents outside the state file, one file per
+// SHA-256 under the database directory. Contents shared by several
+// attachments are stored once and counted, and the file is removed when the
+// last attachment referring to it is released. Compressible contents are
+// gzipped, and blobs are sealed with the database's secret when it has one.
+type BlobStore struct {
+	dir     string
+	secret  []byte
+	cipher  *StateCipher            // Seals new blobs
+	ciphers map[string]*StateCipher // Opens blobs, by the salt in their header
+	mutex   sync.Mutex
+	refs    map[string]int
+}
+
+func blobsDir(config types.ServerConfig) string {
+	return filepath.Join(config.Process.DatabasePath, config.Process.Name+".blobs")
+}
+
+// OpenBlobStore opens the blob store of a database, creating its directory.
+// The cipher seals new blobs; when nil one is derived from the secret.
+func OpenBlobStore(config types.ServerConfig, cipher *StateCipher) (*BlobStore, error) {
+	store := newBlobStore(config, cipher)
+	if err := os.MkdirAll(store.dir, 0700); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func newBlobStore(config types.ServerConfig, cipher *StateCipher) *BlobStore {
+	store := &BlobStore{
+		dir:     blobsDir(config),
+		secret:  config.Secret,
+		cipher:  cipher,
+		ciphers: make(map[string]*StateCipher),
+		refs:    make(map[string]int),
+	}
+	if cipher != nil {
+		store.ciphers[string(cipher.salt)] = cipher
+	}
+	return store
+}
+
+func validBlobHash(hash string) bool {
+	decoded, err := hex.DecodeString(hash)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// blobName splits the name of a file in the store into the hash of the
+// contents it belongs to and its suffix: none for the contents, .gz for
+// compressed contents, or the suffix of a derived file. It returns false for
+// files that are neither.
+func blobName(name string) (string, string, bool) {
+	hash, suffix := name, ""
+	if dot := strings.IndexByte(name, '.'); dot >= 0 {
+		hash, suffix = name[:dot], name[dot:]
+	}
+	switch suffix {
+	case "", blobGzipSuffix, thumbnailSuffix, previewSuffix:
+		return hash, suffix, validBlobHash(hash)
+	}
+	return hash, suffix, false
+}
+
+// isContents returns whether a file with the suffix holds a blob's contents
+// rather than something derived from them
+func isContents(suffix string) bool {
+	return suffix == "" || suffix == blobGzipSuffix
+}
+
+// path spreads blobs over directories named by the first byte of their hash.
+// Compressed contents are stored under the hash with a .gz suffix.
+func (store *BlobStore) path(hash string, compressed bool) string {
+	name := hash
+	if compressed {
+		name += blobGzipSuffix
+	}
+	return filepath.Join(store.dir, hash[:2], name)
+}
+
+// find returns the path of the blob stored under hash and whether it is
+// compressed, or an error satisfying os.IsNotExist when there is none
+func (store *BlobStore) find(hash string) (string, bool, os.FileInfo, error) {
+	for _, compressed := range []bool{false, true} {
+		path := store.path(hash, compressed)
+		info, err := os.Stat(path)
+		if err == nil || !os.IsNotExist(err) {
+			return path, compressed, info, err
+		}
+	}
+	return "", false, nil, os.ErrNotExist
+}
+
+// blobInfo describes a stored blob. Stored sizes leave the encryption out,
+// so they read the same whether the database is encrypted or not.
+func (store *BlobStore) blobInfo(hash string, size int64, compressed bool, file os.FileInfo) core.BlobInfo {
+	info := core.BlobInfo{Hash: hash, Size: size, StoredSize: file.Size()}
+	if len(store.secret) > 0 {
+		info.StoredSize -= int64(blobSealOverhead)
+	}
+	if compressed {
+		info.Compression = core.CompressionGzip
+	}
+	return info
+}
+
+// WriteBlob stores data unless a blob with the same contents exists, and adds
+// a reference to it. With compress the contents are gzipped when that makes
+// them smaller.
+func (store *BlobStore) WriteBlob(data []byte, compress bool) (core.BlobInfo, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, compressed, file, err := store.find(hash); err == nil {
+		store.refs[hash]++
+		return store.blobInfo(hash, int64(len(data)), compressed, file), nil
+	} else if !os.IsNotExist(err) {
+		return core.BlobInfo{}, err
+	}
+
+	stored, compressed := data, false
+	if compress {
+		var packed bytes.Buffer
+		writer := gzip.NewWriter(&packed)
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			return core.BlobInfo{}, err
+		}
+		if packed.Len() < len(data) {
+			stored, compressed = packed.Bytes(), true
+		}
+	}
+	if err := store.write(store.path(hash, compressed), stored); err != nil {
+		return core.BlobInfo{}, err
+	}
+	store.refs[hash]++
+
+	info := core.BlobInfo{Hash: hash, Size: int64(len(data)), StoredSize: int64(len(stored))}
+	if compressed {
+		info.Compression = core.CompressionGzip
+	}
+	return info, nil
+}
+
+// WriteBlobFrom stores what r holds, like WriteBlob. Unencrypted contents are
+// streamed to disk, compressed alongside when asked so the smaller is kept;
+// sealed ones are read into memory first.
+func (store *BlobStore) WriteBlobFrom(r io.Reader, compress bool) (core.BlobInfo, error) {
+	if store.encrypted() {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return core.BlobInfo{}, err
+		}
+		return store.WriteBlob(data, compress)
+	}
+
+	raw, err := os.CreateTemp(store.dir, "incoming-*")
+	if err != nil {
+		return core.BlobInfo{}, err
+	}
+	defer os.Remove(raw.Name())
+	defer raw.Close()
+	hasher := sha256.New()
+	writers := []io.Writer{raw, hasher}
+
+	var packed *os.File
+	var packer *gzip.Writer
+	if compress {
+		if packed, err = os.CreateTemp(store.dir, "incoming-*"); err != nil {
+			return core.BlobInfo{}, err
+		}
+		defer os.Remove(packed.Name())
+		defer packed.Close()
+		packer = gzip.NewWriter(packed)
+		writers = append(writers, packer)
+	}
+
+	size, err := io.Copy(io.MultiWriter(writers...), r)
+	if err == nil && packer != nil {
+		err = packer.Close()
+	}
+	if err == nil {
+		err = raw.Close()
+	}
+	if err == nil && packed != nil {
+		err = packed.Close()
+	}
+	if err != nil {
+		return core.BlobInfo{}, err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	source, compressed := raw.Name(), false
+	if packed != nil {
+		if file, err := os.Stat(packed.Name()); err == nil && file.Size() < size {
+			source, compressed = packed.Name(), true
+		}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, existing, file, err := store.find(hash); err == nil {
+		store.refs[hash]++
+		return store.blobInfo(hash, size, existing, file), nil
+	} else if !os.IsNotExist(err) {
+		return core.BlobInfo{}, err
+	}
+	path := store.path(hash, compressed)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return core.BlobInfo{}, err
+	}
+	if err := os.Rename(source, path); err != nil {
+		return core.BlobInfo{}, err
+	}
+	file, err := os.Stat(path)
+	if err != nil {
+		return core.BlobInfo{}, err
+	}
+	store.refs[hash]++
+	return store.blobInfo(hash, size, compressed, file), nil
+}
+
+func (store *BlobStore) encrypted() bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return len(store.secret) > 0
+}
+
+// sealer returns the cipher new blobs are sealed with, nil when the store is
+// not encrypted. The mutex must be held.
+func (store *BlobStore) sealer() (*StateCipher, error) {
+	if len(store.secret) > 0 && store.cipher == nil {
+		cipher, err := NewStateCipher(store.secret, nil)
+		if err != nil {
+			return nil, err
+		}
+		store.cipher = cipher
+		store.ciphers[string(cipher.salt)] = cipher
+	}
+	return store.cipher, nil
+}
+
+// write stores a blob file, sealed when the store is encrypted. The file's
+// name is authenticated along with the header, so a blob cannot be passed
+// off as other contents.
+func (store *BlobStore) write(path string, data []byte) error {
+	cipher, err := store.sealer()
+	if err != nil {
+		return err
+	}
+	if cipher != nil {
+		header := cipher.header()
+		sealed, err := cipher.Seal(data, append(header, filepath.Base(path)...))
+		if err != nil {
+			return err
+		}
+		data = append(header, sealed...)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Rename(tmpFile, path); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return nil
+}
+
+// ReadBlob returns the contents stored under hash
+func (store *BlobStore) ReadBlob(hash string) ([]byte, error) {
+	if !validBlobHash(hash) {
+		return nil, fmt.Errorf("invalid blob hash: %q", hash)
+	}
+	path, compressed, _, err := store.find(hash)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("blob not found: %s", hash)
+		}
+		return nil, err
+	}
+	data, err := store.readStored(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if compressed {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("blob %s is corrupted: %v", hash, err)
+		}
+		if data, err = io.ReadAll(reader); err != nil {
+			return nil, fmt.Errorf("blob %s is corrupted: %v", hash, err)
+		}
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != hash {
+		if isEncryptedState(data) && !store.encrypted() {
+			return nil, fmt.Errorf("blob %s is encrypted but no passphrase or key file was provided", hash)
+		}
+		return nil, fmt.Errorf("blob %s is corrupted", hash)
+	}
+	return data, nil
+}
+
+// readStored returns a blob file as stored, opening its seal
+func (store *BlobStore) readStored(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isEncryptedState(data) || !store.encrypted() {
+		return data, nil
+	}
+	return store.open(filepath.Base(path), data)
+}
+
+// OpenBlob returns the contents stored under hash for reading in parts.
+// Uncompressed, unencrypted blobs are read from disk as needed, others are
+// opened whole.
+func (store *BlobStore) OpenBlob(hash string) (io.ReadSeekCloser, error) {
+	if !validBlobHash(hash) {
+		return nil, fmt.Errorf("invalid blob hash: %q", hash)
+	}
+	if path, compressed, _, err := store.find(hash); err == nil && !compressed && !store.encrypted() {
+		return os.Open(path)
+	}
+	data, err := store.ReadBlob(hash)
+	if err != nil {
+		return nil, err
+	}
+	return nopSeekCloser{bytes.NewReader(data)}, nil
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+// open decrypts a sealed blob file, deriving the key for its salt once
+func (store *BlobStore) open(name string, data []byte) ([]byte, error) {
+	headerLen := len(stateMagic) + 1 + stateSaltLen
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("blob %s header truncated", name)
+	}
+
+	header := data[:headerLen]
+	salt := string(header[len(stateMagic)+1:])
+	store.mutex.Lock()
+	cipher, exists := store.ciphers[salt]
+	if !exists {
+		var err error
+		if cipher, err = NewStateCipher(store.secret, []byte(salt)); err != nil {
+			store.mutex.Unlock()
+			return nil, err
+		}
+		store.ciphers[salt] = cipher
+	}
+	store.mutex.Unlock()
+
+	return cipher.Open(data[headerLen:], append(append([]byte(nil), header...), name...))
+}
+
+// Retain adds a reference to each blob, stored already
+func (store *BlobStore) Retain(hashes ...string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, hash := range hashes {
+		if validBlobHash(hash) {
+			store.refs[hash]++
+		}
+	}
+}
+
+// releaseImported drops the references the blobs stored from an import's
+// archive hold, leaving those of the attachments that took them
+func (store *BlobStore) releaseImported(blobs map[string]core.BlobInfo) {
+	for hash := range blobs {
+		store.Release(hash)
+	}
+}
+
+// Release drops a reference to each blob, removing those no longer referred to
+func (store *BlobStore) Release(hashes ...string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, hash := range hashes {
+		if !validBlobHash(hash) {
+			continue
+		}
+		store.refs[hash]--
+		if store.refs[hash] > 0 {
+			continue
+		}
+		delete(store.refs, hash)
+		for _, suffix := range []string{"", blobGzipSuffix, thumbnailSuffix, previewSuffix} {
+			os.Remove(store.path(hash, false) + suffix)
+		}
+		os.Remove(filepath.Dir(store.path(hash, false))) // Only succeeds once empty
+	}
+}
+
+// Collect takes the reference counts from the forest and removes every blob
+// nothing refers to, returning how many were removed. Blobs written since the
+// forest was counted would be lost, so it only runs before the server serves.
+func (store *BlobStore) Collect(forest *core.Node) (int, error) {
+	refs := forest.BlobReferences()
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.refs = refs
+
+	removed := 0
+	err := filepath.WalkDir(store.dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		hash, suffix, isBlob := blobName(entry.Name())
+		if isBlob && refs[hash] > 0 {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if isBlob && isContents(suffix) {
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// Usage returns how many blobs the store holds and the bytes they and the
+// files derived from them take on disk, sealing included
+func (store *BlobStore) Usage() (int, int64, error) {
+	blobs, size := 0, int64(0)
+	err := filepath.WalkDir(store.dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if _, suffix, isBlob := blobName(entry.Name()); isBlob {
+			file, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if isContents(suffix) {
+				blobs++
+			}
+			size += file.Size()
+		}
+		return nil
+	})
+	return blobs, size, err
+}
+
+// WriteDerived stores a file made from the contents under hash, such as a
+// thumbnail, kept until the contents are removed
+func (store *BlobStore) WriteDerived(hash string, suffix string, data []byte) error {
+	if !validBlobHash(hash) {
+		return fmt.Errorf("invalid blob hash: %q", hash)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.refs[hash] <= 0 {
+		return fmt.Errorf("blob not found: %s", hash)
+	}
+	return store.write(store.path(hash, false)+suffix, data)
+}
+
+// ReadDerived returns a file made from the contents under hash, or an error
+// satisfying os.IsNotExist when it has not been made
+func (store *BlobStore) ReadDerived(hash string, suffix string) ([]byte, error) {
+	if !validBlobHash(hash) {
+		return nil, fmt.Errorf("invalid blob hash: %q", hash)
+	}
+	return store.readStored(store.path(hash, false) + suffix)
+}
+
+// Reseal writes every blob again with the cipher, or unencrypted when it is
+// nil, once the database's secret changes to newSecret. When it fails the
+// blobs written so far are sealed with the old secret again.
+func (store *BlobStore) Reseal(newSecret []byte, cipher *StateCipher) error {
+	var paths []string
+	err := filepath.WalkDir(store.dir, func(path string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			if _, _, isBlob := blobName(entry.Name()); isBlob {
+				paths = append(paths, path)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	resealed := &BlobStore{
+		dir:     store.dir,
+		secret:  newSecret,
+		cipher:  cipher,
+		ciphers: make(map[string]*StateCipher),
+	}
+	if cipher != nil {
+		resealed.ciphers[string(cipher.salt)] = cipher
+	}
+	for i, path := range paths {
+		data, err := store.readStored(path)
+		if err == nil {
+			err = resealed.write(path, data)
+		}
+		if err != nil {
+			// Seal the blobs done so far with the old key again
+			for _, done := range paths[:i] {
+				data, restoreErr := resealed.readStored(done)
+				if restoreErr == nil {
+					store.mutex.Lock()
+					restoreErr = store.write(done, data)
+					store.mutex.Unlock()
+				}
+				if restoreErr != nil {
+					return fmt.Errorf("%v, then restoring %s: %v", err, done, restoreErr)
+				}
+			}
+			return err
+		}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.secret, store.cipher, store.ciphers = resealed.secret, resealed.cipher, resealed.ciphers
+	return nil
+}
+
+// initBlobs opens the database's blob store, moves the attachment contents
+// older versions kept in the state file into it and removes the blobs
+// nothing refers to any more
+func (server *Server) initBlobs() error {
+	blobs, err := OpenBlobStore(server.config, server.cipher)
+	if err != nil {
+		return err
+	}
+	server.blobs = blobs
+	server.uploads = make(map[string]*uploadSession)
+	server.previewPending = make(map[string]bool)
+	server.previewFailed = make(map[string]string)
+
+	var migrated []*core.Node
+	for _, node := range server.forest.Index() {
+		moved, err := node.TakeAttachmentData(blobs)
+		if err != nil {
+			return err
+		}
+		if moved {
+			migrated = append(migrated, node)
+		}
+	}
+	if len(migrated) > 0 {
+		if err := server.persist(migrated...); err != nil {
+			return err
+		}
+		server.logger.Notice("Moved the attachments of %d nodes into the blob store", len(migrated))
+	}
+
+	removed, err := blobs.Collect(server.forest)
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		server.logger.Notice("Removed %d unreferenced blobs", removed)
+	}
+	return nil
+}
+
+// storeAttachmentData moves the contents the nodes hold into the blob store
+func (server *Server) storeAttachmentData(nodes ...*core.Node) error {
+	for _, node := range nodes {
+		if _, err := node.TakeAttachmentData(server.blobs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachmentData returns the contents of an attachment
+func (server *Server) attachmentData(attachment *core.Attachment) ([]byte, error) {
+	if len(attachment.Data) > 0 || attachment.Size == 0 {
+		return attachment.Data, nil
+	}
+	return server.blobs.ReadBlob(attachment.Hash)
+}
+
+// openAttachment returns the contents of an attachment for reading in parts
+func (server *Server) openAttachment(attachment *core.Attachment) (io.ReadSeekCloser, error) {
+	if len(attachment.Data) > 0 || attachment.Size == 0 {
+		return nopSeekCloser{bytes.NewReader(attachment.Data)}, nil
+	}
+	return server.blobs.OpenBlob(attachment.Hash)
+}
+
+// attachmentLimits are the size and types of files the database takes
+func (server *Server) attachmentLimits() core.AttachmentLimits {
+	return core.AttachmentLimits{
+		MaxSize: server.config.Process.MaxAttachmentSize,
+		Types:   server.config.Process.AttachmentTypes,
+	}
+}
+
+// LoadBlobs opens the blob store of a database for reading alongside
+// LoadForest, writing nothing
+func LoadBlobs(config types.ServerConfig) *BlobStore {
+	return newBlobStore(config, nil)
+}
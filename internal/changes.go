@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vaziolabs/lumberjack/internal/core"
+)
+
+// Kinds of changes published on the change feed
+const (
+	ChangeNodeCreated       = "node.created"
+	ChangeEventStarted      = "event.started"
+	ChangeEventEnded        = "event.ended"
+	ChangeEventOverdue      = "event.overdue" // Still ongoing past its planned end
+	ChangeEntryAppended     = "entry.appended"
+	ChangeAttachmentAdded   = "attachment.added"
+	ChangeAttachmentRemoved = "attachment.removed"
+	ChangeUserAssigned      = "user.assigned"
+	ChangeForestImported    = "forest.imported" // An export was merged into the node
+
+	// ChangeFeedReset tells a subscriber that changes since its sequence number
+	// are no longer held, so it should reload what it shows
+	ChangeFeedReset = "feed.reset"
+)
+
+// changeTypes are the kinds of changes subscribers and webhooks can ask for
+var changeTypes = []string{
+	ChangeNodeCreated, ChangeEventStarted, ChangeEventEnded, ChangeEventOverdue,
+	ChangeEntryAppended, ChangeAttachmentAdded, ChangeAttachmentRemoved, ChangeUserAssigned,
+	ChangeForestImported,
+}
+
+const (
+	changeHistory    = 1000 // Changes kept for subscribers resuming from a sequence number
+	changeBufferSize = 256  // Changes queued per subscriber before it is dropped
+	changeKeepalive  = 15 * time.Second
+)
+
+// Change is one entry of the change feed
+type Change struct {
+	Seq    uint64                 `json:"seq"`
+	Type   string                 `json:"type"`
+	NodeID string                 `json:"node_id,omitempty"`
+	Path   string                 `json:"path,omitempty"`
+	UserID string                 `json:"user_id,omitempty"` // Who made the change
+	Time   time.Time              `json:"time"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+
+	node    *core.Node
+	lineage []*core.Node // The node and every node above it
+}
+
+// ChangeFeed numbers the changes made to the forest and hands them to
+// subscribers. The last changes are kept in memory so subscribers can resume
+// after reconnecting; sequence numbers start over when the server restarts.
+type ChangeFeed struct {
+	mutex       sync.Mutex
+	seq         uint64
+	history     []Change
+	subscribers map[*ChangeSubscription]struct{}
+	closed      bool
+}
+
+// ChangeSubscription receives the changes on a subtree its user can read.
+// Changes is closed when the subscriber falls too far behind or the feed
+// closes; it should then resume from the last sequence number it saw.
+type ChangeSubscription struct {
+	Changes chan Change
+	feed    *ChangeFeed
+	scope   *core.Node
+	userID  string
+}
+
+// NewChangeFeed returns an empty feed
+func NewChangeFeed() *ChangeFeed {
+	return &ChangeFeed{subscribers: make(map[*ChangeSubscription]struct{})}
+}
+
+// Publish numbers the change and hands it to every subscriber it concerns
+func (feed *ChangeFeed) Publish(change Change) Change {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	feed.seq++
+	change.Seq = feed.seq
+	if change.Time.IsZero() {
+		change.Time = time.Now()
+	}
+	feed.history = append(feed.history, change)
+	if len(feed.history) > changeHistory {
+		feed.history = feed.history[len(feed.history)-changeHistory:]
+	}
+
+	for subscription := range feed.subscribers {
+		if !subscription.wants(change) {
+			continue
+		}
+		select {
+		case subscription.Changes <- change:
+		default:
+			// Too far behind, it resumes from the history once it reconnects
+			feed.drop(subscription)
+		}
+	}
+	return change
+}
+
+// Subscribe registers a subscriber for the changes on scope, the whole forest
+// when nil, that userID can read. When resuming, the changes held after since
+// are returned to be sent first, and complete is false when some of them are
+// no longer held. Otherwise only changes published from now on are received.
+func (feed *ChangeFeed) Subscribe(scope *core.Node, userID string, since uint64, resume bool) (subscription *ChangeSubscription, backlog []Change, complete bool) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	subscription = &ChangeSubscription{
+		Changes: make(chan Change, changeBufferSize),
+		feed:    feed,
+		scope:   scope,
+		userID:  userID,
+	}
+	if feed.closed {
+		close(subscription.Changes)
+		return subscription, nil, true
+	}
+	feed.subscribers[subscription] = struct{}{}
+	if !resume {
+		return subscription, nil, true
+	}
+
+	complete = since <= feed.seq
+	if len(feed.history) > 0 && since+1 < feed.history[0].Seq {
+		complete = false
+	}
+	for _, change := range feed.history {
+		if change.Seq > since && subscription.wants(change) {
+			backlog = append(backlog, change)
+		}
+	}
+	return subscription, backlog, complete
+}
+
+// Latest returns the sequence number of the last change published
+func (feed *ChangeFeed) Latest() uint64 {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	return feed.seq
+}
+
+// Close ends every subscription, so streams finish when the server shuts down
+func (feed *ChangeFeed) Close() {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	feed.closed = true
+	for subscription := range feed.subscribers {
+		feed.drop(subscription)
+	}
+}
+
+func (feed *ChangeFeed) drop(subscription *ChangeSubscription) {
+	if _, exists := feed.subscribers[subscription]; exists {
+		delete(feed.subscribers, subscription)
+		close(subscription.Changes)
+	}
+}
+
+// Close stops the subscription
+func (subscription *ChangeSubscription) Close() {
+	subscription.feed.mutex.Lock()
+	defer subscription.feed.mutex.Unlock()
+	subscription.feed.drop(subscription)
+}
+
+func (subscription *ChangeSubscription) wants(change Change) bool {
+	if change.node == nil {
+		return false
+	}
+	if subscription.scope != nil && !inLineage(change.lineage, subscription.scope) {
+		return false
+	}
+	return change.node.CheckPermission(subscription.userID, core.ReadPermission)
+}
+
+// inLineage returns whether node is in a change's lineage, which is whether
+// the change is on its subtree
+func inLineage(lineage []*core.Node, node *core.Node) bool {
+	for _, ancestor := range lineage {
+		if ancestor == node {
+			return true
+		}
+	}
+	return false
+}
+
+// publish records a change made to node by userID on the change feed and
+// sends it to the webhooks and notifiers that want it
+func (server *Server) publish(changeType string, node *core.Node, userID string, data map[string]interface{}) {
+	if server.changes == nil {
+		return
+	}
+	// Found walking up from the node, not down the whole forest
+	change := Change{Type: changeType, NodeID: node.ID, UserID: userID, Data: data, node: node, lineage: node.Lineage()}
+	if paths := node.PathsUp(); len(paths) > 0 {
+		change.Path = paths[0]
+	}
+	change = server.changes.Publish(change)
+	server.dispatchWebhooks(change)
+	server.dispatchNotifications(change)
+}
+
+// subscribeChanges subscribes the request's user to the changes on the node
+// at its path, resuming after the since parameter or the Last-Event-ID
+// header when either is given. It answers the request itself on failure.
+func (server *Server) subscribeChanges(w http.ResponseWriter, r *http.Request) (*ChangeSubscription, []Change, bool, bool) {
+	userID := r.Context().Value("user_id").(string)
+
+	since, resume := r.URL.Query().Get("since"), true
+	if since == "" {
+		since = r.Header.Get("Last-Event-ID")
+	}
+	var after uint64
+	if since == "" {
+		resume = false
+	} else if parsed, err := strconv.ParseUint(since, 10, 64); err != nil {
+		http.Error(w, "Invalid since sequence number", http.StatusBadRequest)
+		return nil, nil, false, false
+	} else {
+		after = parsed
+	}
+
+	node, err := server.getNodeFromPath(r.URL.Query().Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return nil, nil, false, false
+	}
+	if server.changes == nil {
+		http.Error(w, "Change feed not available", http.StatusServiceUnavailable)
+		return nil, nil, false, false
+	}
+
+	subscription, backlog, complete := server.changes.Subscribe(node, userID, after, resume)
+	return subscription, backlog, complete, true
+}
+
+// streamChanges sends the backlog and then every change of the subscription
+// until the client goes away, the subscription ends or the session is revoked
+func (server *Server) streamChanges(r *http.Request, subscription *ChangeSubscription, backlog []Change, complete bool,
+	send func(Change) error, keepalive func() error, closed <-chan struct{}) {
+	if !complete {
+		reset := Change{Seq: server.changes.Latest(), Type: ChangeFeedReset, Time: time.Now()}
+		if len(backlog) > 0 {
+			reset.Seq = backlog[0].Seq - 1
+		}
+		if send(reset) != nil {
+			return
+		}
+	}
+	for _, change := range backlog {
+		if send(change) != nil {
+			return
+		}
+	}
+
+	sessionID, _ := r.Context().Value("session_id").(string)
+	ticker := time.NewTicker(changeKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case change, open := <-subscription.Changes:
+			if !open || send(change) != nil {
+				return
+			}
+		case <-ticker.C:
+			if sessionID != "" && !server.sessions.IsActive(sessionID) {
+				return
+			}
+			if keepalive() != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -1,54 +1,339 @@
 package core
 
 import (
+	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
+	"net/http"
+	"strings"
 	"time"
 )
 
+var (
+	// ErrAttachmentTooLarge is returned for files over the database's size limit
+	ErrAttachmentTooLarge = errors.New("file too large")
+	// ErrAttachmentType is returned for files whose type the database does not allow
+	ErrAttachmentType = errors.New("file type not allowed")
+	// ErrAttachmentNotFound is returned when no attachment has the given ID
+	ErrAttachmentNotFound = errors.New("attachment not found")
+)
+
+// DefaultMaxAttachmentSize applies to databases that set no limit of their own
+const DefaultMaxAttachmentSize = 10 * 1024 * 1024
+
+// CompressionGzip is the compression of blobs stored gzipped
+const CompressionGzip = "gzip"
+
+// BlobReader reads attachment contents by their SHA-256
+type BlobReader interface {
+	ReadBlob(hash string) ([]byte, error)
+}
+
+// BlobInfo describes stored contents
+type BlobInfo struct {
+	Hash        string // SHA-256 of the contents
+	Size        int64  // Bytes of the contents
+	StoredSize  int64  // Bytes once compressed
+	Compression string // CompressionGzip, or empty when stored as they are
+}
+
+// BlobWriter stores attachment contents. Every write adds a reference to the
+// blob, to be released when the attachment goes. With compress, contents
+// not stored yet are compressed when that makes them smaller.
+type BlobWriter interface {
+	WriteBlob(data []byte, compress bool) (BlobInfo, error)
+	// WriteBlobFrom stores what r holds without keeping it in memory
+	WriteBlobFrom(r io.Reader, compress bool) (BlobInfo, error)
+}
+
+// BlobStorer stores attachment contents, and adds and drops references to
+// contents stored already
+type BlobStorer interface {
+	BlobWriter
+	Retain(hashes ...string)
+	Release(hashes ...string)
+}
+
+// AttachmentLimits restrict the files a database takes
+type AttachmentLimits struct {
+	MaxSize int64    // Bytes, DefaultMaxAttachmentSize when zero
+	Types   []string // MIME types allowed, "image/*" allowing a whole family; any when empty
+}
+
+// Max returns the largest file allowed
+func (l AttachmentLimits) Max() int64 {
+	if l.MaxSize <= 0 {
+		return DefaultMaxAttachmentSize
+	}
+	return l.MaxSize
+}
+
+// Check returns an error when a file of the size and type is not allowed. A
+// negative size or an empty type is not checked, for files not known yet.
+func (l AttachmentLimits) Check(size int64, mimeType string) error {
+	if size > l.Max() {
+		return fmt.Errorf("%w: %d bytes (max %d)", ErrAttachmentTooLarge, size, l.Max())
+	}
+	if len(l.Types) == 0 || mimeType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ErrAttachmentType, mimeType)
+	}
+	if matchesType(l.Types, mediaType) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrAttachmentType, mediaType)
+}
+
+// matchesType returns whether a media type, without parameters, is one of
+// the patterns, "image/*" matching a whole family
+func matchesType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == mediaType || pattern == "*/*" ||
+			(strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitedReader fails once more than remaining bytes are read
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	max       int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	if l.remaining -= int64(n); l.remaining < 0 {
+		return n, fmt.Errorf("%w: over %d bytes", ErrAttachmentTooLarge, l.max)
+	}
+	return n, err
+}
+
 type AttachmentStore struct {
-	maxSize int64 // maximum file size in bytes
+	limits AttachmentLimits
+	blobs  BlobWriter
 }
 
-func NewAttachmentStore() *AttachmentStore {
+// NewAttachmentStore returns a store keeping attachment contents in blobs, so
+// only their details end up on nodes
+func NewAttachmentStore(blobs BlobWriter, limits AttachmentLimits) *AttachmentStore {
 	return &AttachmentStore{
-		maxSize: 10 * 1024 * 1024, // 10MB default limit
+		limits: limits,
+		blobs:  blobs,
 	}
 }
 
 func (s *AttachmentStore) Store(file multipart.File, header *multipart.FileHeader, userID string) (*Attachment, error) {
-	if header.Size > s.maxSize {
-		return nil, fmt.Errorf("file too large: %d bytes (max %d)", header.Size, s.maxSize)
+	if header.Size > s.limits.Max() {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrAttachmentTooLarge, header.Size, s.limits.Max())
 	}
+	return s.StoreReader(file, header.Filename, header.Header.Get("Content-Type"), userID)
+}
 
-	// Read file content
-	content, err := io.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %v", err)
+// StoreReader stores a file read from r. Without a type, or with the generic
+// application/octet-stream, the type is sniffed from the first bytes.
+func (s *AttachmentStore) StoreReader(r io.Reader, name string, mimeType string, userID string) (*Attachment, error) {
+	buffered := bufio.NewReaderSize(r, 512)
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		head, _ := buffered.Peek(512)
+		mimeType = http.DetectContentType(head)
+	}
+	if err := s.limits.Check(-1, mimeType); err != nil {
+		return nil, err
 	}
+	limited := &limitedReader{r: buffered, remaining: s.limits.Max(), max: s.limits.Max()}
 
-	// Calculate hash
-	hash := sha256.Sum256(content)
-	hashString := hex.EncodeToString(hash[:])
+	var (
+		info    BlobInfo
+		content []byte
+	)
+	if s.blobs != nil {
+		var err error
+		if info, err = s.blobs.WriteBlobFrom(limited, IsCompressibleType(mimeType)); err != nil {
+			if errors.Is(err, ErrAttachmentTooLarge) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed to store file: %v", err)
+		}
+	} else {
+		var err error
+		if content, err = io.ReadAll(limited); err != nil {
+			if errors.Is(err, ErrAttachmentTooLarge) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed to read file: %v", err)
+		}
+		hash := sha256.Sum256(content)
+		info.Hash = hex.EncodeToString(hash[:])
+		info.Size = int64(len(content))
+	}
 
 	// Create attachment
 	attachment := &Attachment{
-		ID:         hashString,
-		Name:       header.Filename,
-		Type:       header.Header.Get("Content-Type"),
-		Size:       header.Size,
-		Hash:       hashString,
-		Data:       content,
-		UploadedBy: userID,
-		UploadedAt: time.Now(),
+		ID:          info.Hash,
+		Name:        name,
+		Type:        mimeType,
+		Size:        info.Size,
+		StoredSize:  info.StoredSize,
+		Compression: info.Compression,
+		Hash:        info.Hash,
+		Data:        content,
+		UploadedBy:  userID,
+		UploadedAt:  time.Now(),
 	}
 
 	return attachment, nil
 }
 
+// withoutData returns copies of the attachments without their contents, which
+// are fetched on their own
+func withoutData(attachments []Attachment) []Attachment {
+	if attachments == nil {
+		return nil
+	}
+	stripped := make([]Attachment, len(attachments))
+	for i, attachment := range attachments {
+		attachment.Data = nil
+		stripped[i] = attachment
+	}
+	return stripped
+}
+
+func entriesWithoutData(entries []Entry) []Entry {
+	if entries == nil {
+		return nil
+	}
+	stripped := make([]Entry, len(entries))
+	for i, entry := range entries {
+		entry.Attachments = withoutData(entry.Attachments)
+		stripped[i] = entry
+	}
+	return stripped
+}
+
+func eventsWithoutData(events map[string]Event) map[string]Event {
+	if events == nil {
+		return nil
+	}
+	stripped := make(map[string]Event, len(events))
+	for eventID, event := range events {
+		event.Entries = entriesWithoutData(event.Entries)
+		stripped[eventID] = event
+	}
+	return stripped
+}
+
+// AttachmentHashes returns the blob hash of each attachment on the node and
+// its entries, once per attachment, leaving out empty attachments
+func (n *Node) AttachmentHashes() []string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	var hashes []string
+	addEntries := func(entries []Entry) {
+		for _, entry := range entries {
+			for _, attachment := range entry.Attachments {
+				if hash := attachment.BlobHash(); hash != "" {
+					hashes = append(hashes, hash)
+				}
+			}
+		}
+	}
+	for _, attachment := range n.Attachments {
+		if hash := attachment.BlobHash(); hash != "" {
+			hashes = append(hashes, hash)
+		}
+	}
+	addEntries(n.Entries)
+	for _, events := range []map[string]Event{n.Events, n.PlannedEvents} {
+		for _, event := range events {
+			addEntries(event.Entries)
+		}
+	}
+	return hashes
+}
+
+// BlobReferences counts the attachments referring to each blob in the tree,
+// nodes with several parents counted once
+func (n *Node) BlobReferences() map[string]int {
+	references := make(map[string]int)
+	for _, node := range n.Index() {
+		for _, hash := range node.AttachmentHashes() {
+			if hash != "" {
+				references[hash]++
+			}
+		}
+	}
+	return references
+}
+
+// TakeAttachmentData moves the contents still held by the node's attachments,
+// from older state or an import, into blobs, reporting whether any moved
+func (n *Node) TakeAttachmentData(blobs BlobWriter) (bool, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	moved := false
+	take := func(attachment *Attachment) error {
+		if len(attachment.Data) == 0 {
+			return nil
+		}
+		info, err := blobs.WriteBlob(attachment.Data, IsCompressibleType(attachment.Type))
+		if err != nil {
+			return err
+		}
+		attachment.Hash = info.Hash
+		attachment.Size = info.Size
+		attachment.StoredSize = info.StoredSize
+		attachment.Compression = info.Compression
+		attachment.Data = nil
+		moved = true
+		return nil
+	}
+	takeEntries := func(entries []Entry) error {
+		for i := range entries {
+			for j := range entries[i].Attachments {
+				if err := take(&entries[i].Attachments[j]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for attachmentID, attachment := range n.Attachments {
+		if err := take(&attachment); err != nil {
+			return moved, err
+		}
+		n.Attachments[attachmentID] = attachment
+	}
+	if err := takeEntries(n.Entries); err != nil {
+		return moved, err
+	}
+	for _, events := range []map[string]Event{n.Events, n.PlannedEvents} {
+		for _, event := range events {
+			if err := takeEntries(event.Entries); err != nil {
+				return moved, err
+			}
+		}
+	}
+	return moved, nil
+}
+
 // IsCompressibleType returns whether a file type should be compressed
 func IsCompressibleType(mimeType string) bool {
 	// List of mime types that are already compressed
@@ -57,32 +342,138 @@ func IsCompressibleType(mimeType string) bool {
 		"image/png":                    true,
 		"image/gif":                    true,
 		"image/webp":                   true,
+		"image/avif":                   true,
+		"image/heic":                   true,
 		"video/mp4":                    true,
 		"video/mpeg":                   true,
+		"video/webm":                   true,
+		"video/quicktime":              true,
 		"audio/mpeg":                   true,
 		"audio/mp4":                    true,
+		"audio/ogg":                    true,
+		"audio/aac":                    true,
+		"font/woff2":                   true,
 		"application/zip":              true,
+		"application/gzip":             true,
 		"application/x-gzip":           true,
+		"application/x-bzip2":          true,
+		"application/x-xz":             true,
+		"application/zstd":             true,
 		"application/x-rar-compressed": true,
 		"application/x-7z-compressed":  true,
 	}
 
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mimeType = mediaType
+	}
 	return !compressedTypes[mimeType]
 }
 
+// BlobHash returns the hash of the blob holding the attachment's contents,
+// empty for empty attachments, which need none
+func (a Attachment) BlobHash() string {
+	if a.Size == 0 {
+		return ""
+	}
+	return a.Hash
+}
+
+// Stored returns the bytes the attachment's contents take once compressed
+func (a Attachment) Stored() int64 {
+	if a.StoredSize == 0 {
+		return a.Size // Stored before sizes were recorded, or inline
+	}
+	return a.StoredSize
+}
+
+// UsageTotals add up the sizes of attachments
+type UsageTotals struct {
+	Count      int   `json:"count"`
+	Size       int64 `json:"size"`        // Bytes of the contents
+	StoredSize int64 `json:"stored_size"` // Bytes once compressed
+}
+
+func (t *UsageTotals) add(attachment Attachment) {
+	t.Count++
+	t.Size += attachment.Size
+	t.StoredSize += attachment.Stored()
+}
+
+// AttachmentUsage is the space the attachments in a subtree take
+type AttachmentUsage struct {
+	Path string `json:"path"`
+	// Every attachment, contents shared by several counted for each
+	Attachments UsageTotals `json:"attachments"`
+	// Distinct contents, each counted once as the blob store keeps them
+	Blobs UsageTotals            `json:"blobs"`
+	Types map[string]UsageTotals `json:"types"` // Attachments by MIME type, without parameters
+}
+
+// AttachmentUsage totals the attachments of the node and its descendants
+// the user can read, every node when userID is empty
+func (n *Node) AttachmentUsage(path string, userID string) AttachmentUsage {
+	usage := AttachmentUsage{Path: path, Types: make(map[string]UsageTotals)}
+	blobs := make(map[string]bool)
+	add := func(attachment Attachment) {
+		usage.Attachments.add(attachment)
+		mediaType, _, err := mime.ParseMediaType(attachment.Type)
+		if err != nil {
+			mediaType = "application/octet-stream"
+		}
+		totals := usage.Types[mediaType]
+		totals.add(attachment)
+		usage.Types[mediaType] = totals
+		if !blobs[attachment.Hash] {
+			blobs[attachment.Hash] = true
+			usage.Blobs.add(attachment)
+		}
+	}
+
+	for _, node := range n.Index() {
+		if userID != "" && !node.CheckPermission(userID, ReadPermission) {
+			continue
+		}
+		node.mutex.RLock()
+		for _, attachment := range node.Attachments {
+			add(attachment)
+		}
+		for _, entries := range node.allEntries() {
+			for _, entry := range entries {
+				for _, attachment := range entry.Attachments {
+					add(attachment)
+				}
+			}
+		}
+		node.mutex.RUnlock()
+	}
+	return usage
+}
+
+// allEntries returns the node's own entries and those of its events. The
+// mutex must be held.
+func (n *Node) allEntries() [][]Entry {
+	entries := [][]Entry{n.Entries}
+	for _, events := range []map[string]Event{n.Events, n.PlannedEvents} {
+		for _, event := range events {
+			entries = append(entries, event.Entries)
+		}
+	}
+	return entries
+}
+
 // GetAttachmentData returns the attachment data
 func (n *Node) GetAttachment(attachmentID string) (*Attachment, error) {
 	if attachment, exists := n.Attachments[attachmentID]; exists {
 		return &attachment, nil
 	}
-	return nil, fmt.Errorf("attachment not found: %s", attachmentID)
+	return nil, fmt.Errorf("%w: %s", ErrAttachmentNotFound, attachmentID)
 }
 
 // GetEntryAttachment returns an attachment from an event entry
 func (n *Node) GetEntryAttachment(eventID string, entryIndex int, attachmentID string) (*Attachment, error) {
 	event, exists := n.Events[eventID]
 	if !exists {
-		return nil, fmt.Errorf("event not found: %s", eventID)
+		return nil, fmt.Errorf("%w: %s", ErrEventNotFound, eventID)
 	}
 
 	if entryIndex < 0 || entryIndex >= len(event.Entries) {
@@ -95,5 +486,5 @@ func (n *Node) GetEntryAttachment(eventID string, entryIndex int, attachmentID s
 		}
 	}
 
-	return nil, fmt.Errorf("attachment not found: %s", attachmentID)
+	return nil, fmt.Errorf("%w: %s", ErrAttachmentNotFound, attachmentID)
 }
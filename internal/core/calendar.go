@@ -0,0 +1,478 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCalendar is returned for iCalendar data that cannot be parsed
+var ErrInvalidCalendar = errors.New("invalid calendar")
+
+const (
+	calendarUIDSuffix  = "@lumberjack"
+	calendarTimeLayout = "20060102T150405Z"
+	calendarDateLayout = "20060102"
+	calendarLineLength = 75 // Octets per line before folding, RFC 5545 section 3.1
+)
+
+// CalendarEvent is a VEVENT of an iCalendar feed
+type CalendarEvent struct {
+	UID          string
+	Summary      string
+	Description  string
+	Location     string
+	Start        time.Time
+	End          *time.Time
+	AllDay       bool // Start and End are dates
+	Category     string
+	RRule        string
+	ExDates      []time.Time
+	RecurrenceID *time.Time // Set on occurrences of a series that differ from its rule
+	Cancelled    bool
+	Path         string // Node the event is on, exported as X-LUMBERJACK-PATH
+	EventID      string
+	Status       EventStatus
+	Modified     time.Time
+}
+
+// CalendarUID returns the UID an event on a node is exported with
+func CalendarUID(nodeID, eventID string) string {
+	return eventID + "." + nodeID + calendarUIDSuffix
+}
+
+// CalendarEventID returns the event ID a UID exported from the node stands
+// for, or false when the UID came from elsewhere
+func CalendarEventID(nodeID, uid string) (string, bool) {
+	suffix := "." + nodeID + calendarUIDSuffix
+	if !strings.HasSuffix(uid, suffix) || len(uid) == len(suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(uid, suffix), true
+}
+
+// HasEvent reports whether the node has an event or planned event with the given ID
+func (n *Node) HasEvent(eventID string) bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	_, started := n.Events[eventID]
+	_, planned := n.PlannedEvents[eventID]
+	return started || planned
+}
+
+// CalendarEvents returns the node's events and planned events as calendar
+// events. A series is one event with its rule and cancelled occurrences;
+// occurrences that started or were edited on their own are added as
+// exceptions to it, the others follow from the rule.
+func (n *Node) CalendarEvents(path string) []CalendarEvent {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	var events []CalendarEvent
+	add := func(eventID string, event Event, planned bool) {
+		if event.StartTime == nil {
+			return
+		}
+		if event.SeriesID != "" && planned && !event.Detached {
+			return
+		}
+
+		calendarEvent := CalendarEvent{
+			UID:      CalendarUID(n.ID, eventID),
+			Summary:  eventID,
+			Start:    *event.StartTime,
+			Category: event.Category,
+			Path:     path,
+			EventID:  eventID,
+			Status:   event.Status,
+			Modified: event.ModifiedAt,
+		}
+		if calendarEvent.Modified.IsZero() {
+			calendarEvent.Modified = event.CreatedAt
+		}
+		if title, ok := event.Metadata["title"].(string); ok && title != "" {
+			calendarEvent.Summary = title
+		}
+		calendarEvent.Description, _ = event.Metadata["description"].(string)
+		calendarEvent.Location, _ = event.Metadata["location"].(string)
+
+		if event.Status == EventFinished {
+			calendarEvent.End = event.EndTime
+		} else {
+			calendarEvent.End = event.scheduledEnd()
+		}
+
+		if event.SeriesID != "" && event.Recurrence != nil {
+			calendarEvent.UID = CalendarUID(n.ID, event.SeriesID)
+			calendarEvent.RecurrenceID = event.Recurrence
+		} else if rule, err := event.Rule(); err == nil && rule != nil {
+			calendarEvent.RRule = rule.String()
+			calendarEvent.ExDates = event.Exceptions
+		}
+		events = append(events, calendarEvent)
+	}
+
+	for eventID, event := range n.Events {
+		add(eventID, event, false)
+	}
+	for eventID, event := range n.PlannedEvents {
+		if _, started := n.Events[eventID]; !started {
+			add(eventID, event, true)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].Start.Equal(events[j].Start) {
+			return events[i].Start.Before(events[j].Start)
+		}
+		return events[i].UID < events[j].UID
+	})
+	return events
+}
+
+// WriteCalendar writes the events as an iCalendar feed. Times are written in
+// UTC, so rules repeat at the same UTC time across daylight saving changes.
+func WriteCalendar(w io.Writer, name string, events []CalendarEvent) error {
+	writer := bufio.NewWriter(w)
+	line := func(name, value string) {
+		writeCalendarLine(writer, name+":"+value)
+	}
+	stamp := time.Now().UTC().Format(calendarTimeLayout)
+
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//vaziolabs//lumberjack//EN")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	if name != "" {
+		line("X-WR-CALNAME", escapeCalendarText(name))
+	}
+
+	for _, event := range events {
+		line("BEGIN", "VEVENT")
+		line("UID", event.UID)
+		line("DTSTAMP", stamp)
+		if event.AllDay {
+			line("DTSTART;VALUE=DATE", event.Start.Format(calendarDateLayout))
+			if event.End != nil {
+				line("DTEND;VALUE=DATE", event.End.Format(calendarDateLayout))
+			}
+		} else {
+			line("DTSTART", event.Start.UTC().Format(calendarTimeLayout))
+			if event.End != nil {
+				line("DTEND", event.End.UTC().Format(calendarTimeLayout))
+			}
+		}
+		if event.RecurrenceID != nil {
+			line("RECURRENCE-ID", event.RecurrenceID.UTC().Format(calendarTimeLayout))
+		}
+		if event.RRule != "" {
+			line("RRULE", event.RRule)
+		}
+		for _, exDate := range event.ExDates {
+			line("EXDATE", exDate.UTC().Format(calendarTimeLayout))
+		}
+		line("SUMMARY", escapeCalendarText(event.Summary))
+		if event.Description != "" {
+			line("DESCRIPTION", escapeCalendarText(event.Description))
+		}
+		if event.Location != "" {
+			line("LOCATION", escapeCalendarText(event.Location))
+		}
+		if event.Category != "" {
+			line("CATEGORIES", escapeCalendarText(event.Category))
+		}
+		if event.Cancelled {
+			line("STATUS", "CANCELLED")
+		}
+		if !event.Modified.IsZero() {
+			line("LAST-MODIFIED", event.Modified.UTC().Format(calendarTimeLayout))
+		}
+		if event.Path != "" {
+			line("X-LUMBERJACK-PATH", escapeCalendarText(event.Path))
+		}
+		if event.Status != "" {
+			line("X-LUMBERJACK-STATUS", string(event.Status))
+		}
+		line("END", "VEVENT")
+	}
+
+	line("END", "VCALENDAR")
+	return writer.Flush()
+}
+
+// writeCalendarLine writes a content line folded at 75 octets without
+// splitting UTF-8 sequences
+func writeCalendarLine(writer *bufio.Writer, content string) {
+	limit := calendarLineLength
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && content[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		writer.WriteString(content[:cut])
+		writer.WriteString("\r\n ")
+		content = content[cut:]
+		limit = calendarLineLength - 1
+	}
+	writer.WriteString(content)
+	writer.WriteString("\r\n")
+}
+
+var calendarTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func escapeCalendarText(text string) string {
+	return calendarTextEscaper.Replace(text)
+}
+
+func unescapeCalendarText(text string) string {
+	var result strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' || i == len(text)-1 {
+			result.WriteByte(text[i])
+			continue
+		}
+		i++
+		switch text[i] {
+		case 'n', 'N':
+			result.WriteByte('\n')
+		default:
+			result.WriteByte(text[i])
+		}
+	}
+	return result.String()
+}
+
+// calendarProperty is a content line split into its parts
+type calendarProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// ParseCalendar reads the VEVENTs of an iCalendar file. Times with a TZID are
+// read in that zone when it is known, and in UTC otherwise.
+func ParseCalendar(r io.Reader) ([]CalendarEvent, error) {
+	properties, err := readCalendarProperties(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []CalendarEvent
+	var current *CalendarEvent
+	var duration *time.Duration
+	depth := 0 // Components nested in the VEVENT, like VALARM, are skipped
+	for _, property := range properties {
+		switch {
+		case property.name == "BEGIN" && strings.EqualFold(property.value, "VEVENT") && current == nil:
+			current = &CalendarEvent{}
+			duration = nil
+			depth = 0
+			continue
+		case current == nil:
+			continue
+		case property.name == "BEGIN":
+			depth++
+			continue
+		case property.name == "END" && depth > 0:
+			depth--
+			continue
+		case depth > 0:
+			continue
+		case property.name == "END" && strings.EqualFold(property.value, "VEVENT"):
+			if current.Start.IsZero() {
+				return nil, fmt.Errorf("%w: event %q has no DTSTART", ErrInvalidCalendar, current.UID)
+			}
+			if current.End == nil && duration != nil {
+				end := current.Start.Add(*duration)
+				current.End = &end
+			}
+			events = append(events, *current)
+			current = nil
+			continue
+		}
+
+		switch property.name {
+		case "UID":
+			current.UID = property.value
+		case "SUMMARY":
+			current.Summary = unescapeCalendarText(property.value)
+		case "DESCRIPTION":
+			current.Description = unescapeCalendarText(property.value)
+		case "LOCATION":
+			current.Location = unescapeCalendarText(property.value)
+		case "CATEGORIES":
+			// Only the first category is kept, events have one
+			category, _, _ := strings.Cut(property.value, ",")
+			current.Category = unescapeCalendarText(category)
+		case "STATUS":
+			current.Cancelled = strings.EqualFold(property.value, "CANCELLED")
+		case "RRULE":
+			current.RRule = property.value
+		case "DTSTART":
+			start, allDay, err := parseCalendarTime(property)
+			if err != nil {
+				return nil, err
+			}
+			current.Start, current.AllDay = start, allDay
+		case "DTEND":
+			end, _, err := parseCalendarTime(property)
+			if err != nil {
+				return nil, err
+			}
+			current.End = &end
+		case "DURATION":
+			parsed, err := parseCalendarDuration(property.value)
+			if err != nil {
+				return nil, err
+			}
+			duration = &parsed
+		case "RECURRENCE-ID":
+			recurrenceID, _, err := parseCalendarTime(property)
+			if err != nil {
+				return nil, err
+			}
+			current.RecurrenceID = &recurrenceID
+		case "EXDATE":
+			for _, value := range strings.Split(property.value, ",") {
+				exDate, _, err := parseCalendarTime(calendarProperty{property.name, property.params, value})
+				if err != nil {
+					return nil, err
+				}
+				current.ExDates = append(current.ExDates, exDate)
+			}
+		case "X-LUMBERJACK-PATH":
+			current.Path = unescapeCalendarText(property.value)
+		}
+	}
+	if current != nil {
+		return nil, fmt.Errorf("%w: unterminated VEVENT", ErrInvalidCalendar)
+	}
+	return events, nil
+}
+
+// readCalendarProperties unfolds the content lines and splits them
+func readCalendarProperties(r io.Reader) ([]calendarProperty, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCalendar, err)
+	}
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, fmt.Errorf("%w: missing BEGIN:VCALENDAR", ErrInvalidCalendar)
+	}
+
+	properties := make([]calendarProperty, 0, len(lines))
+	for _, line := range lines {
+		property, err := parseCalendarProperty(line)
+		if err != nil {
+			return nil, err
+		}
+		properties = append(properties, property)
+	}
+	return properties, nil
+}
+
+// parseCalendarProperty splits name;param=value;param="quoted":value
+func parseCalendarProperty(line string) (calendarProperty, error) {
+	property := calendarProperty{params: make(map[string]string)}
+	quoted, colon := false, false
+	start := 0
+	var parts []string
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			quoted = !quoted
+		case ';', ':':
+			if quoted {
+				continue
+			}
+			parts = append(parts, line[start:i])
+			start = i + 1
+			if line[i] == ':' {
+				property.value = line[i+1:]
+				colon = true
+				i = len(line)
+			}
+		}
+	}
+	if !colon || parts[0] == "" {
+		return property, fmt.Errorf("%w: malformed line %q", ErrInvalidCalendar, line)
+	}
+
+	property.name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		key, value, _ := strings.Cut(param, "=")
+		property.params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+	}
+	return property, nil
+}
+
+// parseCalendarTime reads a DATE or DATE-TIME value, reporting whether it is a date
+func parseCalendarTime(property calendarProperty) (time.Time, bool, error) {
+	location := time.UTC
+	if tzid := property.params["TZID"]; tzid != "" {
+		if loaded, err := time.LoadLocation(tzid); err == nil {
+			location = loaded
+		}
+	}
+	value := strings.TrimSpace(property.value)
+
+	if strings.EqualFold(property.params["VALUE"], "DATE") || len(value) == len(calendarDateLayout) {
+		date, err := time.ParseInLocation(calendarDateLayout, value, location)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("%w: bad %s %q", ErrInvalidCalendar, property.name, value)
+		}
+		return date, true, nil
+	}
+	if at, err := time.Parse(calendarTimeLayout, value); err == nil {
+		return at, false, nil
+	}
+	at, err := time.ParseInLocation(strings.TrimSuffix(calendarTimeLayout, "Z"), value, location)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: bad %s %q", ErrInvalidCalendar, property.name, value)
+	}
+	return at, false, nil
+}
+
+var calendarDurationPattern = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseCalendarDuration reads a DURATION value such as PT1H30M or P1D
+func parseCalendarDuration(value string) (time.Duration, error) {
+	match := calendarDurationPattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(value)))
+	if match == nil || value == "P" || strings.HasSuffix(value, "T") {
+		return 0, fmt.Errorf("%w: bad DURATION %q", ErrInvalidCalendar, value)
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var duration time.Duration
+	for i, unit := range units {
+		if match[i+2] == "" {
+			continue
+		}
+		count, _ := strconv.Atoi(match[i+2])
+		duration += time.Duration(count) * unit
+	}
+	if match[1] == "-" {
+		duration = -duration
+	}
+	return duration, nil
+}
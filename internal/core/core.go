@@ -4,6 +4,7 @@ const (
 	ReadPermission Permission = iota
 	WritePermission
 	AdminPermission
+	DenyPermission // Explicitly revokes access inherited from parents
 )
 
 const (
@@ -36,7 +37,7 @@ func NewNode(nodeType NodeType, name string) *Node {
 		Children:      make(map[string]*Node),
 		Events:        make(map[string]Event),
 		PlannedEvents: make(map[string]Event),
-		Users:         []User{},
+		Grants:        []Grant{},
 		Entries:       []Entry{},
 	}
 }
@@ -44,5 +45,6 @@ func NewNode(nodeType NodeType, name string) *Node {
 // NewForest initializes a new forest with a root node
 func NewForest(rootNodeName string) *Node {
 	rootNode := NewNode(BranchNode, rootNodeName)
+	rootNode.Directory = NewUserDirectory()
 	return rootNode
 }
@@ -18,12 +18,19 @@ type EventStatus string
 type Event struct {
 	StartTime  *time.Time             `json:"start_time,omitempty"`
 	EndTime    *time.Time             `json:"end_time,omitempty"`
+	PlannedEnd *time.Time             `json:"planned_end,omitempty"` // End planned for a started event
+	OverdueFor *time.Time             `json:"overdue_for,omitempty"` // Planned end the event was last reported overdue for
+	Plan       *Event                 `json:"plan,omitempty"`        // Planned event this event was started from
 	Entries    []Entry                `json:"entries"`
 	Metadata   map[string]interface{} `json:"metadata"`
 	Status     EventStatus            `json:"status"`
 	Category   string                 `json:"category,omitempty"`
 	Frequency  string                 `json:"frequency,omitempty"`
 	Pattern    string                 `json:"pattern,omitempty"`
+	Exceptions []time.Time            `json:"exceptions,omitempty"`    // Cancelled occurrences of a series
+	SeriesID   string                 `json:"series_id,omitempty"`     // Series an occurrence belongs to
+	Recurrence *time.Time             `json:"recurrence_id,omitempty"` // Original start of an occurrence
+	Detached   bool                   `json:"detached,omitempty"`      // Edited on its own, kept when the series changes
 	CreatedBy  string                 `json:"created_by,omitempty"`
 	CreatedAt  time.Time              `json:"created_at,omitempty"`
 	ModifiedBy string                 `json:"modified_by,omitempty"`
@@ -57,33 +64,41 @@ type Entry struct {
 
 // Node represents a node in the tree-forest
 type Node struct {
-	ID            string                `json:"id"`
-	Type          NodeType              `json:"type"`
-	Name          string                `json:"name"`
-	Parents       map[string]string     `json:"parents"`
-	Children      map[string]*Node      `json:"children"`
-	Events        map[string]Event      `json:"events"`
-	PlannedEvents map[string]Event      `json:"planned_events"`
-	Users         []User                `json:"users"`
-	Entries       []Entry               `json:"entries"`
-	Attachments   map[string]Attachment `json:"attachments,omitempty"`
-	mutex         sync.RWMutex          `json:"-"`
-	CreatedBy     string                `json:"created_by,omitempty"`
-	CreatedAt     time.Time             `json:"created_at,omitempty"`
-	ModifiedBy    string                `json:"modified_by,omitempty"`
-	ModifiedAt    time.Time             `json:"modified_at,omitempty"`
+	ID            string                 `json:"id"`
+	Type          NodeType               `json:"type"`
+	Name          string                 `json:"name"`
+	Parents       map[string]string      `json:"parents"`
+	Children      map[string]*Node       `json:"children"`
+	Events        map[string]Event       `json:"events"`
+	PlannedEvents map[string]Event       `json:"planned_events"`
+	Directory     *UserDirectory         `json:"directory,omitempty"` // Set on the root node only
+	Grants        []Grant                `json:"grants"`
+	LegacyUsers   []User                 `json:"users,omitempty"` // Read only to migrate older state, see MigrateUsers
+	Entries       []Entry                `json:"entries"`
+	Attachments   map[string]Attachment  `json:"attachments,omitempty"`
+	TimeSessions  map[string]TimeSession `json:"time_sessions,omitempty"`
+	Webhooks      map[string]Webhook     `json:"webhooks,omitempty"`
+	Notifiers     map[string]Notifier    `json:"notifiers,omitempty"`
+	mutex         sync.RWMutex           `json:"-"`
+	parentNodes   map[string]*Node       // Runtime links matching Parents, see Link
+	CreatedBy     string                 `json:"created_by,omitempty"`
+	CreatedAt     time.Time              `json:"created_at,omitempty"`
+	ModifiedBy    string                 `json:"modified_by,omitempty"`
+	ModifiedAt    time.Time              `json:"modified_at,omitempty"`
 }
 
 // Add to existing types
 type Attachment struct {
-	ID         string    `json:"id"`
-	Name       string    `json:"name"`
-	Type       string    `json:"type"` // mime type
-	Size       int64     `json:"size"`
-	Hash       string    `json:"hash"` // sha256 hash
-	Data       []byte    `json:"data"` // actual file data stored in state file
-	UploadedBy string    `json:"uploaded_by"`
-	UploadedAt time.Time `json:"uploaded_at"`
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"` // mime type
+	Size        int64     `json:"size"`
+	Hash        string    `json:"hash"`                  // sha256 hash
+	StoredSize  int64     `json:"stored_size,omitempty"` // Bytes in the blob store once compressed
+	Compression string    `json:"compression,omitempty"` // How the blob store compressed the contents, if it did
+	Data        []byte    `json:"data,omitempty"`        // Contents in older state and exports, otherwise kept in the blob store
+	UploadedBy  string    `json:"uploaded_by"`
+	UploadedAt  time.Time `json:"uploaded_at"`
 }
 
 // User represents a user in the system
@@ -95,5 +110,28 @@ type User struct {
 	Password     string       `json:"password"`
 	Organization string       `json:"organization"`
 	Phone        string       `json:"phone"`
-	Permissions  []Permission `json:"permissions"`
+	Disabled     bool         `json:"disabled,omitempty"`
+	FeedToken    string       `json:"feed_token,omitempty"` // SHA-256 of the user's calendar feed token
+	CreatedAt    time.Time    `json:"created_at,omitempty"`
+	ModifiedAt   time.Time    `json:"modified_at,omitempty"`
+	Permissions  []Permission `json:"permissions,omitempty"` // Only present in older state
+}
+
+// UserProfile is the public view of a user, without credentials
+type UserProfile struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Username     string    `json:"username"`
+	Email        string    `json:"email"`
+	Organization string    `json:"organization"`
+	Phone        string    `json:"phone"`
+	Disabled     bool      `json:"disabled"`
+	CreatedAt    time.Time `json:"created_at,omitempty"`
+	ModifiedAt   time.Time `json:"modified_at,omitempty"`
+}
+
+// Grant gives a user from the directory a permission on a node
+type Grant struct {
+	UserID     string     `json:"user_id"`
+	Permission Permission `json:"permission"`
 }
@@ -0,0 +1,887 @@
+package core
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidExport is returned for exports that cannot be read or imported
+var ErrInvalidExport = errors.New("invalid export")
+
+// ExportVersion is the version of the documents written by Export, imports
+// refuse documents from a later version
+const ExportVersion = 1
+
+// Export formats
+const (
+	ExportJSON   = "json"   // One nested document
+	ExportNDJSON = "ndjson" // One row per line
+	ExportCSV    = "csv"    // One row per record, the whole record as JSON in its data column
+)
+
+// Kinds of flat export rows
+const (
+	ExportNodeRow  = "node"
+	ExportEventRow = "event"
+	ExportEntryRow = "entry"
+	ExportUserRow  = "user"
+)
+
+var exportKinds = []string{ExportNodeRow, ExportEventRow, ExportEntryRow, ExportUserRow}
+
+// exportColumns are the CSV columns of the flat rows
+var exportColumns = []string{"kind", "path", "node_id", "link", "event_id", "planned", "index",
+	"name", "status", "category", "user_id", "time", "end", "data"}
+
+// Archive layout: the document first, then one file per attachment named by
+// the SHA-256 of its contents
+const (
+	archiveDocument    = "lumberjack"
+	archiveAttachments = "attachments/"
+)
+
+// Export is a subtree of the forest along with the users it refers to
+type Export struct {
+	Version    int          `json:"version"`
+	ExportedAt time.Time    `json:"exported_at,omitempty"`
+	Path       string       `json:"path"` // Where the exported node was in its forest
+	Users      []ExportUser `json:"users"`
+	Root       ExportNode   `json:"root"`
+}
+
+// ExportUser is a user an export refers to
+type ExportUser struct {
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	Name         string `json:"name,omitempty"`
+	Email        string `json:"email,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	Phone        string `json:"phone,omitempty"`
+	Disabled     bool   `json:"disabled,omitempty"`
+	Password     string `json:"password,omitempty"` // Password hash, only with ExportOptions.Credentials
+}
+
+// ExportNode is a node with its subtree. A node with several parents is
+// exported in full under the first of them and as a link under the others.
+type ExportNode struct {
+	ID            string                 `json:"id"`
+	Name          string                 `json:"name"`
+	Type          NodeType               `json:"type"`
+	Link          bool                   `json:"link,omitempty"`
+	Grants        []Grant                `json:"grants,omitempty"`
+	Entries       []Entry                `json:"entries,omitempty"`
+	Events        map[string]Event       `json:"events,omitempty"`
+	PlannedEvents map[string]Event       `json:"planned_events,omitempty"`
+	Attachments   map[string]Attachment  `json:"attachments,omitempty"`
+	TimeSessions  map[string]TimeSession `json:"time_sessions,omitempty"`
+	Children      []ExportNode           `json:"children,omitempty"`
+	CreatedBy     string                 `json:"created_by,omitempty"`
+	CreatedAt     time.Time              `json:"created_at,omitempty"`
+	ModifiedBy    string                 `json:"modified_by,omitempty"`
+	ModifiedAt    time.Time              `json:"modified_at,omitempty"`
+}
+
+// ExportRow is one record of a flat export. The columns before Data describe
+// the record for spreadsheets and filters, Data holds all of it and is what
+// imports read.
+type ExportRow struct {
+	Kind     string          `json:"kind"`
+	Path     string          `json:"path,omitempty"` // Relative to the exported node
+	NodeID   string          `json:"node_id,omitempty"`
+	Link     bool            `json:"link,omitempty"`
+	EventID  string          `json:"event_id,omitempty"`
+	Planned  bool            `json:"planned,omitempty"`
+	Index    *int            `json:"index,omitempty"` // Position of an entry in its node or event
+	Name     string          `json:"name,omitempty"`  // Name of a node, username of a user
+	Status   EventStatus     `json:"status,omitempty"`
+	Category string          `json:"category,omitempty"`
+	UserID   string          `json:"user_id,omitempty"`
+	Time     *time.Time      `json:"time,omitempty"` // Start of an event, timestamp of an entry, creation of a node
+	End      *time.Time      `json:"end,omitempty"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// ExportOptions control what Export includes
+type ExportOptions struct {
+	UserID      string     // Leaves out what the user cannot read, nothing is left out when empty
+	Data        bool       // Keep the contents of attachments
+	Blobs       BlobReader // Where contents the nodes do not hold are read from
+	Directory   bool       // Every user of the directory rather than those the export refers to
+	Credentials bool       // Keep the password hashes of the users
+}
+
+// ImportOptions control how Import merges an export
+type ImportOptions struct {
+	UserID      string              // Who imports, needing admin permission on the target; anyone when empty
+	Credentials bool                // Keep the password hashes of the users the import creates
+	Blobs       map[string]BlobInfo // Attachment contents stored from an archive, by SHA-256
+	Store       BlobStorer          // Where Blobs are, taking a reference for each attachment using one
+}
+
+// ImportReport counts what an import added
+type ImportReport struct {
+	Path        string       `json:"path"`
+	Nodes       int          `json:"nodes"`
+	Links       int          `json:"links"`
+	Events      int          `json:"events"`
+	Entries     int          `json:"entries"`
+	Attachments int          `json:"attachments"`
+	Sessions    int          `json:"time_sessions"`
+	Users       int          `json:"users"`
+	Skipped     []ImportSkip `json:"skipped"`
+}
+
+// ImportSkip is something an import left out
+type ImportSkip struct {
+	Path   string `json:"path"`
+	Item   string `json:"item,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ParseExportKinds reads a comma separated list of row kinds, every kind when empty
+func ParseExportKinds(value string) ([]string, error) {
+	kinds := splitList(value)
+	for _, kind := range kinds {
+		if !containsString(exportKinds, kind) {
+			return nil, fmt.Errorf("unknown row kind %q, expected one of %s", kind, strings.Join(exportKinds, ", "))
+		}
+	}
+	return kinds, nil
+}
+
+// exporter walks a subtree, remembering the nodes already exported and the
+// users referred to along the way
+type exporter struct {
+	options ExportOptions
+	visible map[string]bool
+	users   map[string]bool
+}
+
+// Export returns the subtree at n, which sits at path in its forest, with the
+// users of the directory it refers to
+func (n *Node) Export(path string, directory *UserDirectory, options ExportOptions) *Export {
+	walker := &exporter{options: options, visible: make(map[string]bool), users: make(map[string]bool)}
+	root, _ := walker.node(n)
+
+	export := &Export{
+		Version:    ExportVersion,
+		ExportedAt: time.Now().UTC(),
+		Path:       path,
+		Users:      []ExportUser{},
+		Root:       root,
+	}
+	if directory == nil {
+		return export
+	}
+	for _, user := range directory.List() {
+		if !options.Directory && !walker.users[user.ID] {
+			continue
+		}
+		exported := ExportUser{
+			ID:           user.ID,
+			Username:     user.Username,
+			Name:         user.Name,
+			Email:        user.Email,
+			Organization: user.Organization,
+			Phone:        user.Phone,
+			Disabled:     user.Disabled,
+		}
+		if options.Credentials {
+			exported.Password = user.Password
+		}
+		export.Users = append(export.Users, exported)
+	}
+	return export
+}
+
+// node exports n and reports whether any of it is readable
+func (e *exporter) node(n *Node) (ExportNode, bool) {
+	if visible, seen := e.visible[n.ID]; seen {
+		return ExportNode{ID: n.ID, Name: n.Name, Type: n.Type, Link: true}, visible
+	}
+	e.visible[n.ID] = false
+	readable := e.options.UserID == "" || n.CheckPermission(e.options.UserID, ReadPermission)
+
+	n.mutex.RLock()
+	exported := ExportNode{ID: n.ID, Name: n.Name, Type: n.Type}
+	if readable {
+		exported.Grants = append([]Grant(nil), n.Grants...)
+		exported.Entries = e.entries(n.Entries)
+		exported.Events = e.events(n.Events)
+		exported.PlannedEvents = e.events(n.PlannedEvents)
+		if len(n.Attachments) > 0 {
+			exported.Attachments = make(map[string]Attachment, len(n.Attachments))
+			for attachmentID, attachment := range n.Attachments {
+				exported.Attachments[attachmentID] = e.attachment(attachment)
+				e.refer(attachment.UploadedBy)
+			}
+		}
+		if len(n.TimeSessions) > 0 {
+			exported.TimeSessions = make(map[string]TimeSession, len(n.TimeSessions))
+			for sessionID, session := range n.TimeSessions {
+				exported.TimeSessions[sessionID] = session
+				e.refer(session.UserID, session.ModifiedBy)
+			}
+		}
+		exported.CreatedBy = n.CreatedBy
+		exported.CreatedAt = n.CreatedAt
+		exported.ModifiedBy = n.ModifiedBy
+		exported.ModifiedAt = n.ModifiedAt
+
+		e.refer(n.CreatedBy, n.ModifiedBy)
+		for _, grant := range n.Grants {
+			e.refer(grant.UserID)
+		}
+		e.referEntries(n.Entries)
+		for _, events := range []map[string]Event{n.Events, n.PlannedEvents} {
+			for _, event := range events {
+				e.refer(event.CreatedBy, event.ModifiedBy)
+				e.referEntries(event.Entries)
+			}
+		}
+	}
+	n.mutex.RUnlock()
+
+	children := n.ChildNodes()
+
+	// Children in name order, so a node with several parents is exported in
+	// full under the same parent every time
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].Name != children[j].Name {
+			return children[i].Name < children[j].Name
+		}
+		return children[i].ID < children[j].ID
+	})
+
+	visible := readable
+	for _, child := range children {
+		if exportedChild, childVisible := e.node(child); childVisible {
+			exported.Children = append(exported.Children, exportedChild)
+			visible = true
+		}
+	}
+	e.visible[n.ID] = visible
+	return exported, visible
+}
+
+func (e *exporter) refer(userIDs ...string) {
+	for _, userID := range userIDs {
+		if userID != "" {
+			e.users[userID] = true
+		}
+	}
+}
+
+func (e *exporter) referEntries(entries []Entry) {
+	for _, entry := range entries {
+		e.refer(entry.UserID, entry.CreatedBy, entry.ModifiedBy)
+		for _, attachment := range entry.Attachments {
+			e.refer(attachment.UploadedBy)
+		}
+	}
+}
+
+// attachment returns the attachment as exported, its contents read from the
+// blob store when they are wanted and the node does not hold them
+func (e *exporter) attachment(attachment Attachment) Attachment {
+	if !e.options.Data {
+		attachment.Data = nil
+	} else if len(attachment.Data) == 0 && attachment.Hash != "" && e.options.Blobs != nil {
+		if data, err := e.options.Blobs.ReadBlob(attachment.Hash); err == nil {
+			attachment.Data = data
+		}
+	}
+	return attachment
+}
+
+// entries copies entries, so the contents of their attachments can be taken
+// out of the copy without touching the node
+func (e *exporter) entries(entries []Entry) []Entry {
+	if entries == nil {
+		return nil
+	}
+	copied := make([]Entry, len(entries))
+	for i, entry := range entries {
+		if entry.Attachments != nil {
+			attachments := make([]Attachment, len(entry.Attachments))
+			for j, attachment := range entry.Attachments {
+				attachments[j] = e.attachment(attachment)
+			}
+			entry.Attachments = attachments
+		}
+		copied[i] = entry
+	}
+	return copied
+}
+
+func (e *exporter) events(events map[string]Event) map[string]Event {
+	if len(events) == 0 {
+		return nil
+	}
+	copied := make(map[string]Event, len(events))
+	for eventID, event := range events {
+		event.Entries = e.entries(event.Entries)
+		copied[eventID] = event
+	}
+	return copied
+}
+
+// Rows flattens the export into rows of the given kinds, every kind when none
+// are given: users first, then each node followed by its events, the entries
+// of each event and the node's own entries
+func (export *Export) Rows(kinds []string) ([]ExportRow, error) {
+	wanted := func(kind string) bool {
+		return len(kinds) == 0 || containsString(kinds, kind)
+	}
+
+	var rows []ExportRow
+	add := func(row ExportRow, record interface{}) error {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		row.Data = data
+		rows = append(rows, row)
+		return nil
+	}
+
+	if wanted(ExportUserRow) {
+		for _, user := range export.Users {
+			if err := add(ExportRow{Kind: ExportUserRow, UserID: user.ID, Name: user.Username}, user); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var walk func(node ExportNode, names []string) error
+	walk = func(node ExportNode, names []string) error {
+		nodePath := JoinPath(names...)
+		if wanted(ExportNodeRow) {
+			own := node
+			own.Entries, own.Events, own.PlannedEvents, own.Children = nil, nil, nil, nil
+			row := ExportRow{Kind: ExportNodeRow, Path: nodePath, NodeID: node.ID, Link: node.Link, Name: node.Name, UserID: node.CreatedBy}
+			if !node.CreatedAt.IsZero() {
+				row.Time = &own.CreatedAt
+			}
+			if err := add(row, own); err != nil {
+				return err
+			}
+		}
+
+		for _, planned := range []bool{false, true} {
+			events := node.Events
+			if planned {
+				events = node.PlannedEvents
+			}
+			eventIDs := make([]string, 0, len(events))
+			for eventID := range events {
+				eventIDs = append(eventIDs, eventID)
+			}
+			sort.Strings(eventIDs)
+
+			for _, eventID := range eventIDs {
+				event := events[eventID]
+				if wanted(ExportEventRow) {
+					own := event
+					own.Entries = nil
+					row := ExportRow{
+						Kind:     ExportEventRow,
+						Path:     nodePath,
+						NodeID:   node.ID,
+						EventID:  eventID,
+						Planned:  planned,
+						Status:   event.Status,
+						Category: event.Category,
+						UserID:   event.CreatedBy,
+						Time:     event.StartTime,
+						End:      event.EndTime,
+					}
+					if err := add(row, own); err != nil {
+						return err
+					}
+				}
+				if err := addEntries(add, wanted, event.Entries, ExportRow{Path: nodePath, NodeID: node.ID, EventID: eventID, Planned: planned}); err != nil {
+					return err
+				}
+			}
+		}
+		if err := addEntries(add, wanted, node.Entries, ExportRow{Path: nodePath, NodeID: node.ID}); err != nil {
+			return err
+		}
+
+		for _, child := range node.Children {
+			if err := walk(child, append(names[:len(names):len(names)], child.Name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(export.Root, nil); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func addEntries(add func(ExportRow, interface{}) error, wanted func(string) bool, entries []Entry, base ExportRow) error {
+	if !wanted(ExportEntryRow) {
+		return nil
+	}
+	for i, entry := range entries {
+		row := base
+		row.Kind = ExportEntryRow
+		row.Index = new(int)
+		*row.Index = i
+		row.UserID = entry.UserID
+		row.Time = &entries[i].Timestamp
+		if err := add(row, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes the export in the given format, flat formats holding only
+// rows of the given kinds
+func (export *Export) Write(w io.Writer, format string, kinds []string) error {
+	if format == ExportJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(export)
+	}
+
+	rows, err := export.Rows(kinds)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case ExportNDJSON:
+		encoder := json.NewEncoder(w)
+		for _, row := range rows {
+			if err := encoder.Encode(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ExportCSV:
+		writer := csv.NewWriter(w)
+		writer.Write(exportColumns)
+		for _, row := range rows {
+			writer.Write(row.record())
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	return fmt.Errorf("unknown export format %q, expected json, ndjson or csv", format)
+}
+
+func (row ExportRow) record() []string {
+	formatTime := func(at *time.Time) string {
+		if at == nil || at.IsZero() {
+			return ""
+		}
+		return at.UTC().Format(time.RFC3339Nano)
+	}
+	formatBool := func(value bool) string {
+		if !value {
+			return ""
+		}
+		return "true"
+	}
+	index := ""
+	if row.Index != nil {
+		index = strconv.Itoa(*row.Index)
+	}
+	return []string{row.Kind, row.Path, row.NodeID, formatBool(row.Link), row.EventID, formatBool(row.Planned), index,
+		row.Name, string(row.Status), row.Category, row.UserID, formatTime(row.Time), formatTime(row.End), string(row.Data)}
+}
+
+// WriteArchive writes a tar holding the export in the given format, with the
+// contents of its attachments as files next to it rather than inside it
+func (export *Export) WriteArchive(w io.Writer, format string, kinds []string) error {
+	blobs := export.takeBlobs()
+
+	var document bytes.Buffer
+	if err := export.Write(&document, format, kinds); err != nil {
+		return err
+	}
+
+	archive := tar.NewWriter(w)
+	modified := export.ExportedAt
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	write := func(name string, data []byte) error {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modified, Typeflag: tar.TypeReg}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := archive.Write(data)
+		return err
+	}
+
+	if err := write(archiveDocument+"."+format, document.Bytes()); err != nil {
+		return err
+	}
+	hashes := make([]string, 0, len(blobs))
+	for hash := range blobs {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		if err := write(archiveAttachments+hash, blobs[hash]); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// takeBlobs moves the contents of every attachment out of the export, keyed
+// by their SHA-256
+func (export *Export) takeBlobs() map[string][]byte {
+	blobs := make(map[string][]byte)
+	take := func(attachment *Attachment) {
+		if len(attachment.Data) > 0 {
+			hash := sha256.Sum256(attachment.Data)
+			blobs[hex.EncodeToString(hash[:])] = attachment.Data
+		}
+		attachment.Data = nil
+	}
+	takeEntries := func(entries []Entry) {
+		for i := range entries {
+			for j := range entries[i].Attachments {
+				take(&entries[i].Attachments[j])
+			}
+		}
+	}
+
+	var walk func(node *ExportNode)
+	walk = func(node *ExportNode) {
+		for attachmentID, attachment := range node.Attachments {
+			take(&attachment)
+			node.Attachments[attachmentID] = attachment
+		}
+		takeEntries(node.Entries)
+		for _, events := range []map[string]Event{node.Events, node.PlannedEvents} {
+			for _, event := range events {
+				takeEntries(event.Entries)
+			}
+		}
+		for i := range node.Children {
+			walk(&node.Children[i])
+		}
+	}
+	walk(&export.Root)
+	return blobs
+}
+
+// ReadImport reads an export written by Write or WriteArchive. Archives are
+// recognised by their contents and hold their own format, format names the
+// format of anything else and defaults to json. The attachment contents of an
+// archive are streamed into store and described by SHA-256, each holding a
+// reference the caller releases once the export is imported.
+func ReadImport(r io.Reader, format string, store BlobStorer) (*Export, map[string]BlobInfo, error) {
+	reader := bufio.NewReaderSize(r, 512)
+	header, _ := reader.Peek(512)
+	if len(header) == 512 && string(header[257:262]) == "ustar" {
+		return readArchive(reader, store)
+	}
+	export, err := ReadExport(reader, format)
+	return export, nil, err
+}
+
+// memberReader keeps why reading an archive member failed, telling a broken
+// archive apart from contents that could not be stored
+type memberReader struct {
+	r   io.Reader
+	err error
+}
+
+func (m *memberReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	if err != nil && err != io.EOF {
+		m.err = err
+	}
+	return n, err
+}
+
+func readArchive(r io.Reader, store BlobStorer) (*Export, map[string]BlobInfo, error) {
+	archive := tar.NewReader(r)
+	blobs := make(map[string]BlobInfo)
+	var export *Export
+	fail := func(err error) (*Export, map[string]BlobInfo, error) {
+		for hash := range blobs {
+			store.Release(hash)
+		}
+		return nil, nil, err
+	}
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(fmt.Errorf("%w: %v", ErrInvalidExport, err))
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		switch {
+		case strings.HasPrefix(name, archiveAttachments):
+			hash := strings.TrimPrefix(name, archiveAttachments)
+			if _, exists := blobs[hash]; exists {
+				continue
+			}
+			// Types are not known here, so compressing is tried and the smaller kept
+			member := &memberReader{r: archive}
+			info, err := store.WriteBlobFrom(member, true)
+			if member.err != nil {
+				return fail(fmt.Errorf("%w: %v", ErrInvalidExport, member.err))
+			}
+			if err != nil {
+				return fail(fmt.Errorf("failed to store %s: %v", name, err))
+			}
+			// Contents not matching their name are left out
+			if info.Hash != hash {
+				store.Release(info.Hash)
+				continue
+			}
+			blobs[hash] = info
+		case strings.HasPrefix(name, archiveDocument+".") && export == nil:
+			if export, err = ReadExport(archive, strings.TrimPrefix(name, archiveDocument+".")); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if export == nil {
+		return fail(fmt.Errorf("%w: the archive holds no %s document", ErrInvalidExport, archiveDocument))
+	}
+	return export, blobs, nil
+}
+
+// ReadExport reads an export written by Write in the given format
+func ReadExport(r io.Reader, format string) (*Export, error) {
+	var rows []ExportRow
+	switch format {
+	case "", ExportJSON:
+		var export Export
+		if err := json.NewDecoder(r).Decode(&export); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidExport, err)
+		}
+		if export.Version > ExportVersion {
+			return nil, fmt.Errorf("%w: version %d is newer than this server reads", ErrInvalidExport, export.Version)
+		}
+		return &export, nil
+	case ExportNDJSON:
+		decoder := json.NewDecoder(r)
+		for {
+			var row ExportRow
+			err := decoder.Decode(&row)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: row %d: %v", ErrInvalidExport, len(rows)+1, err)
+			}
+			rows = append(rows, row)
+		}
+	case ExportCSV:
+		reader := csv.NewReader(r)
+		header, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidExport, err)
+		}
+		columns := make(map[string]int, len(header))
+		for i, column := range header {
+			columns[column] = i
+		}
+		for _, column := range []string{"kind", "path", "event_id", "planned", "index", "data"} {
+			if _, exists := columns[column]; !exists {
+				return nil, fmt.Errorf("%w: missing column %s", ErrInvalidExport, column)
+			}
+		}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidExport, err)
+			}
+			row := ExportRow{
+				Kind:    record[columns["kind"]],
+				Path:    record[columns["path"]],
+				EventID: record[columns["event_id"]],
+				Planned: record[columns["planned"]] == "true",
+				Data:    json.RawMessage(record[columns["data"]]),
+			}
+			if value := record[columns["index"]]; value != "" {
+				index, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("%w: bad index %q", ErrInvalidExport, value)
+				}
+				row.Index = &index
+			}
+			rows = append(rows, row)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown format %q, expected json, ndjson or csv", ErrInvalidExport, format)
+	}
+	return exportFromRows(rows)
+}
+
+// exportFromRows puts flat rows back together. Nodes are placed by path, so
+// every node needs the row of its parent.
+func exportFromRows(rows []ExportRow) (*Export, error) {
+	export := &Export{Version: ExportVersion, Users: []ExportUser{}}
+	nodes := make(map[string]*ExportNode)
+	var paths []string
+	type eventKey struct {
+		path    string
+		planned bool
+		eventID string
+	}
+	events := make(map[eventKey]*Event)
+	var eventKeys []eventKey
+	type indexedEntry struct {
+		index int
+		entry Entry
+	}
+	entries := make(map[eventKey][]indexedEntry)
+
+	for i, row := range rows {
+		fail := func(err error) error {
+			return fmt.Errorf("%w: row %d: %v", ErrInvalidExport, i+1, err)
+		}
+		switch row.Kind {
+		case ExportUserRow:
+			var user ExportUser
+			if err := json.Unmarshal(row.Data, &user); err != nil {
+				return nil, fail(err)
+			}
+			export.Users = append(export.Users, user)
+		case ExportNodeRow:
+			var node ExportNode
+			if err := json.Unmarshal(row.Data, &node); err != nil {
+				return nil, fail(err)
+			}
+			if _, exists := nodes[row.Path]; exists {
+				return nil, fail(fmt.Errorf("node %s appears twice", row.Path))
+			}
+			node.Children = nil
+			nodes[row.Path] = &node
+			paths = append(paths, row.Path)
+		case ExportEventRow:
+			var event Event
+			if err := json.Unmarshal(row.Data, &event); err != nil {
+				return nil, fail(err)
+			}
+			if row.EventID == "" {
+				return nil, fail(fmt.Errorf("event without an ID"))
+			}
+			key := eventKey{row.Path, row.Planned, row.EventID}
+			events[key] = &event
+			eventKeys = append(eventKeys, key)
+		case ExportEntryRow:
+			var entry Entry
+			if err := json.Unmarshal(row.Data, &entry); err != nil {
+				return nil, fail(err)
+			}
+			key := eventKey{row.Path, row.Planned, row.EventID}
+			index := len(entries[key])
+			if row.Index != nil {
+				index = *row.Index
+			}
+			entries[key] = append(entries[key], indexedEntry{index, entry})
+		default:
+			return nil, fail(fmt.Errorf("unknown row kind %q", row.Kind))
+		}
+	}
+
+	if _, exists := nodes[""]; !exists {
+		return nil, fmt.Errorf("%w: no row for the exported node", ErrInvalidExport)
+	}
+
+	for _, key := range eventKeys {
+		node, exists := nodes[key.path]
+		if !exists {
+			return nil, fmt.Errorf("%w: event %s on %s has no node row", ErrInvalidExport, key.eventID, key.path)
+		}
+		target := &node.Events
+		if key.planned {
+			target = &node.PlannedEvents
+		}
+		if *target == nil {
+			*target = make(map[string]Event)
+		}
+		(*target)[key.eventID] = *events[key]
+	}
+	for key, list := range entries {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].index < list[j].index })
+		collected := make([]Entry, len(list))
+		for i, item := range list {
+			collected[i] = item.entry
+		}
+
+		node, exists := nodes[key.path]
+		if !exists {
+			return nil, fmt.Errorf("%w: entries on %s have no node row", ErrInvalidExport, key.path)
+		}
+		if key.eventID == "" {
+			node.Entries = collected
+			continue
+		}
+		events := node.Events
+		if key.planned {
+			events = node.PlannedEvents
+		}
+		event, exists := events[key.eventID]
+		if !exists {
+			return nil, fmt.Errorf("%w: entries of event %s on %s have no event row", ErrInvalidExport, key.eventID, key.path)
+		}
+		event.Entries = collected
+		events[key.eventID] = event
+	}
+
+	// Attach every node to the row of its parent, in the order of the rows
+	children := make(map[string][]string)
+	for _, nodePath := range paths {
+		if nodePath == "" {
+			continue
+		}
+		names, err := SplitPath(nodePath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidExport, err)
+		}
+		parentPath := JoinPath(names[:len(names)-1]...)
+		if _, exists := nodes[parentPath]; !exists {
+			return nil, fmt.Errorf("%w: node %s has no parent row", ErrInvalidExport, nodePath)
+		}
+		children[parentPath] = append(children[parentPath], nodePath)
+	}
+	var assemble func(nodePath string) ExportNode
+	assemble = func(nodePath string) ExportNode {
+		node := *nodes[nodePath]
+		for _, childPath := range children[nodePath] {
+			node.Children = append(node.Children, assemble(childPath))
+		}
+		return node
+	}
+	export.Root = assemble("")
+	return export, nil
+}
@@ -0,0 +1,105 @@
+package core
+
+import "fmt"
+
+// AssignUser grants a user a permission on the node, replacing any grant the
+// user already holds there
+func (n *Node) AssignUser(userID string, permission Permission) error {
+	if userID == "" {
+		return fmt.Errorf("user ID is required")
+	}
+	if permission < ReadPermission || permission > DenyPermission {
+		return fmt.Errorf("invalid permission: %d", permission)
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for i := range n.Grants {
+		if n.Grants[i].UserID == userID {
+			n.Grants[i].Permission = permission
+			return nil
+		}
+	}
+	n.Grants = append(n.Grants, Grant{UserID: userID, Permission: permission})
+	return nil
+}
+
+// RevokeUser removes the user's grant from the node, reporting whether it had one
+func (n *Node) RevokeUser(userID string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for i := range n.Grants {
+		if n.Grants[i].UserID == userID {
+			n.Grants = append(n.Grants[:i], n.Grants[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveUser removes the user's grants from every node in the tree and
+// returns the nodes that changed
+func (n *Node) RemoveUser(userID string) []*Node {
+	var changed []*Node
+	for _, node := range n.Index() {
+		if node.RevokeUser(userID) {
+			changed = append(changed, node)
+		}
+	}
+	return changed
+}
+
+// MigrateUsers moves users stored on nodes by older versions into the root's
+// directory, turning each copy into a grant, and returns the nodes that
+// changed. A user's strongest permission on a node becomes its grant there,
+// unless the copy held a deny.
+func (n *Node) MigrateUsers() []*Node {
+	var changed []*Node
+	rootChanged := n.Directory == nil
+	if rootChanged {
+		n.Directory = NewUserDirectory()
+	}
+
+	for _, node := range n.Index() {
+		if len(node.LegacyUsers) == 0 {
+			continue
+		}
+
+		for _, user := range node.LegacyUsers {
+			if _, err := n.Directory.Get(user.ID); err != nil && user.Username != "" && user.Password != "" {
+				if _, err := n.Directory.Add(user); err != nil {
+					// Keep the account reachable under a name that is free
+					user.Username = user.Username + "-" + user.ID
+					n.Directory.Add(user)
+				}
+			}
+
+			permission := noPermission
+			for _, p := range user.Permissions {
+				if p == DenyPermission {
+					permission = DenyPermission
+					break
+				}
+				if p > permission {
+					permission = p
+				}
+			}
+			if permission != noPermission {
+				node.AssignUser(user.ID, permission)
+			}
+		}
+
+		node.LegacyUsers = nil
+		rootChanged = true
+		if node != n {
+			changed = append(changed, node)
+		}
+	}
+	if rootChanged {
+		// Every migrated account is stored on the root, so it is recorded last
+		changed = append(changed, n)
+	}
+	return changed
+}
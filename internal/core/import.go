@@ -0,0 +1,344 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// importer merges an export into the forest, keeping track of the users and
+// nodes it maps and the nodes it changes
+type importer struct {
+	forest  *Node
+	options ImportOptions
+	report  *ImportReport
+	users   map[string]string // Exported user IDs to the IDs of the matching users
+	nodes   map[string]*Node  // Exported node IDs to the nodes they were merged into
+	index   map[string]*Node
+	changed map[*Node]bool
+	updated []*Node
+}
+
+// Import merges an export into the node at path, which must exist. Nodes are
+// matched by path: the exported node is merged into the target and each of
+// its descendants into the child of the same name, which is created when
+// missing. Events, attachments and time sessions are added when the node has
+// none with their ID, entries when it has none with the same user, timestamp
+// and content, so importing the same export again adds nothing. Users are
+// matched by username and created when missing, without a password unless
+// Credentials is set. Call it on the forest's root; it returns what was added
+// under the target's canonical path, along with the nodes that changed.
+func (n *Node) Import(path string, export *Export, options ImportOptions) (ImportReport, []*Node, error) {
+	report := ImportReport{Path: path, Skipped: []ImportSkip{}}
+	if export.Version > ExportVersion {
+		return report, nil, fmt.Errorf("%w: version %d is newer than this server reads", ErrInvalidExport, export.Version)
+	}
+	target, err := n.Resolve(path)
+	if err != nil {
+		return report, nil, err
+	}
+	if paths := n.Paths(target.ID); len(paths) > 0 {
+		report.Path = paths[0]
+	}
+	if options.UserID != "" && !target.CheckPermission(options.UserID, AdminPermission) {
+		return report, nil, fmt.Errorf("insufficient permissions")
+	}
+
+	merger := &importer{
+		forest:  n,
+		options: options,
+		report:  &report,
+		users:   make(map[string]string),
+		nodes:   make(map[string]*Node),
+		index:   n.Index(),
+		changed: make(map[*Node]bool),
+	}
+	merger.importUsers(export.Users)
+	names, _ := SplitPath(report.Path)
+	merger.merge(target, export.Root, names)
+	return report, merger.updated, nil
+}
+
+func (i *importer) touch(nodes ...*Node) {
+	for _, node := range nodes {
+		if !i.changed[node] {
+			i.changed[node] = true
+			i.updated = append(i.updated, node)
+		}
+	}
+}
+
+func (i *importer) skip(names []string, item string, reason string) {
+	i.report.Skipped = append(i.report.Skipped, ImportSkip{Path: JoinPath(names...), Item: item, Reason: reason})
+}
+
+// importUsers maps every exported user to the user with the same username,
+// adding the users the directory lacks
+func (i *importer) importUsers(users []ExportUser) {
+	directory := i.forest.Directory
+	if directory == nil {
+		return
+	}
+	for _, user := range users {
+		if user.Username == "" {
+			i.skip(nil, "user "+user.ID, "no username")
+			continue
+		}
+		if existing, err := directory.FindByUsername(user.Username); err == nil {
+			i.users[user.ID] = existing.ID
+			continue
+		}
+
+		created := User{
+			ID:           user.ID,
+			Name:         user.Name,
+			Username:     user.Username,
+			Email:        user.Email,
+			Organization: user.Organization,
+			Phone:        user.Phone,
+			Disabled:     user.Disabled,
+		}
+		if i.options.Credentials {
+			created.Password = user.Password
+		}
+		if _, err := directory.Get(user.ID); err == nil {
+			created.ID = ""
+		}
+		added, err := directory.Add(created)
+		if err != nil {
+			i.skip(nil, "user "+user.Username, err.Error())
+			continue
+		}
+		i.users[user.ID] = added.ID
+		i.report.Users++
+		i.touch(i.forest)
+	}
+}
+
+func (i *importer) user(userID string) string {
+	if mapped, exists := i.users[userID]; exists {
+		return mapped
+	}
+	return userID
+}
+
+// merge adds what the exported node holds to local, then merges its children
+func (i *importer) merge(local *Node, source ExportNode, names []string) {
+	i.nodes[source.ID] = local
+	if i.mergeOwn(local, source, names) {
+		i.touch(local)
+	}
+
+	for _, child := range source.Children {
+		childNames := append(names[:len(names):len(names)], child.Name)
+		if child.Link {
+			i.link(local, child, childNames)
+			continue
+		}
+
+		var target *Node
+		switch matches := local.childrenNamed(child.Name); len(matches) {
+		case 0:
+			if local.Type != BranchNode {
+				i.skip(childNames, "", "cannot add children to a leaf node")
+				continue
+			}
+			target = NewNode(child.Type, child.Name)
+			if _, taken := i.index[child.ID]; child.ID != "" && !taken {
+				target.ID = child.ID
+			}
+			target.CreatedBy = i.user(child.CreatedBy)
+			target.CreatedAt = child.CreatedAt
+			if target.CreatedBy == "" {
+				target.CreatedBy = i.options.UserID
+			}
+			if target.CreatedAt.IsZero() {
+				target.CreatedAt = time.Now()
+			}
+			target.ModifiedBy = target.CreatedBy
+			target.ModifiedAt = target.CreatedAt
+			local.AddChild(target)
+			i.index[target.ID] = target
+			i.report.Nodes++
+			i.touch(local, target)
+		case 1:
+			target = matches[0]
+		default:
+			i.skip(childNames, "", "several nodes have this path")
+			continue
+		}
+		i.merge(target, child, childNames)
+	}
+}
+
+// link adds a node already merged under another parent as a child of local
+func (i *importer) link(local *Node, child ExportNode, names []string) {
+	node, exists := i.nodes[child.ID]
+	if !exists {
+		i.skip(names, "", "the linked node was not imported")
+		return
+	}
+	local.mutex.RLock()
+	_, linked := local.Children[node.ID]
+	local.mutex.RUnlock()
+
+	switch {
+	case linked:
+		return
+	case local.Type != BranchNode:
+		i.skip(names, "", "cannot add children to a leaf node")
+		return
+	case local.HasChildNamed(node.Name):
+		i.skip(names, "", "another node has this path")
+		return
+	case node.Contains(local.ID):
+		i.skip(names, "", "the link would make a cycle")
+		return
+	}
+	local.AddChild(node)
+	i.report.Links++
+	i.touch(local, node)
+}
+
+// mergeOwn adds the grants, events, entries, attachments and time sessions
+// local lacks, reporting whether anything was added
+func (i *importer) mergeOwn(local *Node, source ExportNode, names []string) bool {
+	local.mutex.Lock()
+	defer local.mutex.Unlock()
+
+	added := false
+	for _, grant := range source.Grants {
+		grant.UserID = i.user(grant.UserID)
+		granted := false
+		for _, existing := range local.Grants {
+			granted = granted || existing.UserID == grant.UserID
+		}
+		if !granted {
+			local.Grants = append(local.Grants, grant)
+			added = true
+		}
+	}
+
+	for _, planned := range []bool{false, true} {
+		events, target := source.Events, &local.Events
+		if planned {
+			events, target = source.PlannedEvents, &local.PlannedEvents
+		}
+		for eventID, event := range events {
+			if _, exists := (*target)[eventID]; exists {
+				continue
+			}
+			if *target == nil {
+				*target = make(map[string]Event)
+			}
+			event.CreatedBy = i.user(event.CreatedBy)
+			event.ModifiedBy = i.user(event.ModifiedBy)
+			event.Entries = i.entries(event.Entries, names, "event "+eventID+" entry")
+			if event.Plan != nil {
+				plan := *event.Plan
+				plan.CreatedBy = i.user(plan.CreatedBy)
+				plan.ModifiedBy = i.user(plan.ModifiedBy)
+				event.Plan = &plan
+			}
+			(*target)[eventID] = event
+			i.report.Events++
+			added = true
+		}
+	}
+
+	existing := make(map[string]bool, len(local.Entries))
+	for _, entry := range local.Entries {
+		existing[entryKey(entry)] = true
+	}
+	for _, entry := range i.entries(source.Entries, names, "entry") {
+		if key := entryKey(entry); !existing[key] {
+			existing[key] = true
+			local.Entries = append(local.Entries, entry)
+			i.report.Entries++
+			added = true
+		}
+	}
+
+	for attachmentID, attachment := range source.Attachments {
+		if _, exists := local.Attachments[attachmentID]; exists {
+			continue
+		}
+		if !i.attachmentData(&attachment) {
+			i.skip(names, "attachment "+attachmentID, "the export does not hold its contents")
+			continue
+		}
+		if local.Attachments == nil {
+			local.Attachments = make(map[string]Attachment)
+		}
+		local.Attachments[attachmentID] = attachment
+		i.report.Attachments++
+		added = true
+	}
+
+	for sessionID, session := range source.TimeSessions {
+		if _, exists := local.TimeSessions[sessionID]; exists {
+			continue
+		}
+		if local.TimeSessions == nil {
+			local.TimeSessions = make(map[string]TimeSession)
+		}
+		session.NodeID = local.ID
+		session.UserID = i.user(session.UserID)
+		session.ModifiedBy = i.user(session.ModifiedBy)
+		local.TimeSessions[sessionID] = session
+		i.report.Sessions++
+		added = true
+	}
+	return added
+}
+
+// entries maps the users of the entries and fills in the contents of their
+// attachments, dropping the attachments whose contents are missing
+func (i *importer) entries(entries []Entry, names []string, item string) []Entry {
+	mapped := make([]Entry, 0, len(entries))
+	for index, entry := range entries {
+		entry.UserID = i.user(entry.UserID)
+		entry.CreatedBy = i.user(entry.CreatedBy)
+		entry.ModifiedBy = i.user(entry.ModifiedBy)
+
+		attachments := entry.Attachments
+		entry.Attachments = nil
+		for _, attachment := range attachments {
+			if !i.attachmentData(&attachment) {
+				i.skip(names, fmt.Sprintf("%s %d attachment %s", item, index, attachment.ID), "the export does not hold its contents")
+				continue
+			}
+			entry.Attachments = append(entry.Attachments, attachment)
+		}
+		mapped = append(mapped, entry)
+	}
+	return mapped
+}
+
+// attachmentData points an attachment at the contents stored from the
+// import's archive when the export left them out, reporting whether it has
+// them
+func (i *importer) attachmentData(attachment *Attachment) bool {
+	attachment.UploadedBy = i.user(attachment.UploadedBy)
+	if len(attachment.Data) > 0 || attachment.Size == 0 {
+		// The hash is only taken from stored contents, so an export cannot
+		// point an attachment at a blob it did not bring along
+		attachment.Hash = ""
+		return true
+	}
+	if info, exists := i.options.Blobs[attachment.Hash]; exists {
+		i.options.Store.Retain(info.Hash)
+		attachment.Size = info.Size
+		attachment.StoredSize = info.StoredSize
+		attachment.Compression = info.Compression
+		return true
+	}
+	return false
+}
+
+// entryKey identifies an entry by who wrote what when
+func entryKey(entry Entry) string {
+	content, _ := json.Marshal(entry.Content)
+	return entry.UserID + "\x00" + strconv.FormatInt(entry.Timestamp.UnixNano(), 10) + "\x00" + string(content)
+}
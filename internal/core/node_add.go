@@ -29,26 +29,43 @@ func (n *Node) AddChild(child *Node) error {
 
 // AddParent adds a parent node to the node
 func (n *Node) AddParent(parent *Node) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
 	if n.Parents == nil {
 		n.Parents = make(map[string]string)
 	}
+	if n.parentNodes == nil {
+		n.parentNodes = make(map[string]*Node)
+	}
 	n.Parents[parent.ID] = parent.Name
+	n.parentNodes[parent.ID] = parent
 }
 
-// Add user to the node's Users slice and assign permission
-func (node *Node) AddUser(user User, permission Permission) error {
-	// Add user to node's Users slice if not already present
-	found := false
-	for i := range node.Users {
-		if node.Users[i].ID == user.ID {
-			found = true
-			node.Users[i].Permissions = append(node.Users[i].Permissions, permission)
-			break
-		}
+// removeParent drops the link to a parent
+func (n *Node) removeParent(parentID string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	delete(n.Parents, parentID)
+	delete(n.parentNodes, parentID)
+}
+
+// Link rebuilds the parent links of every node in the tree. Parents are only
+// stored by ID, so this must run after a tree is decoded or replayed, before
+// it is shared.
+func (n *Node) Link() {
+	index := n.Dedupe()
+	for _, node := range index {
+		node.parentNodes = make(map[string]*Node, len(node.Parents))
 	}
-	if !found {
-		user.Permissions = []Permission{permission}
-		node.Users = append(node.Users, user)
+	for _, node := range index {
+		for _, child := range node.Children {
+			child.parentNodes[node.ID] = node
+			if child.Parents == nil {
+				child.Parents = make(map[string]string)
+			}
+			child.Parents[node.ID] = node.Name
+		}
 	}
-	return nil
 }
@@ -0,0 +1,224 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ParseNodeType converts a node type name ("branch" or "leaf") into a NodeType
+func ParseNodeType(name string) (NodeType, error) {
+	switch strings.ToLower(name) {
+	case "branch":
+		return BranchNode, nil
+	case "leaf":
+		return LeafNode, nil
+	}
+	return LeafNode, fmt.Errorf("invalid node type: %s", name)
+}
+
+// HasChildNamed reports whether the node already has a child with the given name
+func (n *Node) HasChildNamed(name string) bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	for _, child := range n.Children {
+		if child.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether nodeID is this node or one of its descendants
+func (n *Node) Contains(nodeID string) bool {
+	if n.ID == nodeID {
+		return true
+	}
+	for _, child := range n.ChildNodes() {
+		if child.Contains(nodeID) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateChild creates a new node under n, which it inherits permissions from
+func (n *Node) CreateChild(nodeType NodeType, name string, userID string) (*Node, error) {
+	if n.Type != BranchNode {
+		return nil, fmt.Errorf("cannot add children to a leaf node")
+	}
+	if name == "" {
+		return nil, fmt.Errorf("node name is required")
+	}
+	if n.HasChildNamed(name) {
+		return nil, fmt.Errorf("node %s already has a child named %s", n.Name, name)
+	}
+
+	child := NewNode(nodeType, name)
+	child.CreatedBy = userID
+	child.CreatedAt = time.Now()
+	child.ModifiedBy = userID
+	child.ModifiedAt = child.CreatedAt
+
+	if err := n.AddChild(child); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+// Rename changes the node's name and updates the name cached by its children
+func (n *Node) Rename(name string, userID string) error {
+	if name == "" {
+		return fmt.Errorf("node name is required")
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.Name = name
+	n.ModifiedBy = userID
+	n.ModifiedAt = time.Now()
+	for _, child := range n.Children {
+		child.AddParent(n)
+	}
+	return nil
+}
+
+// RemoveChild unlinks a child from this node without touching the child's subtree
+func (n *Node) RemoveChild(childID string) (*Node, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	child, exists := n.Children[childID]
+	if !exists {
+		return nil, fmt.Errorf("node %s is not a child of %s", childID, n.ID)
+	}
+
+	delete(n.Children, childID)
+	child.removeParent(n.ID)
+	return child, nil
+}
+
+// MoveNode moves the node with nodeID from one parent to another. When link is
+// true the existing parent is kept and the target becomes an additional parent.
+func (n *Node) MoveNode(nodeID string, fromParentID string, target *Node, link bool) error {
+	node, err := n.GetNode(nodeID)
+	if err != nil {
+		return err
+	}
+	if node == n {
+		return fmt.Errorf("cannot move the root node")
+	}
+	if target.Type != BranchNode {
+		return fmt.Errorf("cannot move a node under a leaf node")
+	}
+	if node.Contains(target.ID) {
+		return fmt.Errorf("cannot move node %s beneath itself", nodeID)
+	}
+	if target.hasChild(nodeID) {
+		return fmt.Errorf("node %s is already a child of %s", nodeID, target.ID)
+	}
+	if target.HasChildNamed(node.Name) {
+		return fmt.Errorf("node %s already has a child named %s", target.Name, node.Name)
+	}
+
+	if !link {
+		var fromParent *Node
+		parents := node.parentList()
+		for _, parent := range parents {
+			if parent.ID == fromParentID || (fromParentID == "" && len(parents) == 1) {
+				fromParent = parent
+			}
+		}
+		if fromParent == nil {
+			if fromParentID == "" {
+				return fmt.Errorf("node %s has %d parents, the parent to move from must be given", nodeID, len(parents))
+			}
+			return fmt.Errorf("node %s is not a child of %s", nodeID, fromParentID)
+		}
+		if _, err := fromParent.RemoveChild(nodeID); err != nil {
+			return err
+		}
+	}
+
+	return target.AddChild(node)
+}
+
+// DeleteNode removes a node from every one of its parents. With cascade the
+// node's descendants are removed too, except those still reachable through
+// another parent; otherwise its children are re-attached to its parents.
+// It returns the IDs of the removed nodes and the remaining nodes whose links changed.
+func (n *Node) DeleteNode(nodeID string, cascade bool) ([]string, []*Node, error) {
+	node, err := n.GetNode(nodeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if node == n {
+		return nil, nil, fmt.Errorf("cannot delete the root node")
+	}
+
+	parents := node.parentList()
+	children := node.ChildNodes()
+	if !cascade {
+		// Re-attached children must not clash with the names of their new siblings
+		for _, parent := range parents {
+			for _, child := range children {
+				if parent.hasChild(child.ID) {
+					continue
+				}
+				for _, sibling := range parent.childrenNamed(child.Name) {
+					if sibling != node {
+						return nil, nil, fmt.Errorf("node %s already has a child named %s", parent.Name, child.Name)
+					}
+				}
+			}
+		}
+	}
+
+	for _, parent := range parents {
+		if _, err := parent.RemoveChild(nodeID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	removed := []string{node.ID}
+	updated := parents
+
+	if cascade {
+		node.detachDescendants(&removed, &updated)
+		return removed, updated, nil
+	}
+
+	for _, child := range children {
+		if _, err := node.RemoveChild(child.ID); err != nil {
+			return nil, nil, err
+		}
+		for _, parent := range parents {
+			if parent.hasChild(child.ID) {
+				continue
+			}
+			if err := parent.AddChild(child); err != nil {
+				return nil, nil, err
+			}
+		}
+		updated = append(updated, child)
+	}
+	return removed, updated, nil
+}
+
+// detachDescendants unlinks a deleted node from its children and recursively
+// drops every child that is left without a parent.
+func (n *Node) detachDescendants(removed *[]string, updated *[]*Node) {
+	for _, child := range n.ChildNodes() {
+		if _, err := n.RemoveChild(child.ID); err != nil {
+			continue
+		}
+		if len(child.parentList()) == 0 {
+			*removed = append(*removed, child.ID)
+			child.detachDescendants(removed, updated)
+		} else {
+			*updated = append(*updated, child)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package core
 
 import (
 	"fmt"
-	"reflect"
 	"time"
 )
 
@@ -34,41 +33,56 @@ func (n *Node) StartEvent(eventID string, userID string, plannedStart, plannedEn
 		ModifiedAt: time.Now(),
 	}
 
-	// Handle category if provided in metadata
-	if category, ok := metadata["category"].(string); ok {
-		event.Category = category
+	// Category, frequency and custom pattern come from the metadata
+	if err := applyEventMetadata(&event, metadata); err != nil {
+		return err
 	}
 
-	// Handle frequency if provided in metadata
-	if frequency, ok := metadata["frequency"].(string); ok {
-		event.Frequency = frequency
+	if plannedStart != nil && plannedStart.After(time.Now()) {
+		// Left to the scheduler to start when its time comes
+		event.StartTime = plannedStart
+		event.EndTime = plannedEnd
+		n.PlannedEvents[eventID] = event
+		n.materialize(time.Now(), time.Now().Add(RecurrenceHorizon))
+		return nil
 	}
 
-	// Handle custom pattern if provided in metadata
-	if pattern, ok := metadata["custom_pattern"].(string); ok {
-		event.Pattern = pattern
-	}
-
-	if plannedStart == nil || time.Now().After(*plannedStart) {
-		now := time.Now()
+	now := time.Now()
+	if plan, planned := n.PlannedEvents[eventID]; planned {
+		// Starting a planned event begins the plan, which keeps its series
+		// and recurrence unless the metadata replaces them
+		started := plan.begin(now, userID, now)
+		if len(metadata) > 0 {
+			started.Metadata = metadata
+			if err := applyEventMetadata(&started, metadata); err != nil {
+				return err
+			}
+		}
+		if plannedEnd != nil {
+			started.PlannedEnd = plannedEnd
+		}
+		delete(n.PlannedEvents, eventID)
+		event = started
+	} else {
 		event.StartTime = &now
 		event.Status = EventOngoing
+		event.PlannedEnd = plannedEnd
 	}
-
 	n.Events[eventID] = event
+	n.materialize(time.Now(), time.Now().Add(RecurrenceHorizon))
 	return nil
 }
 
 // EndEvent marks an event as finished
 func (n *Node) EndEvent(eventID string, userID string) error {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
-
-	// Check user permission
+	// Check user permission, before locking as the check reads the node
 	if !n.CheckPermission(userID, WritePermission) {
 		return fmt.Errorf("insufficient permissions")
 	}
 
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
 	event, exists := n.Events[eventID]
 	if !exists {
 		return fmt.Errorf("event not found: %s", eventID)
@@ -89,14 +103,14 @@ func (n *Node) EndEvent(eventID string, userID string) error {
 
 // AppendToEvent adds a new entry to an ongoing event
 func (n *Node) AppendToEvent(eventID string, userID string, content interface{}, metadata map[string]interface{}) error {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
-
-	// Check user permission
+	// Check user permission, before locking as the check reads the node
 	if !n.CheckPermission(userID, WritePermission) {
 		return fmt.Errorf("insufficient permissions")
 	}
 
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
 	event, exists := n.Events[eventID]
 	if !exists {
 		return fmt.Errorf("event not found: %s", eventID)
@@ -147,141 +161,16 @@ func (n *Node) PlanEvent(eventID string, userID string, plannedStart, plannedEnd
 		EndTime:   plannedEnd,
 	}
 
-	n.PlannedEvents[eventID] = event
-	return nil
-}
-
-// CheckPermission checks if a user has permission to perform an action on the node
-func (n *Node) CheckPermission(userID string, permission Permission) bool {
-	for _, user := range n.Users {
-		if user.ID == userID {
-			for _, perm := range user.Permissions {
-
-				if perm == permission {
-					return true
-				}
-			}
-		}
+	// Planned events repeat when the metadata holds a frequency or custom pattern
+	if err := applyEventMetadata(&event, metadata); err != nil {
+		return err
 	}
-	return false
-}
 
-// TODO: Ensure user calling this function has admin permissions to this node
-// AssignUser assigns a user to the node with permission checking
-func (n *Node) AssignUser(user User, permission Permission) error {
-	// Add user to node's Users slice if not already present
-	found := false
-	for i := range n.Users {
-		if n.Users[i].ID == user.ID {
-			found = true
-			n.Users[i].Permissions = append(n.Users[i].Permissions, permission)
-			break
-		}
-	}
-	if !found {
-		user.Permissions = []Permission{permission}
-		n.Users = append(n.Users, user)
-	}
+	n.PlannedEvents[eventID] = event
+	n.materialize(time.Now(), time.Now().Add(RecurrenceHorizon))
 	return nil
 }
 
-func (n *Node) StartTimeTracking(userID string) (*Entry, error) {
-	// Check user permission
-	if !n.CheckPermission(userID, WritePermission) {
-		return nil, fmt.Errorf("insufficient permissions")
-	}
-
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
-
-	entry := Entry{
-		Timestamp: time.Now(),
-		UserID:    userID,
-		Content:   "start_time_entry",
-	}
-
-	n.Entries = append(n.Entries, entry)
-	return &entry, nil
-}
-
-// StopTimeTracking stops tracking time for the node
-func (n *Node) StopTimeTracking(userID string) (*Entry, error) {
-	// Check user permission
-	if !n.CheckPermission(userID, WritePermission) {
-		return nil, fmt.Errorf("insufficient permissions")
-	}
-
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
-
-	entry := Entry{
-		Timestamp: time.Now(),
-		UserID:    userID,
-		Content:   "stop_time_entry",
-	}
-
-	n.Entries = append(n.Entries, entry)
-	return &entry, nil
-}
-
-// CompareEvents compares the planned event to the actual event and reports differences
-func (n *Node) CompareEvents(plannedEventID, actualEventID string) (bool, error) {
-	n.mutex.RLock()
-	defer n.mutex.RUnlock()
-
-	plannedEvent, plannedExists := n.PlannedEvents[plannedEventID]
-	actualEvent, actualExists := n.Events[actualEventID]
-
-	if !plannedExists || !actualExists {
-		return false, fmt.Errorf("one or both events not found: plannedEventID=%s, actualEventID=%s", plannedEventID, actualEventID)
-	}
-
-	// Initialize a slice to hold differences
-	var differences []string
-
-	// Compare StartTime
-	if (plannedEvent.StartTime == nil && actualEvent.StartTime != nil) || (plannedEvent.StartTime != nil && actualEvent.StartTime == nil) {
-		differences = append(differences, "StartTime differs")
-	} else if plannedEvent.StartTime != nil && actualEvent.StartTime != nil && !plannedEvent.StartTime.Equal(*actualEvent.StartTime) {
-		differences = append(differences, fmt.Sprintf("StartTime differs: planned=%v, actual=%v", *plannedEvent.StartTime, *actualEvent.StartTime))
-	}
-
-	// Compare EndTime
-	if (plannedEvent.EndTime == nil && actualEvent.EndTime != nil) || (plannedEvent.EndTime != nil && actualEvent.EndTime == nil) {
-		differences = append(differences, "EndTime differs")
-	} else if plannedEvent.EndTime != nil && actualEvent.EndTime != nil && !plannedEvent.EndTime.Equal(*actualEvent.EndTime) {
-		differences = append(differences, fmt.Sprintf("EndTime differs: planned=%v, actual=%v", *plannedEvent.EndTime, *actualEvent.EndTime))
-	}
-
-	// Compare Status
-	if plannedEvent.Status != actualEvent.Status {
-		differences = append(differences, fmt.Sprintf("Status differs: planned=%s, actual=%s", plannedEvent.Status, actualEvent.Status))
-	}
-
-	// Compare Metadata
-	if !reflect.DeepEqual(plannedEvent.Metadata, actualEvent.Metadata) {
-		differences = append(differences, "Metadata differs")
-	}
-
-	// Compare Entries
-	if len(plannedEvent.Entries) != len(actualEvent.Entries) {
-		differences = append(differences, fmt.Sprintf("Entries count differs: planned=%d, actual=%d", len(plannedEvent.Entries), len(actualEvent.Entries)))
-	} else {
-		for i := range plannedEvent.Entries {
-			if !reflect.DeepEqual(plannedEvent.Entries[i], actualEvent.Entries[i]) {
-				differences = append(differences, fmt.Sprintf("Entry %d differs", i))
-			}
-		}
-	}
-
-	// If there are differences, return them
-	if len(differences) > 0 {
-		return false, fmt.Errorf("differences found: %v", differences)
-	}
-
-	return true, nil
-}
-
 // Add attachment to node
 func (n *Node) AddAttachment(attachment *Attachment, userID string) error {
 	if !n.CheckPermission(userID, WritePermission) {
@@ -333,13 +222,43 @@ func (n *Node) DeleteAttachment(attachmentID string, userID string) error {
 	defer n.mutex.Unlock()
 
 	if n.Attachments == nil {
-		return fmt.Errorf("attachment not found: %s", attachmentID)
+		return fmt.Errorf("%w: %s", ErrAttachmentNotFound, attachmentID)
 	}
 
 	if _, exists := n.Attachments[attachmentID]; !exists {
-		return fmt.Errorf("attachment not found: %s", attachmentID)
+		return fmt.Errorf("%w: %s", ErrAttachmentNotFound, attachmentID)
 	}
 
 	delete(n.Attachments, attachmentID)
 	return nil
 }
+
+// DeleteEntryAttachment removes an attachment from an event entry
+func (n *Node) DeleteEntryAttachment(eventID string, entryIndex int, attachmentID string, userID string) error {
+	if !n.CheckPermission(userID, WritePermission) {
+		return fmt.Errorf("insufficient permissions")
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	event, exists := n.Events[eventID]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrEventNotFound, eventID)
+	}
+
+	if entryIndex < 0 || entryIndex >= len(event.Entries) {
+		return fmt.Errorf("invalid entry index: %d", entryIndex)
+	}
+
+	attachments := event.Entries[entryIndex].Attachments
+	for i, attachment := range attachments {
+		if attachment.ID == attachmentID {
+			event.Entries[entryIndex].Attachments = append(attachments[:i:i], attachments[i+1:]...)
+			n.Events[eventID] = event
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrAttachmentNotFound, attachmentID)
+}
@@ -17,8 +17,7 @@ func (n *Node) GetPlannedEvents() (map[string]Event, error) {
 	return plannedEvents, nil
 }
 
-// TODO: Allow it to search for nodes by name or ID
-// GetNode retrieves a node by its ID
+// GetNode retrieves a node by its ID. Use Resolve to look nodes up by path.
 func (n *Node) GetNode(nodeID string) (*Node, error) {
 	if n.ID == nodeID {
 		return n, nil
@@ -28,7 +27,7 @@ func (n *Node) GetNode(nodeID string) (*Node, error) {
 		return n, nil
 	}
 
-	for _, child := range n.Children {
+	for _, child := range n.ChildNodes() {
 		if node, err := child.GetNode(nodeID); err == nil {
 			return node, nil
 		}
@@ -100,48 +99,51 @@ func (n *Node) GetEventEntries(eventID string) ([]Entry, error) {
 	return entries, nil
 }
 
-// GetTimeTrackingSummary returns a summary of the time tracking for the node
-func (n *Node) GetTimeTrackingSummary(userID string) []map[string]interface{} {
-	n.mutex.RLock()
-	defer n.mutex.RUnlock()
-	var summary []map[string]interface{}
-
-	var startTime *Entry
-	for _, entry := range n.Entries {
-		if entry.UserID == userID {
-			if entry.Content == "start_time_entry" {
-				startTime = &entry
-			} else if entry.Content == "end_time_entry" && startTime != nil {
-				duration := entry.Timestamp.Sub(startTime.Timestamp)
-				summary = append(summary, map[string]interface{}{
-					"start_time": startTime.Timestamp,
-					"end_time":   entry.Timestamp,
-					"duration":   duration,
-				})
-				startTime = nil // Reset startTime for the next event
+// Lineage returns the node followed by every node above it, each once, so
+// settings registered on a subtree can be found from any node inside it
+func (n *Node) Lineage() []*Node {
+	lineage := []*Node{n}
+	seen := map[*Node]bool{n: true}
+	for i := 0; i < len(lineage); i++ {
+		for _, parent := range lineage[i].parentList() {
+			if !seen[parent] {
+				seen[parent] = true
+				lineage = append(lineage, parent)
 			}
 		}
 	}
+	return lineage
+}
+
+// parentList returns the node's parents
+func (n *Node) parentList() []*Node {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
 
-	return summary
+	parents := make([]*Node, 0, len(n.parentNodes))
+	for _, parent := range n.parentNodes {
+		parents = append(parents, parent)
+	}
+	return parents
 }
 
-// GetUserProfile returns the user profile
-func (n *Node) GetUserProfile(userID string) (*User, error) {
+// hasChild reports whether the node has a direct child with the given ID
+func (n *Node) hasChild(childID string) bool {
 	n.mutex.RLock()
 	defer n.mutex.RUnlock()
 
-	var user *User
+	_, exists := n.Children[childID]
+	return exists
+}
 
-	for _, u := range n.Users {
-		if u.ID == userID {
-			user = &u
-			break
-		}
-	}
+// ChildNodes returns the node's direct children
+func (n *Node) ChildNodes() []*Node {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
 
-	if user == nil {
-		return nil, fmt.Errorf("user not found: %s", userID)
+	children := make([]*Node, 0, len(n.Children))
+	for _, child := range n.Children {
+		children = append(children, child)
 	}
-	return user, nil
+	return children
 }
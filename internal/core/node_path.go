@@ -0,0 +1,192 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Path syntax understood by Resolve:
+//
+//	""  or "/"        the root node
+//	"id:<node id>"    the node with that ID, wherever it is attached
+//	"a/b/c"           child names from the root; a leading "/" is optional
+//	"a\/b"            a name containing a slash, "\\" is a literal backslash
+//
+// A single segment that matches no child name is looked up as a node ID, so
+// clients that send bare IDs keep working.
+const idPathPrefix = "id:"
+
+var (
+	// ErrNodeNotFound is returned when a path does not lead to a node
+	ErrNodeNotFound = errors.New("node not found")
+	// ErrInvalidPath is returned for paths that cannot be parsed
+	ErrInvalidPath = errors.New("invalid path")
+)
+
+// AmbiguousPathError is returned when a path segment matches several siblings
+type AmbiguousPathError struct {
+	Path    string
+	Segment string
+	NodeIDs []string
+}
+
+func (e *AmbiguousPathError) Error() string {
+	return fmt.Sprintf("path %s is ambiguous: %d nodes named %s, use id:<node id> (one of %s)",
+		e.Path, len(e.NodeIDs), e.Segment, strings.Join(e.NodeIDs, ", "))
+}
+
+// IDPath returns the path addressing a node by its ID
+func IDPath(nodeID string) string {
+	return idPathPrefix + nodeID
+}
+
+// EscapeName escapes a node name for use as a path segment
+func EscapeName(name string) string {
+	return strings.NewReplacer(`\`, `\\`, `/`, `\/`).Replace(name)
+}
+
+// JoinPath builds a path from unescaped node names
+func JoinPath(names ...string) string {
+	escaped := make([]string, len(names))
+	for i, name := range names {
+		escaped[i] = EscapeName(name)
+	}
+	return strings.Join(escaped, "/")
+}
+
+// SplitPath splits a slash path into unescaped node names
+func SplitPath(path string) ([]string, error) {
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return nil, nil
+	}
+
+	var names []string
+	var current strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '\\':
+			if i+1 == len(path) || (path[i+1] != '\\' && path[i+1] != '/') {
+				return nil, fmt.Errorf("%w: bad escape in %s", ErrInvalidPath, path)
+			}
+			i++
+			current.WriteByte(path[i])
+		case '/':
+			if current.Len() == 0 {
+				return nil, fmt.Errorf("%w: empty segment in %s", ErrInvalidPath, path)
+			}
+			names = append(names, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(path[i])
+		}
+	}
+	if current.Len() == 0 {
+		return nil, fmt.Errorf("%w: empty segment in %s", ErrInvalidPath, path)
+	}
+	return append(names, current.String()), nil
+}
+
+// Resolve finds the node addressed by path, relative to n
+func (n *Node) Resolve(path string) (*Node, error) {
+	if strings.HasPrefix(path, idPathPrefix) {
+		node, err := n.GetNode(strings.TrimPrefix(path, idPathPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrNodeNotFound, path)
+		}
+		return node, nil
+	}
+
+	names, err := SplitPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	current := n
+	for _, name := range names {
+		matches := current.childrenNamed(name)
+		switch len(matches) {
+		case 1:
+			current = matches[0]
+		case 0:
+			if len(names) == 1 {
+				if node, err := n.GetNode(name); err == nil {
+					return node, nil
+				}
+			}
+			return nil, fmt.Errorf("%w: %s", ErrNodeNotFound, path)
+		default:
+			ids := make([]string, len(matches))
+			for i, match := range matches {
+				ids[i] = match.ID
+			}
+			sort.Strings(ids)
+			return nil, &AmbiguousPathError{Path: path, Segment: name, NodeIDs: ids}
+		}
+	}
+	return current, nil
+}
+
+// Paths returns every canonical slash path from n to the node with nodeID,
+// one per route through the node's parents, sorted.
+func (n *Node) Paths(nodeID string) []string {
+	var paths []string
+	n.collectPaths(nodeID, nil, &paths)
+	sort.Strings(paths)
+	return paths
+}
+
+// PathsUp returns every canonical slash path to n from the top of its tree,
+// sorted, like Paths called on the root. It walks up through n's parents
+// rather than down the whole tree.
+func (n *Node) PathsUp() []string {
+	var paths []string
+	n.collectPathsUp(nil, &paths)
+	sort.Strings(paths)
+	return paths
+}
+
+func (n *Node) collectPathsUp(suffix []string, paths *[]string) {
+	parents := n.parentList()
+	if len(parents) == 0 {
+		*paths = append(*paths, JoinPath(suffix...))
+		return
+	}
+	names := append([]string{n.Name}, suffix...)
+	for _, parent := range parents {
+		parent.collectPathsUp(names, paths)
+	}
+}
+
+func (n *Node) collectPaths(nodeID string, prefix []string, paths *[]string) {
+	if n.ID == nodeID {
+		*paths = append(*paths, JoinPath(prefix...))
+		return
+	}
+
+	n.mutex.RLock()
+	children := make([]*Node, 0, len(n.Children))
+	for _, child := range n.Children {
+		children = append(children, child)
+	}
+	n.mutex.RUnlock()
+
+	for _, child := range children {
+		child.collectPaths(nodeID, append(prefix[:len(prefix):len(prefix)], child.Name), paths)
+	}
+}
+
+func (n *Node) childrenNamed(name string) []*Node {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	var matches []*Node
+	for _, child := range n.Children {
+		if child.Name == name {
+			matches = append(matches, child)
+		}
+	}
+	return matches
+}
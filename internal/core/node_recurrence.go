@@ -0,0 +1,445 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A series is an event with a Frequency or Pattern. The series event is its
+// own first occurrence; later occurrences are materialised into PlannedEvents
+// under OccurrenceID as they come within RecurrenceHorizon.
+const (
+	// RecurrenceHorizon is how far ahead occurrences are materialised
+	RecurrenceHorizon = 30 * 24 * time.Hour
+
+	ScopeThis      = "this"      // Edit a single occurrence
+	ScopeFollowing = "following" // Split the series and edit this and later occurrences
+	ScopeAll       = "all"       // Edit the series and every occurrence not edited on its own
+
+	occurrenceIDLayout = "20060102T150405Z"
+)
+
+var (
+	// ErrNotOccurrence is returned when a time is not an occurrence of a series
+	ErrNotOccurrence = errors.New("not an occurrence of the series")
+	// ErrEventNotFound is returned when a node has no event with the given ID
+	ErrEventNotFound = errors.New("event not found")
+)
+
+// Occurrence is one instance of an event within a time range
+type Occurrence struct {
+	EventID      string                 `json:"event_id"`
+	SeriesID     string                 `json:"series_id,omitempty"`
+	Start        time.Time              `json:"start"`
+	End          *time.Time             `json:"end,omitempty"`
+	Status       EventStatus            `json:"status"`
+	Category     string                 `json:"category,omitempty"`
+	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+	RecurrenceID *time.Time             `json:"recurrence_id,omitempty"`
+	Materialized bool                   `json:"materialized"` // Stored on the node rather than computed from the rule
+}
+
+// OccurrenceChanges are the fields changed by UpdateOccurrence. Nil fields are
+// left as they are; metadata is merged into the existing metadata.
+type OccurrenceChanges struct {
+	Start     *time.Time
+	End       *time.Time
+	Metadata  map[string]interface{}
+	Frequency *string
+	Pattern   *string
+}
+
+// OccurrenceID returns the ID an occurrence of a series is stored under
+func OccurrenceID(seriesID string, at time.Time) string {
+	return seriesID + "@" + at.UTC().Format(occurrenceIDLayout)
+}
+
+// Rule returns the event's recurrence rule, or nil when it does not repeat
+func (e Event) Rule() (*Recurrence, error) {
+	return ParseRecurrence(e.Frequency, e.Pattern)
+}
+
+// applyEventMetadata copies the category, frequency and custom_pattern
+// metadata into the event's fields and checks the resulting rule
+func applyEventMetadata(event *Event, metadata map[string]interface{}) error {
+	if category, ok := metadata["category"].(string); ok {
+		event.Category = category
+	}
+	if frequency, ok := metadata["frequency"].(string); ok {
+		event.Frequency = frequency
+	}
+	if pattern, ok := metadata["custom_pattern"].(string); ok {
+		event.Pattern = pattern
+	}
+	_, err := event.Rule()
+	return err
+}
+
+// MaterializeOccurrences adds the occurrences of every series on the node
+// starting within [from, until) to PlannedEvents and returns how many were added
+func (n *Node) MaterializeOccurrences(from, until time.Time) int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.materialize(from, until)
+}
+
+func (n *Node) materialize(from, until time.Time) int {
+	added := 0
+	for seriesID, series := range n.seriesEvents() {
+		rule, err := series.Rule()
+		if err != nil || rule == nil {
+			continue
+		}
+		for _, at := range rule.Between(*series.StartTime, from, until) {
+			if at.Equal(*series.StartTime) || series.isException(at) {
+				continue
+			}
+			id := OccurrenceID(seriesID, at)
+			if _, exists := n.PlannedEvents[id]; exists {
+				continue
+			}
+			if _, exists := n.Events[id]; exists {
+				continue
+			}
+			n.PlannedEvents[id] = series.occurrenceAt(seriesID, at)
+			added++
+		}
+	}
+	return added
+}
+
+// seriesEvents returns the node's series, whether planned or already started
+func (n *Node) seriesEvents() map[string]Event {
+	series := make(map[string]Event)
+	for _, events := range []map[string]Event{n.Events, n.PlannedEvents} {
+		for eventID, event := range events {
+			if event.SeriesID == "" && event.StartTime != nil && (event.Frequency != "" || event.Pattern != "") {
+				series[eventID] = event
+			}
+		}
+	}
+	return series
+}
+
+// findSeries returns the series with the given ID and the map holding it
+func (n *Node) findSeries(seriesID string) (Event, map[string]Event, error) {
+	for _, events := range []map[string]Event{n.PlannedEvents, n.Events} {
+		if event, exists := events[seriesID]; exists {
+			if event.SeriesID != "" || event.StartTime == nil || (event.Frequency == "" && event.Pattern == "") {
+				return Event{}, nil, fmt.Errorf("event %s is not a recurring series", seriesID)
+			}
+			return event, events, nil
+		}
+	}
+	return Event{}, nil, fmt.Errorf("%w: %s", ErrEventNotFound, seriesID)
+}
+
+func (e Event) isException(at time.Time) bool {
+	for _, exception := range e.Exceptions {
+		if exception.Equal(at) {
+			return true
+		}
+	}
+	return false
+}
+
+// occurrenceAt builds the occurrence of the series starting at at
+func (e Event) occurrenceAt(seriesID string, at time.Time) Event {
+	occurrence := Event{
+		StartTime:  &at,
+		Entries:    []Entry{},
+		Metadata:   copyMetadata(e.Metadata),
+		Status:     EventPending,
+		Category:   e.Category,
+		SeriesID:   seriesID,
+		Recurrence: &at,
+		CreatedBy:  e.CreatedBy,
+		CreatedAt:  time.Now(),
+	}
+	if plannedEnd := e.scheduledEnd(); plannedEnd != nil {
+		end := at.Add(plannedEnd.Sub(*e.StartTime))
+		occurrence.EndTime = &end
+	}
+	return occurrence
+}
+
+// scheduledEnd returns when the event is planned to end, which for events
+// started by the scheduler is kept apart from their actual end
+func (e Event) scheduledEnd() *time.Time {
+	if e.PlannedEnd != nil {
+		return e.PlannedEnd
+	}
+	return e.EndTime
+}
+
+func copyMetadata(metadata map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Occurrences returns every event on the node starting within [from, to),
+// including the occurrences of series that have not been materialised yet,
+// ordered by start
+func (n *Node) Occurrences(from, to time.Time) []Occurrence {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	var occurrences []Occurrence
+	for _, events := range []map[string]Event{n.Events, n.PlannedEvents} {
+		for eventID, event := range events {
+			if event.StartTime == nil || event.StartTime.Before(from) || !event.StartTime.Before(to) {
+				continue
+			}
+			occurrences = append(occurrences, event.occurrence(eventID, true))
+		}
+	}
+
+	for seriesID, series := range n.seriesEvents() {
+		rule, err := series.Rule()
+		if err != nil || rule == nil {
+			continue
+		}
+		for _, at := range rule.Between(*series.StartTime, from, to) {
+			if at.Equal(*series.StartTime) || series.isException(at) {
+				continue
+			}
+			id := OccurrenceID(seriesID, at)
+			_, planned := n.PlannedEvents[id]
+			_, started := n.Events[id]
+			if !planned && !started {
+				occurrences = append(occurrences, series.occurrenceAt(seriesID, at).occurrence(id, false))
+			}
+		}
+	}
+
+	sort.Slice(occurrences, func(i, j int) bool {
+		if occurrences[i].Start.Equal(occurrences[j].Start) {
+			return occurrences[i].EventID < occurrences[j].EventID
+		}
+		return occurrences[i].Start.Before(occurrences[j].Start)
+	})
+	return occurrences
+}
+
+func (e Event) occurrence(eventID string, materialized bool) Occurrence {
+	return Occurrence{
+		EventID:      eventID,
+		SeriesID:     e.SeriesID,
+		Start:        *e.StartTime,
+		End:          e.scheduledEnd(),
+		Status:       e.Status,
+		Category:     e.Category,
+		Metadata:     e.Metadata,
+		RecurrenceID: e.Recurrence,
+		Materialized: materialized,
+	}
+}
+
+// CancelOccurrence removes one occurrence from a series. The first occurrence
+// is the series event itself and cannot be cancelled on its own.
+func (n *Node) CancelOccurrence(seriesID string, at time.Time, userID string) error {
+	if !n.CheckPermission(userID, WritePermission) {
+		return fmt.Errorf("insufficient permissions")
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	series, events, err := n.findSeries(seriesID)
+	if err != nil {
+		return err
+	}
+	if at.Equal(*series.StartTime) {
+		return fmt.Errorf("the first occurrence is the series itself, update or delete the series instead")
+	}
+	if err := n.checkOccurrence(series, at); err != nil {
+		return err
+	}
+
+	id := OccurrenceID(seriesID, at)
+	if _, started := n.Events[id]; started {
+		return fmt.Errorf("occurrence %s has already started", id)
+	}
+	delete(n.PlannedEvents, id)
+
+	series.Exceptions = append(series.Exceptions, at)
+	series.ModifiedBy = userID
+	series.ModifiedAt = time.Now()
+	events[seriesID] = series
+	return nil
+}
+
+func (n *Node) checkOccurrence(series Event, at time.Time) error {
+	rule, err := series.Rule()
+	if err != nil {
+		return err
+	}
+	if !rule.Includes(*series.StartTime, at) || series.isException(at) {
+		return fmt.Errorf("%w: %s", ErrNotOccurrence, at.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// UpdateOccurrence edits the occurrence of a series at at. ScopeThis edits the
+// single occurrence; ScopeFollowing ends the series before at and starts a new
+// series there holding the changes; ScopeAll edits the series itself and
+// regenerates its occurrences. It returns the ID of the event that was changed.
+func (n *Node) UpdateOccurrence(seriesID string, at time.Time, scope string, changes OccurrenceChanges, userID string) (string, error) {
+	if !n.CheckPermission(userID, WritePermission) {
+		return "", fmt.Errorf("insufficient permissions")
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	series, events, err := n.findSeries(seriesID)
+	if err != nil {
+		return "", err
+	}
+	if err := n.checkOccurrence(series, at); err != nil {
+		return "", err
+	}
+	if at.Equal(*series.StartTime) {
+		switch scope {
+		case ScopeThis:
+			return "", fmt.Errorf("the first occurrence is the series itself, use scope %s", ScopeAll)
+		case ScopeFollowing:
+			scope = ScopeAll
+		}
+	}
+
+	now := time.Now()
+	var eventID string
+	switch scope {
+	case ScopeThis:
+		eventID = OccurrenceID(seriesID, at)
+		if _, started := n.Events[eventID]; started {
+			return "", fmt.Errorf("occurrence %s has already started", eventID)
+		}
+		occurrence, exists := n.PlannedEvents[eventID]
+		if !exists {
+			occurrence = series.occurrenceAt(seriesID, at)
+		}
+		if changes.Frequency != nil || changes.Pattern != nil {
+			return "", fmt.Errorf("a single occurrence cannot change the recurrence, use scope %s or %s", ScopeFollowing, ScopeAll)
+		}
+		applyOccurrenceChanges(&occurrence, changes)
+		occurrence.Detached = true
+		occurrence.ModifiedBy = userID
+		occurrence.ModifiedAt = now
+		n.PlannedEvents[eventID] = occurrence
+
+	case ScopeFollowing:
+		rule, _ := series.Rule()
+		following := series.occurrenceAt(seriesID, at)
+		following.SeriesID = ""
+		following.Recurrence = nil
+		following.Frequency = series.Frequency
+		following.Pattern = series.Pattern
+		for _, exception := range series.Exceptions {
+			if exception.After(at) {
+				following.Exceptions = append(following.Exceptions, exception)
+			}
+		}
+		if rule.Count > 0 {
+			// The occurrences are shared out between the two series
+			before := rule.countBefore(*series.StartTime, at)
+			remaining := *rule
+			remaining.Count = rule.Count - before
+			following.Frequency, following.Pattern = "", remaining.String()
+			rule.Count = before
+		} else {
+			until := at.Add(-time.Second)
+			rule.Until = &until
+		}
+		applyOccurrenceChanges(&following, changes)
+		if _, err := following.Rule(); err != nil {
+			return "", err
+		}
+
+		series.Frequency, series.Pattern = "", rule.String()
+		series.ModifiedBy = userID
+		series.ModifiedAt = now
+		events[seriesID] = series
+
+		// Later occurrences of the old series, edited or not, are replaced by the new series
+		for id, occurrence := range n.PlannedEvents {
+			if occurrence.SeriesID == seriesID && occurrence.Recurrence != nil && !occurrence.Recurrence.Before(at) {
+				delete(n.PlannedEvents, id)
+			}
+		}
+
+		eventID = OccurrenceID(seriesID, at)
+		following.CreatedBy = userID
+		following.ModifiedBy = userID
+		following.ModifiedAt = now
+		n.PlannedEvents[eventID] = following
+
+	case ScopeAll:
+		previous := series
+		applyOccurrenceChanges(&series, changes)
+		if _, err := series.Rule(); err != nil {
+			return "", err
+		}
+		if !series.StartTime.Equal(*previous.StartTime) {
+			// Cancelled occurrences no longer line up with the moved series
+			series.Exceptions = nil
+		}
+		series.ModifiedBy = userID
+		series.ModifiedAt = now
+		events[seriesID] = series
+		eventID = seriesID
+
+		for id, occurrence := range n.PlannedEvents {
+			if occurrence.SeriesID == seriesID && !occurrence.Detached {
+				delete(n.PlannedEvents, id)
+			}
+		}
+
+	default:
+		return "", fmt.Errorf("unknown scope: %s", scope)
+	}
+
+	n.materialize(now, now.Add(RecurrenceHorizon))
+	return eventID, nil
+}
+
+func applyOccurrenceChanges(event *Event, changes OccurrenceChanges) {
+	if changes.Start != nil {
+		if event.EndTime != nil && changes.End == nil {
+			// Moving an occurrence keeps its duration
+			end := changes.Start.Add(event.EndTime.Sub(*event.StartTime))
+			event.EndTime = &end
+		}
+		start := *changes.Start
+		event.StartTime = &start
+	}
+	if changes.End != nil {
+		end := *changes.End
+		event.EndTime = &end
+	}
+	if changes.Metadata != nil {
+		metadata := copyMetadata(event.Metadata)
+		for key, value := range changes.Metadata {
+			metadata[key] = value
+		}
+		event.Metadata = metadata
+		if category, ok := changes.Metadata["category"].(string); ok {
+			event.Category = category
+		}
+	}
+	if changes.Frequency != nil {
+		event.Frequency = *changes.Frequency
+		if changes.Pattern == nil {
+			event.Pattern = ""
+		}
+	}
+	if changes.Pattern != nil {
+		event.Pattern = *changes.Pattern
+	}
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// SchedulerUserID is recorded as the author of scheduled transitions
+	SchedulerUserID = "scheduler"
+
+	// Content of the activity entries recorded for scheduled transitions
+	ActivityEventStarted  = "event_started"
+	ActivityEventFinished = "event_finished"
+	ActivityEventOverdue  = "event_overdue" // Reported by MarkOverdue, not recorded as an entry
+)
+
+// ScheduledTransition is an event started or finished by RunSchedule
+type ScheduledTransition struct {
+	Activity string // ActivityEventStarted, ActivityEventFinished or ActivityEventOverdue
+	EventID  string
+	At       time.Time // When the transition was scheduled for
+}
+
+// RunSchedule starts the planned events whose start time has passed and
+// finishes ongoing events whose planned end has passed when they auto-finish.
+// Started events keep their scheduled start and their plan.
+// An event auto-finishes when its auto_finish metadata is true, or when it has
+// none and autoFinish is set. Transitions missed while the server was down
+// are applied with their scheduled times. Each one is recorded as an activity
+// entry, in order, and the transitions are returned.
+func (n *Node) RunSchedule(now time.Time, autoFinish bool) []ScheduledTransition {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	var started []ScheduledTransition
+	for eventID, event := range n.PlannedEvents {
+		if event.StartTime == nil || event.StartTime.After(now) {
+			continue
+		}
+		if _, exists := n.Events[eventID]; exists {
+			// Started by hand; the plan is kept to compare against
+			continue
+		}
+		delete(n.PlannedEvents, eventID)
+		n.Events[eventID] = event.begin(*event.StartTime, SchedulerUserID, now)
+		started = append(started, ScheduledTransition{ActivityEventStarted, eventID, *event.StartTime})
+	}
+
+	var finished []ScheduledTransition
+	for eventID, event := range n.Events {
+		if event.Status != EventOngoing || event.PlannedEnd == nil || event.PlannedEnd.After(now) || !event.autoFinishes(autoFinish) {
+			continue
+		}
+		end := *event.PlannedEnd
+		event.EndTime = &end
+		event.Status = EventFinished
+		event.ModifiedBy = SchedulerUserID
+		event.ModifiedAt = now
+		n.Events[eventID] = event
+		finished = append(finished, ScheduledTransition{ActivityEventFinished, eventID, end})
+	}
+
+	n.recordTransitions(started, now)
+	n.recordTransitions(finished, now)
+	return append(started, finished...)
+}
+
+// MarkOverdue returns the ongoing events whose planned end has passed and that
+// the scheduler will not finish, each once per planned end, which is kept on
+// the event as OverdueFor
+func (n *Node) MarkOverdue(now time.Time, autoFinish bool) []ScheduledTransition {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	var overdue []ScheduledTransition
+	for eventID, event := range n.Events {
+		if event.Status != EventOngoing || event.PlannedEnd == nil || event.PlannedEnd.After(now) || event.autoFinishes(autoFinish) {
+			continue
+		}
+		if event.OverdueFor != nil && event.OverdueFor.Equal(*event.PlannedEnd) {
+			continue
+		}
+		plannedEnd := *event.PlannedEnd
+		event.OverdueFor = &plannedEnd
+		n.Events[eventID] = event
+		overdue = append(overdue, ScheduledTransition{ActivityEventOverdue, eventID, plannedEnd})
+	}
+	sort.Slice(overdue, func(i, j int) bool {
+		return overdue[i].EventID < overdue[j].EventID
+	})
+	return overdue
+}
+
+// begin returns the event started at start from the plan, which is kept on
+// the event to report variance against
+func (plan Event) begin(start time.Time, userID string, now time.Time) Event {
+	snapshot := plan
+	snapshot.Entries = nil
+	snapshot.Metadata = copyMetadata(plan.Metadata)
+	snapshot.Plan = nil
+
+	event := plan
+	event.Plan = &snapshot
+	event.StartTime = &start
+	event.PlannedEnd = plan.EndTime
+	event.EndTime = nil
+	event.Status = EventOngoing
+	event.ModifiedBy = userID
+	event.ModifiedAt = now
+	if event.Entries == nil {
+		event.Entries = []Entry{}
+	}
+	return event
+}
+
+func (e Event) autoFinishes(fallback bool) bool {
+	if autoFinish, ok := e.Metadata["auto_finish"].(bool); ok {
+		return autoFinish
+	}
+	return fallback
+}
+
+func (n *Node) recordTransitions(transitions []ScheduledTransition, now time.Time) {
+	sort.Slice(transitions, func(i, j int) bool {
+		if transitions[i].At.Equal(transitions[j].At) {
+			return transitions[i].EventID < transitions[j].EventID
+		}
+		return transitions[i].At.Before(transitions[j].At)
+	})
+
+	for _, transition := range transitions {
+		n.Entries = append(n.Entries, Entry{
+			Content: transition.Activity,
+			Metadata: map[string]interface{}{
+				"event_id":      transition.EventID,
+				"scheduled_at":  transition.At,
+				"delay_seconds": int64(now.Sub(transition.At).Seconds()),
+			},
+			UserID:    SchedulerUserID,
+			Timestamp: now,
+		})
+	}
+}
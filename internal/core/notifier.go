@@ -0,0 +1,139 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"text/template"
+	"time"
+)
+
+var (
+	// ErrNotifierNotFound is returned when no notifier on the node has the given ID
+	ErrNotifierNotFound = errors.New("notifier not found")
+	// ErrInvalidNotifier is returned for notifiers without a usable URL or with templates that do not parse
+	ErrInvalidNotifier = errors.New("invalid notifier")
+)
+
+// DefaultNotifierRateLimit is how many messages a notifier sends per minute unless set
+const DefaultNotifierRateLimit = 20
+
+// Notifier posts chat messages about the changes made on a node and its
+// descendants. Provider names the message format, see the server's providers.
+type Notifier struct {
+	ID        string            `json:"id"`
+	NodeID    string            `json:"node_id"`
+	Provider  string            `json:"provider"`
+	URL       string            `json:"url"`
+	Events    []string          `json:"events,omitempty"`    // Change types to send
+	Templates map[string]string `json:"templates,omitempty"` // text/template messages by change type, replacing the defaults
+	Channel   string            `json:"channel,omitempty"`
+	Username  string            `json:"username,omitempty"`   // Name the messages are posted as
+	RateLimit int               `json:"rate_limit,omitempty"` // Messages per minute, DefaultNotifierRateLimit when zero
+	CreatedBy string            `json:"created_by,omitempty"`
+	CreatedAt time.Time         `json:"created_at,omitempty"`
+}
+
+// Wants reports whether the notifier sends changes of the given type
+func (notifier Notifier) Wants(eventType string) bool {
+	for _, event := range notifier.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// MessagesPerMinute returns the notifier's rate limit
+func (notifier Notifier) MessagesPerMinute() int {
+	if notifier.RateLimit <= 0 {
+		return DefaultNotifierRateLimit
+	}
+	return notifier.RateLimit
+}
+
+func newNotifierID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return "nt-" + hex.EncodeToString(id)
+}
+
+// AddNotifier registers a notifier on the node, taking admin permission like
+// webhooks. The ID, node and creator are filled in.
+func (n *Node) AddNotifier(notifier Notifier, userID string) (*Notifier, error) {
+	if !n.CheckPermission(userID, AdminPermission) {
+		return nil, fmt.Errorf("insufficient permissions")
+	}
+	if !isHTTPURL(notifier.URL) {
+		return nil, fmt.Errorf("%w: %q is not an http or https URL", ErrInvalidNotifier, notifier.URL)
+	}
+	if notifier.RateLimit < 0 {
+		return nil, fmt.Errorf("%w: rate limit must not be negative", ErrInvalidNotifier)
+	}
+	for eventType, text := range notifier.Templates {
+		if _, err := template.New(eventType).Parse(text); err != nil {
+			return nil, fmt.Errorf("%w: template for %s: %v", ErrInvalidNotifier, eventType, err)
+		}
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	notifier.ID = newNotifierID()
+	notifier.NodeID = n.ID
+	notifier.CreatedBy = userID
+	notifier.CreatedAt = time.Now()
+	if n.Notifiers == nil {
+		n.Notifiers = make(map[string]Notifier)
+	}
+	n.Notifiers[notifier.ID] = notifier
+	return &notifier, nil
+}
+
+// GetNotifier returns the notifier with the given ID
+func (n *Node) GetNotifier(notifierID string) (Notifier, error) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	notifier, exists := n.Notifiers[notifierID]
+	if !exists {
+		return Notifier{}, fmt.Errorf("%w: %s", ErrNotifierNotFound, notifierID)
+	}
+	return notifier, nil
+}
+
+// ListNotifiers returns the notifiers registered on the node, oldest first
+func (n *Node) ListNotifiers() []Notifier {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	notifiers := make([]Notifier, 0, len(n.Notifiers))
+	for _, notifier := range n.Notifiers {
+		notifiers = append(notifiers, notifier)
+	}
+	sort.Slice(notifiers, func(i, j int) bool {
+		if !notifiers[i].CreatedAt.Equal(notifiers[j].CreatedAt) {
+			return notifiers[i].CreatedAt.Before(notifiers[j].CreatedAt)
+		}
+		return notifiers[i].ID < notifiers[j].ID
+	})
+	return notifiers
+}
+
+// DeleteNotifier removes the notifier
+func (n *Node) DeleteNotifier(notifierID string, userID string) error {
+	if !n.CheckPermission(userID, AdminPermission) {
+		return fmt.Errorf("insufficient permissions")
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, exists := n.Notifiers[notifierID]; !exists {
+		return fmt.Errorf("%w: %s", ErrNotifierNotFound, notifierID)
+	}
+	delete(n.Notifiers, notifierID)
+	return nil
+}
@@ -0,0 +1,129 @@
+package core
+
+// noPermission is the effective level of a user without access to a node
+const noPermission Permission = -1
+
+// CheckPermission reports whether a user holds at least the given permission
+// on the node. Grants are inherited from every parent, a higher grant implies
+// the lower ones (admin ⊇ write ⊇ read), and an explicit deny on a node cuts
+// off whatever would have been inherited through it.
+func (n *Node) CheckPermission(userID string, permission Permission) bool {
+	if permission == DenyPermission {
+		return false
+	}
+	return n.EffectivePermission(userID) >= permission
+}
+
+// EffectivePermission returns the highest permission a user holds on the node,
+// or -1 when the user has no access
+func (n *Node) EffectivePermission(userID string) Permission {
+	return n.effectivePermission(userID, make(map[*Node]Permission))
+}
+
+func (n *Node) effectivePermission(userID string, seen map[*Node]Permission) Permission {
+	if level, exists := seen[n]; exists {
+		return level
+	}
+	// Guards against cycles while this node is being evaluated
+	seen[n] = noPermission
+
+	grants, parents := n.permissionSources(userID)
+	level := noPermission
+	for _, grant := range grants {
+		if grant.Permission == DenyPermission {
+			return noPermission
+		}
+		if grant.Permission > level {
+			level = grant.Permission
+		}
+	}
+
+	if level < AdminPermission {
+		for _, parent := range parents {
+			if inherited := parent.effectivePermission(userID, seen); inherited > level {
+				level = inherited
+			}
+		}
+	}
+
+	seen[n] = level
+	return level
+}
+
+// permissionSources copies out the user's grants on the node and the node's
+// parents, so no lock is held while the parents are evaluated
+func (n *Node) permissionSources(userID string) ([]Grant, []*Node) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	var grants []Grant
+	for _, grant := range n.Grants {
+		if grant.UserID == userID {
+			grants = append(grants, grant)
+		}
+	}
+	parents := make([]*Node, 0, len(n.parentNodes))
+	for _, parent := range n.parentNodes {
+		parents = append(parents, parent)
+	}
+	return grants, parents
+}
+
+// FilterFor returns a copy of the tree holding only what the user may read.
+// Nodes the user cannot read are kept as bare outlines (ID, name and type)
+// when they lead to readable descendants, so the tree stays navigable; the
+// node FilterFor is called on is always returned.
+func (n *Node) FilterFor(userID string) *Node {
+	filtered, _ := n.filterFor(userID, make(map[*Node]Permission))
+	return filtered
+}
+
+func (n *Node) filterFor(userID string, seen map[*Node]Permission) (*Node, bool) {
+	// Resolved before taking the lock, the check locks this node and its parents
+	readable := n.effectivePermission(userID, seen) >= ReadPermission
+
+	n.mutex.RLock()
+	filtered := &Node{
+		ID:       n.ID,
+		Type:     n.Type,
+		Name:     n.Name,
+		Parents:  n.Parents,
+		Children: make(map[string]*Node),
+	}
+	if readable {
+		// Attachment contents are fetched on their own rather than sent with the tree
+		filtered.Events = eventsWithoutData(n.Events)
+		filtered.PlannedEvents = eventsWithoutData(n.PlannedEvents)
+		filtered.Grants = append([]Grant(nil), n.Grants...)
+		filtered.Entries = entriesWithoutData(n.Entries)
+		if n.Attachments != nil {
+			filtered.Attachments = make(map[string]Attachment, len(n.Attachments))
+			for attachmentID, attachment := range n.Attachments {
+				attachment.Data = nil
+				filtered.Attachments[attachmentID] = attachment
+			}
+		}
+		filtered.TimeSessions = n.TimeSessions
+		filtered.CreatedBy = n.CreatedBy
+		filtered.CreatedAt = n.CreatedAt
+		filtered.ModifiedBy = n.ModifiedBy
+		filtered.ModifiedAt = n.ModifiedAt
+	}
+
+	children := make(map[string]*Node, len(n.Children))
+	for childID, child := range n.Children {
+		children[childID] = child
+	}
+	n.mutex.RUnlock()
+
+	// Children are filtered without holding this node's lock, their checks
+	// read this node as a parent
+	visible := readable
+	for childID, child := range children {
+		if filteredChild, childVisible := child.filterFor(userID, seen); childVisible {
+			filtered.Children[childID] = filteredChild
+			visible = true
+		}
+	}
+	return filtered, visible
+}
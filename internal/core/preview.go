@@ -0,0 +1,306 @@
+package core
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // Registered for image.Decode
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// Thumbnail and preview limits
+const (
+	ThumbnailSize      = 256        // Longest edge of a thumbnail in pixels
+	MaxThumbnailPixels = 16_000_000 // Larger images are not decoded
+	thumbnailSamples   = 4          // Source pixels sampled along each edge of a thumbnail pixel
+	PreviewLength      = 4096       // Bytes of text a preview keeps
+	PreviewRows        = 20         // Rows a CSV preview keeps
+	PreviewReadSize    = 64 << 10   // Bytes of a file read to preview it
+)
+
+// Kinds of preview
+const (
+	PreviewText = "text"
+	PreviewJSON = "json"
+	PreviewCSV  = "csv"
+)
+
+// ErrNotPreviewable is returned for attachments whose type has no thumbnail
+// or preview, and wrapped for images that cannot be decoded or are too large.
+// Trying again cannot help with any of these.
+var ErrNotPreviewable = errors.New("no preview for this type")
+
+// Preview is the start of a text attachment
+type Preview struct {
+	Kind      string     `json:"kind"` // PreviewText, PreviewJSON or PreviewCSV
+	Text      string     `json:"text"` // JSON is indented
+	Truncated bool       `json:"truncated"`
+	Rows      [][]string `json:"rows,omitempty"` // First rows of a CSV file
+}
+
+func mediaType(mimeType string) string {
+	if parsed, _, err := mime.ParseMediaType(mimeType); err == nil {
+		return parsed
+	}
+	return strings.ToLower(mimeType)
+}
+
+// CanThumbnail returns whether thumbnails are made for a file type
+func CanThumbnail(mimeType string) bool {
+	switch mediaType(mimeType) {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
+// PreviewKind returns the kind of preview made for a file type, empty when
+// none is
+func PreviewKind(mimeType string) string {
+	switch parsed := mediaType(mimeType); {
+	case parsed == "application/json" || strings.HasSuffix(parsed, "+json"):
+		return PreviewJSON
+	case parsed == "text/csv" || parsed == "application/csv":
+		return PreviewCSV
+	case strings.HasPrefix(parsed, "text/"):
+		return PreviewText
+	}
+	return ""
+}
+
+// MakeThumbnail scales a PNG, JPEG or GIF image down to fit ThumbnailSize,
+// the first frame of an animation, and encodes it as PNG. Smaller images
+// keep their size.
+func MakeThumbnail(data []byte) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotPreviewable, err)
+	}
+	if config.Width*config.Height > MaxThumbnailPixels {
+		return nil, fmt.Errorf("%w: image too large to thumbnail: %dx%d", ErrNotPreviewable, config.Width, config.Height)
+	}
+	source, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotPreviewable, err)
+	}
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, scaleDown(source, ThumbnailSize)); err != nil {
+		return nil, err
+	}
+	return encoded.Bytes(), nil
+}
+
+// scaleDown fits an image within maxEdge pixels, averaging up to
+// thumbnailSamples² of the source pixels each thumbnail pixel covers
+func scaleDown(source image.Image, maxEdge int) image.Image {
+	pixel := pixelReader(source)
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	targetWidth, targetHeight := width, height
+	if width > maxEdge || height > maxEdge {
+		if width >= height {
+			targetWidth, targetHeight = maxEdge, max(1, height*maxEdge/width)
+		} else {
+			targetWidth, targetHeight = max(1, width*maxEdge/height), maxEdge
+		}
+	}
+
+	scaled := image.NewNRGBA(image.Rect(0, 0, targetWidth, targetHeight))
+	for y := 0; y < targetHeight; y++ {
+		y0 := bounds.Min.Y + y*height/targetHeight
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*height/targetHeight)
+		for x := 0; x < targetWidth; x++ {
+			x0 := bounds.Min.X + x*width/targetWidth
+			x1 := max(x0+1, bounds.Min.X+(x+1)*width/targetWidth)
+
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy += max(1, (y1-y0)/thumbnailSamples) {
+				for sx := x0; sx < x1; sx += max(1, (x1-x0)/thumbnailSamples) {
+					pr, pg, pb, pa := pixel(sx, sy)
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					count++
+				}
+			}
+			scaled.Set(x, y, color.RGBA64{
+				R: uint16(r / count),
+				G: uint16(g / count),
+				B: uint16(b / count),
+				A: uint16(a / count),
+			})
+		}
+	}
+	return scaled
+}
+
+// pixelReader returns a function reading an image's alpha-premultiplied
+// colour at a point, reading the pixel buffers of the types the decoders
+// usually return directly rather than through image.Image.At
+func pixelReader(source image.Image) func(x, y int) (r, g, b, a uint32) {
+	switch source := source.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			yi, ci := source.YOffset(x, y), source.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(source.Y[yi], source.Cb[ci], source.Cr[ci])
+			return uint32(r) * 0x101, uint32(g) * 0x101, uint32(b) * 0x101, 0xffff
+		}
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			pix := source.Pix[source.PixOffset(x, y):]
+			a := uint32(pix[3]) * 0x101
+			return uint32(pix[0]) * a / 0xff, uint32(pix[1]) * a / 0xff, uint32(pix[2]) * a / 0xff, a
+		}
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			pix := source.Pix[source.PixOffset(x, y):]
+			return uint32(pix[0]) * 0x101, uint32(pix[1]) * 0x101, uint32(pix[2]) * 0x101, uint32(pix[3]) * 0x101
+		}
+	}
+	return func(x, y int) (uint32, uint32, uint32, uint32) {
+		return source.At(x, y).RGBA()
+	}
+}
+
+// MakePreview returns the start of a plain text, JSON or CSV file. JSON is
+// indented, and invalid JSON or CSV is previewed as plain text.
+func MakePreview(data []byte, mimeType string) (*Preview, error) {
+	return makePreview(data, mimeType, false)
+}
+
+// ReadPreview is MakePreview for a file read from r. Only the first
+// PreviewReadSize bytes are read, enough for the text and rows a preview keeps.
+func ReadPreview(r io.Reader, mimeType string) (*Preview, error) {
+	data, err := io.ReadAll(io.LimitReader(r, PreviewReadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) <= PreviewReadSize {
+		return makePreview(data, mimeType, false)
+	}
+	return makePreview(data[:PreviewReadSize], mimeType, true)
+}
+
+// makePreview previews data, which is only the start of the file when cut
+func makePreview(data []byte, mimeType string, cut bool) (*Preview, error) {
+	kind := PreviewKind(mimeType)
+	if kind == "" {
+		return nil, ErrNotPreviewable
+	}
+	preview := &Preview{Kind: kind}
+
+	text := data
+	switch kind {
+	case PreviewJSON:
+		var indented bytes.Buffer
+		if cut {
+			if indentPrefix(&indented, data) {
+				text = indented.Bytes()
+			} else {
+				preview.Kind = PreviewText
+			}
+		} else if err := json.Indent(&indented, data, "", "  "); err == nil {
+			text = indented.Bytes()
+		} else {
+			preview.Kind = PreviewText
+		}
+	case PreviewCSV:
+		rows := data
+		if end := bytes.LastIndexByte(rows, '\n'); cut && end >= 0 {
+			// The last row read is likely cut short
+			rows = rows[:end+1]
+		}
+		reader := csv.NewReader(bytes.NewReader(rows))
+		reader.FieldsPerRecord = -1
+		for len(preview.Rows) < PreviewRows {
+			row, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				preview.Kind, preview.Rows = PreviewText, nil
+				break
+			}
+			preview.Rows = append(preview.Rows, row)
+		}
+	}
+
+	preview.Truncated = cut
+	if len(text) > PreviewLength {
+		// Cut before a rune rather than in the middle of one
+		end := PreviewLength
+		for end > PreviewLength-utf8.UTFMax && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		text = text[:end]
+		preview.Truncated = true
+	}
+	preview.Text = strings.ToValidUTF8(string(text), "�")
+	return preview, nil
+}
+
+// indentPrefix indents the start of a JSON document, which may end at any
+// point, like json.Indent. It returns false when the start is not JSON.
+func indentPrefix(dst *bytes.Buffer, data []byte) bool {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	type level struct {
+		object bool
+		items  int // Keys and values written, or elements for arrays
+	}
+	var stack []*level
+	newline := func() {
+		dst.WriteByte('\n')
+		dst.WriteString(strings.Repeat("  ", len(stack)))
+	}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF)
+		}
+
+		if delim, ok := token.(json.Delim); ok && (delim == '}' || delim == ']') {
+			closed := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if closed.items > 0 {
+				newline()
+			}
+			dst.WriteByte(byte(delim))
+			continue
+		}
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			if parent.object && parent.items%2 == 1 {
+				dst.WriteString(": ")
+			} else {
+				if parent.items > 0 {
+					dst.WriteByte(',')
+				}
+				newline()
+			}
+			parent.items++
+		}
+
+		switch value := token.(type) {
+		case json.Delim:
+			dst.WriteByte(byte(value))
+			stack = append(stack, &level{object: value == '{'})
+		case json.Number:
+			dst.WriteString(value.String())
+		default:
+			encoder := json.NewEncoder(dst)
+			encoder.SetEscapeHTML(false)
+			encoder.Encode(value)
+			dst.Truncate(dst.Len() - 1) // Encode ends values with a newline
+		}
+	}
+}
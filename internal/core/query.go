@@ -0,0 +1,601 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields a query can sort by
+const (
+	SortByTime     = "time"
+	SortByID       = "id"
+	SortByName     = "name"
+	SortByPath     = "path" // Nodes only, parents before their children
+	SortByStatus   = "status"
+	SortByCategory = "category"
+	SortByUser     = "user"
+	SortBySize     = "size" // Attachments only
+)
+
+// Page size limits
+const (
+	DefaultQueryLimit = 100
+	MaxQueryLimit     = 1000
+)
+
+// ErrInvalidQuery is returned for query parameters that cannot be used
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Query filters, orders, pages and projects a listing of events, entries,
+// nodes or attachments. A filter on something an item does not have, like
+// the status of an entry, matches nothing.
+type Query struct {
+	Status   []EventStatus // Any of these, every status when empty
+	Category []string      // Any of these, every category when empty
+	User     string        // Creator of an event or node, author of an entry, uploader of an attachment
+	From     time.Time     // Zero leaves the range open
+	To       time.Time
+	Metadata map[string]string // Every key must hold the value, compared as text
+	Type     []string          // Any of these attachment MIME types, "image/*" matching a whole family
+	MinSize  int64             // Bytes of an attachment, zero leaves the range open
+	MaxSize  int64             // Zero leaves the range open
+	Sort     string            // Listings pick their own order when empty
+	Desc     bool
+	Cursor   string   // NextCursor of the previous page
+	Limit    int      // DefaultQueryLimit when zero, at most MaxQueryLimit
+	Fields   []string // Fields kept in each item, every field when empty
+}
+
+// QueryItem is an event, entry or node being listed, along with the
+// attributes queries look at
+type QueryItem struct {
+	ID       string
+	Status   EventStatus
+	Category string
+	User     string
+	Time     time.Time // Start of an event, timestamp of an entry, creation of a node, upload of an attachment
+	Name     string
+	Path     string
+	Metadata map[string]interface{}
+	Type     string                 // MIME type of an attachment
+	Size     int64                  // Bytes of an attachment
+	Value    map[string]interface{} // JSON fields of the item
+	idField  string                 // Field of Value always kept by projections
+	order    string                 // Breaks ties between items sorting alike
+}
+
+// Page is one page of a listing
+type Page struct {
+	Items      []map[string]interface{} `json:"items"`
+	Total      int                      `json:"total"` // Items matching the filters over every page
+	NextCursor string                   `json:"next_cursor,omitempty"`
+}
+
+// ParseQuery reads a query from URL parameters: status and category take
+// comma separated lists, from and to RFC 3339 times, meta.<key> metadata
+// values, type a comma separated list of MIME types, min_size and max_size
+// bytes, sort a field with a leading - for descending order, and fields a
+// comma separated projection
+func ParseQuery(values map[string][]string) (Query, error) {
+	get := func(key string) string {
+		if len(values[key]) == 0 {
+			return ""
+		}
+		return strings.TrimSpace(values[key][0])
+	}
+
+	var query Query
+	for _, status := range splitList(get("status")) {
+		query.Status = append(query.Status, EventStatus(status))
+	}
+	query.Category = splitList(get("category"))
+	query.User = get("user")
+	query.Type = splitList(get("type"))
+	query.Fields = splitList(get("fields"))
+	query.Cursor = get("cursor")
+
+	var err error
+	if value := get("from"); value != "" {
+		if query.From, err = time.Parse(time.RFC3339, value); err != nil {
+			return Query{}, fmt.Errorf("%w: invalid from time format", ErrInvalidQuery)
+		}
+	}
+	if value := get("to"); value != "" {
+		if query.To, err = time.Parse(time.RFC3339, value); err != nil {
+			return Query{}, fmt.Errorf("%w: invalid to time format", ErrInvalidQuery)
+		}
+	}
+	for key, size := range map[string]*int64{"min_size": &query.MinSize, "max_size": &query.MaxSize} {
+		if value := get(key); value != "" {
+			if *size, err = strconv.ParseInt(value, 10, 64); err != nil || *size < 0 {
+				return Query{}, fmt.Errorf("%w: invalid %s", ErrInvalidQuery, key)
+			}
+		}
+	}
+	if value := get("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil || query.Limit <= 0 {
+			return Query{}, fmt.Errorf("%w: invalid limit", ErrInvalidQuery)
+		}
+	}
+
+	if value := get("sort"); value != "" {
+		query.Desc = strings.HasPrefix(value, "-")
+		query.Sort = strings.TrimPrefix(value, "-")
+		switch query.Sort {
+		case SortByTime, SortByID, SortByName, SortByPath, SortByStatus, SortByCategory, SortByUser, SortBySize:
+		default:
+			return Query{}, fmt.Errorf("%w: cannot sort by %s", ErrInvalidQuery, query.Sort)
+		}
+	}
+
+	for key, list := range values {
+		if name := strings.TrimPrefix(key, "meta."); name != key && name != "" && len(list) > 0 {
+			if query.Metadata == nil {
+				query.Metadata = make(map[string]string)
+			}
+			query.Metadata[name] = list[0]
+		}
+	}
+	return query, nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Run filters and orders the items and returns the page following the
+// query's cursor
+func (query Query) Run(items []QueryItem) (Page, error) {
+	if query.Sort == "" {
+		query.Sort = SortByTime
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	matched := make([]QueryItem, 0, len(items))
+	for _, item := range items {
+		if query.matches(item) {
+			matched = append(matched, item)
+		}
+	}
+	before := func(a, b QueryItem) bool {
+		keyA, keyB := a.sortKey(query.Sort), b.sortKey(query.Sort)
+		if keyA != keyB {
+			return (keyA < keyB) != query.Desc
+		}
+		return (a.order < b.order) != query.Desc
+	}
+	sort.Slice(matched, func(i, j int) bool { return before(matched[i], matched[j]) })
+
+	start := 0
+	if query.Cursor != "" {
+		after, err := query.decodeCursor()
+		if err != nil {
+			return Page{}, err
+		}
+		start = sort.Search(len(matched), func(i int) bool { return before(after, matched[i]) })
+	}
+	end := start + limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	page := Page{Items: make([]map[string]interface{}, 0, end-start), Total: len(matched)}
+	for _, item := range matched[start:end] {
+		page.Items = append(page.Items, item.project(query.Fields))
+	}
+	if end < len(matched) {
+		page.NextCursor = query.encodeCursor(matched[end-1])
+	}
+	return page, nil
+}
+
+func (query Query) matches(item QueryItem) bool {
+	if len(query.Status) > 0 && !containsStatus(query.Status, item.Status) {
+		return false
+	}
+	if len(query.Category) > 0 && !containsString(query.Category, item.Category) {
+		return false
+	}
+	if query.User != "" && item.User != query.User {
+		return false
+	}
+	if !query.From.IsZero() || !query.To.IsZero() {
+		if item.Time.IsZero() {
+			return false
+		}
+		if !query.From.IsZero() && item.Time.Before(query.From) {
+			return false
+		}
+		if !query.To.IsZero() && !item.Time.Before(query.To) {
+			return false
+		}
+	}
+	if len(query.Type) > 0 && (item.Type == "" || !matchesType(query.Type, mediaType(item.Type))) {
+		return false
+	}
+	if query.MinSize > 0 || query.MaxSize > 0 {
+		// Only attachments have a size
+		if item.Type == "" || item.Size < query.MinSize || (query.MaxSize > 0 && item.Size > query.MaxSize) {
+			return false
+		}
+	}
+	for key, value := range query.Metadata {
+		actual, exists := item.Metadata[key]
+		if !exists || fmt.Sprint(actual) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func containsStatus(statuses []EventStatus, status EventStatus) bool {
+	for _, candidate := range statuses {
+		if candidate == status {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sortKey returns the item's value for the field as text ordering like the value
+func (item QueryItem) sortKey(field string) string {
+	switch field {
+	case SortByID:
+		return item.order
+	case SortByName:
+		return item.Name
+	case SortByPath:
+		// Separators sort first so children follow their parent directly
+		return strings.ReplaceAll(item.Path, "/", "\x00")
+	case SortByStatus:
+		return string(item.Status)
+	case SortByCategory:
+		return item.Category
+	case SortByUser:
+		return item.User
+	case SortBySize:
+		return fmt.Sprintf("%020d", item.Size)
+	default:
+		return item.Time.UTC().Format("2006-01-02T15:04:05.000000000Z")
+	}
+}
+
+// queryCursor is the position of the last item of a page
+type queryCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Key   string `json:"k"`
+	Order string `json:"o"`
+}
+
+func (query Query) encodeCursor(last QueryItem) string {
+	data, _ := json.Marshal(queryCursor{Sort: query.Sort, Desc: query.Desc, Key: last.sortKey(query.Sort), Order: last.order})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns an item placed where the cursor points
+func (query Query) decodeCursor() (QueryItem, error) {
+	var cursor queryCursor
+	data, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil {
+		return QueryItem{}, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	if cursor.Sort != query.Sort || cursor.Desc != query.Desc {
+		return QueryItem{}, fmt.Errorf("%w: cursor belongs to a different sort", ErrInvalidQuery)
+	}
+
+	item := QueryItem{order: cursor.Order}
+	switch query.Sort {
+	case SortByID:
+	case SortByName:
+		item.Name = cursor.Key
+	case SortByPath:
+		item.Path = strings.ReplaceAll(cursor.Key, "\x00", "/")
+	case SortByStatus:
+		item.Status = EventStatus(cursor.Key)
+	case SortByCategory:
+		item.Category = cursor.Key
+	case SortByUser:
+		item.User = cursor.Key
+	case SortBySize:
+		if item.Size, err = strconv.ParseInt(cursor.Key, 10, 64); err != nil {
+			return QueryItem{}, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+		}
+	default:
+		if item.Time, err = time.Parse("2006-01-02T15:04:05.000000000Z", cursor.Key); err != nil {
+			return QueryItem{}, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+		}
+	}
+	return item, nil
+}
+
+// project returns the item with only the given fields, and its ID
+func (item QueryItem) project(fields []string) map[string]interface{} {
+	if len(fields) == 0 {
+		return item.Value
+	}
+	projected := make(map[string]interface{}, len(fields)+1)
+	for _, field := range fields {
+		if value, exists := item.Value[field]; exists {
+			projected[field] = value
+		}
+	}
+	if value, exists := item.Value[item.idField]; exists {
+		projected[item.idField] = value
+	}
+	return projected
+}
+
+// EventItems lists the node's events and planned events for a query. Entries
+// are left out and counted, they are listed on their own.
+func (n *Node) EventItems() []QueryItem {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	items := make([]QueryItem, 0, len(n.Events)+len(n.PlannedEvents))
+	add := func(eventID string, event Event, planned bool) {
+		entries := len(event.Entries)
+		event.Entries = nil
+		value := jsonFields(event)
+		delete(value, "entries")
+		value["id"] = eventID
+		value["entries_count"] = entries
+		value["planned"] = planned
+
+		item := QueryItem{
+			ID:       eventID,
+			Status:   event.Status,
+			Category: event.Category,
+			User:     event.CreatedBy,
+			Time:     event.CreatedAt,
+			Name:     eventID,
+			Metadata: event.Metadata,
+			Value:    value,
+			idField:  "id",
+			order:    eventID,
+		}
+		if event.StartTime != nil {
+			item.Time = *event.StartTime
+		}
+		if planned {
+			item.order += "\x00planned"
+		}
+		items = append(items, item)
+	}
+	for eventID, event := range n.Events {
+		add(eventID, event, false)
+	}
+	for eventID, event := range n.PlannedEvents {
+		add(eventID, event, true)
+	}
+	return items
+}
+
+// EntryItems lists the node's own entries for a query
+func (n *Node) EntryItems() []QueryItem {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return entryItems(n.Entries)
+}
+
+// EventEntryItems lists the entries of an event for a query
+func (n *Node) EventEntryItems(eventID string) ([]QueryItem, error) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	event, exists := n.Events[eventID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrEventNotFound, eventID)
+	}
+	return entryItems(event.Entries), nil
+}
+
+func entryItems(entries []Entry) []QueryItem {
+	items := make([]QueryItem, 0, len(entries))
+	for i, entry := range entries {
+		entry.Attachments = withoutData(entry.Attachments)
+		value := jsonFields(entry)
+		value["index"] = i
+		items = append(items, QueryItem{
+			ID:       strconv.Itoa(i),
+			User:     entry.UserID,
+			Time:     entry.Timestamp,
+			Metadata: entry.Metadata,
+			Value:    value,
+			idField:  "index",
+			order:    fmt.Sprintf("%010d", i),
+		})
+	}
+	return items
+}
+
+// NodeItems lists n, found at path, and every descendant userID can read for
+// a query. Nodes are listed once, under the first path found to them, with
+// their children as IDs and counts in place of their contents.
+func (n *Node) NodeItems(path, userID string) []QueryItem {
+	var items []QueryItem
+	n.Walk(path, func(node *Node, path string) {
+		if node.CheckPermission(userID, ReadPermission) {
+			items = append(items, node.nodeItem(path))
+		}
+	})
+	return items
+}
+
+// Walk visits n, found at path, and its descendants once each, under the
+// first path found to them. Each node's read lock is held while its children
+// are listed, not while it is visited, so it is safe while the tree changes.
+func (n *Node) Walk(path string, visit func(node *Node, path string)) {
+	listed := make(map[*Node]bool)
+	var walk func(node *Node, path string)
+	walk = func(node *Node, path string) {
+		if listed[node] {
+			return
+		}
+		listed[node] = true
+		visit(node, path)
+
+		children := node.ChildNodes()
+		sort.Slice(children, func(i, j int) bool {
+			if children[i].Name == children[j].Name {
+				return children[i].ID < children[j].ID
+			}
+			return children[i].Name < children[j].Name
+		})
+		for _, child := range children {
+			childPath := EscapeName(child.Name)
+			if path != "" {
+				childPath = path + "/" + childPath
+			}
+			walk(child, childPath)
+		}
+	}
+	walk(n, path)
+}
+
+func (n *Node) nodeItem(path string) QueryItem {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	children := make([]string, 0, len(n.Children))
+	for childID := range n.Children {
+		children = append(children, childID)
+	}
+	sort.Strings(children)
+
+	value := map[string]interface{}{
+		"id":                   n.ID,
+		"name":                 n.Name,
+		"type":                 n.Type,
+		"path":                 path,
+		"parents":              n.Parents,
+		"children":             children,
+		"grants":               n.Grants,
+		"entries_count":        len(n.Entries),
+		"events_count":         len(n.Events),
+		"planned_events_count": len(n.PlannedEvents),
+		"attachments_count":    len(n.Attachments),
+		"time_sessions_count":  len(n.TimeSessions),
+		"created_by":           n.CreatedBy,
+		"created_at":           n.CreatedAt,
+		"modified_by":          n.ModifiedBy,
+		"modified_at":          n.ModifiedAt,
+	}
+	return QueryItem{
+		ID:      n.ID,
+		User:    n.CreatedBy,
+		Time:    n.CreatedAt,
+		Name:    n.Name,
+		Path:    path,
+		Value:   value,
+		idField: "id",
+		order:   n.ID,
+	}
+}
+
+// AttachmentItems lists the attachments of n, found at path, and of its
+// entries and event entries for a query. With recursive those of every
+// descendant userID can read follow, under the first path found to them.
+func (n *Node) AttachmentItems(path, userID string, recursive bool) []QueryItem {
+	if !recursive {
+		return n.attachmentItems(path)
+	}
+	var items []QueryItem
+	n.Walk(path, func(node *Node, path string) {
+		if node.CheckPermission(userID, ReadPermission) {
+			items = append(items, node.attachmentItems(path)...)
+		}
+	})
+	return items
+}
+
+func (n *Node) attachmentItems(path string) []QueryItem {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	var items []QueryItem
+	// Entry attachments name their event, if any, and entry index
+	add := func(attachment Attachment, eventID string, entryIndex int) {
+		attachment.Data = nil
+		value := jsonFields(attachment)
+		value["path"] = path
+		value["node_id"] = n.ID
+		order := n.ID + "\x00" + eventID + "\x00"
+		if entryIndex >= 0 {
+			if eventID != "" {
+				value["event_id"] = eventID
+			}
+			value["entry_index"] = entryIndex
+			order += fmt.Sprintf("%010d", entryIndex)
+		}
+		items = append(items, QueryItem{
+			ID:      attachment.ID,
+			User:    attachment.UploadedBy,
+			Time:    attachment.UploadedAt,
+			Name:    attachment.Name,
+			Path:    path,
+			Type:    attachment.Type,
+			Size:    attachment.Size,
+			Value:   value,
+			idField: "id",
+			order:   order + "\x00" + attachment.ID,
+		})
+	}
+
+	for _, attachment := range n.Attachments {
+		add(attachment, "", -1)
+	}
+	for i, entry := range n.Entries {
+		for _, attachment := range entry.Attachments {
+			add(attachment, "", i)
+		}
+	}
+	for eventID, event := range n.Events {
+		for i, entry := range event.Entries {
+			for _, attachment := range entry.Attachments {
+				add(attachment, eventID, i)
+			}
+		}
+	}
+	return items
+}
+
+// jsonFields returns the fields value is encoded to in JSON
+func jsonFields(value interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	data, err := json.Marshal(value)
+	if err == nil {
+		json.Unmarshal(data, &fields)
+	}
+	return fields
+}
@@ -0,0 +1,449 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+	FreqYearly  = "YEARLY"
+
+	// Upper bound on the periods a rule is expanded over, for rules whose
+	// filters rarely or never match
+	maxRecurrencePeriods = 100000
+
+	untilLayout     = "20060102T150405Z"
+	untilDateLayout = "20060102"
+)
+
+// ErrInvalidRecurrence is returned for frequencies and patterns that cannot be parsed
+var ErrInvalidRecurrence = errors.New("invalid recurrence")
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// Recurrence is a repeat rule for events, the subset of RFC 5545 RRULE made
+// of FREQ (DAILY, WEEKLY, MONTHLY or YEARLY), INTERVAL, COUNT, UNTIL, BYDAY,
+// BYMONTHDAY, BYMONTH and WKST. Occurrences keep the time of day of the
+// event's start and are computed in its time zone. In YEARLY rules BYDAY and
+// BYMONTHDAY apply within the months of BYMONTH, or the start's month.
+type Recurrence struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      *time.Time
+	ByDay      []RecurrenceDay
+	ByMonthDay []int
+	ByMonth    []time.Month
+	WeekStart  time.Weekday
+}
+
+// RecurrenceDay is a BYDAY value: a weekday with an optional ordinal within
+// the month, such as the 2 of 2TU or the -1 of -1FR
+type RecurrenceDay struct {
+	Weekday time.Weekday
+	N       int
+}
+
+// ParseRecurrence returns the rule of an event from its Frequency and Pattern
+// fields. Pattern holds an RRULE and takes precedence; Frequency is one of
+// daily, weekly, monthly or yearly. Events with neither have no rule.
+func ParseRecurrence(frequency, pattern string) (*Recurrence, error) {
+	if strings.TrimSpace(pattern) != "" {
+		return ParseRRule(pattern)
+	}
+
+	switch strings.ToUpper(frequency) {
+	case "":
+		return nil, nil
+	case FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+		return &Recurrence{Freq: strings.ToUpper(frequency), Interval: 1, WeekStart: time.Monday}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown frequency %s", ErrInvalidRecurrence, frequency)
+}
+
+// ParseRRule parses an RRULE value, with or without the "RRULE:" prefix
+func ParseRRule(rule string) (*Recurrence, error) {
+	rule = strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:")
+	r := &Recurrence{Interval: 1, WeekStart: time.Monday}
+
+	for _, part := range strings.Split(rule, ";") {
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("%w: malformed part %q", ErrInvalidRecurrence, part)
+		}
+
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(value)
+			switch r.Freq {
+			case FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+			default:
+				err = fmt.Errorf("unsupported FREQ %s", value)
+			}
+		case "INTERVAL":
+			r.Interval, err = parseRuleInt(value, 1, 0)
+		case "COUNT":
+			r.Count, err = parseRuleInt(value, 1, 0)
+		case "UNTIL":
+			var until time.Time
+			until, err = parseUntil(value)
+			r.Until = &until
+		case "BYDAY":
+			for _, code := range strings.Split(value, ",") {
+				var day RecurrenceDay
+				if day, err = parseRecurrenceDay(code); err != nil {
+					break
+				}
+				r.ByDay = append(r.ByDay, day)
+			}
+		case "BYMONTHDAY":
+			for _, item := range strings.Split(value, ",") {
+				var day int
+				if day, err = parseRuleInt(item, -31, 31); err != nil || day == 0 {
+					err = fmt.Errorf("bad BYMONTHDAY %s", item)
+					break
+				}
+				r.ByMonthDay = append(r.ByMonthDay, day)
+			}
+		case "BYMONTH":
+			for _, item := range strings.Split(value, ",") {
+				var month int
+				if month, err = parseRuleInt(item, 1, 12); err != nil {
+					break
+				}
+				r.ByMonth = append(r.ByMonth, time.Month(month))
+			}
+		case "WKST":
+			weekday, exists := weekdayCodes[strings.ToUpper(value)]
+			if !exists {
+				err = fmt.Errorf("bad WKST %s", value)
+			}
+			r.WeekStart = weekday
+		default:
+			err = fmt.Errorf("unsupported part %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRecurrence, err)
+		}
+	}
+
+	if r.Freq == "" {
+		return nil, fmt.Errorf("%w: FREQ is required", ErrInvalidRecurrence)
+	}
+	if r.Count > 0 && r.Until != nil {
+		return nil, fmt.Errorf("%w: COUNT and UNTIL are exclusive", ErrInvalidRecurrence)
+	}
+	if r.Freq == FreqWeekly && len(r.ByMonthDay) > 0 {
+		return nil, fmt.Errorf("%w: BYMONTHDAY is not allowed in WEEKLY rules", ErrInvalidRecurrence)
+	}
+	for _, day := range r.ByDay {
+		if day.N != 0 && r.Freq != FreqMonthly && r.Freq != FreqYearly {
+			return nil, fmt.Errorf("%w: BYDAY ordinals need a MONTHLY or YEARLY rule", ErrInvalidRecurrence)
+		}
+	}
+	return r, nil
+}
+
+func parseRuleInt(value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || (max != 0 && n > max) {
+		return 0, fmt.Errorf("bad value %s", value)
+	}
+	return n, nil
+}
+
+// parseUntil accepts UTC and floating date-times, and dates which include the whole day
+func parseUntil(value string) (time.Time, error) {
+	if until, err := time.Parse(untilLayout, value); err == nil {
+		return until, nil
+	}
+	if until, err := time.Parse(strings.TrimSuffix(untilLayout, "Z"), value); err == nil {
+		return until, nil
+	}
+	if until, err := time.Parse(untilDateLayout, value); err == nil {
+		return until.Add(24*time.Hour - time.Second), nil
+	}
+	return time.Time{}, fmt.Errorf("bad UNTIL %s", value)
+}
+
+func parseRecurrenceDay(code string) (RecurrenceDay, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) < 2 {
+		return RecurrenceDay{}, fmt.Errorf("bad BYDAY %s", code)
+	}
+	weekday, exists := weekdayCodes[code[len(code)-2:]]
+	if !exists {
+		return RecurrenceDay{}, fmt.Errorf("bad BYDAY %s", code)
+	}
+
+	day := RecurrenceDay{Weekday: weekday}
+	if ordinal := code[:len(code)-2]; ordinal != "" {
+		n, err := strconv.Atoi(ordinal)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return RecurrenceDay{}, fmt.Errorf("bad BYDAY %s", code)
+		}
+		day.N = n
+	}
+	return day, nil
+}
+
+// String formats the rule as an RRULE value
+func (r *Recurrence) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if r.Until != nil {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format(untilLayout))
+	}
+	if len(r.ByDay) > 0 {
+		codes := make([]string, len(r.ByDay))
+		for i, day := range r.ByDay {
+			codes[i] = weekdayCode(day.Weekday)
+			if day.N != 0 {
+				codes[i] = strconv.Itoa(day.N) + codes[i]
+			}
+		}
+		parts = append(parts, "BYDAY="+strings.Join(codes, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		days := make([]string, len(r.ByMonthDay))
+		for i, day := range r.ByMonthDay {
+			days[i] = strconv.Itoa(day)
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonth) > 0 {
+		months := make([]string, len(r.ByMonth))
+		for i, month := range r.ByMonth {
+			months[i] = strconv.Itoa(int(month))
+		}
+		parts = append(parts, "BYMONTH="+strings.Join(months, ","))
+	}
+	if r.WeekStart != time.Monday {
+		parts = append(parts, "WKST="+weekdayCode(r.WeekStart))
+	}
+	return strings.Join(parts, ";")
+}
+
+func weekdayCode(weekday time.Weekday) string {
+	for code, day := range weekdayCodes {
+		if day == weekday {
+			return code
+		}
+	}
+	return ""
+}
+
+// Between returns the occurrences of the rule for an event starting at start
+// that fall within [from, to). The start itself is the first occurrence.
+func (r *Recurrence) Between(start, from, to time.Time) []time.Time {
+	var times []time.Time
+	r.each(start, func(t time.Time) bool {
+		if !t.Before(to) {
+			return false
+		}
+		if !t.Before(from) {
+			times = append(times, t)
+		}
+		return true
+	})
+	return times
+}
+
+// Includes reports whether at is an occurrence of the rule for an event starting at start
+func (r *Recurrence) Includes(start, at time.Time) bool {
+	found := false
+	r.each(start, func(t time.Time) bool {
+		found = t.Equal(at)
+		return t.Before(at)
+	})
+	return found
+}
+
+// countBefore returns the number of occurrences before at
+func (r *Recurrence) countBefore(start, at time.Time) int {
+	count := 0
+	r.each(start, func(t time.Time) bool {
+		if !t.Before(at) {
+			return false
+		}
+		count++
+		return true
+	})
+	return count
+}
+
+// each calls fn with the occurrences of the rule in order, until fn returns
+// false or the rule ends
+func (r *Recurrence) each(start time.Time, fn func(time.Time) bool) {
+	interval := r.Interval
+	if interval < 1 {
+		interval = 1
+	}
+
+	count := 0
+	if !fn(start) {
+		return
+	}
+	count++
+
+	for period := 0; period < maxRecurrencePeriods; period++ {
+		for _, t := range r.candidates(start, period*interval) {
+			if !t.After(start) {
+				continue
+			}
+			if r.Until != nil && t.After(*r.Until) {
+				return
+			}
+			if r.Count > 0 && count >= r.Count {
+				return
+			}
+			if !fn(t) {
+				return
+			}
+			count++
+		}
+	}
+}
+
+// candidates returns the times the rule produces in the period offset
+// periods after the one holding start, in order
+func (r *Recurrence) candidates(start time.Time, offset int) []time.Time {
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, start.Hour(), start.Minute(), start.Second(), start.Nanosecond(), start.Location())
+	}
+
+	var times []time.Time
+	switch r.Freq {
+	case FreqDaily:
+		day := at(start.Year(), start.Month(), start.Day()+offset)
+		if r.monthAllowed(day.Month()) && r.dayAllowed(day) {
+			times = append(times, day)
+		}
+	case FreqWeekly:
+		back := (int(start.Weekday()) - int(r.WeekStart) + 7) % 7
+		for i := 0; i < 7; i++ {
+			day := at(start.Year(), start.Month(), start.Day()-back+7*offset+i)
+			if !r.monthAllowed(day.Month()) {
+				continue
+			}
+			if (len(r.ByDay) == 0 && day.Weekday() == start.Weekday()) || r.weekdayListed(day.Weekday()) {
+				times = append(times, day)
+			}
+		}
+	case FreqMonthly:
+		first := at(start.Year(), start.Month()+time.Month(offset), 1)
+		if r.monthAllowed(first.Month()) {
+			times = r.monthDays(first, start.Day())
+		}
+	case FreqYearly:
+		months := r.ByMonth
+		if len(months) == 0 {
+			months = []time.Month{start.Month()}
+		}
+		months = append([]time.Month(nil), months...)
+		sort.Slice(months, func(i, j int) bool { return months[i] < months[j] })
+		for _, month := range months {
+			times = append(times, r.monthDays(at(start.Year()+offset, month, 1), start.Day())...)
+		}
+	}
+	return times
+}
+
+// monthDays returns the days of the month starting at first that match the
+// rule's BYMONTHDAY and BYDAY, or defaultDay when it has neither
+func (r *Recurrence) monthDays(first time.Time, defaultDay int) []time.Time {
+	last := daysIn(first)
+	var days []time.Time
+	for d := 1; d <= last; d++ {
+		day := time.Date(first.Year(), first.Month(), d, first.Hour(), first.Minute(), first.Second(), first.Nanosecond(), first.Location())
+		if len(r.ByMonthDay) == 0 && len(r.ByDay) == 0 {
+			if d == defaultDay {
+				days = append(days, day)
+			}
+			continue
+		}
+		if r.dayAllowed(day) {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// dayAllowed applies the rule's BYMONTHDAY and BYDAY filters to a day
+func (r *Recurrence) dayAllowed(day time.Time) bool {
+	d, last := day.Day(), daysIn(day)
+
+	if len(r.ByMonthDay) > 0 {
+		matched := false
+		for _, monthDay := range r.ByMonthDay {
+			if monthDay == d || (monthDay < 0 && last+monthDay+1 == d) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.ByDay) > 0 {
+		nth, nthFromEnd := (d-1)/7+1, -((last-d)/7 + 1)
+		for _, byDay := range r.ByDay {
+			if byDay.Weekday == day.Weekday() && (byDay.N == 0 || byDay.N == nth || byDay.N == nthFromEnd) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (r *Recurrence) weekdayListed(weekday time.Weekday) bool {
+	for _, day := range r.ByDay {
+		if day.Weekday == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Recurrence) monthAllowed(month time.Month) bool {
+	if len(r.ByMonth) == 0 {
+		return true
+	}
+	for _, allowed := range r.ByMonth {
+		if allowed == month {
+			return true
+		}
+	}
+	return false
+}
+
+// daysIn returns the number of days in the month of t
+func daysIn(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
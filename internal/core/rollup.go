@@ -0,0 +1,423 @@
+package core
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rollup groups and periods understood by ParseRollupGroups
+const (
+	GroupByUser     = "user"
+	GroupByCategory = "category"
+	PeriodDay       = "day"
+	PeriodWeek      = "week" // Weeks start on Monday
+	PeriodMonth     = "month"
+)
+
+// ErrInvalidRollup is returned for rollup options that cannot be used
+var ErrInvalidRollup = errors.New("invalid rollup")
+
+// RollupOptions select what a rollup covers and how its rows are grouped
+type RollupOptions struct {
+	From       time.Time // Zero leaves the range open
+	To         time.Time
+	ByUser     bool
+	ByCategory bool
+	Period     string         // "", PeriodDay, PeriodWeek or PeriodMonth
+	Location   *time.Location // Where periods start, UTC when nil
+	// Shared nodes are counted once in every ancestor by default. PerPath
+	// counts them once for each path leading to them, and lists them under each.
+	PerPath bool
+	UserID  string // Only nodes this user can read are reported, every node when empty
+}
+
+// RollupRow is the time rolled up on a node and its descendants for one group
+type RollupRow struct {
+	NodeID          string `json:"node_id"`
+	Path            string `json:"path"`
+	User            string `json:"user,omitempty"`
+	Username        string `json:"username,omitempty"`
+	Category        string `json:"category,omitempty"`
+	Period          string `json:"period,omitempty"` // First day of the period
+	TrackedSeconds  int64  `json:"tracked_seconds"`
+	BillableSeconds int64  `json:"billable_seconds"`
+	EventSeconds    int64  `json:"event_seconds"` // Duration of finished events
+	Sessions        int    `json:"sessions"`
+	Events          int    `json:"events"`
+}
+
+// RollupReport lists the rolled up time of every node in a subtree, parents
+// before their children
+type RollupReport struct {
+	Path    string      `json:"path"`
+	From    *time.Time  `json:"from,omitempty"`
+	To      *time.Time  `json:"to,omitempty"`
+	GroupBy []string    `json:"group_by"`
+	Rows    []RollupRow `json:"rows"`
+}
+
+// ParseRollupGroups reads a comma separated list of user, category and at
+// most one of day, week or month into the options
+func ParseRollupGroups(groups string, options *RollupOptions) error {
+	for _, group := range strings.Split(groups, ",") {
+		switch group = strings.TrimSpace(strings.ToLower(group)); group {
+		case "":
+		case GroupByUser:
+			options.ByUser = true
+		case GroupByCategory:
+			options.ByCategory = true
+		case PeriodDay, PeriodWeek, PeriodMonth:
+			if options.Period != "" && options.Period != group {
+				return fmt.Errorf("%w: group by one of day, week or month", ErrInvalidRollup)
+			}
+			options.Period = group
+		default:
+			return fmt.Errorf("%w: unknown group %s", ErrInvalidRollup, group)
+		}
+	}
+	return nil
+}
+
+// groups returns the options' groups in the order ParseRollupGroups reads them
+func (options RollupOptions) groups() []string {
+	groups := []string{}
+	if options.ByUser {
+		groups = append(groups, GroupByUser)
+	}
+	if options.ByCategory {
+		groups = append(groups, GroupByCategory)
+	}
+	if options.Period != "" {
+		groups = append(groups, options.Period)
+	}
+	return groups
+}
+
+type rollupKey struct {
+	user     string
+	category string
+	period   string
+}
+
+type rollupTotals struct {
+	tracked   int64
+	billable  int64
+	eventTime int64
+	sessions  int
+	events    int
+}
+
+type rollupTable map[rollupKey]*rollupTotals
+
+func (table rollupTable) add(other rollupTable) {
+	for key, totals := range other {
+		sum := table.totals(key)
+		sum.tracked += totals.tracked
+		sum.billable += totals.billable
+		sum.eventTime += totals.eventTime
+		sum.sessions += totals.sessions
+		sum.events += totals.events
+	}
+}
+
+func (table rollupTable) totals(key rollupKey) *rollupTotals {
+	totals, exists := table[key]
+	if !exists {
+		totals = &rollupTotals{}
+		table[key] = totals
+	}
+	return totals
+}
+
+// Rollup reports the time tracked and the finished events of n, found at
+// path, and every descendant, each node's rows including its descendants
+func (n *Node) Rollup(path string, options RollupOptions) RollupReport {
+	if options.Location == nil {
+		options.Location = time.UTC
+	}
+	report := RollupReport{Path: path, GroupBy: options.groups(), Rows: []RollupRow{}}
+	if !options.From.IsZero() {
+		report.From = &options.From
+	}
+	if !options.To.IsZero() {
+		report.To = &options.To
+	}
+
+	own := make(map[*Node]rollupTable)
+	ownTable := func(node *Node) rollupTable {
+		table, exists := own[node]
+		if !exists {
+			table = rollupTable{}
+			if options.UserID == "" || node.CheckPermission(options.UserID, ReadPermission) {
+				table = node.rollupOwn(options)
+			}
+			own[node] = table
+		}
+		return table
+	}
+
+	// Sums a node and its descendants, each counted once unless PerPath is
+	// set. Sums are kept by node, so each is worked out once from those of
+	// its children. Only where a node below has more than one parent, and
+	// PerPath is not set, are the nodes gathered one by one so the shared
+	// ones are not counted twice, still reusing the sums of the rest.
+	sums := make(map[*Node]rollupTable)
+	linked := make(map[*Node]bool) // The node or a descendant has more than one parent
+	var sum func(node *Node, ancestors map[*Node]bool) rollupTable
+	sum = func(node *Node, ancestors map[*Node]bool) rollupTable {
+		if total, exists := sums[node]; exists {
+			return total
+		}
+		total := rollupTable{}
+		if ancestors[node] {
+			return total
+		}
+		ancestors[node] = true
+		total.add(ownTable(node))
+		linked[node] = len(node.parentList()) > 1
+		children := node.ChildNodes()
+		for _, child := range children {
+			total.add(sum(child, ancestors))
+			linked[node] = linked[node] || linked[child]
+		}
+		delete(ancestors, node)
+
+		if linked[node] && !options.PerPath {
+			total = rollupTable{}
+			seen := make(map[*Node]bool)
+			var gather func(current *Node)
+			gather = func(current *Node) {
+				if seen[current] {
+					return
+				}
+				seen[current] = true
+				if current != node && !linked[current] {
+					// Reached only through its one parent
+					total.add(sums[current])
+					return
+				}
+				total.add(ownTable(current))
+				for _, child := range current.ChildNodes() {
+					gather(child)
+				}
+			}
+			gather(node)
+		}
+		sums[node] = total
+		return total
+	}
+
+	listed := make(map[*Node]bool)
+	var walk func(node *Node, path string, ancestors map[*Node]bool)
+	walk = func(node *Node, path string, ancestors map[*Node]bool) {
+		// A node is never its own descendant, but guard against cycles anyway
+		if ancestors[node] || (listed[node] && !options.PerPath) {
+			return
+		}
+		listed[node] = true
+
+		if options.UserID == "" || node.CheckPermission(options.UserID, ReadPermission) {
+			report.Rows = append(report.Rows, sum(node, make(map[*Node]bool)).rows(node.ID, path)...)
+		}
+
+		ancestors[node] = true
+		children := node.ChildNodes()
+		sort.Slice(children, func(i, j int) bool {
+			if children[i].Name == children[j].Name {
+				return children[i].ID < children[j].ID
+			}
+			return children[i].Name < children[j].Name
+		})
+		for _, child := range children {
+			childPath := EscapeName(child.Name)
+			if path != "" {
+				childPath = path + "/" + childPath
+			}
+			walk(child, childPath, ancestors)
+		}
+		delete(ancestors, node)
+	}
+	walk(n, path, make(map[*Node]bool))
+	return report
+}
+
+// rollupOwn totals the sessions and finished events held by the node itself
+func (n *Node) rollupOwn(options RollupOptions) rollupTable {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	now := time.Now()
+	table := rollupTable{}
+	for _, session := range n.TimeSessions {
+		stop := now
+		if session.Stop != nil {
+			stop = *session.Stop
+		}
+		key := options.key(session.UserID, "")
+		counted := false
+		options.split(session.Start, stop, func(period string, seconds int64) {
+			key.period = period
+			totals := table.totals(key)
+			totals.tracked += seconds
+			if session.Billable {
+				totals.billable += seconds
+			}
+			if !counted {
+				totals.sessions++
+				counted = true
+			}
+		})
+	}
+
+	for _, event := range n.Events {
+		if event.Status != EventFinished || event.StartTime == nil || event.EndTime == nil {
+			continue
+		}
+		key := options.key(event.CreatedBy, event.Category)
+		counted := false
+		options.split(*event.StartTime, *event.EndTime, func(period string, seconds int64) {
+			key.period = period
+			totals := table.totals(key)
+			totals.eventTime += seconds
+			if !counted {
+				totals.events++
+				counted = true
+			}
+		})
+	}
+	return table
+}
+
+func (options RollupOptions) key(userID, category string) rollupKey {
+	var key rollupKey
+	if options.ByUser {
+		key.user = userID
+	}
+	if options.ByCategory {
+		key.category = category
+	}
+	return key
+}
+
+// split clips [start, stop) to the options' range and hands each part of it
+// falling in a different period to add, in order
+func (options RollupOptions) split(start, stop time.Time, add func(period string, seconds int64)) {
+	if !options.From.IsZero() && start.Before(options.From) {
+		start = options.From
+	}
+	if !options.To.IsZero() && stop.After(options.To) {
+		stop = options.To
+	}
+	if !stop.After(start) {
+		return
+	}
+	if options.Period == "" {
+		add("", int64(stop.Sub(start).Seconds()))
+		return
+	}
+
+	for start.Before(stop) {
+		period := options.periodStart(start)
+		next := options.nextPeriod(period)
+		end := stop
+		if next.Before(end) {
+			end = next
+		}
+		add(period.Format("2006-01-02"), int64(end.Sub(start).Seconds()))
+		start = end
+	}
+}
+
+func (options RollupOptions) periodStart(at time.Time) time.Time {
+	at = at.In(options.Location)
+	day := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, options.Location)
+	switch options.Period {
+	case PeriodWeek:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case PeriodMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	default:
+		return day
+	}
+}
+
+func (options RollupOptions) nextPeriod(period time.Time) time.Time {
+	switch options.Period {
+	case PeriodWeek:
+		return period.AddDate(0, 0, 7)
+	case PeriodMonth:
+		return period.AddDate(0, 1, 0)
+	default:
+		return period.AddDate(0, 0, 1)
+	}
+}
+
+func (table rollupTable) rows(nodeID, path string) []RollupRow {
+	rows := make([]RollupRow, 0, len(table))
+	for key, totals := range table {
+		rows = append(rows, RollupRow{
+			NodeID:          nodeID,
+			Path:            path,
+			User:            key.user,
+			Category:        key.category,
+			Period:          key.period,
+			TrackedSeconds:  totals.tracked,
+			BillableSeconds: totals.billable,
+			EventSeconds:    totals.eventTime,
+			Sessions:        totals.sessions,
+			Events:          totals.events,
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Period != rows[j].Period {
+			return rows[i].Period < rows[j].Period
+		}
+		if rows[i].User != rows[j].User {
+			return rows[i].User < rows[j].User
+		}
+		return rows[i].Category < rows[j].Category
+	})
+	return rows
+}
+
+// SetUsernames fills in the username of each row grouped by user
+func (report *RollupReport) SetUsernames(directory *UserDirectory) {
+	if directory == nil {
+		return
+	}
+	for i, row := range report.Rows {
+		if user, err := directory.Get(row.User); err == nil {
+			report.Rows[i].Username = user.Username
+		}
+	}
+}
+
+// WriteCSV writes the report's rows as CSV with a header line
+func (report RollupReport) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"path", "node_id", "user", "username", "category", "period",
+		"tracked_seconds", "billable_seconds", "event_seconds", "sessions", "events"})
+	for _, row := range report.Rows {
+		writer.Write([]string{
+			row.Path,
+			row.NodeID,
+			row.User,
+			row.Username,
+			row.Category,
+			row.Period,
+			strconv.FormatInt(row.TrackedSeconds, 10),
+			strconv.FormatInt(row.BillableSeconds, 10),
+			strconv.FormatInt(row.EventSeconds, 10),
+			strconv.Itoa(row.Sessions),
+			strconv.Itoa(row.Events),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
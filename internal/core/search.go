@@ -0,0 +1,427 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Kinds of things a search hit can point at
+const (
+	SearchNode       = "node"
+	SearchEntry      = "entry"
+	SearchEvent      = "event"
+	SearchAttachment = "attachment"
+)
+
+// Search result limits
+const (
+	DefaultSearchLimit = 50
+	MaxSearchLimit     = 200
+	snippetLength      = 160
+)
+
+// SearchQuery selects the hits returned by SearchIndex.Search. Every word of
+// Text must match, the last one as a prefix so partly typed words still find
+// something.
+type SearchQuery struct {
+	Text     string
+	Scope    *Node     // Only hits on Scope and its descendants, the whole forest when nil
+	User     string    // Only hits written or uploaded by this user
+	From     time.Time // Zero leaves the range open
+	To       time.Time
+	Category string // Only events of this category and their entries
+	Limit    int    // DefaultSearchLimit when zero, at most MaxSearchLimit
+}
+
+// SearchHit is a node, entry, event or attachment matching a search
+type SearchHit struct {
+	NodeID       string     `json:"node_id"`
+	Path         string     `json:"path"`
+	Paths        []string   `json:"paths,omitempty"` // Every path to the node when it has several parents
+	Kind         string     `json:"kind"`
+	EventID      string     `json:"event_id,omitempty"`
+	Planned      bool       `json:"planned,omitempty"`
+	EntryIndex   *int       `json:"entry_index,omitempty"`
+	AttachmentID string     `json:"attachment_id,omitempty"`
+	Name         string     `json:"name,omitempty"` // Node or attachment name
+	UserID       string     `json:"user_id,omitempty"`
+	Category     string     `json:"category,omitempty"`
+	Time         *time.Time `json:"time,omitempty"`
+	Snippet      string     `json:"snippet"`
+	Score        int        `json:"score"`
+}
+
+// searchDoc is one indexed piece of a node
+type searchDoc struct {
+	node  *Node
+	hit   SearchHit
+	text  string
+	terms map[string]int
+}
+
+// SearchIndex is an inverted index over the names, entries, events and
+// attachments of the nodes in a forest. It is kept in memory and rebuilt per
+// node on every change, so it is never written to disk.
+type SearchIndex struct {
+	mutex    sync.RWMutex
+	postings map[string]map[*searchDoc]int
+	byNode   map[string][]*searchDoc
+}
+
+// NewSearchIndex returns an empty index
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		postings: make(map[string]map[*searchDoc]int),
+		byNode:   make(map[string][]*searchDoc),
+	}
+}
+
+// IndexAll replaces the contents of the index with every node in the forest
+func (index *SearchIndex) IndexAll(forest *Node) {
+	index.mutex.Lock()
+	index.postings = make(map[string]map[*searchDoc]int)
+	index.byNode = make(map[string][]*searchDoc)
+	index.mutex.Unlock()
+
+	for _, node := range forest.Index() {
+		index.Update(node)
+	}
+}
+
+// Update reindexes the given nodes
+func (index *SearchIndex) Update(nodes ...*Node) {
+	for _, node := range nodes {
+		docs := node.searchDocs()
+
+		index.mutex.Lock()
+		index.remove(node.ID)
+		for _, doc := range docs {
+			for term, count := range doc.terms {
+				if index.postings[term] == nil {
+					index.postings[term] = make(map[*searchDoc]int)
+				}
+				index.postings[term][doc] = count
+			}
+		}
+		if len(docs) > 0 {
+			index.byNode[node.ID] = docs
+		}
+		index.mutex.Unlock()
+	}
+}
+
+// Remove drops the given nodes from the index
+func (index *SearchIndex) Remove(nodeIDs ...string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	for _, nodeID := range nodeIDs {
+		index.remove(nodeID)
+	}
+}
+
+func (index *SearchIndex) remove(nodeID string) {
+	for _, doc := range index.byNode[nodeID] {
+		for term := range doc.terms {
+			delete(index.postings[term], doc)
+			if len(index.postings[term]) == 0 {
+				delete(index.postings, term)
+			}
+		}
+	}
+	delete(index.byNode, nodeID)
+}
+
+// Search returns the hits in forest matching the query on nodes userID can
+// read, best matches first and the most recent first among equals
+func (index *SearchIndex) Search(forest *Node, query SearchQuery, userID string) []SearchHit {
+	hits := []SearchHit{}
+	terms := tokenize(query.Text)
+	if len(terms) == 0 {
+		return hits
+	}
+
+	index.mutex.RLock()
+	scores := index.match(terms)
+	index.mutex.RUnlock()
+
+	readable := make(map[*Node]bool)
+	inScope := make(map[*Node]bool)
+	for doc, score := range scores {
+		if !query.matches(doc.hit) {
+			continue
+		}
+		allowed, checked := readable[doc.node]
+		if !checked {
+			allowed = doc.node.CheckPermission(userID, ReadPermission)
+			readable[doc.node] = allowed
+		}
+		if !allowed {
+			continue
+		}
+		if query.Scope != nil {
+			contained, checked := inScope[doc.node]
+			if !checked {
+				contained = query.Scope.Contains(doc.node.ID)
+				inScope[doc.node] = contained
+			}
+			if !contained {
+				continue
+			}
+		}
+
+		hit := doc.hit
+		hit.Score = score
+		hit.Snippet = snippet(doc.text, terms)
+		hits = append(hits, hit)
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if ti, tj := hits[i].searchTime(), hits[j].searchTime(); !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return hits[i].NodeID < hits[j].NodeID
+	})
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	// Paths are looked up now rather than indexed, so renames and moves show at once
+	paths := make(map[string][]string)
+	for i, hit := range hits {
+		nodePaths, exists := paths[hit.NodeID]
+		if !exists {
+			nodePaths = forest.Paths(hit.NodeID)
+			paths[hit.NodeID] = nodePaths
+		}
+		if len(nodePaths) > 0 {
+			hits[i].Path = nodePaths[0]
+		}
+		if len(nodePaths) > 1 {
+			hits[i].Paths = nodePaths
+		}
+	}
+	return hits
+}
+
+// match scores the documents holding every term, the last one as a prefix
+func (index *SearchIndex) match(terms []string) map[*searchDoc]int {
+	var scores map[*searchDoc]int
+	for i, term := range terms {
+		found := make(map[*searchDoc]int)
+		if i == len(terms)-1 {
+			for indexed, docs := range index.postings {
+				if strings.HasPrefix(indexed, term) {
+					for doc, count := range docs {
+						found[doc] += count
+					}
+				}
+			}
+		} else {
+			for doc, count := range index.postings[term] {
+				found[doc] = count
+			}
+		}
+
+		if scores == nil {
+			scores = found
+			continue
+		}
+		for doc := range scores {
+			if count, exists := found[doc]; exists {
+				scores[doc] += count
+			} else {
+				delete(scores, doc)
+			}
+		}
+	}
+	return scores
+}
+
+func (query SearchQuery) matches(hit SearchHit) bool {
+	if query.User != "" && hit.UserID != query.User {
+		return false
+	}
+	if query.Category != "" && hit.Category != query.Category {
+		return false
+	}
+	if !query.From.IsZero() || !query.To.IsZero() {
+		if hit.Time == nil {
+			return false
+		}
+		if !query.From.IsZero() && hit.Time.Before(query.From) {
+			return false
+		}
+		if !query.To.IsZero() && !hit.Time.Before(query.To) {
+			return false
+		}
+	}
+	return true
+}
+
+func (hit SearchHit) searchTime() time.Time {
+	if hit.Time == nil {
+		return time.Time{}
+	}
+	return *hit.Time
+}
+
+// searchDocs splits the node into the documents it is indexed as
+func (n *Node) searchDocs() []*searchDoc {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	var docs []*searchDoc
+	add := func(hit SearchHit, parts ...string) {
+		text := strings.Join(strings.Fields(strings.Join(parts, " ")), " ")
+		terms := make(map[string]int)
+		for _, term := range tokenize(text) {
+			terms[term]++
+		}
+		if len(terms) == 0 {
+			return
+		}
+		hit.NodeID = n.ID
+		docs = append(docs, &searchDoc{node: n, hit: hit, text: text, terms: terms})
+	}
+	attachments := func(hit SearchHit, attachments []Attachment) {
+		for _, attachment := range attachments {
+			hit := hit
+			hit.Kind = SearchAttachment
+			hit.AttachmentID = attachment.ID
+			hit.Name = attachment.Name
+			hit.UserID = attachment.UploadedBy
+			hit.Time = searchTimeOf(attachment.UploadedAt)
+			add(hit, attachment.Name)
+		}
+	}
+	entries := func(hit SearchHit, entries []Entry) {
+		for i, entry := range entries {
+			hit := hit
+			entryIndex := i
+			hit.Kind = SearchEntry
+			hit.EntryIndex = &entryIndex
+			hit.UserID = entry.UserID
+			hit.Time = searchTimeOf(entry.Timestamp)
+			add(hit, searchText(entry.Content), searchText(entry.Metadata))
+			attachments(hit, entry.Attachments)
+		}
+	}
+	events := func(events map[string]Event, planned bool) {
+		for eventID, event := range events {
+			hit := SearchHit{EventID: eventID, Planned: planned, Category: event.Category}
+			eventHit := hit
+			eventHit.Kind = SearchEvent
+			eventHit.UserID = event.CreatedBy
+			if event.StartTime != nil {
+				eventHit.Time = searchTimeOf(*event.StartTime)
+			} else {
+				eventHit.Time = searchTimeOf(event.CreatedAt)
+			}
+			add(eventHit, eventID, event.Category, searchText(event.Metadata))
+			entries(hit, event.Entries)
+		}
+	}
+
+	add(SearchHit{Kind: SearchNode, Name: n.Name, UserID: n.CreatedBy, Time: searchTimeOf(n.CreatedAt)}, n.Name)
+	entries(SearchHit{}, n.Entries)
+	events(n.Events, false)
+	events(n.PlannedEvents, true)
+	nodeAttachments := make([]Attachment, 0, len(n.Attachments))
+	for _, attachment := range n.Attachments {
+		nodeAttachments = append(nodeAttachments, attachment)
+	}
+	attachments(SearchHit{}, nodeAttachments)
+	return docs
+}
+
+func searchTimeOf(at time.Time) *time.Time {
+	if at.IsZero() {
+		return nil
+	}
+	return &at
+}
+
+// searchText flattens entry content and metadata into text, keys included
+func searchText(value interface{}) string {
+	var parts []string
+	var collect func(value interface{})
+	collect = func(value interface{}) {
+		switch value := value.(type) {
+		case nil:
+		case string:
+			parts = append(parts, value)
+		case map[string]interface{}:
+			keys := make([]string, 0, len(value))
+			for key := range value {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				parts = append(parts, key)
+				collect(value[key])
+			}
+		case []interface{}:
+			for _, item := range value {
+				collect(item)
+			}
+		default:
+			parts = append(parts, fmt.Sprint(value))
+		}
+	}
+	collect(value)
+	return strings.Join(parts, " ")
+}
+
+// tokenize lowercases text and splits it into words of letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// snippet returns the part of text around the first word matching a term
+func snippet(text string, terms []string) string {
+	runes := []rune(text)
+	if len(runes) <= snippetLength {
+		return text
+	}
+
+	lower := []rune(strings.ToLower(text))
+	start := 0
+	for _, term := range terms {
+		if at := strings.Index(string(lower), term); at >= 0 {
+			start = len([]rune(string(lower)[:at])) - snippetLength/4
+			break
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > len(runes)-snippetLength {
+		start = len(runes) - snippetLength
+	}
+
+	result := string(runes[start : start+snippetLength])
+	if start > 0 {
+		result = "…" + result
+	}
+	if start+snippetLength < len(runes) {
+		result += "…"
+	}
+	return result
+}
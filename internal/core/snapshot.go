@@ -0,0 +1,121 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// nodeSnapshot is a node's own state with its children referenced by ID. The
+// Children field shadows the embedded node's map when encoding and decoding.
+type nodeSnapshot struct {
+	*Node
+	Children []string `json:"children"`
+}
+
+// treeSnapshot is a node's own state with its children encoded beforehand
+type treeSnapshot struct {
+	*Node
+	Children map[string]json.RawMessage `json:"children"`
+}
+
+// MarshalTree encodes the node and its subtree the way json.Marshal does,
+// holding each node's read lock while its own state is encoded, so it is
+// safe while the tree changes
+func (n *Node) MarshalTree() ([]byte, error) {
+	n.mutex.RLock()
+	children := make(map[string]*Node, len(n.Children))
+	for childID, child := range n.Children {
+		children[childID] = child
+	}
+	n.mutex.RUnlock()
+
+	encoded := make(map[string]json.RawMessage, len(children))
+	for childID, child := range children {
+		data, err := child.MarshalTree()
+		if err != nil {
+			return nil, err
+		}
+		encoded[childID] = data
+	}
+
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return json.Marshal(treeSnapshot{Node: n, Children: encoded})
+}
+
+// Snapshot encodes the node without its subtree, so the cost of recording a
+// change does not grow with the number of descendants.
+func (n *Node) Snapshot() ([]byte, error) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	childIDs := make([]string, 0, len(n.Children))
+	for childID := range n.Children {
+		childIDs = append(childIDs, childID)
+	}
+	return json.Marshal(nodeSnapshot{Node: n, Children: childIDs})
+}
+
+// DecodeSnapshot decodes a snapshot produced by Snapshot. The returned node has
+// an empty Children map; the child IDs are returned for the caller to link.
+func DecodeSnapshot(data []byte) (*Node, []string, error) {
+	snapshot := nodeSnapshot{Node: &Node{}}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, nil, err
+	}
+	if snapshot.Node.ID == "" {
+		return nil, nil, fmt.Errorf("snapshot has no node ID")
+	}
+
+	node := snapshot.Node
+	node.Children = make(map[string]*Node)
+	if node.Parents == nil {
+		node.Parents = make(map[string]string)
+	}
+	if node.Events == nil {
+		node.Events = make(map[string]Event)
+	}
+	if node.PlannedEvents == nil {
+		node.PlannedEvents = make(map[string]Event)
+	}
+	return node, snapshot.Children, nil
+}
+
+// Index maps every node in the tree by ID. Each node's read lock is held
+// while its children are listed, so it is safe while the tree changes.
+func (n *Node) Index() map[string]*Node {
+	index := make(map[string]*Node)
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		index[node.ID] = node
+		for _, child := range node.ChildNodes() {
+			if _, exists := index[child.ID]; !exists {
+				walk(child)
+			}
+		}
+	}
+	walk(n)
+	return index
+}
+
+// Dedupe maps every node in a freshly decoded tree by ID. A node reachable
+// through several parents is decoded from JSON once per parent, so
+// duplicates are collapsed onto the first copy found to keep multi-parent
+// nodes shared. It writes to the tree without locking, so it must run
+// before the tree is shared.
+func (n *Node) Dedupe() map[string]*Node {
+	index := make(map[string]*Node)
+	n.dedupe(index)
+	return index
+}
+
+func (n *Node) dedupe(index map[string]*Node) {
+	index[n.ID] = n
+	for childID, child := range n.Children {
+		if existing, exists := index[childID]; exists {
+			n.Children[childID] = existing
+			continue
+		}
+		child.dedupe(index)
+	}
+}
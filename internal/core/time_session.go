@@ -0,0 +1,328 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrTimerRunning is returned when a user starts a timer on a node where theirs is already running
+	ErrTimerRunning = errors.New("timer already running")
+	// ErrNoTimer is returned when a user has no timer running on the node
+	ErrNoTimer = errors.New("no timer running")
+	// ErrTimeSessionNotFound is returned when no session on the node has the given ID
+	ErrTimeSessionNotFound = errors.New("time session not found")
+	// ErrInvalidTimeSession is returned for edits that leave a session ending before it starts
+	ErrInvalidTimeSession = errors.New("invalid time session")
+)
+
+// TimeSession is a span of time a user tracked on a node
+type TimeSession struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	NodeID     string     `json:"node_id"`
+	Start      time.Time  `json:"start"`
+	Stop       *time.Time `json:"stop,omitempty"` // Unset while the timer runs
+	Note       string     `json:"note,omitempty"`
+	Billable   bool       `json:"billable"`
+	CreatedAt  time.Time  `json:"created_at,omitempty"`
+	ModifiedBy string     `json:"modified_by,omitempty"`
+	ModifiedAt time.Time  `json:"modified_at,omitempty"`
+}
+
+// TimeSessionChanges are the fields changed by UpdateTimeSession, nil fields
+// are left as they are
+type TimeSessionChanges struct {
+	Start    *time.Time
+	Stop     *time.Time
+	Note     *string
+	Billable *bool
+}
+
+// TimeSummary totals the time sessions of a node
+type TimeSummary struct {
+	Sessions        []TimeSession `json:"sessions"`
+	TotalSeconds    int64         `json:"total_seconds"`
+	BillableSeconds int64         `json:"billable_seconds"`
+}
+
+// Running reports whether the session's timer is still running
+func (s TimeSession) Running() bool {
+	return s.Stop == nil
+}
+
+// Duration returns how much of the session falls within [from, to), a zero
+// bound leaving that side open. Running sessions count up to now.
+func (s TimeSession) Duration(from, to, now time.Time) time.Duration {
+	start, stop := s.Start, now
+	if s.Stop != nil {
+		stop = *s.Stop
+	}
+	if !from.IsZero() && start.Before(from) {
+		start = from
+	}
+	if !to.IsZero() && stop.After(to) {
+		stop = to
+	}
+	if !stop.After(start) {
+		return 0
+	}
+	return stop.Sub(start)
+}
+
+func newTimeSessionID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return "ts-" + hex.EncodeToString(id)
+}
+
+// StartTimeTracking starts a timer for the user on the node. Users run one
+// timer at a time; stopping the one running elsewhere is left to the caller.
+func (n *Node) StartTimeTracking(userID string, note string, billable bool) (*TimeSession, error) {
+	// Check user permission
+	if !n.CheckPermission(userID, WritePermission) {
+		return nil, fmt.Errorf("insufficient permissions")
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, running := n.runningSession(userID); running {
+		return nil, fmt.Errorf("%w on node %s", ErrTimerRunning, n.ID)
+	}
+
+	now := time.Now()
+	session := TimeSession{
+		ID:         newTimeSessionID(),
+		UserID:     userID,
+		NodeID:     n.ID,
+		Start:      now,
+		Note:       note,
+		Billable:   billable,
+		CreatedAt:  now,
+		ModifiedBy: userID,
+		ModifiedAt: now,
+	}
+	if n.TimeSessions == nil {
+		n.TimeSessions = make(map[string]TimeSession)
+	}
+	n.TimeSessions[session.ID] = session
+	return &session, nil
+}
+
+// StopTimeTracking stops the user's timer on the node. Reading the node is
+// enough, so users whose access was lowered can still stop their own timer.
+func (n *Node) StopTimeTracking(userID string) (*TimeSession, error) {
+	// Check user permission
+	if !n.CheckPermission(userID, ReadPermission) {
+		return nil, fmt.Errorf("insufficient permissions")
+	}
+
+	session, stopped := n.StopTimer(userID, time.Now())
+	if !stopped {
+		return nil, fmt.Errorf("%w on node %s", ErrNoTimer, n.ID)
+	}
+	return session, nil
+}
+
+// StopTimer stops the user's timer on the node at the given time, reporting
+// whether one was running
+func (n *Node) StopTimer(userID string, at time.Time) (*TimeSession, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	session, running := n.runningSession(userID)
+	if !running {
+		return nil, false
+	}
+	if at.Before(session.Start) {
+		at = session.Start
+	}
+	session.Stop = &at
+	session.ModifiedBy = userID
+	session.ModifiedAt = time.Now()
+	n.TimeSessions[session.ID] = session
+	return &session, true
+}
+
+// RunningTimer returns the user's running session on the node
+func (n *Node) RunningTimer(userID string) (TimeSession, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.runningSession(userID)
+}
+
+func (n *Node) runningSession(userID string) (TimeSession, bool) {
+	for _, session := range n.TimeSessions {
+		if session.UserID == userID && session.Running() {
+			return session, true
+		}
+	}
+	return TimeSession{}, false
+}
+
+// GetTimeSession returns the session with the given ID
+func (n *Node) GetTimeSession(sessionID string) (TimeSession, error) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	session, exists := n.TimeSessions[sessionID]
+	if !exists {
+		return TimeSession{}, fmt.Errorf("%w: %s", ErrTimeSessionNotFound, sessionID)
+	}
+	return session, nil
+}
+
+// UpdateTimeSession edits a session. A session may not end before it starts
+// or start in the future, and setting the stop of a running session stops it.
+func (n *Node) UpdateTimeSession(sessionID string, changes TimeSessionChanges, userID string) (TimeSession, error) {
+	// Check user permission
+	if !n.CheckPermission(userID, WritePermission) {
+		return TimeSession{}, fmt.Errorf("insufficient permissions")
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	session, exists := n.TimeSessions[sessionID]
+	if !exists {
+		return TimeSession{}, fmt.Errorf("%w: %s", ErrTimeSessionNotFound, sessionID)
+	}
+
+	now := time.Now()
+	if changes.Start != nil {
+		session.Start = *changes.Start
+	}
+	if changes.Stop != nil {
+		stop := *changes.Stop
+		session.Stop = &stop
+	}
+	if changes.Note != nil {
+		session.Note = *changes.Note
+	}
+	if changes.Billable != nil {
+		session.Billable = *changes.Billable
+	}
+
+	if session.Start.After(now) {
+		return TimeSession{}, fmt.Errorf("%w: start is in the future", ErrInvalidTimeSession)
+	}
+	if session.Stop != nil && !session.Stop.After(session.Start) {
+		return TimeSession{}, fmt.Errorf("%w: stop must be after start", ErrInvalidTimeSession)
+	}
+
+	session.ModifiedBy = userID
+	session.ModifiedAt = now
+	n.TimeSessions[sessionID] = session
+	return session, nil
+}
+
+// TimeSessionsFor returns the sessions on the node overlapping [from, to),
+// a zero bound leaving that side open, ordered by start. An empty userID
+// returns the sessions of every user.
+func (n *Node) TimeSessionsFor(userID string, from, to time.Time) []TimeSession {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	sessions := []TimeSession{}
+	for _, session := range n.TimeSessions {
+		if userID != "" && session.UserID != userID {
+			continue
+		}
+		if !to.IsZero() && !session.Start.Before(to) {
+			continue
+		}
+		if !from.IsZero() && session.Stop != nil && !session.Stop.After(from) {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Start.Equal(sessions[j].Start) {
+			return sessions[i].ID < sessions[j].ID
+		}
+		return sessions[i].Start.Before(sessions[j].Start)
+	})
+	return sessions
+}
+
+// GetTimeTrackingSummary returns the user's sessions on the node within
+// [from, to) and the time they add up to within the range
+func (n *Node) GetTimeTrackingSummary(userID string, from, to time.Time) TimeSummary {
+	now := time.Now()
+	summary := TimeSummary{Sessions: n.TimeSessionsFor(userID, from, to)}
+	for _, session := range summary.Sessions {
+		seconds := int64(session.Duration(from, to, now).Seconds())
+		summary.TotalSeconds += seconds
+		if session.Billable {
+			summary.BillableSeconds += seconds
+		}
+	}
+	return summary
+}
+
+// MigrateTimeEntries turns the start and stop entries older versions added to
+// nodes into time sessions and returns the nodes that changed. Starts without
+// a matching stop are left as entries.
+func (n *Node) MigrateTimeEntries() []*Node {
+	var changed []*Node
+	for _, node := range n.Index() {
+		if node.migrateTimeEntries() {
+			changed = append(changed, node)
+		}
+	}
+	return changed
+}
+
+func (n *Node) migrateTimeEntries() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	started := make(map[string]int)
+	paired := make(map[int]bool)
+	for i, entry := range n.Entries {
+		switch entry.Content {
+		case "start_time_entry":
+			started[entry.UserID] = i
+		case "stop_time_entry", "end_time_entry":
+			start, exists := started[entry.UserID]
+			if !exists {
+				continue
+			}
+			delete(started, entry.UserID)
+
+			stop := entry.Timestamp
+			session := TimeSession{
+				ID:         newTimeSessionID(),
+				UserID:     entry.UserID,
+				NodeID:     n.ID,
+				Start:      n.Entries[start].Timestamp,
+				Stop:       &stop,
+				CreatedAt:  n.Entries[start].Timestamp,
+				ModifiedBy: entry.UserID,
+				ModifiedAt: stop,
+			}
+			if n.TimeSessions == nil {
+				n.TimeSessions = make(map[string]TimeSession)
+			}
+			n.TimeSessions[session.ID] = session
+			paired[start], paired[i] = true, true
+		}
+	}
+	if len(paired) == 0 {
+		return false
+	}
+
+	entries := make([]Entry, 0, len(n.Entries)-len(paired))
+	for i, entry := range n.Entries {
+		if !paired[i] {
+			entries = append(entries, entry)
+		}
+	}
+	n.Entries = entries
+	return true
+}
@@ -1,21 +1,259 @@
 package core
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	// ErrUserNotFound is returned when no user in the directory has the given ID
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUsernameTaken is returned when a username is already in use
+	ErrUsernameTaken = errors.New("username already taken")
+)
+
 // SetPassword sets the password for the user
 func (u *User) SetPassword(password string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := HashPassword(password)
 	if err != nil {
 		return err
 	}
-	u.Password = string(hashedPassword)
+	u.Password = hashedPassword
 	return nil
 }
 
+// HashPassword returns the hash of a password as it is stored. Hashing is
+// slow on purpose, so it is best done before taking any lock.
+func HashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashedPassword), nil
+}
+
 // VerifyPassword verifies the password for the user
 func (u *User) VerifyPassword(password string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
 	return err == nil
 }
+
+// NewFeedToken returns a random calendar feed token along with the hash
+// stored for it, the token itself is only shown to the user
+func NewFeedToken() (string, string, error) {
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		return "", "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(token)
+	return encoded, HashFeedToken(encoded), nil
+}
+
+// HashFeedToken returns the hash a feed token is stored as
+func HashFeedToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Profile returns the user without its password hash
+func (u *User) Profile() UserProfile {
+	return UserProfile{
+		ID:           u.ID,
+		Name:         u.Name,
+		Username:     u.Username,
+		Email:        u.Email,
+		Organization: u.Organization,
+		Phone:        u.Phone,
+		Disabled:     u.Disabled,
+		CreatedAt:    u.CreatedAt,
+		ModifiedAt:   u.ModifiedAt,
+	}
+}
+
+// UserDirectory holds every account of a database. It lives on the root node
+// and is the only place user details are stored; nodes only hold grants.
+type UserDirectory struct {
+	users map[string]*User
+	mutex sync.RWMutex
+}
+
+// NewUserDirectory creates an empty user directory
+func NewUserDirectory() *UserDirectory {
+	return &UserDirectory{users: make(map[string]*User)}
+}
+
+// MarshalJSON encodes the directory as a list of users ordered by ID
+func (d *UserDirectory) MarshalJSON() ([]byte, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	users := make([]*User, 0, len(d.users))
+	for _, user := range d.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return json.Marshal(users)
+}
+
+// UnmarshalJSON decodes a directory encoded by MarshalJSON
+func (d *UserDirectory) UnmarshalJSON(data []byte) error {
+	var users []*User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.users = make(map[string]*User, len(users))
+	for _, user := range users {
+		d.users[user.ID] = user
+	}
+	return nil
+}
+
+// Add stores a new user, generating an ID when it has none
+func (d *UserDirectory) Add(user User) (User, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if user.Username == "" {
+		return User{}, fmt.Errorf("username is required")
+	}
+	if d.findByUsername(user.Username) != nil {
+		return User{}, fmt.Errorf("%w: %s", ErrUsernameTaken, user.Username)
+	}
+	if user.ID == "" {
+		user.ID = GenerateID()
+	}
+	if _, exists := d.users[user.ID]; exists {
+		return User{}, fmt.Errorf("user %s already exists", user.ID)
+	}
+
+	user.Permissions = nil
+	user.CreatedAt = time.Now()
+	user.ModifiedAt = user.CreatedAt
+	d.users[user.ID] = &user
+	return user, nil
+}
+
+// Get returns a copy of the user with the given ID
+func (d *UserDirectory) Get(userID string) (User, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	user, exists := d.users[userID]
+	if !exists {
+		return User{}, fmt.Errorf("%w: %s", ErrUserNotFound, userID)
+	}
+	return *user, nil
+}
+
+// FindByUsername returns a copy of the user with the given username
+func (d *UserDirectory) FindByUsername(username string) (User, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	user := d.findByUsername(username)
+	if user == nil {
+		return User{}, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	return *user, nil
+}
+
+func (d *UserDirectory) findByUsername(username string) *User {
+	for _, user := range d.users {
+		if user.Username == username {
+			return user
+		}
+	}
+	return nil
+}
+
+// FindByFeedToken returns a copy of the user holding the calendar feed token
+func (d *UserDirectory) FindByFeedToken(token string) (User, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if token == "" {
+		return User{}, fmt.Errorf("%w: no feed token", ErrUserNotFound)
+	}
+	hash := HashFeedToken(token)
+	for _, user := range d.users {
+		if user.FeedToken != "" && subtle.ConstantTimeCompare([]byte(user.FeedToken), []byte(hash)) == 1 {
+			return *user, nil
+		}
+	}
+	return User{}, fmt.Errorf("%w: unknown feed token", ErrUserNotFound)
+}
+
+// Update applies update to the user with the given ID and returns the result.
+// Nothing is changed when update returns an error or takes a username in use.
+func (d *UserDirectory) Update(userID string, update func(*User) error) (User, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	user, exists := d.users[userID]
+	if !exists {
+		return User{}, fmt.Errorf("%w: %s", ErrUserNotFound, userID)
+	}
+
+	updated := *user
+	if err := update(&updated); err != nil {
+		return User{}, err
+	}
+	if updated.Username == "" {
+		return User{}, fmt.Errorf("username is required")
+	}
+	if other := d.findByUsername(updated.Username); other != nil && other.ID != userID {
+		return User{}, fmt.Errorf("%w: %s", ErrUsernameTaken, updated.Username)
+	}
+
+	updated.ID = userID
+	updated.ModifiedAt = time.Now()
+	d.users[userID] = &updated
+	return updated, nil
+}
+
+// Delete removes the user with the given ID
+func (d *UserDirectory) Delete(userID string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, exists := d.users[userID]; !exists {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, userID)
+	}
+	delete(d.users, userID)
+	return nil
+}
+
+// List returns copies of all users ordered by username
+func (d *UserDirectory) List() []User {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	users := make([]User, 0, len(d.users))
+	for _, user := range d.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// Len returns the number of users in the directory
+func (d *UserDirectory) Len() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return len(d.users)
+}
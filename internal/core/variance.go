@@ -0,0 +1,275 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// MetadataChange is a metadata key whose value differs between a plan and
+// the event that followed it
+type MetadataChange struct {
+	Key     string      `json:"key"`
+	Planned interface{} `json:"planned,omitempty"`
+	Actual  interface{} `json:"actual,omitempty"`
+}
+
+// EventVariance describes how far an event drifted from its plan. Slips and
+// deltas are in seconds, positive when reality ran late or long, and are left
+// out when either side has no time to compare.
+type EventVariance struct {
+	PlannedEventID string           `json:"planned_event_id"`
+	ActualEventID  string           `json:"actual_event_id,omitempty"` // Empty when the plan was never started
+	PlannedStart   *time.Time       `json:"planned_start,omitempty"`
+	PlannedEnd     *time.Time       `json:"planned_end,omitempty"`
+	ActualStart    *time.Time       `json:"actual_start,omitempty"`
+	ActualEnd      *time.Time       `json:"actual_end,omitempty"`
+	StartSlip      *int64           `json:"start_slip_seconds,omitempty"`
+	EndSlip        *int64           `json:"end_slip_seconds,omitempty"`
+	DurationDelta  *int64           `json:"duration_delta_seconds,omitempty"`
+	ExpectedStatus EventStatus      `json:"expected_status"` // Status the plan called for at the time of the report
+	ActualStatus   EventStatus      `json:"actual_status"`
+	StatusMismatch bool             `json:"status_mismatch"`
+	MetadataDiff   []MetadataChange `json:"metadata_diff,omitempty"`
+}
+
+// VarianceSummary aggregates the variance of several events
+type VarianceSummary struct {
+	Planned            int    `json:"planned"`
+	Started            int    `json:"started"`
+	Missed             int    `json:"missed"` // Due but never started
+	StatusMismatches   int    `json:"status_mismatches"`
+	MetadataMismatches int    `json:"metadata_mismatches"`
+	AverageStartSlip   *int64 `json:"average_start_slip_seconds,omitempty"`
+	AverageEndSlip     *int64 `json:"average_end_slip_seconds,omitempty"`
+	TotalDurationDelta int64  `json:"total_duration_delta_seconds"`
+}
+
+// NodeVariance is the variance of the events planned on one node
+type NodeVariance struct {
+	NodeID  string          `json:"node_id"`
+	Path    string          `json:"path"`
+	Summary VarianceSummary `json:"summary"`
+	Events  []EventVariance `json:"events"`
+}
+
+// VarianceReport is the variance of a subtree over a date range, per node
+// and for the subtree as a whole
+type VarianceReport struct {
+	Path    string          `json:"path"`
+	From    time.Time       `json:"from"`
+	To      time.Time       `json:"to"`
+	Summary VarianceSummary `json:"summary"`
+	Nodes   []NodeVariance  `json:"nodes"`
+}
+
+// CompareEvents reports how the actual event drifted from the planned one. The
+// plan is looked up in the planned events, then on the event started from it.
+func (n *Node) CompareEvents(plannedEventID, actualEventID string) (*EventVariance, error) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	plannedEvent, plannedExists := n.PlannedEvents[plannedEventID]
+	if !plannedExists {
+		if started, exists := n.Events[plannedEventID]; exists && started.Plan != nil {
+			plannedEvent, plannedExists = *started.Plan, true
+		}
+	}
+	actualEvent, actualExists := n.Events[actualEventID]
+
+	if !plannedExists || !actualExists {
+		return nil, fmt.Errorf("one or both events not found: plannedEventID=%s, actualEventID=%s", plannedEventID, actualEventID)
+	}
+
+	variance := compareEvents(plannedEventID, plannedEvent, actualEventID, &actualEvent, time.Now())
+	return &variance, nil
+}
+
+// Variance reports every plan on the node starting within [from, to) that was
+// due by now, against the event started from it, ordered by planned start
+func (n *Node) Variance(from, to, now time.Time) []EventVariance {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	inRange := func(plan Event) bool {
+		return plan.StartTime != nil && !plan.StartTime.Before(from) && plan.StartTime.Before(to) && !plan.StartTime.After(now)
+	}
+
+	var variances []EventVariance
+	for eventID, event := range n.Events {
+		if event.Plan != nil && inRange(*event.Plan) {
+			variances = append(variances, compareEvents(eventID, *event.Plan, eventID, &event, now))
+		}
+	}
+	for eventID, plan := range n.PlannedEvents {
+		if !inRange(plan) {
+			continue
+		}
+		if actual, started := n.Events[eventID]; started {
+			variances = append(variances, compareEvents(eventID, plan, eventID, &actual, now))
+		} else {
+			variances = append(variances, compareEvents(eventID, plan, "", nil, now))
+		}
+	}
+
+	sort.Slice(variances, func(i, j int) bool {
+		if variances[i].PlannedStart.Equal(*variances[j].PlannedStart) {
+			return variances[i].PlannedEventID < variances[j].PlannedEventID
+		}
+		return variances[i].PlannedStart.Before(*variances[j].PlannedStart)
+	})
+	return variances
+}
+
+// VarianceReport reports the variance of n, found at path, and of every
+// descendant userID can read. Nodes without plans in range are left out.
+func (n *Node) VarianceReport(path string, from, to, now time.Time, userID string) VarianceReport {
+	report := VarianceReport{Path: path, From: from, To: to, Nodes: []NodeVariance{}}
+
+	var all []EventVariance
+	seen := make(map[string]bool)
+	var walk func(node *Node, path string)
+	walk = func(node *Node, path string) {
+		if seen[node.ID] {
+			return
+		}
+		seen[node.ID] = true
+
+		if node.CheckPermission(userID, ReadPermission) {
+			if variances := node.Variance(from, to, now); len(variances) > 0 {
+				report.Nodes = append(report.Nodes, NodeVariance{
+					NodeID:  node.ID,
+					Path:    path,
+					Summary: SummarizeVariance(variances),
+					Events:  variances,
+				})
+				all = append(all, variances...)
+			}
+		}
+
+		children := node.ChildNodes()
+		sort.Slice(children, func(i, j int) bool { return children[i].Name < children[j].Name })
+		for _, child := range children {
+			childPath := EscapeName(child.Name)
+			if path != "" {
+				childPath = path + "/" + childPath
+			}
+			walk(child, childPath)
+		}
+	}
+	walk(n, path)
+
+	report.Summary = SummarizeVariance(all)
+	return report
+}
+
+// SummarizeVariance aggregates the given variances
+func SummarizeVariance(variances []EventVariance) VarianceSummary {
+	summary := VarianceSummary{Planned: len(variances)}
+
+	var startSlips, endSlips []int64
+	for _, variance := range variances {
+		if variance.ActualStart == nil {
+			summary.Missed++
+		} else {
+			summary.Started++
+		}
+		if variance.StatusMismatch {
+			summary.StatusMismatches++
+		}
+		if len(variance.MetadataDiff) > 0 {
+			summary.MetadataMismatches++
+		}
+		if variance.StartSlip != nil {
+			startSlips = append(startSlips, *variance.StartSlip)
+		}
+		if variance.EndSlip != nil {
+			endSlips = append(endSlips, *variance.EndSlip)
+		}
+		if variance.DurationDelta != nil {
+			summary.TotalDurationDelta += *variance.DurationDelta
+		}
+	}
+
+	summary.AverageStartSlip = averageSeconds(startSlips)
+	summary.AverageEndSlip = averageSeconds(endSlips)
+	return summary
+}
+
+func compareEvents(plannedEventID string, plan Event, actualEventID string, actual *Event, now time.Time) EventVariance {
+	variance := EventVariance{
+		PlannedEventID: plannedEventID,
+		ActualEventID:  actualEventID,
+		PlannedStart:   plan.StartTime,
+		PlannedEnd:     plan.EndTime,
+		ExpectedStatus: plan.expectedStatus(now),
+		ActualStatus:   EventPending,
+	}
+
+	var actualMetadata map[string]interface{}
+	if actual != nil {
+		variance.ActualStart = actual.StartTime
+		variance.ActualEnd = actual.EndTime
+		variance.ActualStatus = actual.Status
+		actualMetadata = actual.Metadata
+
+		variance.StartSlip = slipSeconds(plan.StartTime, actual.StartTime)
+		variance.EndSlip = slipSeconds(plan.EndTime, actual.EndTime)
+		if plan.StartTime != nil && plan.EndTime != nil && actual.StartTime != nil && actual.EndTime != nil {
+			delta := int64((actual.EndTime.Sub(*actual.StartTime) - plan.EndTime.Sub(*plan.StartTime)).Seconds())
+			variance.DurationDelta = &delta
+		}
+	}
+	variance.StatusMismatch = variance.ExpectedStatus != variance.ActualStatus
+	variance.MetadataDiff = diffMetadata(plan.Metadata, actualMetadata)
+	return variance
+}
+
+// expectedStatus returns the status the plan calls for at now
+func (e Event) expectedStatus(now time.Time) EventStatus {
+	switch {
+	case e.EndTime != nil && !e.EndTime.After(now):
+		return EventFinished
+	case e.StartTime != nil && !e.StartTime.After(now):
+		return EventOngoing
+	default:
+		return EventPending
+	}
+}
+
+func slipSeconds(planned, actual *time.Time) *int64 {
+	if planned == nil || actual == nil {
+		return nil
+	}
+	slip := int64(actual.Sub(*planned).Seconds())
+	return &slip
+}
+
+func averageSeconds(values []int64) *int64 {
+	if len(values) == 0 {
+		return nil
+	}
+	var total int64
+	for _, value := range values {
+		total += value
+	}
+	average := total / int64(len(values))
+	return &average
+}
+
+func diffMetadata(planned, actual map[string]interface{}) []MetadataChange {
+	var changes []MetadataChange
+	for key, plannedValue := range planned {
+		if actualValue, exists := actual[key]; !exists || !reflect.DeepEqual(plannedValue, actualValue) {
+			changes = append(changes, MetadataChange{Key: key, Planned: plannedValue, Actual: actualValue})
+		}
+	}
+	for key, actualValue := range actual {
+		if _, exists := planned[key]; !exists {
+			changes = append(changes, MetadataChange{Key: key, Actual: actualValue})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
@@ -0,0 +1,199 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrWebhookNotFound is returned when no webhook on the node has the given ID
+	ErrWebhookNotFound = errors.New("webhook not found")
+	// ErrInvalidWebhook is returned for webhooks without a usable URL
+	ErrInvalidWebhook = errors.New("invalid webhook")
+)
+
+// MaxDeadLetters is how many failed deliveries a webhook keeps, oldest dropped first
+const MaxDeadLetters = 100
+
+// Webhook sends the changes made on a node and its descendants to a URL
+type Webhook struct {
+	ID          string            `json:"id"`
+	NodeID      string            `json:"node_id"`
+	URL         string            `json:"url"`
+	Secret      string            `json:"secret,omitempty"` // Signs payloads, only shown when the webhook is created
+	Events      []string          `json:"events,omitempty"` // Change types to send, every type when empty
+	CreatedBy   string            `json:"created_by,omitempty"`
+	CreatedAt   time.Time         `json:"created_at,omitempty"`
+	DeadLetters []WebhookDelivery `json:"dead_letters,omitempty"`
+}
+
+// WebhookDelivery is one payload sent to a webhook
+type WebhookDelivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	Status    int             `json:"status,omitempty"` // HTTP status of the last attempt, unset when no response came
+	Error     string          `json:"error,omitempty"`
+	FailedAt  time.Time       `json:"failed_at,omitempty"`
+}
+
+// Wants reports whether the webhook sends changes of the given type
+func (w Webhook) Wants(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, event := range w.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacted returns the webhook without its secret and dead letters, as listed
+func (w Webhook) Redacted() Webhook {
+	w.Secret = ""
+	w.DeadLetters = nil
+	return w
+}
+
+func newWebhookID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return "wh-" + hex.EncodeToString(id)
+}
+
+// NewWebhookDeliveryID returns a random ID for a delivery
+func NewWebhookDeliveryID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return "whd-" + hex.EncodeToString(id)
+}
+
+func isHTTPURL(target string) bool {
+	parsed, err := url.Parse(target)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// AddWebhook registers a webhook on the node. A secret is generated when none
+// is given. Webhooks send data out of the forest, so they take admin permission.
+func (n *Node) AddWebhook(target string, events []string, secret string, userID string) (*Webhook, error) {
+	if !n.CheckPermission(userID, AdminPermission) {
+		return nil, fmt.Errorf("insufficient permissions")
+	}
+	if !isHTTPURL(target) {
+		return nil, fmt.Errorf("%w: %q is not an http or https URL", ErrInvalidWebhook, target)
+	}
+	if secret == "" {
+		generated := make([]byte, 32)
+		if _, err := rand.Read(generated); err != nil {
+			return nil, fmt.Errorf("failed to generate secret: %v", err)
+		}
+		secret = hex.EncodeToString(generated)
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	webhook := Webhook{
+		ID:        newWebhookID(),
+		NodeID:    n.ID,
+		URL:       target,
+		Secret:    secret,
+		Events:    events,
+		CreatedBy: userID,
+		CreatedAt: time.Now(),
+	}
+	if n.Webhooks == nil {
+		n.Webhooks = make(map[string]Webhook)
+	}
+	n.Webhooks[webhook.ID] = webhook
+	return &webhook, nil
+}
+
+// GetWebhook returns the webhook with the given ID
+func (n *Node) GetWebhook(webhookID string) (Webhook, error) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	webhook, exists := n.Webhooks[webhookID]
+	if !exists {
+		return Webhook{}, fmt.Errorf("%w: %s", ErrWebhookNotFound, webhookID)
+	}
+	return webhook, nil
+}
+
+// ListWebhooks returns the webhooks registered on the node, oldest first
+func (n *Node) ListWebhooks() []Webhook {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	webhooks := make([]Webhook, 0, len(n.Webhooks))
+	for _, webhook := range n.Webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		if !webhooks[i].CreatedAt.Equal(webhooks[j].CreatedAt) {
+			return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+		}
+		return webhooks[i].ID < webhooks[j].ID
+	})
+	return webhooks
+}
+
+// DeleteWebhook removes the webhook, along with its dead letters
+func (n *Node) DeleteWebhook(webhookID string, userID string) error {
+	if !n.CheckPermission(userID, AdminPermission) {
+		return fmt.Errorf("insufficient permissions")
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, exists := n.Webhooks[webhookID]; !exists {
+		return fmt.Errorf("%w: %s", ErrWebhookNotFound, webhookID)
+	}
+	delete(n.Webhooks, webhookID)
+	return nil
+}
+
+// AddDeadLetter records a delivery that failed for good on its webhook
+func (n *Node) AddDeadLetter(delivery WebhookDelivery) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	webhook, exists := n.Webhooks[delivery.WebhookID]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrWebhookNotFound, delivery.WebhookID)
+	}
+	webhook.DeadLetters = append(webhook.DeadLetters, delivery)
+	if len(webhook.DeadLetters) > MaxDeadLetters {
+		webhook.DeadLetters = webhook.DeadLetters[len(webhook.DeadLetters)-MaxDeadLetters:]
+	}
+	n.Webhooks[webhook.ID] = webhook
+	return nil
+}
+
+// TakeDeadLetters removes and returns the dead letters of the webhook, to be
+// delivered again
+func (n *Node) TakeDeadLetters(webhookID string) ([]WebhookDelivery, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	webhook, exists := n.Webhooks[webhookID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrWebhookNotFound, webhookID)
+	}
+	deadLetters := webhook.DeadLetters
+	webhook.DeadLetters = nil
+	n.Webhooks[webhookID] = webhook
+	return deadLetters, nil
+}
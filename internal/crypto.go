@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/vaziolabs/lumberjack/types"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// Encrypted state files start with this magic; files without it are the
+	// legacy plaintext format of a SHA-256 header followed by gzip data
+	stateMagic   = "LJDB"
+	stateVersion = byte(1)
+	stateSaltLen = 16
+
+	// Environment variable a spawned server reads its passphrase from
+	PassphraseEnv = "LUMBERJACK_PASSPHRASE"
+)
+
+// StateCipher seals the state file and journal with a key derived from the
+// database secret (a passphrase or the contents of a key file) and a salt
+// stored in the state file header.
+type StateCipher struct {
+	salt []byte
+	aead cipher.AEAD
+}
+
+// NewStateCipher derives the key for secret. A nil salt generates a new one.
+func NewStateCipher(secret []byte, salt []byte) (*StateCipher, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("encryption secret is empty")
+	}
+
+	if salt == nil {
+		salt = make([]byte, stateSaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+
+	key := argon2.IDKey(secret, salt, 1, 64*1024, 4, chacha20poly1305.KeySize)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return &StateCipher{salt: salt, aead: aead}, nil
+}
+
+// header returns the versioned state file header, which is also authenticated
+func (c *StateCipher) header() []byte {
+	header := make([]byte, 0, len(stateMagic)+1+stateSaltLen)
+	header = append(header, stateMagic...)
+	header = append(header, stateVersion)
+	return append(header, c.salt...)
+}
+
+// Seal encrypts plaintext, returning the nonce followed by the ciphertext
+func (c *StateCipher) Seal(plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// Open decrypts data produced by Seal
+func (c *StateCipher) Open(data, additional []byte) ([]byte, error) {
+	if len(data) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted data too short")
+	}
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt state, wrong passphrase or key file")
+	}
+	return plaintext, nil
+}
+
+// encryptState wraps the plaintext state in the encrypted file format
+func (c *StateCipher) encryptState(plaintext []byte) ([]byte, error) {
+	header := c.header()
+	sealed, err := c.Seal(plaintext, header)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, sealed...), nil
+}
+
+// isEncryptedState reports whether data uses the encrypted file format
+func isEncryptedState(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(stateMagic))
+}
+
+// decryptState unwraps an encrypted state file, returning the cipher for its salt
+func decryptState(data []byte, secret []byte) ([]byte, *StateCipher, error) {
+	headerLen := len(stateMagic) + 1 + stateSaltLen
+	if len(data) < headerLen {
+		return nil, nil, fmt.Errorf("state file header truncated")
+	}
+	if version := data[len(stateMagic)]; version != stateVersion {
+		return nil, nil, fmt.Errorf("unsupported state file version: %d", version)
+	}
+	if len(secret) == 0 {
+		return nil, nil, fmt.Errorf("state file is encrypted but no passphrase or key file was provided")
+	}
+
+	stateCipher, err := NewStateCipher(secret, data[len(stateMagic)+1:headerLen])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, err := stateCipher.Open(data[headerLen:], data[:headerLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, stateCipher, nil
+}
+
+// sealedFile is a small file of server state, such as the signing keys or the
+// sessions, encrypted when the database has a secret. Its key is derived
+// once and kept, as every derivation takes a deliberate while. Saves are
+// numbered when their state is captured, so callers can write outside their
+// own locks: a save older than what is already on disk is dropped.
+type sealedFile struct {
+	path   string
+	secret []byte
+	cipher *StateCipher
+	saved  uint64 // Number of the save on disk
+	mutex  sync.Mutex
+}
+
+// readSealedFile reads a sealed file, decrypting it if needed. The file is
+// returned even when it does not exist yet, along with the error.
+func readSealedFile(path string, secret []byte) (*sealedFile, []byte, error) {
+	file := &sealedFile{path: path, secret: secret}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return file, nil, err
+	}
+	if isEncryptedState(data) {
+		// Writes reuse the salt, and with it the key, the file was sealed with
+		var stateCipher *StateCipher
+		if data, stateCipher, err = decryptState(data, secret); err != nil {
+			return file, nil, err
+		}
+		file.cipher = stateCipher
+	}
+	return file, data, nil
+}
+
+// setSecret changes the secret the next saves are encrypted with
+func (f *sealedFile) setSecret(secret []byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.secret = secret
+	f.cipher = nil
+}
+
+// write atomically replaces the file with save number version, unless a
+// later save is already on disk
+func (f *sealedFile) write(version uint64, data []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if version <= f.saved {
+		return nil
+	}
+	if len(f.secret) > 0 {
+		if f.cipher == nil {
+			stateCipher, err := NewStateCipher(f.secret, nil)
+			if err != nil {
+				return err
+			}
+			f.cipher = stateCipher
+		}
+		var err error
+		if data, err = f.cipher.encryptState(data); err != nil {
+			return err
+		}
+	}
+
+	tmpFile := f.path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Rename(tmpFile, f.path); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	f.saved = version
+	return nil
+}
+
+// ErrRekeyIncomplete is returned by Rekey when re-encrypting failed and the
+// files already written with the new secret could not be put back, so both
+// secrets must be kept
+var ErrRekeyIncomplete = errors.New("database is left partly encrypted with the new secret")
+
+// Rekey re-encrypts a stopped database with newSecret. config.Secret must hold
+// the current secret, if any; an empty newSecret stores the database unencrypted.
+// When it fails the files are re-encrypted with the current secret again, and
+// ErrRekeyIncomplete is returned if that fails too.
+func Rekey(config types.ServerConfig, newSecret []byte) error {
+	server, err := LoadServer(config)
+	if err != nil {
+		return err
+	}
+
+	var stateCipher *StateCipher
+	if len(newSecret) > 0 {
+		if stateCipher, err = NewStateCipher(newSecret, nil); err != nil {
+			server.Shutdown(context.Background())
+			return err
+		}
+	}
+
+	oldSecret, oldCipher := server.secret, server.cipher
+	if err = server.rekey(newSecret, stateCipher); err != nil {
+		if restoreErr := server.rekey(oldSecret, oldCipher); restoreErr != nil {
+			err = fmt.Errorf("%w: %v, then restoring the old secret: %v", ErrRekeyIncomplete, err, restoreErr)
+		}
+	}
+	if shutdownErr := server.Shutdown(context.Background()); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// rekey writes the state file, key and session files and blobs with secret
+func (server *Server) rekey(secret []byte, stateCipher *StateCipher) error {
+	// Fold the journal into a snapshot written with the key
+	err := server.journal.Compact(func() error {
+		server.secret = secret
+		server.cipher = stateCipher
+		server.journal.cipher = stateCipher
+		server.lastHash = nil
+		return server.writeChangesToFile(server.forest, server.dbFile())
+	})
+	if err == nil {
+		err = server.jwtConfig.Keys.SetSecret(secret)
+	}
+	if err == nil {
+		err = server.sessions.SetSecret(secret)
+	}
+	if err == nil {
+		err = server.blobs.Reseal(secret, stateCipher)
+	}
+	return err
+}
@@ -41,10 +41,15 @@ func NewDashboard(apiEndpoint string, port string) *DashboardServer {
 	protected.Use(dashboardServer.authMiddleware)
 	protected.HandleFunc("/forest", dashboardServer.handleGetTree).Methods("GET")
 	protected.HandleFunc("/events", dashboardServer.handleGetEvents).Methods("GET")
+	protected.HandleFunc("/search", dashboardServer.handleSearch).Methods("GET")
+	protected.HandleFunc("/changes", dashboardServer.handleChangeStream).Methods("GET")
+	protected.HandleFunc("/changes/ws", dashboardServer.handleChangeSocket).Methods("GET")
 	protected.HandleFunc("/logs", dashboardServer.handleGetLogs).Methods("GET")
 	protected.HandleFunc("/users", dashboardServer.handleGetUsers).Methods("GET")
 	protected.HandleFunc("/users", dashboardServer.handleCreateUser).Methods("POST")
 	protected.HandleFunc("/user/profile", dashboardServer.handleGetUserProfile).Methods("GET")
+	protected.HandleFunc("/user/sessions", dashboardServer.handleGetSessions).Methods("GET")
+	protected.HandleFunc("/user/sessions/revoke", dashboardServer.handleRevokeSessions).Methods("POST")
 	protected.HandleFunc("/logout", dashboardServer.handleLogout).Methods("POST")
 	protected.HandleFunc("/settings", dashboardServer.handleUpdateSettings).Methods("POST")
 
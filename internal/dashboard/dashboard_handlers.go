@@ -1,12 +1,16 @@
 package dashboard
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"html/template"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -39,6 +43,165 @@ func (s *DashboardServer) handleGetTree(w http.ResponseWriter, r *http.Request)
 	io.Copy(w, resp.Body)
 }
 
+func (s *DashboardServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		http.Error(w, "No authentication token found", http.StatusUnauthorized)
+		return
+	}
+
+	// The search parameters are passed through as they are
+	req, _ := http.NewRequest("GET", s.apiEndpoint+"/search?"+r.URL.RawQuery, nil)
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		http.Error(w, "Error connecting to API server: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// handleChangeStream relays the API's change stream as it arrives
+func (s *DashboardServer) handleChangeStream(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		http.Error(w, "No authentication token found", http.StatusUnauthorized)
+		return
+	}
+
+	req, _ := http.NewRequestWithContext(r.Context(), "GET", s.apiEndpoint+"/changes?"+r.URL.RawQuery, nil)
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	// No client timeout, the stream stays open until either side goes away
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, "Error connecting to API server: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+
+	buffer := make([]byte, 4096)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if _, err := w.Write(buffer[:n]); err != nil {
+				return
+			}
+			controller.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleChangeSocket tunnels a WebSocket to the API's change socket, adding
+// the session token the browser cannot send itself
+func (s *DashboardServer) handleChangeSocket(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		http.Error(w, "No authentication token found", http.StatusUnauthorized)
+		return
+	}
+
+	target, err := url.Parse(s.apiEndpoint)
+	if err != nil {
+		http.Error(w, "Invalid API endpoint", http.StatusInternalServerError)
+		return
+	}
+	host := target.Host
+	if target.Port() == "" {
+		if target.Scheme == "https" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+	var upstream net.Conn
+	if target.Scheme == "https" {
+		upstream, err = tls.Dial("tcp", host, &tls.Config{ServerName: target.Hostname()})
+	} else {
+		upstream, err = net.Dial("tcp", host)
+	}
+	if err != nil {
+		http.Error(w, "Error connecting to API server: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	req, _ := http.NewRequest("GET", s.apiEndpoint+"/changes/ws?"+r.URL.RawQuery, nil)
+	for _, name := range []string{"Upgrade", "Connection", "Sec-WebSocket-Key", "Sec-WebSocket-Version"} {
+		req.Header.Set(name, r.Header.Get(name))
+	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	if err := req.Write(upstream); err != nil {
+		http.Error(w, "Error connecting to API server: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	upstreamReader := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(upstreamReader, req)
+	if err != nil {
+		http.Error(w, "Error connecting to API server: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Websockets not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	client.SetDeadline(time.Time{})
+
+	io.WriteString(client, "HTTP/1.1 101 Switching Protocols\r\n")
+	resp.Header.Write(client)
+	io.WriteString(client, "\r\n")
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, buffered.Reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstreamReader)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
 func (s *DashboardServer) handleGetEvents(w http.ResponseWriter, r *http.Request) {
 	// Forward request to API server
 	req, _ := http.NewRequest("POST", s.apiEndpoint+"/events", r.Body)
@@ -250,17 +413,22 @@ func (s *DashboardServer) handleRefreshToken(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Forward refresh request to API
-	req, _ := http.NewRequest("POST", s.apiEndpoint+"/refresh", nil)
-	req.Header.Set("Authorization", "Bearer "+refreshCookie.Value)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	body, _ := json.Marshal(map[string]string{"refresh_token": refreshCookie.Value})
+	resp, err := http.Post(s.apiEndpoint+"/refresh", "application/json", bytes.NewBuffer(body))
 	if err != nil {
 		http.Error(w, "Error connecting to API server", http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
 
+	// A rejected refresh token means the session was revoked or reused
+	if resp.StatusCode != http.StatusOK {
+		s.clearSessionCookies(w)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
 	// Parse the API response
 	var newTokens struct {
 		SessionToken string `json:"session_token"`
@@ -351,7 +519,23 @@ func (s *DashboardServer) handleGetUserProfile(w http.ResponseWriter, r *http.Re
 }
 
 func (s *DashboardServer) handleLogout(w http.ResponseWriter, r *http.Request) {
-	// Clear cookies with same attributes
+	// Revoke the session on the API so its refresh token stops working
+	req, _ := http.NewRequest("POST", s.apiEndpoint+"/logout", nil)
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+
+	client := &http.Client{}
+	if resp, err := client.Do(req); err != nil {
+		s.logger.Error("Error revoking session: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	s.clearSessionCookies(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+// clearSessionCookies expires the token cookies with the attributes they were set with
+func (s *DashboardServer) clearSessionCookies(w http.ResponseWriter) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session_token",
 		Value:    "",
@@ -370,7 +554,42 @@ func (s *DashboardServer) handleLogout(w http.ResponseWriter, r *http.Request) {
 		Secure:   !strings.HasPrefix(s.apiEndpoint, "http://localhost"),
 		SameSite: http.SameSiteStrictMode,
 	})
-	w.WriteHeader(http.StatusOK)
+}
+
+func (s *DashboardServer) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	// Forward request to API server
+	req, _ := http.NewRequest("GET", s.apiEndpoint+"/users/me/sessions", nil)
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		http.Error(w, "Error connecting to API server: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (s *DashboardServer) handleRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	req, _ := http.NewRequest("POST", s.apiEndpoint+"/users/me/sessions/revoke", r.Body)
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		http.Error(w, "Error connecting to API server: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
 }
 
 func (s *DashboardServer) handleUpdateSettings(w http.ResponseWriter, r *http.Request) {
@@ -33,13 +33,11 @@ function renderUsers(data) {
     usersList.innerHTML = users.length ? users.map(user => `
         <div class="user-item">
             <div class="user-info">
-                <span class="username">${user.username}</span>
-                <span class="email">${user.email}</span>
+                <span class="username">${escapeHtml(user.username)}</span>
+                <span class="email">${escapeHtml(user.email)}</span>
             </div>
             <div class="permissions">
-                ${user.permissions.map(perm => `
-                    <span class="permission-tag">${Permission[perm]}</span>
-                `).join('')}
+                ${user.disabled ? '<span class="permission-tag">Disabled</span>' : ''}
             </div>
         </div>
     `).join('') : '<div class="no-users">No users found</div>';
@@ -112,6 +110,7 @@ document.addEventListener('DOMContentLoaded', async () => {
     const userProfile = document.getElementById('user-profile');
     const profileMenu = document.getElementById('profile-menu');
     const serverSettings = document.getElementById('server-settings');
+    const activeSessions = document.getElementById('active-sessions');
     const logoutButton = document.getElementById('logout');
 
     userProfile.addEventListener('click', (e) => {
@@ -128,6 +127,11 @@ document.addEventListener('DOMContentLoaded', async () => {
         showServerSettingsModal();
     });
 
+    activeSessions.addEventListener('click', async (e) => {
+        e.preventDefault();
+        showSessionsModal();
+    });
+
     logoutButton.addEventListener('click', async (e) => {
         e.preventDefault();
         try {
@@ -163,6 +167,7 @@ document.addEventListener('DOMContentLoaded', async () => {
         // Then load view data
         await loadViewData('forest');
         await loadUsers();
+        watchChanges();
     } catch (error) {
         window.location.href = '/';
         console.error('Error during initialization:', error);
@@ -403,6 +408,66 @@ function renderEvents(data) {
     `;
 }
 
+async function runSearch() {
+    const text = document.getElementById('search-input').value.trim();
+    if (!text) return;
+
+    const params = new URLSearchParams({ q: text });
+    const filters = { path: 'search-path', category: 'search-category', user: 'search-user' };
+    for (const [name, id] of Object.entries(filters)) {
+        const value = document.getElementById(id).value.trim();
+        if (value) params.set(name, value);
+    }
+
+    showView('search');
+    const results = document.getElementById('search-results');
+    try {
+        const response = await fetch(`/api/search?${params}`, {
+            headers: {
+                'Authorization': `Bearer ${getCookie('session_token')}`
+            }
+        });
+        if (response.status === 401) {
+            window.location.href = '/';
+            return;
+        }
+        if (!response.ok) {
+            results.innerHTML = `<div class="no-results">${escapeHtml(await response.text())}</div>`;
+            return;
+        }
+        renderSearchResults(await response.json());
+    } catch (error) {
+        console.error('Error searching:', error);
+    }
+}
+
+function renderSearchResults(data) {
+    const results = document.getElementById('search-results');
+    const hits = data.hits || [];
+
+    results.innerHTML = hits.length ? hits.map(hit => `
+        <div class="search-hit">
+            <div class="search-hit-header">
+                <span class="search-hit-kind">${escapeHtml(hit.kind)}</span>
+                <span class="search-hit-path">/${escapeHtml(hit.path)}</span>
+                ${hit.event_id ? `<span class="search-hit-event">${escapeHtml(hit.event_id)}</span>` : ''}
+                ${hit.category ? `<span class="permission-tag">${escapeHtml(hit.category)}</span>` : ''}
+            </div>
+            <div class="search-hit-snippet">${escapeHtml(hit.snippet)}</div>
+            ${hit.time ? `<div class="search-hit-time">${new Date(hit.time).toLocaleString()}</div>` : ''}
+        </div>
+    `).join('') : '<div class="no-results">No matches found</div>';
+}
+
+document.getElementById('search-form').addEventListener('submit', (e) => {
+    e.preventDefault();
+    runSearch();
+});
+
+['search-path', 'search-category', 'search-user'].forEach(id => {
+    document.getElementById(id).addEventListener('change', runSearch);
+});
+
 // Add Permission enum to match Go constants
 const Permission = {
     0: 'Read',
@@ -492,6 +557,87 @@ async function handleServerSettingsSave(e) {
     }
 }
 
+async function showSessionsModal() {
+    const modalHtml = `
+        <div id="sessions-modal" class="modal">
+            <div class="modal-content">
+                <h3>Active Sessions</h3>
+                <div id="sessions-list" class="sessions-list">Loading...</div>
+                <div class="form-actions">
+                    <button type="button" class="btn" onclick="revokeSessions()">Sign Out Everywhere</button>
+                    <button type="button" class="btn btn-secondary" onclick="closeSessionsModal()">Close</button>
+                </div>
+            </div>
+        </div>
+    `;
+
+    document.body.insertAdjacentHTML('beforeend', modalHtml);
+    document.getElementById('sessions-modal').style.display = 'block';
+    await loadSessions();
+}
+
+function closeSessionsModal() {
+    const modal = document.getElementById('sessions-modal');
+    modal.remove();
+}
+
+async function loadSessions() {
+    const list = document.getElementById('sessions-list');
+    try {
+        const response = await fetch('/api/user/sessions', {
+            headers: {
+                'Authorization': `Bearer ${getCookie('session_token')}`
+            }
+        });
+
+        if (!response.ok) {
+            throw new Error('Failed to load sessions');
+        }
+
+        const sessions = await response.json();
+        list.innerHTML = sessions.map(session => `
+            <div class="session-item">
+                <div class="session-info">
+                    <span class="session-device">${escapeHtml(session.device || 'Unknown device')}</span>
+                    ${session.current ? '<span class="permission-tag">This session</span>' : ''}
+                    <span class="session-dates">Signed in ${new Date(session.issued_at).toLocaleString()},
+                        last active ${new Date(session.last_used_at).toLocaleString()}</span>
+                </div>
+                ${session.current ? '' : `<button class="btn btn-secondary" onclick="revokeSessions('${session.id}')">Revoke</button>`}
+            </div>
+        `).join('');
+    } catch (error) {
+        list.textContent = 'Failed to load sessions';
+        console.error('Error loading sessions:', error);
+    }
+}
+
+// Revokes one session, or every session including this one when no ID is given
+async function revokeSessions(sessionId) {
+    try {
+        const response = await fetch('/api/user/sessions/revoke', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+                'Authorization': `Bearer ${getCookie('session_token')}`
+            },
+            body: JSON.stringify(sessionId ? { session_id: sessionId } : {})
+        });
+
+        if (!response.ok) {
+            throw new Error('Failed to revoke sessions');
+        }
+
+        if (!sessionId) {
+            window.location.href = '/';
+            return;
+        }
+        await loadSessions();
+    } catch (error) {
+        console.error('Error revoking sessions:', error);
+    }
+}
+
 async function loadUserProfile() {
     try {
         const response = await fetch('/api/users/profile', {
@@ -606,6 +752,35 @@ async function loadForest() {
     }
 }
 
+// Reload the forest as changes arrive instead of polling for them. The
+// browser resumes the stream from the last change it saw on reconnect.
+const changeTypes = ['node.created', 'event.started', 'event.ended', 'event.overdue', 'entry.appended',
+    'attachment.added', 'user.assigned', 'forest.imported', 'feed.reset'];
+let changeStream = null;
+let forestReload = null;
+
+function watchChanges() {
+    if (changeStream) return;
+    changeStream = new EventSource('/api/changes');
+    changeTypes.forEach(type => changeStream.addEventListener(type, scheduleForestReload));
+    changeStream.onerror = () => {
+        // Closed for good when the session ended, otherwise the browser retries
+        if (changeStream.readyState === EventSource.CLOSED) {
+            changeStream = null;
+            setTimeout(watchChanges, 5000);
+        }
+    };
+}
+
+function scheduleForestReload() {
+    const forestView = document.getElementById('forest-view');
+    if (forestView.style.display === 'none' || forestReload) return;
+    forestReload = setTimeout(async () => {
+        forestReload = null;
+        await loadForest();
+    }, 500);
+}
+
 let currentPage = 1;
 let hasMore = false;
 let lastEventId = '';
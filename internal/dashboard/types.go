@@ -39,7 +39,8 @@ type UserData struct {
 	ID          string       `json:"id"`
 	Username    string       `json:"username"`
 	Email       string       `json:"email"`
-	Permissions []Permission `json:"permissions"`
+	Disabled    bool         `json:"disabled"`
+	Permissions []Permission `json:"permissions,omitempty"` // Granted per node, not on the account
 }
 
 type Permission int
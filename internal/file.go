@@ -1,35 +1,54 @@
 package internal
 
 import (
+	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/vaziolabs/lumberjack/internal/core"
 )
 
-// loadFromFile loads the forest data from the file.
+// loadFromFile loads the forest data from the file, decrypting it first when
+// it uses the encrypted format.
 func (server *Server) loadFromFile(filename string) error {
 	server.logger.Enter("loadFromFile")
 	defer server.logger.Exit("loadFromFile")
 
-	file, err := os.Open(filename)
+	contents, err := os.ReadFile(filename)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	// Read hash first
-	hash := make([]byte, sha256.Size)
-	if _, err := file.Read(hash); err != nil {
-		return err
+	if isEncryptedState(contents) {
+		plaintext, stateCipher, err := decryptState(contents, server.secret)
+		if err != nil {
+			server.logger.Failure("Failed to decrypt state file: %v", err)
+			return err
+		}
+		contents = plaintext
+		server.cipher = stateCipher
+	} else if len(server.secret) > 0 {
+		// Plaintext database opened with a secret: encrypt it from the next write on
+		server.logger.Notice("State file is not encrypted, it will be encrypted on the next checkpoint")
+		if server.cipher, err = NewStateCipher(server.secret, nil); err != nil {
+			return err
+		}
+	}
+
+	if len(contents) < sha256.Size {
+		return fmt.Errorf("state file too short")
 	}
 
+	// Read hash first
+	hash := contents[:sha256.Size]
+
 	// Read and decompress remaining data
-	data, err := server.loadCompressedData(file)
+	data, err := server.loadCompressedData(bytes.NewReader(contents[sha256.Size:]))
 	if err != nil {
 		return fmt.Errorf("error loading compressed data: %v", err)
 	}
@@ -46,8 +65,7 @@ func (server *Server) loadFromFile(filename string) error {
 	return nil
 }
 
-// TODO: Encrypt this
-// Function to write changes to an encrypted state file
+// Function to write changes to the state file, encrypted when the database has a secret
 func (server *Server) writeChangesToFile(data interface{}, filename string) error {
 	server.logger.Enter("writeChangesToFile")
 	defer server.logger.Exit("writeChangesToFile")
@@ -55,8 +73,8 @@ func (server *Server) writeChangesToFile(data interface{}, filename string) erro
 	server.mutex.Lock()
 	defer server.mutex.Unlock()
 
-	// Always save the entire forest state
-	jsonData, err := json.Marshal(server.forest)
+	// Always save the entire forest state, each node read under its lock
+	jsonData, err := server.forest.MarshalTree()
 	if err != nil {
 		server.logger.Failure("Failed to marshal forest: %v", err)
 		return err
@@ -71,29 +89,31 @@ func (server *Server) writeChangesToFile(data interface{}, filename string) erro
 		return nil
 	}
 
-	tmpFile := filename + ".tmp"
-	file, err := os.Create(tmpFile)
-	if err != nil {
-		server.logger.Failure("Failed to create temporary file: %v", err)
+	var plaintext bytes.Buffer
+	plaintext.Write(newHash)
+
+	gzipWriter := gzip.NewWriter(&plaintext)
+	if _, err := gzipWriter.Write(jsonData); err != nil {
+		server.logger.Failure("Failed to compress state: %v", err)
 		return err
 	}
-	defer file.Close()
-
-	if _, err := file.Write(newHash); err != nil {
-		os.Remove(tmpFile)
-		server.logger.Failure("Failed to write hash to temporary file: %v", err)
+	if err := gzipWriter.Close(); err != nil {
+		server.logger.Failure("Failed to close gzip writer: %v", err)
 		return err
 	}
 
-	gzipWriter := gzip.NewWriter(file)
-	if _, err := gzipWriter.Write(jsonData); err != nil {
-		os.Remove(tmpFile)
-		server.logger.Failure("Failed to write compressed data to temporary file: %v", err)
-		return err
+	contents := plaintext.Bytes()
+	if server.cipher != nil {
+		if contents, err = server.cipher.encryptState(contents); err != nil {
+			server.logger.Failure("Failed to encrypt state: %v", err)
+			return err
+		}
 	}
-	if err := gzipWriter.Close(); err != nil {
+
+	tmpFile := filename + ".tmp"
+	if err := os.WriteFile(tmpFile, contents, 0600); err != nil {
 		os.Remove(tmpFile)
-		server.logger.Failure("Failed to close gzip writer: %v", err)
+		server.logger.Failure("Failed to write temporary file: %v", err)
 		return err
 	}
 
@@ -143,3 +163,8 @@ func (server *Server) validateAndUnmarshal(data []byte, hash []byte, target inte
 	server.logger.Debug("Unmarshalled data: %+v", target)
 	return nil
 }
+
+// dbFile returns the path of the database state file
+func (server *Server) dbFile() string {
+	return filepath.Join(server.config.Process.DatabasePath, server.config.Process.Name+".dat")
+}
@@ -0,0 +1,417 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vaziolabs/lumberjack/internal/core"
+)
+
+const (
+	journalPutNode    = "put_node"
+	journalDeleteNode = "delete_node"
+
+	// Number of journal records after which the journal is compacted into the snapshot
+	defaultCheckpointRecords = 1000
+	// Interval at which a non-empty journal is compacted regardless of its size
+	defaultCheckpointInterval = 5 * time.Minute
+)
+
+// JournalRecord is a single mutation appended to the journal
+type JournalRecord struct {
+	Seq    uint64          `json:"seq"`
+	Op     string          `json:"op"`
+	NodeID string          `json:"node_id"`
+	Node   json.RawMessage `json:"node,omitempty"`
+	Time   time.Time       `json:"time"`
+}
+
+// Journal is an append-only log of node mutations kept next to the state file.
+// Each line holds the CRC32 of the record followed by the record itself, so a
+// torn write at the tail is detected and ignored on replay. When the database
+// is encrypted each record is sealed and stored base64 encoded.
+type Journal struct {
+	path    string
+	file    *os.File
+	cipher  *StateCipher
+	seq     uint64
+	records int
+	valid   int64 // Bytes of the valid records the last call to Records read
+	mutex   sync.Mutex
+}
+
+// OpenJournal opens or creates the journal at path
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{path: path, file: file}, nil
+}
+
+// Append writes records to the journal and syncs them to disk
+func (j *Journal) Append(records ...JournalRecord) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	var buffer bytes.Buffer
+	for _, record := range records {
+		j.seq++
+		record.Seq = j.seq
+		if record.Time.IsZero() {
+			record.Time = time.Now()
+		}
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if j.cipher != nil {
+			sealed, err := j.cipher.Seal(data, nil)
+			if err != nil {
+				return err
+			}
+			data = []byte(base64.StdEncoding.EncodeToString(sealed))
+		}
+		fmt.Fprintf(&buffer, "%08x %s\n", crc32.ChecksumIEEE(data), data)
+	}
+
+	if _, err := j.file.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.records += len(records)
+	return nil
+}
+
+// Records returns the journal's valid records, stopping at the first corrupt
+// line. A last line without its newline is torn too: Append writes a record
+// and its newline at once and only acknowledges it once synced.
+func (j *Journal) Records() ([]JournalRecord, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	file, err := os.Open(j.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		records []JournalRecord
+		valid   int64
+	)
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return records, err
+		}
+		record, ok := j.parseLine(line[:len(line)-1])
+		if !ok {
+			break
+		}
+		records = append(records, record)
+		valid += int64(len(line))
+	}
+
+	j.valid = valid
+	j.records = len(records)
+	if len(records) > 0 {
+		j.seq = records[len(records)-1].Seq
+	}
+	return records, nil
+}
+
+// Repair cuts off what follows the valid records the last call to Records
+// read, so records appended after a torn write start on a line of their own
+// rather than being joined to it and lost with it on the next replay. It
+// returns whether anything was cut.
+func (j *Journal) Repair() (bool, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	info, err := j.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() <= j.valid {
+		return false, nil
+	}
+	if err := j.file.Truncate(j.valid); err != nil {
+		return false, err
+	}
+	return true, j.file.Sync()
+}
+
+// Len returns the number of records written since the last checkpoint
+func (j *Journal) Len() int {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.records
+}
+
+// Compact runs write, which must save every change recorded so far, and then
+// empties the journal. The journal stays locked throughout so that a record
+// appended concurrently is never truncated without being part of the snapshot.
+func (j *Journal) Compact(write func() error) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if err := write(); err != nil {
+		return err
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	j.records = 0
+	return j.file.Sync()
+}
+
+// SetCipher changes the cipher used for records appended from now on
+func (j *Journal) SetCipher(stateCipher *StateCipher) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.cipher = stateCipher
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.file.Close()
+}
+
+func (j *Journal) parseLine(line []byte) (JournalRecord, bool) {
+	var record JournalRecord
+	if len(line) < 10 || line[8] != ' ' {
+		return record, false
+	}
+
+	checksum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil || crc32.ChecksumIEEE(line[9:]) != uint32(checksum) {
+		return record, false
+	}
+
+	data := line[9:]
+	if data[0] != '{' {
+		// Sealed record, only readable with the database's cipher
+		if j.cipher == nil {
+			return record, false
+		}
+		sealed, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return record, false
+		}
+		if data, err = j.cipher.Open(sealed, nil); err != nil {
+			return record, false
+		}
+	}
+
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+// replayJournal applies the journal's records on top of the loaded snapshot
+func (server *Server) replayJournal() error {
+	server.logger.Enter("replayJournal")
+	defer server.logger.Exit("replayJournal")
+
+	records, err := server.journal.Records()
+	if err != nil {
+		server.logger.Failure("Failed to read journal: %v", err)
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	index := server.forest.Dedupe()
+	pendingChildren := make(map[string][]string)
+
+	for _, record := range records {
+		switch record.Op {
+		case journalPutNode:
+			node, childIDs, err := core.DecodeSnapshot(record.Node)
+			if err != nil {
+				return fmt.Errorf("journal record %d: %v", record.Seq, err)
+			}
+
+			if previous, exists := index[node.ID]; exists {
+				for parentID := range previous.Parents {
+					if parent, exists := index[parentID]; exists && parent.Children[node.ID] == previous {
+						delete(parent.Children, node.ID)
+					}
+				}
+			}
+			for parentID := range node.Parents {
+				if parent, exists := index[parentID]; exists {
+					parent.Children[node.ID] = node
+				}
+			}
+
+			index[node.ID] = node
+			pendingChildren[node.ID] = childIDs
+			if node.ID == server.forest.ID {
+				server.forest = node
+			}
+		case journalDeleteNode:
+			if previous, exists := index[record.NodeID]; exists {
+				for parentID := range previous.Parents {
+					if parent, exists := index[parentID]; exists {
+						delete(parent.Children, record.NodeID)
+					}
+				}
+				delete(index, record.NodeID)
+				delete(pendingChildren, record.NodeID)
+			}
+		default:
+			return fmt.Errorf("journal record %d: unknown operation %s", record.Seq, record.Op)
+		}
+	}
+
+	// Children are linked last since a parent may be recorded before its new child
+	for nodeID, childIDs := range pendingChildren {
+		node := index[nodeID]
+		for _, childID := range childIDs {
+			if child, exists := index[childID]; exists {
+				node.Children[childID] = child
+			}
+		}
+	}
+
+	server.logger.Info("Replayed %d journal records", len(records))
+	return nil
+}
+
+// persist records the changed nodes in the journal, compacting the journal
+// into the state file once it grows past the checkpoint threshold. The nodes
+// are reindexed for search along the way.
+func (server *Server) persist(nodes ...*core.Node) error {
+	if server.search != nil {
+		server.search.Update(nodes...)
+	}
+
+	records := make([]JournalRecord, 0, len(nodes))
+	for _, node := range nodes {
+		data, err := node.Snapshot()
+		if err != nil {
+			return err
+		}
+		records = append(records, JournalRecord{Op: journalPutNode, NodeID: node.ID, Node: data})
+	}
+	return server.appendJournal(records...)
+}
+
+// persistDelete records the removal of nodes along with the nodes they were detached from
+func (server *Server) persistDelete(removedIDs []string, nodes ...*core.Node) error {
+	if server.search != nil {
+		server.search.Remove(removedIDs...)
+		server.search.Update(nodes...)
+	}
+
+	records := make([]JournalRecord, 0, len(removedIDs)+len(nodes))
+	for _, nodeID := range removedIDs {
+		records = append(records, JournalRecord{Op: journalDeleteNode, NodeID: nodeID})
+	}
+	for _, node := range nodes {
+		data, err := node.Snapshot()
+		if err != nil {
+			return err
+		}
+		records = append(records, JournalRecord{Op: journalPutNode, NodeID: node.ID, Node: data})
+	}
+	return server.appendJournal(records...)
+}
+
+func (server *Server) appendJournal(records ...JournalRecord) error {
+	if server.journal == nil {
+		return server.writeChangesToFile(server.forest, server.dbFile())
+	}
+
+	if err := server.journal.Append(records...); err != nil {
+		server.logger.Failure("Failed to append to journal: %v", err)
+		return err
+	}
+
+	if server.journal.Len() >= server.checkpointRecords {
+		return server.checkpoint()
+	}
+	return nil
+}
+
+// checkpoint writes the full forest snapshot and truncates the journal
+func (server *Server) checkpoint() error {
+	server.logger.Enter("checkpoint")
+	defer server.logger.Exit("checkpoint")
+
+	if server.journal == nil {
+		return server.writeChangesToFile(server.forest, server.dbFile())
+	}
+	return server.journal.Compact(func() error {
+		return server.writeChangesToFile(server.forest, server.dbFile())
+	})
+}
+
+// openJournal opens the journal next to the state file and starts periodic compaction
+func (server *Server) openJournal() error {
+	journal, err := OpenJournal(server.dbFile() + ".journal")
+	if err != nil {
+		return err
+	}
+
+	journal.cipher = server.cipher
+	server.journal = journal
+	server.checkpointRecords = defaultCheckpointRecords
+	server.stopCheckpoints = make(chan struct{})
+	go server.checkpointLoop(defaultCheckpointInterval)
+	return nil
+}
+
+func (server *Server) checkpointLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if server.journal.Len() == 0 {
+				continue
+			}
+			if err := server.checkpoint(); err != nil {
+				server.logger.Failure("Periodic checkpoint failed: %v", err)
+			}
+		case <-server.stopCheckpoints:
+			return
+		}
+	}
+}
+
+// closeJournal stops periodic compaction, folds the journal into the state file and closes it
+func (server *Server) closeJournal() error {
+	if server.journal == nil {
+		return nil
+	}
+
+	close(server.stopCheckpoints)
+	if err := server.checkpoint(); err != nil {
+		return err
+	}
+	return server.journal.Close()
+}
@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/vaziolabs/lumberjack/types"
+)
+
+const (
+	sessionTokenType = "session"
+	refreshTokenType = "refresh"
+
+	defaultSessionExpiry = 1 * time.Hour
+	defaultRefreshExpiry = 7 * 24 * time.Hour
+	signingKeySize       = 32
+	signingKeyIDSize     = 8
+)
+
+// SigningKey is an HMAC key used to sign one type of token. Retired keys only
+// verify tokens, until the rotation window after their retirement has passed.
+type SigningKey struct {
+	ID        string     `json:"kid"`
+	Key       []byte     `json:"key"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+// KeyRing holds a database's session and refresh signing keys, newest first.
+// It is stored next to the state file and encrypted with the database secret.
+type KeyRing struct {
+	Session []SigningKey `json:"session"`
+	Refresh []SigningKey `json:"refresh"`
+
+	file    *sealedFile
+	version uint64 // Number of the last save, taken under the mutex
+	mutex   sync.RWMutex
+}
+
+// NewKeyRing generates a key ring with one session and one refresh key
+func NewKeyRing(path string, secret []byte) (*KeyRing, error) {
+	sessionKey, err := newSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	refreshKey, err := newSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	ring := &KeyRing{
+		Session: []SigningKey{sessionKey},
+		Refresh: []SigningKey{refreshKey},
+		file:    &sealedFile{path: path, secret: secret},
+	}
+	return ring, ring.Save()
+}
+
+// LoadKeyRing reads the key ring at path, generating a new one if it does not exist
+func LoadKeyRing(path string, secret []byte) (*KeyRing, error) {
+	file, data, err := readSealedFile(path, secret)
+	if os.IsNotExist(err) {
+		return NewKeyRing(path, secret)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing keys: %v", err)
+	}
+
+	ring := &KeyRing{file: file}
+	if err := json.Unmarshal(data, ring); err != nil {
+		return nil, fmt.Errorf("failed to parse signing keys: %v", err)
+	}
+	if len(ring.Session) == 0 || len(ring.Refresh) == 0 {
+		return nil, fmt.Errorf("signing key file %s has no active keys", path)
+	}
+	return ring, nil
+}
+
+// Save writes the key ring to disk, encrypting it when the database has a
+// secret. The ring is only locked while it is encoded, so token checks never
+// wait for the disk.
+func (ring *KeyRing) Save() error {
+	ring.mutex.Lock()
+	data, err := json.Marshal(ring)
+	ring.version++
+	version := ring.version
+	ring.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return ring.file.write(version, data)
+}
+
+// Rotate retires the current keys, generates new ones and drops retired keys
+// whose rotation window has passed. The key ring is saved afterwards.
+func (ring *KeyRing) Rotate(window time.Duration) error {
+	sessionKey, err := newSigningKey()
+	if err != nil {
+		return err
+	}
+	refreshKey, err := newSigningKey()
+	if err != nil {
+		return err
+	}
+
+	ring.mutex.Lock()
+	now := time.Now()
+	ring.Session = rotateKeys(ring.Session, sessionKey, now, window)
+	ring.Refresh = rotateKeys(ring.Refresh, refreshKey, now, window)
+	ring.mutex.Unlock()
+
+	return ring.Save()
+}
+
+// SetSecret changes the secret the key ring is encrypted with and saves it
+func (ring *KeyRing) SetSecret(secret []byte) error {
+	ring.file.setSecret(secret)
+	return ring.Save()
+}
+
+// Sign signs claims with the current key for tokenType, setting the kid header
+func (ring *KeyRing) Sign(tokenType string, claims jwt.Claims) (string, error) {
+	ring.mutex.RLock()
+	keys := ring.keys(tokenType)
+	if len(keys) == 0 {
+		ring.mutex.RUnlock()
+		return "", fmt.Errorf("no signing key for %s tokens", tokenType)
+	}
+	current := keys[0]
+	ring.mutex.RUnlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = current.ID
+	return token.SignedString(current.Key)
+}
+
+// Keyfunc returns a jwt.Keyfunc that picks the key for tokenType named by the
+// token's kid header, rejecting retired keys outside the rotation window.
+func (ring *KeyRing) Keyfunc(tokenType string, window time.Duration) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, fmt.Errorf("token has no kid header")
+		}
+
+		ring.mutex.RLock()
+		defer ring.mutex.RUnlock()
+
+		for _, key := range ring.keys(tokenType) {
+			if key.ID != kid {
+				continue
+			}
+			if key.RetiredAt != nil && time.Since(*key.RetiredAt) > window {
+				return nil, fmt.Errorf("signing key %s has expired", kid)
+			}
+			return key.Key, nil
+		}
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+}
+
+func (ring *KeyRing) keys(tokenType string) []SigningKey {
+	switch tokenType {
+	case sessionTokenType:
+		return ring.Session
+	case refreshTokenType:
+		return ring.Refresh
+	}
+	return nil
+}
+
+func rotateKeys(keys []SigningKey, next SigningKey, now time.Time, window time.Duration) []SigningKey {
+	rotated := []SigningKey{next}
+	for _, key := range keys {
+		if key.RetiredAt == nil {
+			retiredAt := now
+			key.RetiredAt = &retiredAt
+		}
+		if now.Sub(*key.RetiredAt) <= window {
+			rotated = append(rotated, key)
+		}
+	}
+	return rotated
+}
+
+func newSigningKey() (SigningKey, error) {
+	key := make([]byte, signingKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return SigningKey{}, err
+	}
+	id := make([]byte, signingKeyIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return SigningKey{}, err
+	}
+	return SigningKey{ID: hex.EncodeToString(id), Key: key, CreatedAt: time.Now()}, nil
+}
+
+// keyRingFile returns the path of the database's signing key file
+func keyRingFile(config types.ServerConfig) string {
+	return filepath.Join(config.Process.DatabasePath, config.Process.Name+".keys")
+}
+
+// newJWTConfig builds the token settings for a database around its key ring.
+// Retired keys stay valid for KeyRotationWindow, by default the refresh token
+// lifetime, so that no issued token is invalidated early by a rotation.
+func newJWTConfig(config types.ServerConfig, keys *KeyRing) (JWTConfig, error) {
+	jwtConfig := JWTConfig{
+		ExpiresIn:        defaultSessionExpiry,
+		RefreshExpiresIn: defaultRefreshExpiry,
+		RotationWindow:   defaultRefreshExpiry,
+		Keys:             keys,
+	}
+	if config.Process.KeyRotationWindow != "" {
+		window, err := time.ParseDuration(config.Process.KeyRotationWindow)
+		if err != nil {
+			return jwtConfig, fmt.Errorf("invalid key rotation window: %v", err)
+		}
+		jwtConfig.RotationWindow = window
+	}
+	return jwtConfig, nil
+}
+
+// RotateKeys rotates the signing keys of a stopped database. A running server
+// rotates its keys itself when it receives SIGHUP.
+func RotateKeys(config types.ServerConfig) error {
+	keys, err := LoadKeyRing(keyRingFile(config), config.Secret)
+	if err != nil {
+		return err
+	}
+	jwtConfig, err := newJWTConfig(config, keys)
+	if err != nil {
+		return err
+	}
+	return keys.Rotate(jwtConfig.RotationWindow)
+}
+
+// watchKeyRotation rotates the signing keys each time the process receives SIGHUP
+func (server *Server) watchKeyRotation() {
+	server.rotateSignal = make(chan os.Signal, 1)
+	signal.Notify(server.rotateSignal, syscall.SIGHUP)
+
+	go func() {
+		for range server.rotateSignal {
+			if err := server.jwtConfig.Keys.Rotate(server.jwtConfig.RotationWindow); err != nil {
+				server.logger.Failure("Failed to rotate signing keys: %v", err)
+				continue
+			}
+			server.logger.Info("Rotated signing keys")
+		}
+	}()
+}
+
+func (server *Server) stopKeyRotation() {
+	if server.rotateSignal != nil {
+		signal.Stop(server.rotateSignal)
+		close(server.rotateSignal)
+	}
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/vaziolabs/lumberjack/internal/core"
+)
+
+// Notification providers built in, see RegisterNotificationProvider
+const (
+	NotifierSlack      = "slack"      // Slack incoming webhooks
+	NotifierMattermost = "mattermost" // Mattermost incoming webhooks
+	NotifierJSON       = "json"       // Any endpoint taking the message and the change as JSON
+)
+
+const notifierTimeout = 10 * time.Second
+
+// notifierEvents are the change types notifiers send when none are given
+var notifierEvents = []string{ChangeEventStarted, ChangeEventEnded, ChangeEventOverdue}
+
+// defaultNotificationTemplates are the messages for changes whose notifier has
+// no template of its own. Other change types need a template to be sent.
+var defaultNotificationTemplates = map[string]string{
+	ChangeEventStarted: `Event {{.EventID}} started on {{.Path}}{{with .User}} by {{.}}{{end}}`,
+	ChangeEventEnded:   `Event {{.EventID}} ended on {{.Path}}{{with .User}} by {{.}}{{end}}`,
+	ChangeEventOverdue: `Event {{.EventID}} on {{.Path}} is overdue{{with .ScheduledAt}}, it was planned to end {{.Format "Jan 2 15:04 MST"}}{{end}}`,
+}
+
+// Notification is a message about a change, ready for a provider to format
+type Notification struct {
+	Text   string
+	Change Change
+}
+
+// NotificationData is what message templates are executed with
+type NotificationData struct {
+	Type        string
+	Path        string
+	NodeID      string
+	EventID     string
+	User        string // Username of who made the change, or their ID when not in the directory
+	Time        time.Time
+	ScheduledAt *time.Time // When a scheduled transition was due, the planned end of an overdue event
+	Data        map[string]interface{}
+}
+
+// NotificationProvider turns notifications into the request body a chat
+// service expects
+type NotificationProvider interface {
+	Payload(notifier core.Notifier, notification Notification) (interface{}, error)
+}
+
+// NotificationProviderFunc adapts a function to a NotificationProvider
+type NotificationProviderFunc func(notifier core.Notifier, notification Notification) (interface{}, error)
+
+// Payload calls the function
+func (f NotificationProviderFunc) Payload(notifier core.Notifier, notification Notification) (interface{}, error) {
+	return f(notifier, notification)
+}
+
+var notificationProviders = map[string]NotificationProvider{
+	NotifierSlack: NotificationProviderFunc(func(notifier core.Notifier, notification Notification) (interface{}, error) {
+		payload := map[string]interface{}{"text": notification.Text}
+		if notifier.Channel != "" {
+			payload["channel"] = notifier.Channel
+		}
+		if notifier.Username != "" {
+			payload["username"] = notifier.Username
+		}
+		return payload, nil
+	}),
+	NotifierMattermost: NotificationProviderFunc(func(notifier core.Notifier, notification Notification) (interface{}, error) {
+		payload := map[string]interface{}{
+			"text":  notification.Text,
+			"props": map[string]interface{}{"lumberjack": notification.Change},
+		}
+		if notifier.Channel != "" {
+			payload["channel"] = notifier.Channel
+		}
+		if notifier.Username != "" {
+			payload["username"] = notifier.Username
+		}
+		return payload, nil
+	}),
+	NotifierJSON: NotificationProviderFunc(func(notifier core.Notifier, notification Notification) (interface{}, error) {
+		return map[string]interface{}{
+			"text":   notification.Text,
+			"type":   notification.Change.Type,
+			"path":   notification.Change.Path,
+			"change": notification.Change,
+		}, nil
+	}),
+}
+
+// RegisterNotificationProvider adds a provider notifiers can name, or replaces
+// a built in one. Call it before the server starts.
+func RegisterNotificationProvider(name string, provider NotificationProvider) {
+	notificationProviders[name] = provider
+}
+
+// notifierWindow holds what a notifier sent in the last minute
+type notifierWindow struct {
+	sent       []time.Time
+	suppressed int // Skipped since the last message went out
+}
+
+func (server *Server) initNotifiers() {
+	server.notifierClient = &http.Client{Timeout: notifierTimeout}
+	server.notifierWindows = make(map[string]*notifierWindow)
+}
+
+// validateNotifier checks what core cannot: the provider and the change types
+// the notifier can send a message for
+func validateNotifier(notifier core.Notifier) error {
+	if _, exists := notificationProviders[notifier.Provider]; !exists {
+		return fmt.Errorf("%w: unknown provider %q", core.ErrInvalidNotifier, notifier.Provider)
+	}
+	for _, event := range notifier.Events {
+		known := false
+		for _, changeType := range changeTypes {
+			known = known || event == changeType
+		}
+		if !known {
+			return fmt.Errorf("%w: unknown event type %q", core.ErrInvalidNotifier, event)
+		}
+		if _, templated := notifier.Templates[event]; !templated && defaultNotificationTemplates[event] == "" {
+			return fmt.Errorf("%w: %s needs a template", core.ErrInvalidNotifier, event)
+		}
+	}
+	return nil
+}
+
+// dispatchNotifications queues a message for every notifier registered on the
+// change's node or above it that wants its type and is within its rate limit
+func (server *Server) dispatchNotifications(change Change) {
+	if change.node == nil || server.notifierWindows == nil {
+		return
+	}
+
+	for _, node := range change.node.Lineage() {
+		for _, notifier := range node.ListNotifiers() {
+			if !notifier.Wants(change.Type) || !change.node.CheckPermission(notifier.CreatedBy, core.ReadPermission) {
+				continue
+			}
+			allowed, suppressed := server.allowNotification(notifier, change.Time)
+			if !allowed {
+				continue
+			}
+
+			notifier := notifier
+			request := APIRequest{
+				Type: "NOTIFY",
+				Path: node.ID,
+				Callback: func(*core.Node) interface{} {
+					if err := server.sendNotification(notifier, change, suppressed); err != nil {
+						server.logger.Warn("Notifier %s failed to send %s: %v", notifier.ID, change.Type, err)
+					}
+					return nil
+				},
+			}
+			select {
+			case server.apiQueue.queue <- request:
+			default:
+				server.logger.Warn("Notifier %s skipped %s, the queue is full", notifier.ID, change.Type)
+			}
+		}
+	}
+}
+
+// allowNotification records a message for the notifier when it is within its
+// rate limit, returning how many were skipped since the last one went out
+func (server *Server) allowNotification(notifier core.Notifier, now time.Time) (bool, int) {
+	server.notifierMutex.Lock()
+	defer server.notifierMutex.Unlock()
+
+	window := server.notifierWindows[notifier.ID]
+	if window == nil {
+		window = &notifierWindow{}
+		server.notifierWindows[notifier.ID] = window
+	}
+	recent := window.sent[:0]
+	for _, sent := range window.sent {
+		if now.Sub(sent) < time.Minute {
+			recent = append(recent, sent)
+		}
+	}
+	window.sent = recent
+
+	if len(window.sent) >= notifier.MessagesPerMinute() {
+		window.suppressed++
+		return false, 0
+	}
+	window.sent = append(window.sent, now)
+	suppressed := window.suppressed
+	window.suppressed = 0
+	return true, suppressed
+}
+
+// sendNotification renders the message for the change and posts it
+func (server *Server) sendNotification(notifier core.Notifier, change Change, suppressed int) error {
+	text, err := server.renderNotification(notifier, change)
+	if err != nil {
+		return err
+	}
+	if suppressed > 0 {
+		text += fmt.Sprintf("\n(%d earlier notifications were skipped by the rate limit)", suppressed)
+	}
+	_, err = server.postNotification(notifier, Notification{Text: text, Change: change})
+	return err
+}
+
+func (server *Server) renderNotification(notifier core.Notifier, change Change) (string, error) {
+	text, exists := notifier.Templates[change.Type]
+	if !exists {
+		text = defaultNotificationTemplates[change.Type]
+	}
+	tmpl, err := template.New(change.Type).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	data := NotificationData{
+		Type:   change.Type,
+		Path:   change.Path,
+		NodeID: change.NodeID,
+		User:   change.UserID,
+		Time:   change.Time,
+		Data:   change.Data,
+	}
+	data.EventID, _ = change.Data["event_id"].(string)
+	if scheduledAt, ok := change.Data["scheduled_at"].(time.Time); ok {
+		data.ScheduledAt = &scheduledAt
+	}
+	if user, err := server.forest.Directory.Get(change.UserID); err == nil {
+		data.User = user.Username
+	}
+
+	var message strings.Builder
+	if err := tmpl.Execute(&message, data); err != nil {
+		return "", err
+	}
+	return message.String(), nil
+}
+
+// postNotification sends the notification in the notifier's format,
+// returning the status the service answered with
+func (server *Server) postNotification(notifier core.Notifier, notification Notification) (int, error) {
+	provider, exists := notificationProviders[notifier.Provider]
+	if !exists {
+		return 0, fmt.Errorf("unknown provider %q", notifier.Provider)
+	}
+	payload, err := provider.Payload(notifier, notification)
+	if err != nil {
+		return 0, err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := server.notifierClient.Post(notifier.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("service answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// findNotifier returns the notifier with the given ID and the node it is registered on
+func (server *Server) findNotifier(notifierID string) (*core.Node, core.Notifier, error) {
+	for _, node := range server.forest.Index() {
+		if notifier, err := node.GetNotifier(notifierID); err == nil {
+			return node, notifier, nil
+		}
+	}
+	return nil, core.Notifier{}, fmt.Errorf("%w: %s", core.ErrNotifierNotFound, notifierID)
+}
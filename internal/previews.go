@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/vaziolabs/lumberjack/internal/core"
+)
+
+// maxPreviewJobs caps the thumbnails and previews queued or being made at
+// once, leaving the other API queue workers free for requests
+const maxPreviewJobs = 2
+
+// previewSuffixes returns the derived files made for an attachment's type
+func previewSuffixes(attachment core.Attachment) []string {
+	var suffixes []string
+	if core.CanThumbnail(attachment.Type) {
+		suffixes = append(suffixes, thumbnailSuffix)
+	}
+	if core.PreviewKind(attachment.Type) != "" {
+		suffixes = append(suffixes, previewSuffix)
+	}
+	return suffixes
+}
+
+// queuePreviews has the API queue workers make the thumbnail or preview an
+// attachment's type has. Being keyed by the contents' hash, they are made
+// once for every attachment with the same contents.
+func (server *Server) queuePreviews(attachment core.Attachment) {
+	for _, suffix := range previewSuffixes(attachment) {
+		server.queuePreview(attachment, suffix)
+	}
+}
+
+// queuePreview queues one derived file unless it is queued already, could
+// not be made before, or maxPreviewJobs are queued. Asking for it again
+// queues it once one of those is done.
+func (server *Server) queuePreview(attachment core.Attachment, suffix string) {
+	key := attachment.Hash + suffix
+	server.previewMutex.Lock()
+	_, failed := server.previewFailed[key]
+	if server.previewPending[key] || failed || len(server.previewPending) >= maxPreviewJobs {
+		server.previewMutex.Unlock()
+		return
+	}
+	server.previewPending[key] = true
+	server.previewMutex.Unlock()
+
+	request := APIRequest{
+		Type: "PROCESS_ATTACHMENT",
+		Path: attachment.Hash,
+		Callback: func(*core.Node) interface{} {
+			err := server.makePreview(attachment, suffix)
+			server.previewMutex.Lock()
+			delete(server.previewPending, key)
+			if errors.Is(err, core.ErrNotPreviewable) {
+				// Only failures trying again cannot fix are kept
+				server.previewFailed[key] = err.Error()
+			}
+			server.previewMutex.Unlock()
+			if err != nil {
+				server.logger.Warn("Failed to make %s of attachment %s: %v", suffix[1:], attachment.ID, err)
+			}
+			return nil
+		},
+	}
+	select {
+	case server.apiQueue.queue <- request:
+	default:
+		// Asking for it again queues it once there is room
+		server.previewMutex.Lock()
+		delete(server.previewPending, key)
+		server.previewMutex.Unlock()
+		server.logger.Warn("Skipped %s of attachment %s, the queue is full", suffix[1:], attachment.ID)
+	}
+}
+
+// makePreview makes and stores a thumbnail or preview
+func (server *Server) makePreview(attachment core.Attachment, suffix string) error {
+	if _, err := server.blobs.ReadDerived(attachment.Hash, suffix); err == nil {
+		return nil
+	}
+
+	var derived []byte
+	var err error
+	switch suffix {
+	case thumbnailSuffix:
+		var data []byte
+		if data, err = server.attachmentData(&attachment); err == nil {
+			derived, err = core.MakeThumbnail(data)
+		}
+	case previewSuffix:
+		// Previews keep the start of the file, so only that much is read
+		var contents io.ReadCloser
+		if contents, err = server.openAttachment(&attachment); err == nil {
+			var preview *core.Preview
+			if preview, err = core.ReadPreview(contents, attachment.Type); err == nil {
+				derived, err = json.Marshal(preview)
+			}
+			contents.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return server.blobs.WriteDerived(attachment.Hash, suffix, derived)
+}
+
+// requestAttachment returns the attachment a request names, on the node or,
+// with event_id and entry_index, on one of its event entries
+func requestAttachment(node *core.Node, r *http.Request) (*core.Attachment, error) {
+	attachmentID := mux.Vars(r)["id"]
+	query := r.URL.Query()
+	if eventID := query.Get("event_id"); eventID != "" {
+		index, err := strconv.Atoi(query.Get("entry_index"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry index: %q", query.Get("entry_index"))
+		}
+		return node.GetEntryAttachment(eventID, index, attachmentID)
+	}
+	return node.GetAttachment(attachmentID)
+}
+
+// handleGetThumbnail answers with a PNG thumbnail of an image attachment
+func (server *Server) handleGetThumbnail(w http.ResponseWriter, r *http.Request) {
+	server.serveDerived(w, r, thumbnailSuffix)
+}
+
+// handleGetPreview answers with the start of a text, JSON or CSV attachment
+func (server *Server) handleGetPreview(w http.ResponseWriter, r *http.Request) {
+	server.serveDerived(w, r, previewSuffix)
+}
+
+// serveDerived answers with a thumbnail or preview once it is made. Until
+// then it answers 202 and makes sure it is queued.
+func (server *Server) serveDerived(w http.ResponseWriter, r *http.Request, suffix string) {
+	userID := r.Context().Value("user_id").(string)
+	node, err := server.getNodeFromPath(r.URL.Query().Get("path"))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	if !node.CheckPermission(userID, core.ReadPermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	attachment, err := requestAttachment(node, r)
+	if err != nil {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	supported := false
+	for _, made := range previewSuffixes(*attachment) {
+		supported = supported || made == suffix
+	}
+	if !supported {
+		http.Error(w, fmt.Sprintf("No %s for %s attachments", suffix[1:], attachment.Type), http.StatusNotFound)
+		return
+	}
+
+	derived, err := server.blobs.ReadDerived(attachment.Hash, suffix)
+	if os.IsNotExist(err) {
+		server.previewMutex.Lock()
+		reason, failed := server.previewFailed[attachment.Hash+suffix]
+		server.previewMutex.Unlock()
+		if failed {
+			http.Error(w, fmt.Sprintf("Could not make %s: %s", suffix[1:], reason), http.StatusUnprocessableEntity)
+			return
+		}
+		server.queuePreview(*attachment, suffix)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"status": "pending"})
+		return
+	}
+	if err != nil {
+		server.logger.Failure("Failed to read %s of attachment %s: %v", suffix[1:], attachment.ID, err)
+		http.Error(w, "Failed to read "+suffix[1:], http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "application/json"
+	if suffix == thumbnailSuffix {
+		contentType = "image/png"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", `"`+attachment.Hash+suffix+`"`)
+	http.ServeContent(w, r, "", attachment.UploadedAt, bytes.NewReader(derived))
+}
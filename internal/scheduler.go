@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/vaziolabs/lumberjack/internal/core"
+)
+
+const defaultSchedulerInterval = 30 * time.Second
+
+// runSchedule applies every event transition due at now across the forest,
+// materialises upcoming occurrences, persists the nodes that changed and
+// publishes the transitions on the change feed, along with the events that
+// became overdue. Only the transitions are counted.
+func (server *Server) runSchedule(now time.Time) (int, error) {
+	autoFinish := server.config.Process.AutoFinishEvents
+
+	transitions := make(map[*core.Node][]core.ScheduledTransition)
+	count := 0
+	var changed []*core.Node
+	server.forest.Walk("", func(node *core.Node, _ string) {
+		applied := node.RunSchedule(now, autoFinish)
+		overdue := node.MarkOverdue(now, autoFinish)
+		added := node.MaterializeOccurrences(now, now.Add(core.RecurrenceHorizon))
+		if len(applied)+len(overdue)+added > 0 {
+			transitions[node] = append(applied, overdue...)
+			count += len(applied)
+			changed = append(changed, node)
+		}
+	})
+
+	if len(changed) == 0 {
+		return 0, nil
+	}
+	if err := server.persist(changed...); err != nil {
+		return count, err
+	}
+
+	for _, node := range changed {
+		for _, transition := range transitions[node] {
+			changeType := ChangeEventStarted
+			switch transition.Activity {
+			case core.ActivityEventFinished:
+				changeType = ChangeEventEnded
+			case core.ActivityEventOverdue:
+				changeType = ChangeEventOverdue
+			}
+			server.publish(changeType, node, core.SchedulerUserID, map[string]interface{}{
+				"event_id":     transition.EventID,
+				"scheduled_at": transition.At,
+			})
+		}
+	}
+	return count, nil
+}
+
+// startScheduler catches up on the transitions missed while the server was
+// down, then keeps applying them every interval until stopScheduler is called
+func (server *Server) startScheduler(interval time.Duration) {
+	server.stopSchedule = make(chan struct{})
+
+	server.scheduleTick(time.Now())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				server.scheduleTick(now)
+			case <-server.stopSchedule:
+				return
+			}
+		}
+	}()
+}
+
+func (server *Server) scheduleTick(now time.Time) {
+	transitions, err := server.runSchedule(now)
+	if err != nil {
+		server.logger.Failure("Scheduler failed to persist transitions: %v", err)
+		return
+	}
+	if transitions > 0 {
+		server.logger.Info("Scheduler applied %d event transitions", transitions)
+	}
+}
+
+func (server *Server) stopScheduler() {
+	if server.stopSchedule != nil {
+		close(server.stopSchedule)
+		server.stopSchedule = nil
+	}
+}
@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vaziolabs/lumberjack/types"
+)
+
+// errRefreshTokenReuse is returned when a refresh token that was already
+// exchanged is presented again, which means the token was copied
+var errRefreshTokenReuse = errors.New("refresh token reuse detected")
+
+// RefreshSession tracks one login. Its refresh token is replaced on every
+// refresh and only the latest token ID is accepted.
+type RefreshSession struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Device     string     `json:"device"`
+	TokenID    string     `json:"token_id"`
+	IssuedAt   time.Time  `json:"issued_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the session can still be refreshed
+func (session *RefreshSession) Active() bool {
+	return session.RevokedAt == nil && time.Now().Before(session.ExpiresAt)
+}
+
+// SessionStore holds the refresh sessions of a database. It is stored next to
+// the state file and encrypted with the database secret.
+type SessionStore struct {
+	Sessions map[string]*RefreshSession `json:"sessions"`
+
+	file    *sealedFile
+	version uint64 // Number of the last save, taken under the mutex
+	mutex   sync.RWMutex
+}
+
+// NewSessionStore creates an empty session store at path
+func NewSessionStore(path string, secret []byte) (*SessionStore, error) {
+	store := &SessionStore{
+		Sessions: make(map[string]*RefreshSession),
+		file:     &sealedFile{path: path, secret: secret},
+	}
+	return store, store.Save()
+}
+
+// LoadSessionStore reads the session store at path, creating it if it does not exist
+func LoadSessionStore(path string, secret []byte) (*SessionStore, error) {
+	file, data, err := readSealedFile(path, secret)
+	if os.IsNotExist(err) {
+		return NewSessionStore(path, secret)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sessions: %v", err)
+	}
+
+	store := &SessionStore{file: file}
+	if err := json.Unmarshal(data, store); err != nil {
+		return nil, fmt.Errorf("failed to parse sessions: %v", err)
+	}
+	if store.Sessions == nil {
+		store.Sessions = make(map[string]*RefreshSession)
+	}
+	return store, nil
+}
+
+// Save drops expired sessions and writes the store to disk. The store is
+// only locked while it is encoded, so requests checking sessions never wait
+// for the disk.
+func (store *SessionStore) Save() error {
+	store.mutex.Lock()
+	now := time.Now()
+	for id, session := range store.Sessions {
+		if now.After(session.ExpiresAt) {
+			delete(store.Sessions, id)
+		}
+	}
+	data, err := json.Marshal(store)
+	store.version++
+	version := store.version
+	store.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return store.file.write(version, data)
+}
+
+// SetSecret changes the secret the store is encrypted with and saves it
+func (store *SessionStore) SetSecret(secret []byte) error {
+	store.file.setSecret(secret)
+	return store.Save()
+}
+
+// Create starts a new session for userID
+func (store *SessionStore) Create(userID string, device string, lifetime time.Duration) (RefreshSession, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return RefreshSession{}, err
+	}
+	tokenID, err := newTokenID()
+	if err != nil {
+		return RefreshSession{}, err
+	}
+
+	now := time.Now()
+	session := &RefreshSession{
+		ID:         id,
+		UserID:     userID,
+		Device:     device,
+		TokenID:    tokenID,
+		IssuedAt:   now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(lifetime),
+	}
+
+	store.mutex.Lock()
+	store.Sessions[id] = session
+	store.mutex.Unlock()
+	return *session, store.Save()
+}
+
+// Rotate exchanges the refresh token tokenID of a session for a new one. A
+// token that was already exchanged revokes the whole session.
+func (store *SessionStore) Rotate(sessionID string, tokenID string, lifetime time.Duration) (RefreshSession, error) {
+	newID, err := newTokenID()
+	if err != nil {
+		return RefreshSession{}, err
+	}
+
+	store.mutex.Lock()
+	session, exists := store.Sessions[sessionID]
+	if !exists || !session.Active() {
+		store.mutex.Unlock()
+		return RefreshSession{}, fmt.Errorf("session %s is not active", sessionID)
+	}
+
+	now := time.Now()
+	if session.TokenID != tokenID {
+		session.RevokedAt = &now
+		store.mutex.Unlock()
+		if err := store.Save(); err != nil {
+			return RefreshSession{}, err
+		}
+		return RefreshSession{}, errRefreshTokenReuse
+	}
+
+	session.TokenID = newID
+	session.LastUsedAt = now
+	session.ExpiresAt = now.Add(lifetime)
+	rotated := *session
+	store.mutex.Unlock()
+	return rotated, store.Save()
+}
+
+// Revoke ends a session of userID, returning false if it does not exist
+func (store *SessionStore) Revoke(userID string, sessionID string) (bool, error) {
+	store.mutex.Lock()
+	session, exists := store.Sessions[sessionID]
+	if !exists || session.UserID != userID || session.RevokedAt != nil {
+		store.mutex.Unlock()
+		return false, nil
+	}
+	now := time.Now()
+	session.RevokedAt = &now
+	store.mutex.Unlock()
+	return true, store.Save()
+}
+
+// RevokeUser ends every active session of userID and returns how many were revoked
+func (store *SessionStore) RevokeUser(userID string) (int, error) {
+	store.mutex.Lock()
+	now := time.Now()
+	revoked := 0
+	for _, session := range store.Sessions {
+		if session.UserID == userID && session.Active() {
+			session.RevokedAt = &now
+			revoked++
+		}
+	}
+	store.mutex.Unlock()
+
+	if revoked == 0 {
+		return 0, nil
+	}
+	return revoked, store.Save()
+}
+
+// IsActive reports whether the session exists and has not been revoked or expired
+func (store *SessionStore) IsActive(sessionID string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	session, exists := store.Sessions[sessionID]
+	return exists && session.Active()
+}
+
+// List returns the active sessions of userID, most recently used first
+func (store *SessionStore) List(userID string) []RefreshSession {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var sessions []RefreshSession
+	for _, session := range store.Sessions {
+		if session.UserID == userID && session.Active() {
+			sessions = append(sessions, *session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions
+}
+
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// sessionsFile returns the path of the database's session store
+func sessionsFile(config types.ServerConfig) string {
+	return filepath.Join(config.Process.DatabasePath, config.Process.Name+".sessions")
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -11,10 +12,10 @@ import (
 
 // JWTConfig holds JWT configuration
 type JWTConfig struct {
-	SessionKey []byte
-	RefreshKey []byte
-	ExpiresIn  time.Duration
-	SecretKey  []byte
+	ExpiresIn        time.Duration // Session token lifetime
+	RefreshExpiresIn time.Duration // Refresh token lifetime
+	RotationWindow   time.Duration // How long retired keys keep validating tokens
+	Keys             *KeyRing
 }
 
 type LogEntry struct {
@@ -68,7 +69,41 @@ type Server struct {
 	jwtConfig JWTConfig
 	logger    types.Logger
 	server    *http.Server
+	stopOnce  sync.Once // Shutdown runs once
 	config    types.ServerConfig
 	logCache  *LogCache
 	lastHash  []byte
+
+	secret       []byte
+	cipher       *StateCipher
+	blobs        *BlobStore
+	uploads      map[string]*uploadSession // Resumable uploads in progress, by ID
+	uploadMutex  sync.Mutex
+	rotateSignal chan os.Signal
+	sessions     *SessionStore
+
+	previewPending map[string]bool   // Thumbnails and previews queued, by hash and suffix
+	previewFailed  map[string]string // Why making one failed, by hash and suffix
+	previewMutex   sync.Mutex
+
+	journal           *Journal
+	checkpointRecords int
+	stopCheckpoints   chan struct{}
+
+	search  *core.SearchIndex
+	changes *ChangeFeed
+
+	webhookClient   *http.Client
+	webhookBackoff  time.Duration // Wait before the second attempt, doubled for each one after
+	webhookMutex    sync.Mutex
+	webhookPending  map[*webhookJob]*time.Timer // Deliveries queued or waiting to retry, nil timer when queued
+	webhooksStopped bool
+
+	notifierClient  *http.Client
+	notifierMutex   sync.Mutex
+	notifierWindows map[string]*notifierWindow // Recent messages by notifier ID, for rate limiting
+
+	stopSchedule chan struct{}
+	timers       sync.Mutex // Held while starting, stopping or editing timers so users run one at a time
+	structure    sync.Mutex // Held while nodes are created, renamed, moved or deleted so sibling names stay unique
 }
@@ -0,0 +1,528 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vaziolabs/lumberjack/internal/core"
+)
+
+const (
+	// uploadTTL is how long an upload session waits for its next chunk
+	uploadTTL = 24 * time.Hour
+	// uploadRecordSize is the most an encrypted database seals in one record
+	// of a partial upload
+	uploadRecordSize = 1 << 20
+	// maxMultipartOverhead allows for the form around a file in a multipart upload
+	maxMultipartOverhead = 1 << 20
+	// maxUploadSessions is the most uploads a user may have open at once
+	maxUploadSessions = 16
+)
+
+// uploadSession is a file uploaded in chunks, in the manner of the tus
+// protocol: each chunk is sent with the offset it starts at, so an
+// interrupted upload resumes from the offset the server reports. Chunks go
+// to a partial file beside the blobs, sealed when the database is encrypted,
+// and the file becomes an attachment once the last byte arrives.
+type uploadSession struct {
+	ID         string    `json:"id"`
+	Path       string    `json:"path"`
+	NodeID     string    `json:"node_id"`
+	EventID    string    `json:"event_id,omitempty"`
+	EntryIndex *int      `json:"entry_index,omitempty"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type,omitempty"`
+	Size       int64     `json:"size"`
+	Offset     int64     `json:"offset"`
+	ExpiresAt  time.Time `json:"expires_at"`
+
+	userID string
+	file   string
+	cipher *StateCipher // Seals the chunks of encrypted databases
+	mutex  sync.Mutex   // Held while a chunk is written
+	ended  bool         // Completed or cancelled while a request waited on the mutex
+}
+
+type createUploadRequest struct {
+	Path       string `json:"path"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Size       int64  `json:"size"`
+	EventID    string `json:"event_id,omitempty"`
+	EntryIndex *int   `json:"entry_index,omitempty"`
+}
+
+// uploadsDir holds partial uploads. Loading the database clears it along
+// with unreferenced blobs, so sessions do not outlive the server.
+func (store *BlobStore) uploadsDir() string {
+	return filepath.Join(store.dir, "uploads")
+}
+
+// session returns the caller's upload session, dropping expired ones
+func (server *Server) session(uploadID string, userID string) (*uploadSession, bool) {
+	server.uploadMutex.Lock()
+	defer server.uploadMutex.Unlock()
+
+	now := time.Now()
+	for id, session := range server.uploads {
+		if !session.mutex.TryLock() {
+			continue // Busy with a chunk, so not expired
+		}
+		if now.After(session.ExpiresAt) {
+			os.Remove(session.file)
+			delete(server.uploads, id)
+		}
+		session.mutex.Unlock()
+	}
+	session, exists := server.uploads[uploadID]
+	return session, exists && session.userID == userID
+}
+
+// newUploadID returns a random ID for an upload session, which is all a
+// request needs to address it
+func newUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return "upload-" + hex.EncodeToString(id), nil
+}
+
+// endSession drops an upload and its partial file. The session's mutex must be held.
+func (server *Server) endSession(session *uploadSession) {
+	session.ended = true
+	server.uploadMutex.Lock()
+	delete(server.uploads, session.ID)
+	server.uploadMutex.Unlock()
+	os.Remove(session.file)
+}
+
+// handleCreateUpload starts a resumable upload to a node or an event entry
+func (server *Server) handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	var req createUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || req.Size < 0 {
+		http.Error(w, "An upload needs a name and a size", http.StatusBadRequest)
+		return
+	}
+
+	node, err := server.getNodeFromPath(req.Path)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	if !node.CheckPermission(userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	if req.EventID != "" {
+		if req.EntryIndex == nil {
+			http.Error(w, "An entry upload needs an entry_index", http.StatusBadRequest)
+			return
+		}
+		entries, err := node.GetEventEntries(req.EventID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if *req.EntryIndex < 0 || *req.EntryIndex >= len(entries) {
+			http.Error(w, "Invalid entry index", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Types are checked now when given and again once the contents can be sniffed
+	checkType := req.Type
+	if checkType == "application/octet-stream" {
+		checkType = ""
+	}
+	if err := server.attachmentLimits().Check(req.Size, checkType); err != nil {
+		writeAttachmentError(w, err)
+		return
+	}
+
+	// Gone from the tree since it was resolved
+	paths := server.forest.Paths(node.ID)
+	if len(paths) == 0 {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+
+	uploadID, err := newUploadID()
+	if err != nil {
+		server.logger.Failure("Failed to create upload ID: %v", err)
+		http.Error(w, "Failed to start upload", http.StatusInternalServerError)
+		return
+	}
+	session := &uploadSession{
+		ID:         uploadID,
+		Path:       paths[0],
+		NodeID:     node.ID,
+		EventID:    req.EventID,
+		EntryIndex: req.EntryIndex,
+		Name:       req.Name,
+		Type:       req.Type,
+		Size:       req.Size,
+		ExpiresAt:  time.Now().Add(uploadTTL),
+		userID:     userID,
+	}
+	if session.cipher, err = server.blobs.uploadCipher(); err != nil {
+		server.logger.Failure("Failed to set up upload encryption: %v", err)
+		http.Error(w, "Failed to start upload", http.StatusInternalServerError)
+		return
+	}
+	dir := server.blobs.uploadsDir()
+	session.file = filepath.Join(dir, session.ID)
+
+	// Each open session holds a partial file, so users get a limited number
+	server.uploadMutex.Lock()
+	open := 0
+	for _, other := range server.uploads {
+		if other.userID == userID && time.Now().Before(other.ExpiresAt) {
+			open++
+		}
+	}
+	if open >= maxUploadSessions {
+		server.uploadMutex.Unlock()
+		http.Error(w, "Too many uploads in progress", http.StatusTooManyRequests)
+		return
+	}
+	server.uploads[session.ID] = session
+	server.uploadMutex.Unlock()
+
+	if err := os.MkdirAll(dir, 0700); err == nil {
+		err = os.WriteFile(session.file, nil, 0600)
+	}
+	if err != nil {
+		server.uploadMutex.Lock()
+		delete(server.uploads, session.ID)
+		server.uploadMutex.Unlock()
+		server.logger.Failure("Failed to create upload: %v", err)
+		http.Error(w, "Failed to start upload", http.StatusInternalServerError)
+		return
+	}
+
+	// An empty file has nothing to wait for
+	if session.Size == 0 {
+		session.mutex.Lock()
+		defer session.mutex.Unlock()
+		server.completeUpload(w, session)
+		return
+	}
+
+	w.Header().Set("Location", "/attachments/uploads/"+session.ID)
+	w.Header().Set("Upload-Offset", "0")
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Size, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session)
+}
+
+// handleGetUpload reports how much of an upload has arrived, for resuming
+// it. HEAD answers with the headers alone.
+func (server *Server) handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	session, exists := server.session(mux.Vars(r)["id"], userID)
+	if !exists {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.ended {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// handleAppendUpload adds the chunk in the body at the offset in the
+// Upload-Offset header, which must be how much has arrived so far. The
+// upload becomes an attachment with its last chunk.
+func (server *Server) handleAppendUpload(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	session, exists := server.session(mux.Vars(r)["id"], userID)
+	if !exists {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid or missing Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.ended {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if offset != session.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		http.Error(w, fmt.Sprintf("Upload is at offset %d", session.Offset), http.StatusConflict)
+		return
+	}
+	if r.ContentLength > session.Size-session.Offset {
+		http.Error(w, "Chunk goes past the upload's size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// What arrives before the client goes away is kept, so it can resume
+	body := http.MaxBytesReader(w, r.Body, session.Size-session.Offset)
+	written, err := session.append(body)
+	session.Offset += written
+	session.ExpiresAt = time.Now().Add(uploadTTL)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) && session.Offset == session.Size {
+		err = nil // The rest of the body is not needed
+	}
+	if err != nil {
+		server.logger.Warn("Upload %s stopped at %d bytes: %v", session.ID, session.Offset, err)
+		http.Error(w, "Failed to write chunk", http.StatusInternalServerError)
+		return
+	}
+
+	if session.Offset < session.Size {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	server.completeUpload(w, session)
+}
+
+// handleCancelUpload abandons an upload
+func (server *Server) handleCancelUpload(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	session, exists := server.session(mux.Vars(r)["id"], userID)
+	if !exists {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if !session.ended {
+		server.endSession(session)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload stores a finished upload and attaches it. The session's
+// mutex must be held.
+func (server *Server) completeUpload(w http.ResponseWriter, session *uploadSession) {
+	defer server.endSession(session)
+
+	// The node may have been removed since the upload started
+	node, err := server.getNodeFromPath(core.IDPath(session.NodeID))
+	if err != nil {
+		http.Error(w, "The upload's node no longer exists", http.StatusGone)
+		return
+	}
+	if !node.CheckPermission(session.userID, core.WritePermission) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	contents, err := session.open()
+	if err != nil {
+		server.logger.Failure("Failed to read upload %s: %v", session.ID, err)
+		http.Error(w, "Failed to read upload", http.StatusInternalServerError)
+		return
+	}
+	defer contents.Close()
+	attachment, err := core.NewAttachmentStore(server.blobs, server.attachmentLimits()).
+		StoreReader(contents, session.Name, session.Type, session.userID)
+	if err != nil {
+		writeAttachmentError(w, err)
+		return
+	}
+
+	changeData := map[string]interface{}{"name": attachment.Name}
+	if session.EventID != "" {
+		err = node.AddEntryAttachment(session.EventID, *session.EntryIndex, attachment, session.userID)
+		changeData["event_id"] = session.EventID
+		changeData["entry_index"] = *session.EntryIndex
+	} else {
+		attachment.ID = fmt.Sprintf("att-%d", time.Now().UnixNano())
+		err = node.AddAttachment(attachment, session.userID)
+	}
+	if err != nil {
+		server.blobs.Release(attachment.Hash)
+		http.Error(w, fmt.Sprintf("Failed to add attachment: %v", err), http.StatusInternalServerError)
+		return
+	}
+	changeData["attachment_id"] = attachment.ID
+
+	if err := server.persist(node); err != nil {
+		http.Error(w, "Failed to save state", http.StatusInternalServerError)
+		return
+	}
+	server.publish(ChangeAttachmentAdded, node, session.userID, changeData)
+	server.queuePreviews(*attachment)
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// uploadCipher returns the cipher partial uploads are sealed with, nil when
+// the store is not encrypted
+func (store *BlobStore) uploadCipher() (*StateCipher, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.sealer()
+}
+
+// additional binds a sealed record to its upload and place in it
+func (session *uploadSession) additional(offset int64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(session.ID), uint64(offset))
+}
+
+// append writes what r holds to the partial file, returning how much it wrote
+func (session *uploadSession) append(r io.Reader) (int64, error) {
+	file, err := os.OpenFile(session.file, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if session.cipher == nil {
+		return io.Copy(file, r)
+	}
+
+	written := int64(0)
+	buffer := make([]byte, uploadRecordSize)
+	for {
+		n, readErr := io.ReadFull(r, buffer)
+		if n > 0 {
+			sealed, err := session.cipher.Seal(buffer[:n], session.additional(session.Offset+written))
+			if err != nil {
+				return written, err
+			}
+			record := binary.BigEndian.AppendUint32(nil, uint32(len(sealed)))
+			if _, err := file.Write(append(record, sealed...)); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+// open reads the partial file back as the uploaded contents
+func (session *uploadSession) open() (io.ReadCloser, error) {
+	file, err := os.Open(session.file)
+	if err != nil {
+		return nil, err
+	}
+	if session.cipher == nil {
+		return file, nil
+	}
+	return &uploadReader{file: file, session: session}, nil
+}
+
+// uploadReader opens the sealed records of a partial upload in turn
+type uploadReader struct {
+	file    *os.File
+	session *uploadSession
+	offset  int64
+	pending []byte
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	for len(u.pending) == 0 {
+		var length [4]byte
+		if _, err := io.ReadFull(u.file, length[:]); err != nil {
+			return 0, err
+		}
+		sealed := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(u.file, sealed); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		chunk, err := u.session.cipher.Open(sealed, u.session.additional(u.offset))
+		if err != nil {
+			return 0, err
+		}
+		u.offset += int64(len(chunk))
+		u.pending = chunk
+	}
+	n := copy(p, u.pending)
+	u.pending = u.pending[n:]
+	return n, nil
+}
+
+func (u *uploadReader) Close() error {
+	return u.file.Close()
+}
+
+// serveAttachment answers with an attachment's contents, honouring Range
+// and If-None-Match requests against the contents' hash
+func (server *Server) serveAttachment(w http.ResponseWriter, r *http.Request, attachment *core.Attachment) {
+	contents, err := server.openAttachment(attachment)
+	if err != nil {
+		server.logger.Failure("Failed to read attachment %s: %v", attachment.ID, err)
+		http.Error(w, "Failed to read attachment", http.StatusInternalServerError)
+		return
+	}
+	defer contents.Close()
+
+	contentType := attachment.Type
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", attachment.Name))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if attachment.Hash != "" {
+		w.Header().Set("ETag", `"`+attachment.Hash+`"`)
+	}
+	http.ServeContent(w, r, "", attachment.UploadedAt, contents)
+}
+
+// contentDisposition formats a Content-Disposition header for a file name,
+// adding an ASCII fallback for clients that do not read RFC 2231 names
+func contentDisposition(disposition string, name string) string {
+	ascii := strings.Map(func(r rune) rune {
+		if r < 0x20 || r >= 0x7f {
+			return '_'
+		}
+		return r
+	}, name)
+	if ascii == name {
+		return mime.FormatMediaType(disposition, map[string]string{"filename": name})
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": ascii}) + "; " +
+		strings.TrimPrefix(mime.FormatMediaType(disposition, map[string]string{"filename": name}), disposition+"; ")
+}
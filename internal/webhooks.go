@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vaziolabs/lumberjack/internal/core"
+)
+
+// Headers sent with every webhook delivery
+const (
+	WebhookSignatureHeader = "X-Lumberjack-Signature" // sha256=<hex HMAC of the body keyed with the secret>
+	WebhookEventHeader     = "X-Lumberjack-Event"
+	WebhookDeliveryHeader  = "X-Lumberjack-Delivery"
+)
+
+const (
+	webhookAttempts       = 6 // Tries before a delivery becomes a dead letter
+	defaultWebhookBackoff = 5 * time.Second
+	maxWebhookBackoff     = time.Hour
+	webhookTimeout        = 10 * time.Second
+)
+
+// webhookJob is a delivery on its way to the webhook registered on a node
+type webhookJob struct {
+	nodeID   string
+	delivery core.WebhookDelivery
+}
+
+// SignWebhookPayload returns the signature header value for a payload, for
+// receivers to compare against what they were sent
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (server *Server) initWebhooks() {
+	server.webhookClient = &http.Client{Timeout: webhookTimeout}
+	server.webhookBackoff = defaultWebhookBackoff
+	server.webhookPending = make(map[*webhookJob]*time.Timer)
+}
+
+// dispatchWebhooks queues the change for every webhook registered on its node
+// or above it that wants its type, as long as the webhook's creator can still
+// read the node
+func (server *Server) dispatchWebhooks(change Change) {
+	if change.node == nil || server.webhookPending == nil {
+		return
+	}
+
+	var payload []byte
+	for _, node := range change.node.Lineage() {
+		for _, webhook := range node.ListWebhooks() {
+			if !webhook.Wants(change.Type) || !change.node.CheckPermission(webhook.CreatedBy, core.ReadPermission) {
+				continue
+			}
+			if payload == nil {
+				var err error
+				if payload, err = json.Marshal(change); err != nil {
+					server.logger.Failure("Failed to encode change %d for webhooks: %v", change.Seq, err)
+					return
+				}
+			}
+			server.queueWebhook(&webhookJob{
+				nodeID: node.ID,
+				delivery: core.WebhookDelivery{
+					ID:        core.NewWebhookDeliveryID(),
+					WebhookID: webhook.ID,
+					Event:     change.Type,
+					Payload:   payload,
+				},
+			})
+		}
+	}
+}
+
+// queueWebhook hands the job to the API queue's workers
+func (server *Server) queueWebhook(job *webhookJob) {
+	server.webhookMutex.Lock()
+	if server.webhooksStopped {
+		server.webhookMutex.Unlock()
+		return
+	}
+	server.webhookPending[job] = nil
+	server.webhookMutex.Unlock()
+
+	request := APIRequest{
+		Type: "WEBHOOK",
+		Path: job.nodeID,
+		Callback: func(*core.Node) interface{} {
+			server.deliverWebhook(job)
+			return nil
+		},
+	}
+	select {
+	case server.apiQueue.queue <- request:
+	default:
+		// The queue is full, wait for room without holding up the change
+		go func() {
+			select {
+			case server.apiQueue.queue <- request:
+			case <-server.apiQueue.shutdown:
+			}
+		}()
+	}
+}
+
+// deliverWebhook makes one attempt at the job, scheduling the next one with
+// exponential backoff or recording a dead letter once attempts run out
+func (server *Server) deliverWebhook(job *webhookJob) {
+	node, err := server.getNodeFromPath(core.IDPath(job.nodeID))
+	if err != nil {
+		server.finishWebhook(job)
+		return
+	}
+	webhook, err := node.GetWebhook(job.delivery.WebhookID)
+	if err != nil {
+		// Deleted since the change was made
+		server.finishWebhook(job)
+		return
+	}
+
+	job.delivery.Attempts++
+	job.delivery.Status, err = server.postWebhook(webhook, job.delivery)
+	if err == nil {
+		server.finishWebhook(job)
+		return
+	}
+	job.delivery.Error = err.Error()
+	server.logger.Warn("Webhook %s delivery %s failed (attempt %d): %v", webhook.ID, job.delivery.ID, job.delivery.Attempts, err)
+
+	if job.delivery.Attempts >= webhookAttempts {
+		server.finishWebhook(job)
+		server.deadLetter(node, job.delivery)
+		return
+	}
+
+	delay := server.webhookBackoff << (job.delivery.Attempts - 1)
+	if delay > maxWebhookBackoff || delay <= 0 {
+		delay = maxWebhookBackoff
+	}
+	server.webhookMutex.Lock()
+	defer server.webhookMutex.Unlock()
+	if server.webhooksStopped {
+		return
+	}
+	server.webhookPending[job] = time.AfterFunc(delay, func() {
+		server.queueWebhook(job)
+	})
+}
+
+// postWebhook sends the delivery, returning the status the receiver answered with
+func (server *Server) postWebhook(webhook core.Webhook, delivery core.WebhookDelivery) (int, error) {
+	request, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "lumberjack-webhooks")
+	request.Header.Set(WebhookSignatureHeader, SignWebhookPayload(webhook.Secret, delivery.Payload))
+	request.Header.Set(WebhookEventHeader, delivery.Event)
+	request.Header.Set(WebhookDeliveryHeader, delivery.ID)
+	request.Header.Set("X-Lumberjack-Attempt", strconv.Itoa(delivery.Attempts))
+
+	response, err := server.webhookClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("receiver answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+func (server *Server) finishWebhook(job *webhookJob) {
+	server.webhookMutex.Lock()
+	defer server.webhookMutex.Unlock()
+	delete(server.webhookPending, job)
+}
+
+// deadLetter keeps a delivery that failed for good on its webhook, where it
+// can be looked at and sent again
+func (server *Server) deadLetter(node *core.Node, delivery core.WebhookDelivery) {
+	delivery.FailedAt = time.Now()
+	if err := node.AddDeadLetter(delivery); err != nil {
+		return
+	}
+	if err := server.persist(node); err != nil {
+		server.logger.Failure("Failed to save dead letter %s: %v", delivery.ID, err)
+		return
+	}
+	server.logger.Notice("Webhook %s delivery %s moved to dead letters after %d attempts", delivery.WebhookID, delivery.ID, delivery.Attempts)
+}
+
+// stopWebhooks cancels the retries still waiting and keeps their deliveries as
+// dead letters, so nothing is lost when the server shuts down. The API queue's
+// workers must have stopped first.
+func (server *Server) stopWebhooks() {
+	server.webhookMutex.Lock()
+	server.webhooksStopped = true
+	pending := server.webhookPending
+	server.webhookPending = make(map[*webhookJob]*time.Timer)
+	server.webhookMutex.Unlock()
+
+	for job, timer := range pending {
+		if timer != nil {
+			timer.Stop()
+		}
+		node, err := server.getNodeFromPath(core.IDPath(job.nodeID))
+		if err != nil {
+			continue
+		}
+		if job.delivery.Error == "" {
+			job.delivery.Error = "server shut down before delivery"
+		}
+		server.deadLetter(node, job.delivery)
+	}
+}
+
+// findWebhook returns the webhook with the given ID and the node it is registered on
+func (server *Server) findWebhook(webhookID string) (*core.Node, core.Webhook, error) {
+	for _, node := range server.forest.Index() {
+		if webhook, err := node.GetWebhook(webhookID); err == nil {
+			return node, webhook, nil
+		}
+	}
+	return nil, core.Webhook{}, fmt.Errorf("%w: %s", core.ErrWebhookNotFound, webhookID)
+}
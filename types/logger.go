@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 )
 
 type Logger interface {
@@ -21,14 +22,17 @@ type Logger interface {
 	Exit(name string)
 }
 
+// LogInfo is shared by handlers and queue workers, so its depth is guarded
 type LogInfo struct {
 	depth int
+	mutex sync.Mutex
 }
 
 func NewLogger() *LogInfo {
 	return &LogInfo{depth: 0}
 }
 
+// getIndent returns the indentation for the depth. The mutex must be held.
 func (l *LogInfo) getIndent() string {
 	if l.depth < 0 {
 		l.depth = 0
@@ -38,6 +42,8 @@ func (l *LogInfo) getIndent() string {
 
 func (l *LogInfo) log(prefix, format string, args ...interface{}) {
 	message := fmt.Sprintf(format, args...)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	log.Printf("%s%s %s", l.getIndent(), prefix, message)
 }
 
@@ -55,13 +61,17 @@ func (l *LogInfo) Failure(format string, args ...interface{}) {
 
 func (l *LogInfo) Enter(name string) {
 	l.log("┌─", "BEGIN: %s", name)
+	l.mutex.Lock()
 	l.depth++
+	l.mutex.Unlock()
 }
 
 func (l *LogInfo) Exit(name string) {
+	l.mutex.Lock()
 	if l.depth > 0 {
 		l.depth--
 	}
+	l.mutex.Unlock()
 	l.log("└─", "END: %s", name)
 }
 
@@ -11,6 +11,16 @@ type ProcessInfo struct {
 	DashboardUp   bool   `json:"dashboard_up"`
 	LogPath       string `json:"log_path"`
 	DatabasePath  string `json:"database_path"`
+	Encryption    string `json:"encryption,omitempty"` // "", "passphrase" or "keyfile"
+	KeyFile       string `json:"key_file,omitempty"`
+	// How long tokens signed with a rotated-out key stay valid, e.g. "168h"
+	KeyRotationWindow string `json:"key_rotation_window,omitempty"`
+	// Finish started events at their planned end unless their metadata says otherwise
+	AutoFinishEvents bool `json:"auto_finish_events,omitempty"`
+	// Largest attachment in bytes, core.DefaultMaxAttachmentSize when zero
+	MaxAttachmentSize int64 `json:"max_attachment_size,omitempty"`
+	// MIME types attachments may have, e.g. "image/*" or "application/pdf"; any when empty
+	AttachmentTypes []string `json:"attachment_types,omitempty"`
 }
 
 type Config struct {
@@ -22,4 +32,6 @@ type ServerConfig struct {
 	Organization string      `json:"organization"`
 	Phone        string      `json:"phone,omitempty"`
 	Process      ProcessInfo `json:"process"`
+	// Secret used to encrypt the database at rest, never written to the config file
+	Secret []byte `json:"-" yaml:"-" mapstructure:"-"`
 }